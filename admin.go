@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminToken guards /api/admin. The admin API is disabled while it is empty.
+var adminToken = os.Getenv("POSTBIN_ADMIN_TOKEN")
+
+// adminAPIHandler authenticates and dispatches everything under /api/admin/.
+func adminAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if adminToken == "" {
+		http.Error(w, `{"msg":"Admin API is disabled"}`, http.StatusNotFound)
+		return
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="postbin admin"`)
+		http.Error(w, `{"msg":"Unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	switch strings.TrimSuffix(r.URL.Path[len("/api/admin/"):], "/") {
+	case "bins":
+		adminListBinsHandler(w, r)
+	case "stats":
+		adminStatsHandler(w, r)
+	case "cleanup":
+		adminCleanupHandler(w, r)
+	case "backup":
+		adminBackupHandler(w, r)
+	case "restore":
+		adminRestoreHandler(w, r)
+	case "maintenance":
+		adminMaintenanceHandler(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// AdminBin describes a bin as seen by operators
+type AdminBin struct {
+	BinID     string `json:"binId"`
+	CreatedAt int64  `json:"createdAt"`
+	Expires   int64  `json:"expires"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+}
+
+type AdminBinsResponse struct {
+	Bins       []AdminBin `json:"bins"`
+	Total      int        `json:"total"`
+	TotalBytes int64      `json:"totalBytes"`
+}
+
+// storedColumns are the requests columns counted as a request's storage,
+// besides blob_size for bodies offloaded to the blob store
+var storedColumns = []string{"headers", "query", "body", "parsed_body", "encoded_body"}
+
+// rowBytes is an SQL expression for the storage used by a request row, with
+// its columns qualified by prefix (such as "new.")
+func rowBytes(prefix string) string {
+	terms := make([]string, 0, len(storedColumns)+1)
+	for _, col := range storedColumns {
+		terms = append(terms, "length("+prefix+col+")")
+	}
+	return strings.Join(append(terms, prefix+"blob_size"), " + ")
+}
+
+// requestBytes approximates the storage used by a request row
+var requestBytes = rowBytes("")
+
+func adminListBinsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, `{"msg":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		limit = n
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, `{"msg":"Invalid offset"}`, http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	usage, err := store.Usage(r.Context(), "")
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	resp := AdminBinsResponse{Total: usage.Bins, TotalBytes: usage.Bytes, Bins: []AdminBin{}}
+
+	bins, err := store.ListBins(r.Context(), limit, offset)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	ids := make([]string, len(bins))
+	for i, bin := range bins {
+		ids[i] = bin.BinID
+	}
+	binUsage, err := store.UsageByBin(r.Context(), ids)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	for _, bin := range bins {
+		resp.Bins = append(resp.Bins, adminBin(bin, binUsage[bin.BinID]))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// adminBin is bin with how many requests it holds and their bytes
+func adminBin(bin BinRecord, usage StoreUsage) AdminBin {
+	return AdminBin{BinID: bin.BinID, CreatedAt: bin.CreatedAt, Expires: bin.ExpiresAt,
+		Entries: usage.Requests, Bytes: usage.Bytes}
+}
+
+// rateCounter keeps per-second event counts for the last minute
+type rateCounter struct {
+	mu      sync.Mutex
+	total   int64
+	seconds [60]int64
+	stamps  [60]int64
+}
+
+var captureRate = &rateCounter{}
+
+func (c *rateCounter) record() {
+	now := time.Now().Unix()
+	i := now % int64(len(c.seconds))
+
+	c.mu.Lock()
+	if c.stamps[i] != now {
+		c.stamps[i] = now
+		c.seconds[i] = 0
+	}
+	c.seconds[i]++
+	c.total++
+	c.mu.Unlock()
+}
+
+// lastMinute returns the number of events in the trailing 60 seconds and
+// the total since the server started.
+func (c *rateCounter) lastMinute() (recent, total int64) {
+	now := time.Now().Unix()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := range c.seconds {
+		if now-c.stamps[i] < int64(len(c.seconds)) {
+			recent += c.seconds[i]
+		}
+	}
+	return recent, c.total
+}
+
+// AdminStats has the SQLite database's size as DBBytes, which is left out for
+// other stores
+type AdminStats struct {
+	Bins               int       `json:"bins"`
+	ExpiredBins        int       `json:"expiredBins"`
+	Requests           int       `json:"requests"`
+	DBBytes            *int64    `json:"dbBytes,omitempty"`
+	CapturesLastMinute int64     `json:"capturesLastMinute"`
+	CapturesPerSecond  float64   `json:"capturesPerSecond"`
+	CapturesSinceStart int64     `json:"capturesSinceStart"`
+	OldestActiveBin    *AdminBin `json:"oldestActiveBin"`
+	// Sinks has delivery counts for every kind of sink, by name
+	Sinks map[string]SinkStats `json:"sinks"`
+}
+
+func adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	usage, err := store.Usage(r.Context(), "")
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	stats := AdminStats{Bins: usage.Bins, ExpiredBins: usage.ExpiredBins, Requests: usage.Requests}
+
+	if storeIsSQLite() {
+		ctx, cancel := dbContext(r.Context())
+		size := dbSize(ctx)
+		cancel()
+		stats.DBBytes = &size
+	}
+
+	stats.CapturesLastMinute, stats.CapturesSinceStart = captureRate.lastMinute()
+	stats.CapturesPerSecond = float64(stats.CapturesLastMinute) / 60
+	stats.Sinks = sinkStatsSnapshot()
+
+	oldest, err := oldestActiveBin(r.Context())
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	stats.OldestActiveBin = oldest
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
+// oldestActiveBin finds the first bin, in ListBins order, that hasn't
+// expired, or nil when there's none
+func oldestActiveBin(ctx context.Context) (*AdminBin, error) {
+	bin, err := store.OldestActiveBin(ctx)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	usage, err := store.Usage(ctx, bin.BinID)
+	if err != nil {
+		return nil, err
+	}
+	ab := adminBin(bin, usage)
+	return &ab, nil
+}
+
+// CleanupResponse has the SQLite database's size before and after, which is
+// left out for other stores
+type CleanupResponse struct {
+	BinsDeleted     int64  `json:"binsDeleted"`
+	RequestsDeleted int64  `json:"requestsDeleted"`
+	BytesBefore     *int64 `json:"bytesBefore,omitempty"`
+	BytesAfter      *int64 `json:"bytesAfter,omitempty"`
+}
+
+// dbSize reports the size of the database in bytes
+func dbSize(ctx context.Context) int64 {
+	var pageCount, pageSize int64
+	db.QueryRowContext(ctx, "PRAGMA page_count").Scan(&pageCount)
+	db.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize)
+	return pageCount * pageSize
+}
+
+// adminCleanupHandler purges every expired bin right away and reclaims the
+// space they used, instead of waiting for them to be swept. Bins go a sweep
+// batch at a time, so each batch has dbTimeout to itself.
+func adminCleanupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	ctx := r.Context()
+	var resp CleanupResponse
+	if storeIsSQLite() {
+		before := dbSize(ctx)
+		resp.BytesBefore = &before
+	}
+	var err error
+	resp.BinsDeleted, resp.RequestsDeleted, err = sweepExpired(ctx)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if _, err := collectBlobs(ctx); err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	// Other stores reclaim their own space
+	if storeIsSQLite() {
+		if _, err := reclaimSpace(ctx, true); err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		after := dbSize(ctx)
+		resp.BytesAfter = &after
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// adminMaintenanceHandler runs database maintenance now, without waiting for
+// enough deletions to set it off. Unlike the sweeper's runs it'll VACUUM a
+// database from before incremental vacuuming.
+func adminMaintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if refuseOtherStores(w, "Database maintenance") {
+		return
+	}
+	resp, err := maintainDatabase(r.Context(), true)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// refuseOtherStores answers with 501 unless bins are kept in the local SQLite
+// database, the only one what works on, reporting whether it did
+func refuseOtherStores(w http.ResponseWriter, what string) bool {
+	if storeIsSQLite() {
+		return false
+	}
+	msg, _ := json.Marshal(map[string]string{"msg": what + " only covers --db-driver=sqlite, and bins aren't kept there"})
+	http.Error(w, string(msg), http.StatusNotImplemented)
+	return true
+}
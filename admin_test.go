@@ -0,0 +1,180 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Helper function to issue an admin API request with the test token
+func adminRequest(method, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	w := httptest.NewRecorder()
+	adminAPIHandler(w, req)
+	return w
+}
+
+func TestAdminAuth(t *testing.T) {
+	adminToken = ""
+	if w := adminRequest(http.MethodGet, "/api/admin/bins"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d with no token configured, got %d", http.StatusNotFound, w.Code)
+	}
+
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/bins", nil)
+	req.Header.Set("Authorization", "Bearer wrong")
+	w := httptest.NewRecorder()
+	adminAPIHandler(w, req)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status code %d with a bad token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAdminListBins(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	first := createTestBin(t)
+	second := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+first.BinID, strings.NewReader("hello"))
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	w := adminRequest(http.MethodGet, "/api/admin/bins")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp AdminBinsResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Total != 2 || len(resp.Bins) != 2 {
+		t.Fatalf("Expected 2 bins, got total %d and %d listed", resp.Total, len(resp.Bins))
+	}
+
+	byID := map[string]AdminBin{}
+	for _, bin := range resp.Bins {
+		byID[bin.BinID] = bin
+	}
+	if byID[first.BinID].Entries != 1 || byID[first.BinID].Bytes == 0 {
+		t.Errorf("Expected 1 entry with some bytes for %s, got %+v", first.BinID, byID[first.BinID])
+	}
+	if byID[second.BinID].Entries != 0 || byID[second.BinID].Bytes != 0 {
+		t.Errorf("Expected an empty %s, got %+v", second.BinID, byID[second.BinID])
+	}
+	if resp.TotalBytes != byID[first.BinID].Bytes {
+		t.Errorf("Expected totalBytes %d, got %d", byID[first.BinID].Bytes, resp.TotalBytes)
+	}
+
+	w = adminRequest(http.MethodGet, "/api/admin/bins?limit=1&offset=1")
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Bins) != 1 || resp.Total != 2 {
+		t.Errorf("Expected a single bin page out of 2, got %d of %d", len(resp.Bins), resp.Total)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	bin := createTestBin(t)
+	for i := 0; i < 3; i++ {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hello"))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+	testDB.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES ('stale', 1, 2)")
+
+	w := adminRequest(http.MethodGet, "/api/admin/stats")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var stats AdminStats
+	if err := json.NewDecoder(w.Body).Decode(&stats); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if stats.Bins != 2 || stats.ExpiredBins != 1 || stats.Requests != 3 {
+		t.Errorf("Expected 2 bins (1 expired) and 3 requests, got %+v", stats)
+	}
+	if stats.DBBytes == nil || *stats.DBBytes == 0 {
+		t.Error("Expected a non-zero database size")
+	}
+	if stats.CapturesLastMinute < 3 {
+		t.Errorf("Expected at least 3 recent captures, got %d", stats.CapturesLastMinute)
+	}
+	if stats.OldestActiveBin == nil || stats.OldestActiveBin.BinID != bin.BinID {
+		t.Errorf("Expected oldest active bin %s, got %+v", bin.BinID, stats.OldestActiveBin)
+	}
+}
+
+func TestAdminCleanup(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	live := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+live.BinID, strings.NewReader("keep")))
+
+	testDB.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES ('stale', 1, 2)")
+	for _, id := range []string{"old1", "old2"} {
+		testDB.Exec(`INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
+            VALUES (?, 'stale', 'POST', '/stale', '{}', '{}', '""', '', 1)`, id)
+	}
+
+	w := adminRequest(http.MethodPost, "/api/admin/cleanup")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var resp CleanupResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.BinsDeleted != 1 || resp.RequestsDeleted != 2 {
+		t.Errorf("Expected 1 bin and 2 requests deleted, got %+v", resp)
+	}
+	if resp.BytesBefore == nil || resp.BytesAfter == nil {
+		t.Errorf("Expected the database size before and after, got %+v", resp)
+	}
+
+	var bins, requests int
+	testDB.QueryRow("SELECT COUNT(*), (SELECT COUNT(*) FROM requests) FROM bins").Scan(&bins, &requests)
+	if bins != 1 || requests != 1 {
+		t.Errorf("Expected the live bin and its request to survive, got %d bins and %d requests", bins, requests)
+	}
+
+	if w := adminRequest(http.MethodGet, "/api/admin/cleanup"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestAdminMaintenance(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	w := adminRequest(http.MethodPost, "/api/admin/maintenance")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var resp MaintenanceResponse
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if resp.Vacuum == "" || resp.BytesAfter == 0 {
+		t.Errorf("Expected the database vacuumed, got %+v", resp)
+	}
+
+	if w := adminRequest(http.MethodGet, "/api/admin/maintenance"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
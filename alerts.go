@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// alertInterval is how often thresholds are checked between captures, and
+// digests for whether they're due; overridable with a command-line flag
+var alertInterval = time.Minute
+
+// maxAlertWindow bounds how far back a rule counts
+const maxAlertWindow = 7 * 24 * time.Hour
+
+// AlertRule notifies about a bin's captures that match Match, a query string
+// of listing filters. Without a threshold every matching capture notifies.
+// With MoreThan it alerts once more than that many arrive within WithinMs,
+// and with FewerThan once fewer than that many have, say to spot a sender
+// that's stopped. A rule that's fired notifies again when it's back to
+// normal, and can then fire again.
+type AlertRule struct {
+	Name      string `json:"name"`
+	Match     string `json:"match,omitempty"`
+	MoreThan  *int   `json:"moreThan,omitempty"`
+	FewerThan *int   `json:"fewerThan,omitempty"`
+	WithinMs  int64  `json:"withinMs,omitempty"`
+}
+
+func (r AlertRule) validate() string {
+	if r.Name == "" {
+		return "notify rules need a name"
+	}
+	q, err := url.ParseQuery(r.Match)
+	if err == nil {
+		_, err = parseRequestFilter(q)
+	}
+	if err != nil {
+		return fmt.Sprintf("notify rule %q match: %v", r.Name, err)
+	}
+	switch {
+	case r.MoreThan != nil && r.FewerThan != nil:
+		return fmt.Sprintf("notify rule %q can't have both moreThan and fewerThan", r.Name)
+	case r.MoreThan == nil && r.FewerThan == nil:
+		if r.WithinMs != 0 {
+			return fmt.Sprintf("notify rule %q needs moreThan or fewerThan for withinMs", r.Name)
+		}
+		return ""
+	case r.MoreThan != nil && *r.MoreThan < 0:
+		return fmt.Sprintf("notify rule %q moreThan can't be negative", r.Name)
+	case r.FewerThan != nil && *r.FewerThan < 1:
+		return fmt.Sprintf("notify rule %q fewerThan must be at least 1", r.Name)
+	}
+	if r.WithinMs <= 0 || r.window() > maxAlertWindow {
+		return fmt.Sprintf("notify rule %q withinMs must be between 1 and %d", r.Name, maxAlertWindow/time.Millisecond)
+	}
+	return ""
+}
+
+func (r AlertRule) window() time.Duration {
+	return time.Duration(r.WithinMs) * time.Millisecond
+}
+
+func (r AlertRule) threshold() bool {
+	return r.MoreThan != nil || r.FewerThan != nil
+}
+
+// alertState is whether a bin's rule is firing, and since when it's been
+// watched: a FewerThan rule can't fire until it's been watched for its
+// whole window, so bins that have just been configured, or a server that's
+// just started, don't raise false alarms.
+type alertState struct {
+	watchedSince time.Time
+	firing       bool
+}
+
+var (
+	alertsMu sync.Mutex
+	// alerts is keyed by bin ID and the rule's JSON, so changing a rule
+	// starts it afresh
+	alerts = map[string]*alertState{}
+)
+
+func alertKey(binID string, rule AlertRule) string {
+	raw, _ := json.Marshal(rule)
+	return binID + "\x00" + string(raw)
+}
+
+// checkRules notifies for each rule a capture matches: at once for rules
+// without a threshold, and otherwise if it changes whether the rule fires.
+// Thresholds are counted up to when the capture was stored, so a backed-up
+// queue doesn't count captures behind it.
+func (c NotifyConfig) checkRules(ctx context.Context, req *Request) error {
+	now := time.UnixMilli(req.Inserted)
+	var first error
+	for _, rule := range c.Rules {
+		matched, err := captureMatches(ctx, req, rule.Match)
+		if err == nil && matched {
+			if rule.threshold() {
+				err = c.evaluateRule(ctx, req.BinID, rule, req, now)
+			} else {
+				n := newCaptureNotification(req)
+				n.Title = rule.Name + ": " + n.Title
+				err = c.send(ctx, n)
+			}
+		}
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// evaluateRule counts a threshold rule's matches in its window, and
+// notifies if the rule has started or stopped firing. req is the capture
+// that prompted the check, if any, for building links.
+func (c NotifyConfig) evaluateRule(ctx context.Context, binID string, rule AlertRule, req *Request, now time.Time) error {
+	count, err := countMatches(ctx, binID, rule.Match, now.Add(-rule.window()), now)
+	if err != nil {
+		return err
+	}
+
+	alertsMu.Lock()
+	key := alertKey(binID, rule)
+	state := alerts[key]
+	if state == nil {
+		state = &alertState{watchedSince: now}
+		alerts[key] = state
+	}
+	var breached bool
+	if rule.MoreThan != nil {
+		breached = count > *rule.MoreThan
+	} else {
+		breached = count < *rule.FewerThan && now.Sub(state.watchedSince) >= rule.window()
+	}
+	changed := breached != state.firing
+	state.firing = breached
+	alertsMu.Unlock()
+	if !changed {
+		return nil
+	}
+
+	n := notification{
+		Title:   fmt.Sprintf("%s: %s in the last %s", rule.Name, plural(count, "matching request"), formatWindow(rule.window())),
+		Snippet: rule.Match,
+	}
+	if !breached {
+		n.Title = fmt.Sprintf("%s: back to normal, %s in the last %s", rule.Name, plural(count, "matching request"), formatWindow(rule.window()))
+	}
+	if base := apiBase(req); base != "" {
+		n.Link = base + "/api/bin/" + url.PathEscape(binID) + "/req"
+		if rule.Match != "" {
+			n.Link += "?" + rule.Match
+		}
+		n.LinkText = "View requests"
+	}
+	return c.send(ctx, n)
+}
+
+// countMatches counts a bin's captures between two times, inclusive, that
+// match a query string of listing filters
+func countMatches(ctx context.Context, binID, match string, since, until time.Time) (int, error) {
+	q, _ := url.ParseQuery(match)
+	f, err := parseRequestFilter(q)
+	if err != nil {
+		return 0, err
+	}
+	return store.CountRequests(ctx, binID, f.within(since.UnixMilli(), until.UnixMilli()))
+}
+
+// plural counts something, such as "1 request" or "2 requests"
+func plural(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// formatWindow describes a duration in the largest whole unit it's a
+// multiple of, such as "1 hour" or "90 seconds"
+func formatWindow(d time.Duration) string {
+	for _, unit := range []struct {
+		d    time.Duration
+		name string
+	}{{24 * time.Hour, "day"}, {time.Hour, "hour"}, {time.Minute, "minute"}, {time.Second, "second"}} {
+		if d%unit.d == 0 {
+			if n := d / unit.d; n != 1 {
+				return fmt.Sprintf("%d %ss", n, unit.name)
+			}
+			return "1 " + unit.name
+		}
+	}
+	return d.String()
+}
+
+// checkAlerts evaluates every live bin's threshold rules, so that rules fire
+// when captures stop and stop firing once a burst is over. State for rules
+// that no longer exist is dropped.
+func checkAlerts(ctx context.Context, now time.Time) error {
+	all, err := store.ListBins(ctx, 0, 0)
+	if err != nil {
+		return err
+	}
+	type binRules struct {
+		binID  string
+		config NotifyConfig
+	}
+	var bins []binRules
+	for _, bin := range all {
+		cfg := bin.Config
+		if enabled, ok := cfg.Sinks["notify"]; ok && !enabled {
+			continue
+		}
+		if cfg.Notify != nil && len(cfg.Notify.Rules) > 0 && !binExpired(bin.ExpiresAt) {
+			bins = append(bins, binRules{bin.BinID, *cfg.Notify})
+		}
+	}
+
+	live := map[string]bool{}
+	for _, bin := range bins {
+		for _, rule := range bin.config.Rules {
+			if !rule.threshold() {
+				continue
+			}
+			live[alertKey(bin.binID, rule)] = true
+			if err := bin.config.evaluateRule(ctx, bin.binID, rule, nil, now); err != nil {
+				log.Printf("Checking alert %q for %s failed: %v", rule.Name, bin.binID, err)
+			}
+		}
+	}
+
+	alertsMu.Lock()
+	defer alertsMu.Unlock()
+	for key := range alerts {
+		if !live[key] {
+			delete(alerts, key)
+		}
+	}
+	return nil
+}
+
+// startAlertChecker runs checkAlerts and sendDueDigests every interval
+// until the returned function is called
+func startAlertChecker(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C:
+				checkCtx, done := context.WithTimeout(ctx, interval)
+				if err := checkAlerts(checkCtx, now); err != nil {
+					log.Printf("Checking alerts failed: %v", err)
+				}
+				// Digests record what they've sent in the local database
+				if noLocalTables == nil {
+					if err := sendDueDigests(checkCtx, now); err != nil {
+						log.Printf("Sending digests failed: %v", err)
+					}
+				}
+				done()
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
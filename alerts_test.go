@@ -0,0 +1,130 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// setAlertRules configures a bin to notify a fake Slack webhook through
+// rules, returning the messages' titles as they're posted
+func setAlertRules(t *testing.T, binID, rules string) func() []string {
+	chat, server := newFakeChat(t)
+	t.Cleanup(func() {
+		alertsMu.Lock()
+		alerts = map[string]*alertState{}
+		alertsMu.Unlock()
+	})
+	setTestConfig(t, binID, `{"notify": {"slack": {"webhookUrl": "`+server.URL+`"}, "rules": `+rules+`}}`)
+	return func() []string {
+		waitForSinks(t)
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+		var titles []string
+		for _, payload := range chat.payloads {
+			titles = append(titles, payload["text"].(string))
+		}
+		return titles
+	}
+}
+
+func TestAlertRuleMatch(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	titles := setAlertRules(t, bin.BinID, `[{"name": "Posts", "match": "method=POST"}]`)
+
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+	captureTestRequests(t, bin.BinID, 1)
+	if got := strings.Join(titles(), "|"); got != "Posts: POST /"+bin.BinID {
+		t.Errorf("Expected only the POST to notify, got %q", got)
+	}
+}
+
+func TestAlertRuleMoreThan(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	titles := setAlertRules(t, bin.BinID, `[{"name": "Flood", "moreThan": 2, "withinMs": 60000}]`)
+
+	// Captures within the same millisecond count together, so the alert
+	// may see the fourth
+	captureTestRequests(t, bin.BinID, 4)
+	got := titles()
+	if len(got) != 1 || !regexp.MustCompile(`^Flood: [34] matching requests in the last 1 minute$`).MatchString(got[0]) {
+		t.Errorf("Expected one alert once there were more than 2, got %q", got)
+	}
+
+	// Once the burst has left the window the rule is back to normal
+	if err := checkAlerts(context.Background(), time.Now().Add(2*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if got := titles(); len(got) != 2 || got[1] != "Flood: back to normal, 0 matching requests in the last 1 minute" {
+		t.Errorf("Expected the alert to end, got %q", got)
+	}
+}
+
+func TestAlertRuleFewerThan(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	titles := setAlertRules(t, bin.BinID, `[{"name": "Quiet", "match": "method=POST", "fewerThan": 1, "withinMs": 3600000}]`)
+
+	// A rule doesn't fire until it's been watched for its whole window
+	now := time.Now()
+	checkAlerts(context.Background(), now)
+	checkAlerts(context.Background(), now.Add(30*time.Minute))
+	if got := titles(); len(got) != 0 {
+		t.Errorf("Expected no alert before the window has passed, got %q", got)
+	}
+	checkAlerts(context.Background(), now.Add(61*time.Minute))
+	checkAlerts(context.Background(), now.Add(62*time.Minute))
+	if got := strings.Join(titles(), "|"); got != "Quiet: 0 matching requests in the last 1 hour" {
+		t.Errorf("Expected one alert once the window had passed, got %q", got)
+	}
+
+	// A capture puts it right at once
+	captureTestRequests(t, bin.BinID, 1)
+	if got := titles(); len(got) != 2 || got[1] != "Quiet: back to normal, 1 matching request in the last 1 hour" {
+		t.Errorf("Expected the capture to end the alert, got %q", got)
+	}
+}
+
+func TestAlertRuleValidation(t *testing.T) {
+	slack := `"slack": {"webhookUrl": "https://hooks.slack.com/x"}`
+	for _, notify := range []string{
+		`"rules": [{"match": "method=POST"}]`,
+		`"rules": [{"name": "a"}, {"name": "a"}]`,
+		`"rules": [{"name": "a", "match": "since=soon"}]`,
+		`"rules": [{"name": "a", "moreThan": 1, "fewerThan": 1, "withinMs": 1000}]`,
+		`"rules": [{"name": "a", "moreThan": 1}]`,
+		`"rules": [{"name": "a", "withinMs": 1000}]`,
+		`"rules": [{"name": "a", "fewerThan": 0, "withinMs": 1000}]`,
+		`"rules": [{"name": "a", "fewerThan": 1, "withinMs": 1000000000}]`,
+		`"rules": [{"name": "a"}], "filter": "method=POST"`,
+	} {
+		cfg := loadBinConfig(`{"notify": {` + slack + `, ` + notify + `}}`)
+		if cfg.Notify == nil || len(cfg.Notify.Rules) == 0 {
+			t.Fatalf("Bad test config %s", notify)
+		}
+		if cfg.validate() == "" {
+			t.Errorf("Expected %s to be rejected", notify)
+		}
+	}
+}
+
+func TestFormatWindow(t *testing.T) {
+	for d, want := range map[time.Duration]string{
+		time.Hour:               "1 hour",
+		48 * time.Hour:          "2 days",
+		90 * time.Second:        "90 seconds",
+		1500 * time.Millisecond: "1.5s",
+	} {
+		if got := formatWindow(d); got != want {
+			t.Errorf("formatWindow(%v) = %q, want %q", d, got, want)
+		}
+	}
+}
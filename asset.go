@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// maxAssetBytes bounds the file a bin can serve; bins are stubs, not a CDN
+const maxAssetBytes = 1 << 20
+
+// assetSchema holds the file each bin answers GET captures with
+const assetSchema = `
+        CREATE TABLE IF NOT EXISTS bin_assets (
+            bin_id TEXT PRIMARY KEY,
+            content_type TEXT NOT NULL,
+            body BLOB NOT NULL,
+            updated_at INTEGER NOT NULL,
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+    `
+
+// binAssetHandler serves GET, PUT and DELETE /api/bin/{binId}/asset. PUT
+// stores the body, with its Content-Type, as the file the bin answers GET
+// captures with.
+func binAssetHandler(w http.ResponseWriter, r *http.Request) {
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/asset")
+	if refuseLocalFeature(w, "Assets") {
+		return
+	}
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if !serveBinAsset(w, r, binID) {
+			http.Error(w, `{"msg":"No asset"}`, http.StatusNotFound)
+		}
+
+	case http.MethodPut:
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxAssetBytes+1))
+		if err != nil {
+			http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxAssetBytes {
+			http.Error(w, fmt.Sprintf(`{"msg":"Assets can't be over %d bytes"}`, maxAssetBytes), http.StatusRequestEntityTooLarge)
+			return
+		}
+		contentType := r.Header.Get("Content-Type")
+		if contentType == "" {
+			contentType = http.DetectContentType(body)
+		}
+		ctx, cancel := dbContext(r.Context())
+		defer cancel()
+		_, err = db.ExecContext(ctx, `
+            INSERT INTO bin_assets (bin_id, content_type, body, updated_at) VALUES (?, ?, ?, ?)
+            ON CONFLICT(bin_id) DO UPDATE SET content_type = excluded.content_type, body = excluded.body,
+                updated_at = excluded.updated_at`, binID, contentType, body, time.Now().UnixMilli())
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"contentType":%q,"size":%d}`, contentType, len(body))
+
+	case http.MethodDelete:
+		ctx, cancel := dbContext(r.Context())
+		defer cancel()
+		if _, err := db.ExecContext(ctx, "DELETE FROM bin_assets WHERE bin_id = ?", binID); err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveBinAsset replies with a bin's asset, if it has one, reporting
+// whether it did. Conditional and range requests are honoured.
+func serveBinAsset(w http.ResponseWriter, r *http.Request, binID string) bool {
+	if noLocalTables != nil {
+		return false
+	}
+	var contentType string
+	var body []byte
+	var updated int64
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+	err := db.QueryRowContext(ctx, "SELECT content_type, body, updated_at FROM bin_assets WHERE bin_id = ?", binID).
+		Scan(&contentType, &body, &updated)
+	if err != nil {
+		return false
+	}
+	w.Header().Set("Content-Type", contentType)
+	http.ServeContent(w, r, "", time.UnixMilli(updated), bytes.NewReader(body))
+	return true
+}
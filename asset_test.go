@@ -0,0 +1,61 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBinAsset(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+
+	put := httptest.NewRequest(http.MethodPut, "/api/bin/"+bin.BinID+"/asset", strings.NewReader("<feed><entry/></feed>"))
+	put.Header.Set("Content-Type", "application/atom+xml")
+	w := httptest.NewRecorder()
+	binAPIHandler(w, put)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the asset to be stored, got %d %s", w.Code, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodGet, "/"+bin.BinID+"/feed.xml", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/atom+xml" || w.Body.String() != "<feed><entry/></feed>" {
+		t.Errorf("Expected the asset, got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil))
+	if w.Body.String() == "<feed><entry/></feed>" {
+		t.Errorf("Expected only GETs to get the asset")
+	}
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&stored)
+	if stored != 2 {
+		t.Errorf("Expected both captures to be stored, got %d", stored)
+	}
+
+	w = httptest.NewRecorder()
+	binAPIHandler(w, httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID+"/asset", nil))
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+	if w.Header().Get("Content-Type") == "application/atom+xml" {
+		t.Errorf("Expected the asset to be gone once deleted")
+	}
+}
+
+func TestBinAssetTooLarge(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, httptest.NewRequest(http.MethodPut, "/api/bin/"+bin.BinID+"/asset",
+		bytes.NewReader(make([]byte, maxAssetBytes+1))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected an oversized asset to be refused, got %d", w.Code)
+	}
+}
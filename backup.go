@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// keySetup is the PRAGMA key that opens copies of the database, if it's keyed
+func keySetup() []string {
+	if sqliteKey == "" {
+		return nil
+	}
+	return []string{"PRAGMA key = " + sqliteKey}
+}
+
+// errBadSnapshot is wrapped by restoreSQLite's errors for snapshots it won't
+// restore
+var errBadSnapshot = errors.New("not a postbin database this build can restore")
+
+// checkSnapshot makes sure a snapshot is intact and from postbin, at a schema
+// version this build can migrate
+func checkSnapshot(ctx context.Context, snapshot *sql.DB) error {
+	var check string
+	if err := snapshot.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&check); err != nil {
+		return fmt.Errorf("%w: %v", errBadSnapshot, err)
+	}
+	if check != "ok" {
+		return fmt.Errorf("%w: integrity check failed: %s", errBadSnapshot, check)
+	}
+	var bins int
+	snapshot.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'bins'").Scan(&bins)
+	if bins == 0 {
+		return fmt.Errorf("%w: it has no bins table", errBadSnapshot)
+	}
+	// Databases from before migrations have no versions, and are brought up
+	// to date like any other
+	var version int
+	snapshot.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version)
+	if version > sqliteMigrations.latest() {
+		return fmt.Errorf("%w: its schema is at version %d, newer than this build's %d",
+			errBadSnapshot, version, sqliteMigrations.latest())
+	}
+	return nil
+}
+
+// adminBackupHandler streams a snapshot of the SQLite database. It's staged
+// in a temporary file first, so a slow download doesn't hold the read lock.
+func adminBackupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if refuseOtherStores(w, "A backup") {
+		return
+	}
+	tmp, err := os.CreateTemp("", "postbin-backup-*.db")
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err := backupSQLite(r.Context(), tmp.Name()); err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := os.Open(tmp.Name())
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	defer snapshot.Close()
+	info, err := snapshot.Stat()
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.sqlite3")
+	w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf(`attachment; filename="postbin-%s.db"`, time.Now().UTC().Format("20060102-150405")))
+	io.Copy(w, snapshot)
+}
+
+// RestoreRequest points a restore at a snapshot already on the server
+type RestoreRequest struct {
+	Path string `json:"path"`
+}
+
+// RestoreResponse describes the database after a restore
+type RestoreResponse struct {
+	Bins     int64 `json:"bins"`
+	Requests int64 `json:"requests"`
+}
+
+// adminRestoreHandler restores the SQLite database from a snapshot, either
+// uploaded as the request body or named by a JSON RestoreRequest
+func adminRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if refuseOtherStores(w, "A restore") {
+		return
+	}
+	var path string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req RestoreRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Path == "" {
+			http.Error(w, `{"msg":"Expected a snapshot path"}`, http.StatusBadRequest)
+			return
+		}
+		if _, err := os.Stat(req.Path); err != nil {
+			http.Error(w, `{"msg":"Snapshot not found"}`, http.StatusBadRequest)
+			return
+		}
+		path = req.Path
+	} else {
+		tmp, err := os.CreateTemp("", "postbin-restore-*.db")
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		defer os.Remove(tmp.Name())
+		_, err = io.Copy(tmp, r.Body)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			http.Error(w, `{"msg":"Failed to read the snapshot"}`, http.StatusBadRequest)
+			return
+		}
+		path = tmp.Name()
+	}
+
+	if err := restoreSQLite(r.Context(), path); errors.Is(err, errBadSnapshot) {
+		msg, _ := json.Marshal(map[string]string{"msg": err.Error()})
+		http.Error(w, string(msg), http.StatusBadRequest)
+		return
+	} else if err != nil {
+		log.Printf("Restore failed: %v", err)
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	var resp RestoreResponse
+	db.QueryRowContext(r.Context(), "SELECT COUNT(*), (SELECT COUNT(*) FROM requests) FROM bins").
+		Scan(&resp.Bins, &resp.Requests)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
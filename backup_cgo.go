@@ -0,0 +1,100 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// copySQLite copies the whole of src over dest with SQLite's online backup
+// API. The copy is made in one step, under a read lock on src and a write lock
+// on dest, so it's consistent without stopping captures.
+func copySQLite(ctx context.Context, dest, src *sqlite3.SQLiteConn) error {
+	backup, err := dest.Backup("main", src, "main")
+	if err != nil {
+		return err
+	}
+	// Step reports a busy database as not done yet, so it's retried
+	for {
+		done, err := backup.Step(-1)
+		if err != nil || done {
+			if finishErr := backup.Finish(); err == nil {
+				err = finishErr
+			}
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			backup.Finish()
+			return ctx.Err()
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
+
+// rawSQLite runs f on one of conn's go-sqlite3 connections
+func rawSQLite(ctx context.Context, conn *sql.DB, f func(*sqlite3.SQLiteConn) error) error {
+	c, err := conn.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	return c.Raw(func(driverConn interface{}) error {
+		raw, ok := driverConn.(*sqlite3.SQLiteConn)
+		if !ok {
+			return fmt.Errorf("unexpected driver connection %T", driverConn)
+		}
+		return f(raw)
+	})
+}
+
+// backupSQLite writes a snapshot of the SQLite database to a new file at
+// path. A database encrypted with SQLCipher is backed up encrypted with the
+// same key.
+func backupSQLite(ctx context.Context, path string) error {
+	dest, err := sqliteConnector{dsn: path, setup: keySetup()}.Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+	return rawSQLite(ctx, db, func(src *sqlite3.SQLiteConn) error {
+		return copySQLite(ctx, dest.(*sqlite3.SQLiteConn), src)
+	})
+}
+
+// restoreSQLite replaces the SQLite database's contents with the snapshot at
+// path, once it's been checked. The snapshot is copied in with the backup API
+// rather than by swapping files, so other connections see all of it or none
+// of it; idle ones are then closed so they're reopened, the snapshot is
+// migrated, and anything derived from the old contents is rebuilt.
+func restoreSQLite(ctx context.Context, path string) error {
+	snapshot := sql.OpenDB(sqliteConnector{dsn: path, setup: keySetup()})
+	defer snapshot.Close()
+	if err := checkSnapshot(ctx, snapshot); err != nil {
+		return err
+	}
+
+	err := rawSQLite(ctx, snapshot, func(src *sqlite3.SQLiteConn) error {
+		return rawSQLite(ctx, db, func(dest *sqlite3.SQLiteConn) error {
+			return copySQLite(ctx, dest, src)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// An in-memory database goes when its connection does
+	var file string
+	db.QueryRowContext(ctx, "SELECT file FROM pragma_database_list WHERE name = 'main'").Scan(&file)
+	if file != "" {
+		db.SetMaxIdleConns(0)
+		db.SetMaxIdleConns(2)
+	}
+	cachedBins.clear()
+	return initSchema(db)
+}
@@ -0,0 +1,99 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdminBackup(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	bin := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("backed up")))
+
+	w := adminRequest(http.MethodGet, "/api/admin/backup")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/vnd.sqlite3" {
+		t.Errorf("Expected an SQLite database, got %s", ct)
+	}
+
+	path := filepath.Join(t.TempDir(), "backup.db")
+	os.WriteFile(path, w.Body.Bytes(), 0o600)
+	snapshot, err := sql.Open("sqlite3", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	var check, body string
+	snapshot.QueryRow("PRAGMA integrity_check").Scan(&check)
+	snapshot.QueryRow("SELECT body FROM requests WHERE bin_id = ?", bin.BinID).Scan(&body)
+	if check != "ok" || !strings.Contains(body, "backed up") {
+		t.Errorf("Expected an intact copy with the capture, got %q and body %q", check, body)
+	}
+
+	if w := adminRequest(http.MethodPost, "/api/admin/backup"); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status code %d, got %d", http.StatusMethodNotAllowed, w.Code)
+	}
+}
+
+func TestAdminRestore(t *testing.T) {
+	clearDB(t)
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+
+	kept := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+kept.BinID, strings.NewReader("restored")))
+	backup := adminRequest(http.MethodGet, "/api/admin/backup").Body.Bytes()
+
+	clearDB(t)
+	lost := createTestBin(t)
+
+	r := httptest.NewRequest(http.MethodPost, "/api/admin/restore", bytes.NewReader(backup))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	r.Header.Set("Content-Type", "application/vnd.sqlite3")
+	w := httptest.NewRecorder()
+	adminAPIHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d: %s", http.StatusOK, w.Code, w.Body)
+	}
+	var resp RestoreResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Bins != 1 || resp.Requests != 1 {
+		t.Errorf("Expected the snapshot's bin and request, got %+v", resp)
+	}
+	if _, err := store.GetBin(context.Background(), kept.BinID); err != nil {
+		t.Errorf("Expected the backed up bin restored, got %v", err)
+	}
+	if _, err := store.GetBin(context.Background(), lost.BinID); err != sql.ErrNoRows {
+		t.Errorf("Expected the newer bin gone, got %v", err)
+	}
+
+	// A snapshot named by path, which isn't a database
+	path := filepath.Join(t.TempDir(), "junk.db")
+	os.WriteFile(path, []byte("not sqlite"), 0o600)
+	r = httptest.NewRequest(http.MethodPost, "/api/admin/restore", strings.NewReader(`{"path":"`+path+`"}`))
+	r.Header.Set("Authorization", "Bearer s3cret")
+	r.Header.Set("Content-Type", "application/json")
+	w = httptest.NewRecorder()
+	adminAPIHandler(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected a bad snapshot to be refused, got %d", w.Code)
+	}
+	if _, err := store.GetBin(context.Background(), kept.BinID); err != nil {
+		t.Errorf("Expected a refused restore to leave the database alone, got %v", err)
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Insert batching settings; overridable with command-line flags
+var (
+	// insertBatchSize is the most captures written per transaction; 0
+	// writes each capture in a transaction of its own, as it arrives
+	insertBatchSize = 0
+	// insertFlushInterval is the longest a capture waits for its batch to
+	// fill before it's written anyway
+	insertFlushInterval = 5 * time.Millisecond
+	// insertQueueSize is how many captures may wait to be written before
+	// more have to wait to join the queue
+	insertQueueSize = 1024
+	// insertAsync answers captures once they're queued rather than once
+	// they're written, so a crash loses at most the queue and a batch
+	insertAsync = false
+)
+
+// inserts batches captures when insertBatchSize is set; it's started
+// alongside store
+var inserts *insertBatcher
+
+// pendingInsert is a capture waiting to be written
+type pendingInsert struct {
+	req        Request
+	maxEntries int
+}
+
+// batchInserter is a Store that can write several captures at once. There's
+// an error for each, so one failing doesn't fail the rest.
+type batchInserter interface {
+	InsertRequests(ctx context.Context, batch []pendingInsert) []error
+}
+
+// queuedInsert is a pendingInsert and where its result goes, if anyone is
+// waiting for it
+type queuedInsert struct {
+	pendingInsert
+	done chan error
+}
+
+// insertBatcher writes queued captures from a single goroutine, a batch at a
+// time, which on SQLite turns a commit per capture into a commit per batch.
+type insertBatcher struct {
+	queue    chan queuedInsert
+	size     int
+	interval time.Duration
+	stopped  chan struct{}
+}
+
+// startInsertBatcher writes batches of up to size captures, at least every
+// interval while any are waiting, until stop is called.
+func startInsertBatcher(size int, interval time.Duration, queueSize int) *insertBatcher {
+	b := &insertBatcher{
+		queue:    make(chan queuedInsert, queueSize),
+		size:     size,
+		interval: interval,
+		stopped:  make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// insertCapture stores a capture, through the batcher when there is one.
+// With insertAsync it returns once the capture is queued unless wait is set,
+// for callers that go on to use the stored row. Batches are written on no
+// one capture's behalf, so ctx only applies without the batcher.
+func insertCapture(ctx context.Context, req Request, maxEntries int, wait bool) error {
+	if inserts == nil {
+		return store.InsertRequest(ctx, req, maxEntries)
+	}
+	return inserts.insert(req, maxEntries, wait || !insertAsync)
+}
+
+func (b *insertBatcher) insert(req Request, maxEntries int, wait bool) error {
+	q := queuedInsert{pendingInsert: pendingInsert{req, maxEntries}}
+	if wait {
+		q.done = make(chan error, 1)
+	}
+	b.queue <- q
+	if !wait {
+		return nil
+	}
+	return <-q.done
+}
+
+// stop writes whatever is queued and waits for it. Nothing may be inserted
+// once it's been called.
+func (b *insertBatcher) stop() {
+	close(b.queue)
+	<-b.stopped
+}
+
+func (b *insertBatcher) run() {
+	defer close(b.stopped)
+	batch := make([]queuedInsert, 0, b.size)
+	for {
+		q, ok := <-b.queue
+		if !ok {
+			return
+		}
+		batch = append(batch[:0], q)
+
+		// Gather whatever else arrives before the batch fills or the
+		// interval runs out
+		timer := time.NewTimer(b.interval)
+	gather:
+		for len(batch) < b.size {
+			select {
+			case q, ok := <-b.queue:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, q)
+			case <-timer.C:
+				break gather
+			}
+		}
+		timer.Stop()
+		b.flush(batch)
+	}
+}
+
+func (b *insertBatcher) flush(batch []queuedInsert) {
+	pending := make([]pendingInsert, len(batch))
+	for i, q := range batch {
+		pending[i] = q.pendingInsert
+	}
+	ctx := context.Background()
+	var errs []error
+	if s, ok := store.(batchInserter); ok {
+		errs = s.InsertRequests(ctx, pending)
+	} else {
+		errs = make([]error, len(pending))
+		for i, p := range pending {
+			errs[i] = store.InsertRequest(ctx, p.req, p.maxEntries)
+		}
+	}
+
+	for i, q := range batch {
+		if q.done != nil {
+			q.done <- errs[i]
+			continue
+		}
+		// Nobody is waiting to clean up after a queued capture that failed
+		if errs[i] != nil {
+			log.Printf("Storing queued request %s failed: %v", q.req.ReqID, errs[i])
+			if q.req.BodyOffloaded {
+				blobs.Delete(q.req.blobKey)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInsertBatcher(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	b := startInsertBatcher(10, 50*time.Millisecond, 100)
+	defer b.stop()
+
+	now := time.Now().UnixMilli()
+	errs := make([]error, 25)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every fifth request reuses an ID, and should fail alone
+			id := fmt.Sprintf("batch-%d", i)
+			if i%5 == 4 {
+				id = "batch-0"
+			}
+			errs[i] = b.insert(Request{BinID: bin.BinID, ReqID: id, Inserted: now + int64(i)}, 0, true)
+		}(i)
+	}
+	wg.Wait()
+
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			failed++
+		}
+	}
+	if failed != 5 {
+		t.Errorf("Expected only the 5 duplicates to fail, got %d failures", failed)
+	}
+	if n, _ := store.CountRequests(context.Background(), bin.BinID, requestFilter{}); n != 20 {
+		t.Errorf("Expected 20 requests stored, got %d", n)
+	}
+}
+
+func TestInsertBatcherWithoutBatchStore(t *testing.T) {
+	previous := store
+	store = newMemoryStore()
+	defer func() { store = previous }()
+
+	now := time.Now().UnixMilli()
+	store.CreateBin(context.Background(), BinRecord{BinID: "batched", CreatedAt: now, ExpiresAt: now + 60000})
+	b := startInsertBatcher(4, time.Millisecond, 10)
+	for i := 0; i < 6; i++ {
+		if err := b.insert(Request{BinID: "batched", ReqID: fmt.Sprintf("m%d", i), Inserted: now}, 3, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.stop()
+	if n, _ := store.CountRequests(context.Background(), "batched", requestFilter{}); n != 3 {
+		t.Errorf("Expected eviction to keep 3 requests, got %d", n)
+	}
+}
+
+func TestAsyncCapture(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	inserts = startInsertBatcher(100, time.Hour, 100)
+	insertAsync = true
+	defer func() { inserts, insertAsync = nil, false }()
+
+	for i := 0; i < 3; i++ {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("queued")))
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200, got %d", w.Code)
+		}
+	}
+	if n, _ := store.CountRequests(context.Background(), bin.BinID, requestFilter{}); n != 0 {
+		t.Errorf("Expected queued captures not to be written before the batch is, got %d", n)
+	}
+
+	inserts.stop()
+	if n, _ := store.CountRequests(context.Background(), bin.BinID, requestFilter{}); n != 3 {
+		t.Errorf("Expected stopping to write the queued captures, got %d", n)
+	}
+}
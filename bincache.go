@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bin cache settings; overridable with command-line flags. Captures look
+// their bin up on every request, so a hot bin is served from memory for up
+// to binCacheTTL after it was last read from the store.
+var (
+	binCacheTTL  = time.Second
+	binCacheSize = 10000
+)
+
+// cachedBins caches the bin records captures are checked against
+var cachedBins = newBinCache()
+
+// binCache maps bin IDs to their records, each until it's older than
+// binCacheTTL. Changes made through this server forget the bin; changes made
+// by another server sharing the store are seen once the entry lapses.
+type binCache struct {
+	mu      sync.Mutex
+	entries map[string]binCacheEntry
+	// gen counts forgets, so a lookup that raced one isn't cached
+	gen int
+}
+
+type binCacheEntry struct {
+	record  BinRecord
+	fetched time.Time
+}
+
+func newBinCache() *binCache {
+	return &binCache{entries: map[string]binCacheEntry{}}
+}
+
+// get returns the bin from the cache, or from the store if it's not cached
+// or has lapsed. Bins that aren't found aren't cached, so one created
+// meanwhile is seen straight away.
+func (c *binCache) get(ctx context.Context, binID string) (BinRecord, error) {
+	if binCacheTTL <= 0 {
+		return store.GetBin(ctx, binID)
+	}
+	c.mu.Lock()
+	entry, ok := c.entries[binID]
+	gen := c.gen
+	c.mu.Unlock()
+	if ok && time.Since(entry.fetched) < binCacheTTL {
+		return entry.record, nil
+	}
+
+	bin, err := store.GetBin(ctx, binID)
+	if err != nil {
+		return bin, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.gen != gen {
+		return bin, nil
+	}
+	if len(c.entries) >= binCacheSize {
+		c.evict()
+	}
+	c.entries[binID] = binCacheEntry{record: bin, fetched: time.Now()}
+	return bin, nil
+}
+
+// evict drops lapsed entries, and everything if none had. c.mu must be held.
+func (c *binCache) evict() {
+	for id, entry := range c.entries {
+		if time.Since(entry.fetched) >= binCacheTTL {
+			delete(c.entries, id)
+		}
+	}
+	if len(c.entries) >= binCacheSize {
+		c.entries = map[string]binCacheEntry{}
+	}
+}
+
+// forget drops a bin that's been changed or deleted
+func (c *binCache) forget(binID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, binID)
+	c.gen++
+}
+
+// clear drops every bin, for when bins have gone in bulk
+func (c *binCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = map[string]binCacheEntry{}
+	c.gen++
+}
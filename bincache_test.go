@@ -0,0 +1,79 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBinCache(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	c := newBinCache()
+
+	if _, err := c.get(context.Background(), bin.BinID); err != nil {
+		t.Fatal(err)
+	}
+	// Changed behind the cache's back, so only forgetting picks it up
+	testDB.Exec("UPDATE bins SET max_entries = 7 WHERE bin_id = ?", bin.BinID)
+	if cached, _ := c.get(context.Background(), bin.BinID); cached.MaxEntries != 0 {
+		t.Errorf("Expected the cached record, got max entries %d", cached.MaxEntries)
+	}
+	c.forget(bin.BinID)
+	if fresh, _ := c.get(context.Background(), bin.BinID); fresh.MaxEntries != 7 {
+		t.Errorf("Expected the forgotten bin to be read again, got max entries %d", fresh.MaxEntries)
+	}
+
+	defer func(ttl time.Duration) { binCacheTTL = ttl }(binCacheTTL)
+	binCacheTTL = time.Millisecond
+	testDB.Exec("UPDATE bins SET max_entries = 8 WHERE bin_id = ?", bin.BinID)
+	time.Sleep(2 * time.Millisecond)
+	if fresh, _ := c.get(context.Background(), bin.BinID); fresh.MaxEntries != 8 {
+		t.Errorf("Expected a lapsed entry to be read again, got max entries %d", fresh.MaxEntries)
+	}
+
+	if _, err := c.get(context.Background(), "missing"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows, got %v", err)
+	}
+	if _, ok := c.entries["missing"]; ok {
+		t.Errorf("Expected a missing bin not to be cached")
+	}
+}
+
+func TestBinCacheSize(t *testing.T) {
+	clearDB(t)
+	defer func(size int) { binCacheSize = size }(binCacheSize)
+	binCacheSize = 3
+	c := newBinCache()
+	for i := 0; i < 5; i++ {
+		c.get(context.Background(), createTestBin(t).BinID)
+	}
+	if len(c.entries) > 3 {
+		t.Errorf("Expected at most 3 cached bins, got %d", len(c.entries))
+	}
+}
+
+func TestCaptureSeesBinChanges(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	capture := func() int {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("x")))
+		return w.Code
+	}
+	if code := capture(); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	deleteBinHandler(w, httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID, nil))
+	if code := capture(); code != http.StatusNotFound {
+		t.Errorf("Expected a deleted bin to stop capturing at once, got %d", code)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// BinConfig holds a bin's optional capture behaviour. It is stored as JSON in
+// bins.config and managed through /api/bin/{binId}/config.
+type BinConfig struct {
+	// Signature verifies each capture's webhook signature
+	Signature *SignatureConfig `json:"signature,omitempty"`
+	// Schema is a JSON Schema each capture's body is validated against
+	Schema json.RawMessage `json:"schema,omitempty"`
+	// Forward relays each capture to another URL once it's stored
+	Forward *ForwardConfig `json:"forward,omitempty"`
+	// Proxy relays each capture to an upstream and replies with, and
+	// records, its response
+	Proxy *ProxyConfig `json:"proxy,omitempty"`
+	// Response replaces the request ID captures are replied to with
+	Response *ResponseConfig `json:"response,omitempty"`
+	// Chaos fails a share of captures' responses on purpose
+	Chaos *ChaosConfig `json:"chaos,omitempty"`
+	// CORS answers browsers' preflights and lets pages read the replies
+	CORS *CORSConfig `json:"cors,omitempty"`
+	// Handshake answers providers' endpoint verification checks
+	Handshake *HandshakeConfig `json:"handshake,omitempty"`
+	// Kafka publishes each capture to a Kafka topic
+	Kafka *KafkaSinkConfig `json:"kafka,omitempty"`
+	// NATS publishes each capture to a NATS subject
+	NATS *NATSSinkConfig `json:"nats,omitempty"`
+	// SQS and SNS send each capture to an AWS queue or topic
+	SQS *SQSSinkConfig `json:"sqs,omitempty"`
+	SNS *SNSSinkConfig `json:"sns,omitempty"`
+	// RabbitMQ publishes each capture to an AMQP exchange
+	RabbitMQ *RabbitMQSinkConfig `json:"rabbitmq,omitempty"`
+	// PubSub publishes each capture to a Google Cloud Pub/Sub topic
+	PubSub *PubSubSinkConfig `json:"pubsub,omitempty"`
+	// Elasticsearch indexes each capture into a daily index
+	Elasticsearch *ElasticsearchSinkConfig `json:"elasticsearch,omitempty"`
+	// Notify posts a message to chat about each capture
+	Notify *NotifyConfig `json:"notify,omitempty"`
+	// Callback pings a URL with the IDs of each capture
+	Callback *CallbackConfig `json:"callback,omitempty"`
+	// Encryption seals each capture's body so only the bin's key holder can
+	// read it. It's chosen when the bin is created and kept from then on.
+	Encryption *EncryptionConfig `json:"encryption,omitempty"`
+	// Sinks switches kinds of sink off for the bin, by name, when false:
+	// both the server-wide one and the bin's own
+	Sinks map[string]bool `json:"sinks,omitempty"`
+}
+
+// validate returns a message describing the first problem with the config,
+// or "" when it's usable
+func (c BinConfig) validate() string {
+	// These keep what they've done in the local database
+	if noLocalTables != nil {
+		switch {
+		case c.Forward != nil:
+			return "forward isn't available: " + noLocalTables.Error()
+		case c.Response != nil && c.Response.sequenced():
+			return "response sequences aren't available: " + noLocalTables.Error()
+		case c.Notify != nil && c.Notify.Digest != "":
+			return "notify digests aren't available: " + noLocalTables.Error()
+		}
+	}
+	if c.Signature != nil {
+		if msg := c.Signature.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Forward != nil {
+		if msg := c.Forward.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Proxy != nil {
+		if msg := c.Proxy.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Response != nil {
+		if c.Proxy != nil {
+			return "response can't be combined with proxy, which replies with the upstream's response"
+		}
+		if msg := c.Response.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Chaos != nil {
+		if msg := c.Chaos.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.CORS != nil {
+		if msg := c.CORS.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Handshake != nil {
+		if msg := c.Handshake.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Kafka != nil {
+		if msg := c.Kafka.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.NATS != nil {
+		if msg := c.NATS.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.SQS != nil {
+		if msg := c.SQS.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.SNS != nil {
+		if msg := c.SNS.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.RabbitMQ != nil {
+		if msg := c.RabbitMQ.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.PubSub != nil {
+		if msg := c.PubSub.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Elasticsearch != nil {
+		if msg := c.Elasticsearch.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Notify != nil {
+		if msg := c.Notify.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Callback != nil {
+		if msg := c.Callback.validate(); msg != "" {
+			return msg
+		}
+	}
+	if c.Encryption != nil {
+		if c.Forward != nil || c.Proxy != nil {
+			return "encryption can't be combined with forward or proxy, which send the body on"
+		}
+		if msg := c.Encryption.validate(); msg != "" {
+			return msg
+		}
+	}
+	if msg := validateSinkSwitches(c.Sinks); msg != "" {
+		return msg
+	}
+	if c.Schema != nil {
+		if _, err := compileJSONSchema(c.Schema); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+// loadBinConfig decodes a bins.config value; an empty column means no config
+func loadBinConfig(raw string) BinConfig {
+	var cfg BinConfig
+	if raw != "" {
+		json.Unmarshal([]byte(raw), &cfg)
+	}
+	return cfg
+}
+
+func (c BinConfig) encode() string {
+	out, _ := json.Marshal(c)
+	if string(out) == "{}" {
+		return ""
+	}
+	return string(out)
+}
+
+// binConfigHandler serves GET and PUT /api/bin/{binId}/config. PUT replaces
+// the whole config; send {} to clear it.
+func binConfigHandler(w http.ResponseWriter, r *http.Request) {
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/config")
+
+	switch r.Method {
+	case http.MethodGet:
+		bin, err := store.GetBin(r.Context(), binID)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bin.Config)
+
+	case http.MethodPut:
+		var cfg BinConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+			return
+		}
+		// Captures already sealed stay sealed to the bin's key, so it can't
+		// change; leaving it out keeps it
+		bin, err := store.GetBin(r.Context(), binID)
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if cfg.Encryption != nil && (bin.Config.Encryption == nil || *cfg.Encryption != *bin.Config.Encryption) {
+			http.Error(w, `{"msg":"Encryption can only be set when the bin is created"}`, http.StatusBadRequest)
+			return
+		}
+		cfg.Encryption = bin.Config.Encryption
+		if msg := cfg.validate(); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"msg":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+		found, err := store.SetBinConfig(r.Context(), binID, cfg)
+		cachedBins.forget(binID)
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+			return
+		}
+		// Response sequences start over with the new config
+		if noLocalTables == nil {
+			ctx, cancel := dbContext(r.Context())
+			defer cancel()
+			if _, err := db.ExecContext(ctx, "DELETE FROM response_cursors WHERE bin_id = ?", binID); err != nil {
+				http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(cfg)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Blob offload settings; overridable with command-line flags. Bodies larger
+// than blobThreshold bytes are written to the blob store instead of SQLite,
+// when one is configured and the threshold is positive.
+var (
+	blobThreshold  int64
+	blobDir        = "./blobs"
+	blobS3Bucket   string
+	blobS3Region   = "us-east-1"
+	blobS3Endpoint string
+)
+
+// blobs is where offloaded bodies live; nil when offloading is disabled
+var blobs blobStore
+
+var errBlobNotFound = errors.New("blob not found")
+
+// blobStore keeps request bodies too large to store inline. Keys are
+// "{binId}/{reqId}".
+type blobStore interface {
+	// Put stores everything read from r under key and returns its length. On
+	// error nothing is left behind under key.
+	Put(key string, r io.Reader) (int64, error)
+	// Get returns the body stored under key, or errBlobNotFound.
+	Get(key string) (io.ReadCloser, error)
+	// Delete removes key; deleting a missing key is not an error.
+	Delete(key string) error
+}
+
+// newBlobStore returns an S3 store when a bucket is configured and a local
+// directory store otherwise.
+func newBlobStore() (blobStore, error) {
+	if blobS3Bucket != "" {
+		return newS3BlobStore(blobS3Bucket, blobS3Region, blobS3Endpoint, awsCredentialsFromEnv())
+	}
+	if err := os.MkdirAll(blobDir, 0o755); err != nil {
+		return nil, err
+	}
+	return dirBlobStore{dir: blobDir}, nil
+}
+
+// blobSchema queues the blob of every deleted request for removal, so that
+// shifts, evictions and expiry don't each have to clean up after themselves.
+const blobSchema = `
+        CREATE TABLE IF NOT EXISTS blob_orphans (
+            blob_key TEXT PRIMARY KEY
+        );
+        CREATE TRIGGER IF NOT EXISTS requests_blob_ad AFTER DELETE ON requests WHEN old.blob_key != '' BEGIN
+            INSERT OR IGNORE INTO blob_orphans (blob_key) VALUES (old.blob_key);
+        END;
+    `
+
+// orphanBlobs gets rid of blobs on behalf of stores other than SQLite, whose
+// trigger isn't there to do it: they're queued for collectBlobs in the local
+// database, or deleted right away when there's none or it can't take them.
+// The requests are gone by the time it's called, so it never fails the
+// caller, only logging what it couldn't delete.
+func orphanBlobs(ctx context.Context, keys ...string) {
+	for _, key := range keys {
+		if key == "" {
+			continue
+		}
+		if localSQLite {
+			err := queueOrphan(ctx, key)
+			if err == nil {
+				continue
+			}
+			log.Printf("Queueing blob %s for removal failed: %v", key, err)
+		}
+		if blobs != nil {
+			if err := blobs.Delete(key); err != nil {
+				log.Printf("Deleting blob %s failed: %v", key, err)
+			}
+		}
+	}
+}
+
+// queueOrphan adds a blob to collectBlobs's queue
+func queueOrphan(ctx context.Context, key string) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, "INSERT OR IGNORE INTO blob_orphans (blob_key) VALUES (?)", key)
+	return err
+}
+
+// blobKeys lists the blobs of requests, for orphanBlobs
+func blobKeys(reqs []Request) []string {
+	keys := make([]string, len(reqs))
+	for i, req := range reqs {
+		keys[i] = req.blobKey
+	}
+	return keys
+}
+
+// readCaptureBody reads a capture's body, streaming it to the blob store
+// under key once it grows past blobThreshold. Inline bodies are returned;
+// offloaded ones report how many bytes were written instead.
+func readCaptureBody(body io.Reader, key string) (inline []byte, offloaded int64, err error) {
+	if blobs == nil || blobThreshold <= 0 {
+		inline, err = io.ReadAll(body)
+		return inline, 0, err
+	}
+
+	head, err := io.ReadAll(io.LimitReader(body, blobThreshold+1))
+	if err != nil || int64(len(head)) <= blobThreshold {
+		return head, 0, err
+	}
+	n, err := blobs.Put(key, io.MultiReader(bytes.NewReader(head), body))
+	return nil, n, err
+}
+
+// collectBlobs deletes the blobs of requests that no longer exist, in
+// batches so the orphan list is never held open while the store is called.
+// Without the local database nothing is queued, orphanBlobs having deleted
+// them already.
+func collectBlobs(ctx context.Context) (int, error) {
+	if blobs == nil || !localSQLite {
+		return 0, nil
+	}
+
+	const batch = 1000
+	collected := 0
+	for {
+		keys, err := orphanedBlobs(ctx, batch)
+		if err != nil {
+			return collected, err
+		}
+		for _, key := range keys {
+			if err := blobs.Delete(key); err != nil {
+				return collected, err
+			}
+			if err := unorphanBlob(ctx, key); err != nil {
+				return collected, err
+			}
+			collected++
+		}
+		if len(keys) < batch {
+			return collected, nil
+		}
+	}
+}
+
+// orphanedBlobs lists up to limit blobs queued for removal
+func orphanedBlobs(ctx context.Context, limit int) ([]string, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT blob_key FROM blob_orphans LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+// unorphanBlob takes a removed blob off the queue
+func unorphanBlob(ctx context.Context, key string) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, "DELETE FROM blob_orphans WHERE blob_key = ?", key)
+	return err
+}
+
+// lookupRequest loads the request addressed by /api/bin/{binId}/req/{reqId}/...,
+// writing a 404 or 500 and returning false when it can't.
+func lookupRequest(w http.ResponseWriter, r *http.Request) (Request, bool) {
+	binID, reqID := leasePath(r.URL.Path)
+	req, err := store.GetRequest(r.Context(), binID, reqID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"Request not found"}`, http.StatusNotFound)
+		return req, false
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return req, false
+	}
+	return req, true
+}
+
+// openRequestBody returns a request's body bytes and their length, reading
+// from the blob store when the body was offloaded.
+func openRequestBody(req Request) (io.ReadCloser, int64, error) {
+	if !req.BodyOffloaded {
+		return io.NopCloser(strings.NewReader(req.RawBody)), int64(len(req.RawBody)), nil
+	}
+	if blobs == nil {
+		return nil, 0, errBlobsDisabled
+	}
+	blob, err := blobs.Get(req.blobKey)
+	return blob, req.BodySize, err
+}
+
+var errBlobsDisabled = errors.New("blob storage is not configured")
+
+// openOriginalBody is openRequestBody for the body exactly as it was sent,
+// before any Content-Encoding was decoded.
+func openOriginalBody(ctx context.Context, req Request) (io.ReadCloser, int64, error) {
+	if req.DecodedFrom == "" {
+		return openRequestBody(req)
+	}
+	encoded, err := store.EncodedBody(ctx, req.BinID, req.ReqID)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(encoded)), int64(len(encoded)), nil
+}
+
+// writeBodyError reports a failure from openRequestBody
+func writeBodyError(w http.ResponseWriter, err error) {
+	switch err {
+	case errBlobNotFound:
+		http.Error(w, `{"msg":"Request body not found"}`, http.StatusNotFound)
+	case errBlobsDisabled:
+		http.Error(w, `{"msg":"Blob storage is not configured"}`, http.StatusServiceUnavailable)
+	default:
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+	}
+}
+
+// requestBodyHandler streams a request's full body, from the blob store when
+// it was offloaded. The captured Content-Type is sent back with it. Bodies
+// that were decoded on capture are served decoded unless ?original=true.
+// Sealed bodies are opened with X-Bin-Key, or served as the sealed box.
+func requestBodyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := lookupRequest(w, r)
+	if !ok || !openSealedBodies(w, r, &req) {
+		return
+	}
+	if req.Encrypted {
+		// The box itself, for crypto_box_seal_open
+		sealed, _ := base64.StdEncoding.DecodeString(req.RawBody)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Length", fmt.Sprint(len(sealed)))
+		w.Write(sealed)
+		return
+	}
+	var body io.ReadCloser
+	var size int64
+	var err error
+	if r.URL.Query().Get("original") == "true" && req.DecodedFrom != "" {
+		w.Header().Set("Content-Encoding", req.DecodedFrom)
+		body, size, err = openOriginalBody(r.Context(), req)
+	} else {
+		body, size, err = openRequestBody(req)
+	}
+	if err != nil {
+		w.Header().Del("Content-Encoding")
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	contentType := req.Headers.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", fmt.Sprint(size))
+	io.Copy(w, body)
+}
+
+// dirBlobStore keeps blobs as files under a local directory.
+type dirBlobStore struct {
+	dir string
+}
+
+func (s dirBlobStore) path(key string) string {
+	return filepath.Join(s.dir, filepath.FromSlash(key))
+}
+
+func (s dirBlobStore) Put(key string, r io.Reader) (int64, error) {
+	path := s.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return 0, err
+	}
+
+	// Write to a temporary file first so readers never see a partial blob
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return 0, err
+	}
+	return n, nil
+}
+
+func (s dirBlobStore) Get(key string) (io.ReadCloser, error) {
+	f, err := os.Open(s.path(key))
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	return f, err
+}
+
+func (s dirBlobStore) Delete(key string) error {
+	path := s.path(key)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// Drop the bin's directory once it's empty; this fails harmlessly otherwise
+	os.Remove(filepath.Dir(path))
+	return nil
+}
+
+// s3BlobStore keeps blobs in an S3 bucket, or any S3-compatible service when
+// an endpoint is given (addressed path-style, as MinIO expects).
+type s3BlobStore struct {
+	base   *url.URL
+	region string
+	creds  awsCredentials
+	client *http.Client
+}
+
+func newS3BlobStore(bucket, region, endpoint string, creds awsCredentials) (*s3BlobStore, error) {
+	raw := "https://" + bucket + ".s3." + region + ".amazonaws.com/"
+	if endpoint != "" {
+		raw = strings.TrimSuffix(endpoint, "/") + "/" + bucket + "/"
+	}
+	base, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobStore{base: base, region: region, creds: creds, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (s *s3BlobStore) request(method, key string, body io.Reader, payloadHash string) (*http.Response, error) {
+	u := *s.base
+	u.Path += key
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	signAWSRequest(req, payloadHash, "s3", s.region, s.creds, time.Now())
+	return s.client.Do(req)
+}
+
+func (s *s3BlobStore) Put(key string, r io.Reader) (int64, error) {
+	// S3 needs the length and hash up front, so spool the body to disk first
+	f, err := os.CreateTemp("", "postbin-blob-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	hash := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, hash), r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	u := *s.base
+	u.Path += key
+	req, err := http.NewRequest(http.MethodPut, u.String(), f)
+	if err != nil {
+		return 0, err
+	}
+	req.ContentLength = n
+	signAWSRequest(req, hex.EncodeToString(hash.Sum(nil)), "s3", s.region, s.creds, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, s3Error(resp)
+	}
+	return n, nil
+}
+
+func (s *s3BlobStore) Get(key string) (io.ReadCloser, error) {
+	resp, err := s.request(http.MethodGet, key, nil, emptyPayloadHash)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, errBlobNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, s3Error(resp)
+	}
+	return resp.Body, nil
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	resp, err := s.request(http.MethodDelete, key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK &&
+		resp.StatusCode != http.StatusNotFound {
+		return s3Error(resp)
+	}
+	return nil
+}
+
+func s3Error(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("s3: %s: %s", resp.Status, bytes.TrimSpace(msg))
+}
@@ -0,0 +1,134 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBlobOffload(t *testing.T) {
+	clearDB(t)
+	dir := t.TempDir()
+	blobs, blobThreshold = dirBlobStore{dir: dir}, 16
+	defer func() { blobs, blobThreshold = nil, 0 }()
+
+	bin := createTestBin(t)
+	large := strings.Repeat("0123456789", 10)
+
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(large))
+	captureReq.Header.Set("Content-Type", "text/plain")
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	reqID := captureW.Body.String()
+
+	small := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("tiny"))
+	smallW := httptest.NewRecorder()
+	captureRequestHandler(smallW, small)
+
+	var stored string
+	testDB.QueryRow("SELECT body FROM requests WHERE req_id = ?", reqID).Scan(&stored)
+	if stored != `""` {
+		t.Errorf("Expected the offloaded body to be kept out of SQLite, got %s", stored)
+	}
+	if _, err := os.Stat(filepath.Join(dir, bin.BinID, reqID)); err != nil {
+		t.Errorf("Expected the body in the blob directory: %v", err)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/body", nil)
+	getW := httptest.NewRecorder()
+	binAPIHandler(getW, getReq)
+	if getW.Body.String() != large {
+		t.Errorf("Expected the full body back, got %q", getW.Body.String())
+	}
+	if ct := getW.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("Expected the captured Content-Type, got %q", ct)
+	}
+
+	getReq = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+smallW.Body.String()+"/body", nil)
+	getW = httptest.NewRecorder()
+	binAPIHandler(getW, getReq)
+	if getW.Body.String() != "tiny" {
+		t.Errorf("Expected the inline body back, got %q", getW.Body.String())
+	}
+
+	// Deleting the request queues its blob for collection
+	delReq := httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID+"/req/"+reqID, nil)
+	binAPIHandler(httptest.NewRecorder(), delReq)
+	if n, err := collectBlobs(context.Background()); err != nil || n != 1 {
+		t.Errorf("Expected 1 blob collected, got %d (%v)", n, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, bin.BinID, reqID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the blob to be deleted, got %v", err)
+	}
+}
+
+func TestS3BlobStore(t *testing.T) {
+	var mu sync.Mutex
+	objects := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "AWS4-HMAC-SHA256 Credential=AKID/") || r.Header.Get("X-Amz-Date") == "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			body, _ := io.ReadAll(r.Body)
+			if sha256Hex(body) != r.Header.Get("X-Amz-Content-Sha256") {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			objects[r.URL.Path] = string(body)
+		case http.MethodGet:
+			body, ok := objects[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			io.WriteString(w, body)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer server.Close()
+
+	store, err := newS3BlobStore("bodies", "us-east-1", server.URL, awsCredentials{AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := store.Put("bin1/req1", strings.NewReader("payload")); err != nil || n != 7 {
+		t.Fatalf("Expected 7 bytes stored, got %d (%v)", n, err)
+	}
+	if _, ok := objects["/bodies/bin1/req1"]; !ok {
+		t.Errorf("Expected a path-style object key, got %v", objects)
+	}
+
+	rc, err := store.Get("bin1/req1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(rc)
+	rc.Close()
+	if string(body) != "payload" {
+		t.Errorf("Expected payload, got %q", body)
+	}
+
+	if err := store.Delete("bin1/req1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Get("bin1/req1"); err != errBlobNotFound {
+		t.Errorf("Expected errBlobNotFound after delete, got %v", err)
+	}
+}
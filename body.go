@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// bodyPart is one part of a multipart/form-data capture
+type bodyPart struct {
+	Name        string
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// FilePart describes an uploaded file in a parsed multipart body; the file
+// itself is downloaded from /req/{reqId}/part/{name}
+type FilePart struct {
+	Filename    string `json:"filename"`
+	ContentType string `json:"contentType"`
+	Size        int    `json:"size"`
+}
+
+// parseBody interprets a captured body according to its Content-Type,
+// returning it as a JSON document: JSON bodies as themselves, form bodies as
+// an object of their fields (repeated fields become arrays), and multipart
+// bodies likewise with files described by a FilePart. Multipart bodies also
+// return their parts. Other bodies, and bodies that don't parse, return nil
+// and are kept only as raw text.
+func parseBody(contentType string, body []byte) (json.RawMessage, []bodyPart) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || len(body) == 0 {
+		return nil, nil
+	}
+
+	switch {
+	case mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"):
+		var doc bytes.Buffer
+		if json.Compact(&doc, body) != nil {
+			return nil, nil
+		}
+		return doc.Bytes(), nil
+
+	case mediaType == "application/x-www-form-urlencoded":
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			return nil, nil
+		}
+		fields := make(map[string][]interface{}, len(values))
+		for key, vs := range values {
+			for _, v := range vs {
+				fields[key] = append(fields[key], v)
+			}
+		}
+		return fieldDocument(fields), nil
+
+	case mediaType == "multipart/form-data" && params["boundary"] != "":
+		return parseMultipart(params["boundary"], body)
+	}
+	return nil, nil
+}
+
+func parseMultipart(boundary string, body []byte) (json.RawMessage, []bodyPart) {
+	var parts []bodyPart
+	fields := make(map[string][]interface{})
+
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil
+		}
+		data, err := io.ReadAll(p)
+		if err != nil {
+			return nil, nil
+		}
+
+		part := bodyPart{
+			Name:        p.FormName(),
+			Filename:    p.FileName(),
+			ContentType: p.Header.Get("Content-Type"),
+			Data:        data,
+		}
+		parts = append(parts, part)
+		if part.Filename != "" {
+			fields[part.Name] = append(fields[part.Name], FilePart{part.Filename, part.ContentType, len(data)})
+		} else {
+			fields[part.Name] = append(fields[part.Name], string(data))
+		}
+	}
+	return fieldDocument(fields), parts
+}
+
+// fieldDocument renders form fields as a JSON object, with repeated fields
+// as arrays
+func fieldDocument(fields map[string][]interface{}) json.RawMessage {
+	doc := make(map[string]interface{}, len(fields))
+	for key, vs := range fields {
+		if len(vs) == 1 {
+			doc[key] = vs[0]
+		} else {
+			doc[key] = vs
+		}
+	}
+	out, _ := json.Marshal(doc)
+	return out
+}
+
+// insertParts stores a multipart capture's parts in order
+func insertParts(ctx context.Context, tx *sql.Tx, req Request) error {
+	for i, part := range req.parts {
+		_, err := tx.ExecContext(ctx, `
+            INSERT INTO request_parts (bin_id, req_id, idx, name, filename, content_type, data)
+            VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			req.BinID, req.ReqID, i, part.Name, part.Filename, part.ContentType, part.Data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requestPartHandler serves GET /api/bin/{id}/req/{reqId}/part/{name}: the
+// first part of a multipart capture with that form name.
+func requestPartHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID, reqID := leasePath(r.URL.Path)
+	name := r.URL.Path[strings.Index(r.URL.Path, "/part/")+len("/part/"):]
+
+	part, err := store.RequestPart(r.Context(), binID, reqID, name)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"Part not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	contentType := part.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(part.Data)))
+	if part.Filename != "" {
+		w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": part.Filename}))
+	}
+	w.Write(part.Data)
+}
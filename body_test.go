@@ -0,0 +1,121 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsedBodies(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	tests := []struct {
+		contentType, body string
+		want              interface{}
+	}{
+		{"application/json", `{"event": {"id": 12345678901234567}}`,
+			map[string]interface{}{"event": map[string]interface{}{"id": json.Number("12345678901234567")}}},
+		{"application/vnd.api+json; charset=utf-8", `[1, 2]`, []interface{}{json.Number("1"), json.Number("2")}},
+		{"application/x-www-form-urlencoded", "a=1&b=2&b=3",
+			map[string]interface{}{"a": "1", "b": []interface{}{"2", "3"}}},
+		{"application/json", `{"truncated":`, `{"truncated":`},
+		{"text/plain", "hello", "hello"},
+	}
+	for _, tt := range tests {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(tt.body))
+		captureReq.Header.Set("Content-Type", tt.contentType)
+		captureW := httptest.NewRecorder()
+		captureRequestHandler(captureW, captureReq)
+
+		getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+		getW := httptest.NewRecorder()
+		getRequestHandler(getW, getReq)
+
+		var got Request
+		dec := json.NewDecoder(getW.Body)
+		dec.UseNumber()
+		dec.Decode(&got)
+		if !reflect.DeepEqual(got.Body, tt.want) {
+			t.Errorf("%s: expected body %#v, got %#v", tt.contentType, tt.want, got.Body)
+		}
+		if got.RawBody != tt.body {
+			t.Errorf("%s: expected rawBody %q, got %q", tt.contentType, tt.body, got.RawBody)
+		}
+	}
+
+	// Parsed form fields can be filtered like JSON
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?jsonpath=$.a&equals=1", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 1 {
+		t.Errorf("Expected the form request to match, got %d requests", len(reqs))
+	}
+}
+
+func TestMultipartParts(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("title", "report")
+	fw, _ := mw.CreateFormFile("upload", "report.csv")
+	fw.Write([]byte("a,b\n1,2\n"))
+	mw.Close()
+
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, &buf)
+	captureReq.Header.Set("Content-Type", mw.FormDataContentType())
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	reqID := captureW.Body.String()
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID, nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var got struct {
+		Body struct {
+			Title  string   `json:"title"`
+			Upload FilePart `json:"upload"`
+		} `json:"body"`
+	}
+	json.NewDecoder(getW.Body).Decode(&got)
+	if got.Body.Title != "report" || got.Body.Upload != (FilePart{"report.csv", "application/octet-stream", 8}) {
+		t.Errorf("Expected the parts to be summarised in body, got %+v", got.Body)
+	}
+
+	partReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/part/upload", nil)
+	partW := httptest.NewRecorder()
+	binAPIHandler(partW, partReq)
+	if partW.Body.String() != "a,b\n1,2\n" {
+		t.Errorf("Expected the uploaded file, got %q", partW.Body.String())
+	}
+	if cd := partW.Header().Get("Content-Disposition"); cd != `attachment; filename=report.csv` {
+		t.Errorf("Expected the original filename, got %q", cd)
+	}
+
+	partReq = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/part/missing", nil)
+	partW = httptest.NewRecorder()
+	binAPIHandler(partW, partReq)
+	if partW.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, partW.Code)
+	}
+
+	// Parts go with their request
+	testDB.Exec("DELETE FROM requests")
+	var parts int
+	testDB.QueryRow("SELECT COUNT(*) FROM request_parts").Scan(&parts)
+	if parts != 0 {
+		t.Errorf("Expected parts to be deleted with their request, %d left", parts)
+	}
+}
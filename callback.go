@@ -0,0 +1,40 @@
+package main
+
+import "context"
+
+// CallbackConfig pings URL whenever one of a bin's requests is captured,
+// with just enough to fetch it: unlike forwarding, the capture itself isn't
+// sent.
+type CallbackConfig struct {
+	URL string `json:"url"`
+}
+
+func (c CallbackConfig) validate() string {
+	return validateWebhookURL("callback url", c.URL)
+}
+
+// callbackPing is the body of a callback: the capture's IDs and when it
+// was stored, in milliseconds
+type callbackPing struct {
+	BinID     string `json:"binId"`
+	ReqID     string `json:"reqId"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func init() {
+	registerSink(sinkKind{
+		name:   "callback",
+		global: func() Sink { return nil },
+		forBin: func(c BinConfig) Sink {
+			if c.Callback != nil {
+				return *c.Callback
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver posts the ping for a capture
+func (c CallbackConfig) Deliver(ctx context.Context, req *Request) error {
+	return postNotification(ctx, "callback", c.URL, callbackPing{BinID: req.BinID, ReqID: req.ReqID, Timestamp: req.Inserted})
+}
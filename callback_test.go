@@ -0,0 +1,31 @@
+//go:build cgo
+
+package main
+
+import "testing"
+
+func TestCallback(t *testing.T) {
+	clearDB(t)
+	chat, server := newFakeChat(t)
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"callback": {"url": "`+server.URL+`/ping"}}`)
+	reqIDs := captureTestRequests(t, bin.BinID, 1)
+	waitForSinks(t)
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if len(chat.payloads) != 1 {
+		t.Fatalf("Expected one ping, got %v", chat.payloads)
+	}
+	ping := chat.payloads[0]
+	if ping["path"] != "/ping" || ping["binId"] != bin.BinID || ping["reqId"] != reqIDs[0] || ping["timestamp"].(float64) == 0 || len(ping) != 4 {
+		t.Errorf("Unexpected ping %v", ping)
+	}
+}
+
+func TestCallbackValidation(t *testing.T) {
+	if (BinConfig{Callback: &CallbackConfig{URL: "/relative"}}).validate() == "" {
+		t.Error("Expected a relative callback URL to be rejected")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+)
+
+// ChaosConfig fails a share of a bin's captures on purpose, to check a
+// sender retries: ErrorPercent of them are answered with ErrorStatus (503
+// by default), and DropPercent have their connection closed with no
+// response at all. Captures are stored either way.
+type ChaosConfig struct {
+	ErrorPercent float64 `json:"errorPercent,omitempty"`
+	ErrorStatus  int     `json:"errorStatus,omitempty"`
+	DropPercent  float64 `json:"dropPercent,omitempty"`
+}
+
+func (c ChaosConfig) validate() string {
+	if c.ErrorPercent < 0 || c.DropPercent < 0 || c.ErrorPercent+c.DropPercent > 100 {
+		return "chaos errorPercent and dropPercent can't be negative or add up to over 100"
+	}
+	if c.ErrorStatus != 0 && (c.ErrorStatus < 400 || c.ErrorStatus > 599) {
+		return "chaos errorStatus must be between 400 and 599"
+	}
+	return ""
+}
+
+// inject fails the response to a capture if the dice say so, reporting
+// whether it did
+func (c ChaosConfig) inject(w http.ResponseWriter) bool {
+	roll := rand.Float64() * 100
+	switch {
+	case roll < c.DropPercent:
+		dropConnection(w)
+		return true
+	case roll < c.DropPercent+c.ErrorPercent:
+		status := c.ErrorStatus
+		if status == 0 {
+			status = http.StatusServiceUnavailable
+		}
+		http.Error(w, fmt.Sprintf("Injected failure: %d %s", status, http.StatusText(status)), status)
+		return true
+	}
+	return false
+}
+
+// dropConnection closes the client's connection without a response,
+// resetting it where it can so the sender sees an abrupt failure rather
+// than a clean close
+func dropConnection(w http.ResponseWriter) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		// HTTP/2 can't be hijacked; aborting resets the stream instead
+		panic(http.ErrAbortHandler)
+	}
+	conn, _, err := hj.Hijack()
+	if err != nil {
+		panic(http.ErrAbortHandler)
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
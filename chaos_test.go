@@ -0,0 +1,51 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestChaos(t *testing.T) {
+	clearDB(t)
+	server := httptest.NewServer(http.HandlerFunc(captureRequestHandler))
+	t.Cleanup(server.Close)
+	bin := createTestBin(t)
+
+	setTestConfig(t, bin.BinID, `{"chaos": {"errorPercent": 100, "errorStatus": 500}}`)
+	resp, err := http.Post(server.URL+"/"+bin.BinID, "text/plain", strings.NewReader("a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected an injected 500, got %d", resp.StatusCode)
+	}
+
+	setTestConfig(t, bin.BinID, `{"chaos": {"dropPercent": 100}}`)
+	if resp, err := http.Post(server.URL+"/"+bin.BinID, "text/plain", strings.NewReader("b")); err == nil {
+		resp.Body.Close()
+		t.Errorf("Expected the connection to be dropped, got %d", resp.StatusCode)
+	}
+
+	var n int
+	db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&n)
+	if n != 2 {
+		t.Errorf("Expected both captures to be stored, got %d", n)
+	}
+}
+
+func TestChaosValidation(t *testing.T) {
+	for _, cfg := range []ChaosConfig{
+		{ErrorPercent: -1},
+		{ErrorPercent: 60, DropPercent: 50},
+		{ErrorPercent: 10, ErrorStatus: 200},
+	} {
+		if (BinConfig{Chaos: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// maxCORSMaxAge is the longest browsers are told to cache a preflight; they
+// cap it lower themselves
+const maxCORSMaxAge = 86400
+
+// CORSConfig lets browsers post to a bin from another origin. Preflights
+// are answered on the bin's behalf, after they're stored, and captures
+// from an allowed origin are replied to with the headers that let the page
+// read the reply. AllowOrigins empty or "*" allows any origin; with no
+// AllowMethods or AllowHeaders, whatever a preflight asks for is allowed.
+type CORSConfig struct {
+	AllowOrigins     []string `json:"allowOrigins,omitempty"`
+	AllowMethods     []string `json:"allowMethods,omitempty"`
+	AllowHeaders     []string `json:"allowHeaders,omitempty"`
+	ExposeHeaders    []string `json:"exposeHeaders,omitempty"`
+	AllowCredentials bool     `json:"allowCredentials,omitempty"`
+	MaxAgeSeconds    int      `json:"maxAgeSeconds,omitempty"`
+}
+
+func (c CORSConfig) validate() string {
+	for _, origin := range c.AllowOrigins {
+		if origin == "*" {
+			continue
+		}
+		u, err := url.Parse(origin)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			return fmt.Sprintf("cors origin %q must be * or a scheme and host, such as https://app.example.com", origin)
+		}
+	}
+	for _, method := range c.AllowMethods {
+		if !headerName.MatchString(method) {
+			return fmt.Sprintf("cors method %q isn't a valid method", method)
+		}
+	}
+	for _, name := range append(append([]string{}, c.AllowHeaders...), c.ExposeHeaders...) {
+		if name != "*" && !headerName.MatchString(name) {
+			return fmt.Sprintf("cors header %q isn't a valid name", name)
+		}
+	}
+	if c.MaxAgeSeconds < 0 || c.MaxAgeSeconds > maxCORSMaxAge {
+		return fmt.Sprintf("cors maxAgeSeconds must be between 0 and %d", maxCORSMaxAge)
+	}
+	return ""
+}
+
+// allowsOrigin reports whether a page on origin may use the bin
+func (c CORSConfig) allowsOrigin(origin string) bool {
+	if len(c.AllowOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range c.AllowOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// apply adds the CORS headers for r to the reply, and answers it when it's
+// a preflight, reporting whether it did. A preflight from an origin that
+// isn't allowed is answered without them, so the browser stops there.
+func (c CORSConfig) apply(w http.ResponseWriter, r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	preflight := r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+	h := w.Header()
+	h.Add("Vary", "Origin")
+	if origin != "" && c.allowsOrigin(origin) {
+		// The origin is repeated back rather than sent as *, which browsers
+		// refuse alongside credentials
+		h.Set("Access-Control-Allow-Origin", origin)
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			methods := strings.Join(c.AllowMethods, ", ")
+			if methods == "" {
+				methods = r.Header.Get("Access-Control-Request-Method")
+			}
+			h.Set("Access-Control-Allow-Methods", methods)
+			headers := strings.Join(c.AllowHeaders, ", ")
+			if headers == "" {
+				headers = r.Header.Get("Access-Control-Request-Headers")
+			}
+			if headers != "" {
+				h.Set("Access-Control-Allow-Headers", headers)
+			}
+			if c.MaxAgeSeconds > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAgeSeconds))
+			}
+		} else if len(c.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+	}
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
@@ -0,0 +1,68 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORSPreflight(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"cors": {"allowOrigins": ["https://app.example.com"], "exposeHeaders": ["X-Trace"],
+		"allowCredentials": true, "maxAgeSeconds": 600}}`)
+
+	preflight := func(origin string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodOptions, "/"+bin.BinID, nil)
+		r.Header.Set("Origin", origin)
+		r.Header.Set("Access-Control-Request-Method", "PUT")
+		r.Header.Set("Access-Control-Request-Headers", "content-type, x-api-key")
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, r)
+		return w
+	}
+
+	w := preflight("https://app.example.com")
+	h := w.Header()
+	if w.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		h.Get("Access-Control-Allow-Methods") != "PUT" || h.Get("Access-Control-Allow-Headers") != "content-type, x-api-key" ||
+		h.Get("Access-Control-Allow-Credentials") != "true" || h.Get("Access-Control-Max-Age") != "600" {
+		t.Errorf("Unexpected preflight response %d %v", w.Code, h)
+	}
+
+	w = preflight("https://evil.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("Expected a preflight from another origin to get no CORS headers, got %d %v", w.Code, w.Header())
+	}
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ? AND method = 'OPTIONS'", bin.BinID).Scan(&stored)
+	if stored != 2 {
+		t.Errorf("Expected both preflights to be stored, got %d", stored)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil)
+	r.Header.Set("Origin", "https://app.example.com")
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		w.Header().Get("Access-Control-Expose-Headers") != "X-Trace" || w.Body.Len() == 0 {
+		t.Errorf("Expected the capture's usual reply with CORS headers, got %d %v %s", w.Code, w.Header(), w.Body)
+	}
+}
+
+func TestCORSValidation(t *testing.T) {
+	for _, cfg := range []CORSConfig{
+		{AllowOrigins: []string{"app.example.com"}},
+		{AllowOrigins: []string{"https://app.example.com/path"}},
+		{AllowMethods: []string{"GET POST"}},
+		{AllowHeaders: []string{"Bad Name"}},
+		{MaxAgeSeconds: -1},
+	} {
+		if cfg.validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
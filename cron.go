@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week, each a set of allowed values
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	// domAny and dowAny record a "*" day field, which changes how the two
+	// day fields combine
+	domAny, dowAny bool
+}
+
+var cronMacros = map[string]string{
+	"@yearly":  "0 0 1 1 *",
+	"@monthly": "0 0 1 * *",
+	"@weekly":  "0 0 * * 0",
+	"@daily":   "0 0 * * *",
+	"@hourly":  "0 * * * *",
+}
+
+// parseCron understands the standard fields with "*", lists, ranges and
+// steps ("*/15", "1-5", "0,30"), and the @hourly-style macros. Sunday is 0
+// or 7.
+func parseCron(expr string) (*cronSchedule, error) {
+	if macro, ok := cronMacros[strings.TrimSpace(expr)]; ok {
+		expr = macro
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression must have 5 fields")
+	}
+
+	var s cronSchedule
+	var err error
+	bounds := []struct {
+		set      *uint64
+		min, max int
+		name     string
+	}{
+		{&s.minute, 0, 59, "minute"},
+		{&s.hour, 0, 23, "hour"},
+		{&s.dom, 1, 31, "day of month"},
+		{&s.month, 1, 12, "month"},
+		{&s.dow, 0, 7, "day of week"},
+	}
+	for i, b := range bounds {
+		if *b.set, err = parseCronField(fields[i], b.min, b.max); err != nil {
+			return nil, fmt.Errorf("cron %s: %v", b.name, err)
+		}
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow |= 1
+	}
+	s.domAny = fields[2] == "*"
+	s.dowAny = fields[4] == "*"
+	return &s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var set uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, step := part, 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %q", part)
+			}
+			rng, step = part[:i], n
+		}
+
+		lo, hi := min, max
+		if rng != "*" {
+			var err error
+			from, to, isRange := strings.Cut(rng, "-")
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid value %q", part)
+				}
+			} else if step > 1 {
+				// "5/15" means every 15 starting at 5
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set |= 1 << uint(v)
+		}
+	}
+	return set, nil
+}
+
+func (s *cronSchedule) matchesDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	// When both day fields are restricted, either may match
+	switch {
+	case s.domAny && s.dowAny:
+		return true
+	case s.domAny:
+		return dow
+	case s.dowAny:
+		return dom
+	default:
+		return dom || dow
+	}
+}
+
+// next returns the first time after t that the schedule fires, in t's
+// location, or the zero time if it never does within five years
+func (s *cronSchedule) next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case s.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case s.hour&(1<<uint(t.Hour())) == 0:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case s.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
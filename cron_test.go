@@ -0,0 +1,51 @@
+//go:build cgo
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronNext(t *testing.T) {
+	from := time.Date(2024, 5, 1, 12, 34, 56, 0, time.UTC) // a Wednesday
+	tests := []struct {
+		expr string
+		want time.Time
+	}{
+		{"* * * * *", time.Date(2024, 5, 1, 12, 35, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2024, 5, 1, 12, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * 1-5", time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC)},
+		{"30 2 * * *", time.Date(2024, 5, 2, 2, 30, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 5, 5, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1,15 * *", time.Date(2024, 5, 15, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2028, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"@monthly", time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)},
+		{"5/20 * * * *", time.Date(2024, 5, 1, 12, 45, 0, 0, time.UTC)},
+		// Both day fields restricted: either one matches
+		{"0 0 10 * 5", time.Date(2024, 5, 3, 0, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%q: %v", tt.expr, err)
+			continue
+		}
+		if got := s.next(from); !got.Equal(tt.want) {
+			t.Errorf("%q: expected %v, got %v", tt.expr, tt.want, got)
+		}
+	}
+
+	never, _ := parseCron("0 0 31 2 *")
+	if got := never.next(from); !got.IsZero() {
+		t.Errorf("Expected February 31st never to fire, got %v", got)
+	}
+}
+
+func TestParseCronErrors(t *testing.T) {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "a * * * *"} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("Expected %q to be rejected", expr)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// shellQuote wraps s in single quotes for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// curlCommand renders a request as a curl invocation. The body is inlined
+// when it's text; other bodies are piped in through base64 so the command
+// stays copy-pasteable.
+func curlCommand(req Request, targetURL string, body []byte) string {
+	var args []string
+	if req.Method != http.MethodGet || len(body) > 0 {
+		args = append(args, "-X", req.Method)
+	}
+	args = append(args, shellQuote(targetURL))
+
+	names := make([]string, 0, len(req.Headers))
+	for name := range req.Headers {
+		if !resendSkippedHeaders[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range req.Headers[name] {
+			args = append(args, "-H", shellQuote(name+": "+value))
+		}
+	}
+
+	prefix := ""
+	if len(body) > 0 {
+		if utf8.Valid(body) && !strings.ContainsRune(string(body), 0) {
+			args = append(args, "--data-binary", shellQuote(string(body)))
+		} else {
+			prefix = "printf '%s' " + shellQuote(base64.StdEncoding.EncodeToString(body)) + " | base64 -d | "
+			args = append(args, "--data-binary", "@-")
+		}
+	}
+	return prefix + "curl " + strings.Join(args, " ")
+}
+
+// curlHandler serves GET /api/bin/{id}/req/{reqId}/curl: a shell command that
+// resends the captured request, to ?target= if given. Bodies are sent as they
+// were captured, before any Content-Encoding was decoded.
+func curlHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := lookupRequest(w, r)
+	if !ok {
+		return
+	}
+	targetURL, err := resendURL(req, r.URL.Query().Get("target"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	body, err := readOriginalBody(r.Context(), req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	io.WriteString(w, curlCommand(req, targetURL, body)+"\n")
+}
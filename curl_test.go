@@ -0,0 +1,92 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestShellQuote(t *testing.T) {
+	if got := shellQuote(`it's "$HOME"`); got != `'it'\''s "$HOME"'` {
+		t.Errorf("Unexpected quoting %s", got)
+	}
+}
+
+func TestCurlCommand(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	capture := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hooks/github?a=1&a=2", strings.NewReader(`{"msg":"it's"}`))
+	capture.Header.Set("Content-Type", "application/json")
+	capture.Header.Set("X-Note", "$(rm -rf /)")
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, capture)
+	reqID := captureW.Body.String()
+
+	get := func(query string) (int, string) {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/curl"+query, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		return w.Code, w.Body.String()
+	}
+
+	code, cmd := get("")
+	want := `curl -X POST 'http://example.com/` + bin.BinID + `/hooks/github?a=1&a=2' ` +
+		`-H 'Content-Type: application/json' -H 'X-Note: $(rm -rf /)' --data-binary '{"msg":"it'\''s"}'` + "\n"
+	if code != http.StatusOK || cmd != want {
+		t.Errorf("Expected\n%s\ngot %d\n%s", want, code, cmd)
+	}
+
+	if code, _ := get("?target=ftp://example.com"); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a non-HTTP target, got %d", code)
+	}
+
+	if _, err := exec.LookPath("curl"); err != nil {
+		t.Skip("curl not installed")
+	}
+
+	// Run the command against a real server and check what arrives
+	var got *http.Request
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	_, cmd = get("?target=" + srv.URL + "/base")
+	if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+		t.Fatalf("curl failed: %v\n%s", err, out)
+	}
+	if got == nil || got.Method != http.MethodPost || got.URL.RequestURI() != "/base/hooks/github?a=1&a=2" {
+		t.Fatalf("Unexpected request %+v", got)
+	}
+	if got.Header.Get("X-Note") != "$(rm -rf /)" || string(gotBody) != `{"msg":"it's"}` {
+		t.Errorf("Expected the header and body verbatim, got %q %q", got.Header.Get("X-Note"), gotBody)
+	}
+
+	// Binary bodies are piped in
+	gzipped := compress(t, "gzip", []byte("hello"))
+	binary := httptest.NewRequest(http.MethodPut, "/"+bin.BinID, bytes.NewReader(gzipped))
+	binary.Header.Set("Content-Encoding", "gzip")
+	binaryW := httptest.NewRecorder()
+	captureRequestHandler(binaryW, binary)
+	reqID = binaryW.Body.String()
+
+	_, cmd = get("?target=" + srv.URL)
+	if !strings.Contains(cmd, "base64 -d | curl") {
+		t.Errorf("Expected the body piped through base64, got %s", cmd)
+	}
+	if out, err := exec.Command("sh", "-c", cmd).CombinedOutput(); err != nil {
+		t.Fatalf("curl failed: %v\n%s", err, out)
+	}
+	if !bytes.Equal(gotBody, gzipped) || got.Header.Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the gzipped body as sent, got %q", gotBody)
+	}
+}
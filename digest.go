@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Digest periods, which end on the hour or at midnight UTC
+const (
+	digestHourly = "hourly"
+	digestDaily  = "daily"
+)
+
+// digestTopPaths is how many of the busiest paths a digest lists
+const digestTopPaths = 5
+
+// digestSchema records the end of the last period each bin's digest
+// covered, so a restart neither repeats nor skips one
+const digestSchema = `
+        CREATE TABLE IF NOT EXISTS notify_digests (
+            bin_id TEXT PRIMARY KEY,
+            sent_until INTEGER NOT NULL,
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+    `
+
+func digestPeriod(digest string) time.Duration {
+	if digest == digestDaily {
+		return 24 * time.Hour
+	}
+	return time.Hour
+}
+
+// sendDueDigests sends a digest for every bin whose digest period has
+// ended since its last one. A bin's first digest covers the first whole
+// period after it was configured. Each period is summarized once: a
+// digest that fails to send is logged, not retried.
+func sendDueDigests(ctx context.Context, now time.Time) error {
+	bins, err := store.ListBins(ctx, 0, 0)
+	if err != nil {
+		return err
+	}
+	sent, err := digestsSent(ctx)
+	if err != nil {
+		return err
+	}
+	type binDigest struct {
+		binID     string
+		config    NotifyConfig
+		sentUntil int64
+	}
+	var due []binDigest
+	for _, bin := range bins {
+		cfg := bin.Config
+		if enabled, ok := cfg.Sinks["notify"]; ok && !enabled {
+			continue
+		}
+		if cfg.Notify != nil && cfg.Notify.Digest != "" && !binExpired(bin.ExpiresAt) {
+			due = append(due, binDigest{bin.BinID, *cfg.Notify, sent[bin.BinID]})
+		}
+	}
+
+	for _, d := range due {
+		period := digestPeriod(d.config.Digest)
+		end := now.UTC().Truncate(period)
+		if d.sentUntil >= end.UnixMilli() {
+			continue
+		}
+		if err := markDigestSent(ctx, d.binID, end); err != nil {
+			return err
+		}
+		if d.sentUntil == 0 {
+			continue
+		}
+		n, err := buildDigest(ctx, d.binID, d.config, end.Add(-period), end)
+		if err == nil {
+			err = d.config.send(ctx, n)
+		}
+		if err != nil {
+			log.Printf("Sending the digest for %s failed: %v", d.binID, err)
+		}
+	}
+	return nil
+}
+
+// digestsSent reads how far each bin's digests have got
+func digestsSent(ctx context.Context) (map[string]int64, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT bin_id, sent_until FROM notify_digests")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sent := map[string]int64{}
+	for rows.Next() {
+		var binID string
+		var until int64
+		if err := rows.Scan(&binID, &until); err != nil {
+			return nil, err
+		}
+		sent[binID] = until
+	}
+	return sent, rows.Err()
+}
+
+// markDigestSent records that a bin's captures until end have been digested
+func markDigestSent(ctx context.Context, binID string, end time.Time) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO notify_digests (bin_id, sent_until) VALUES (?, ?)
+        ON CONFLICT(bin_id) DO UPDATE SET sent_until = excluded.sent_until`, binID, end.UnixMilli())
+	return err
+}
+
+// buildDigest summarizes a bin's captures from start until end: how many
+// there were, matching the notify filter if there is one, the busiest
+// paths, and how its forwards went
+func buildDigest(ctx context.Context, binID string, cfg NotifyConfig, start, end time.Time) (notification, error) {
+	var n notification
+	q, _ := url.ParseQuery(cfg.Filter)
+	f, err := parseRequestFilter(q)
+	if err != nil {
+		return n, err
+	}
+	until := end.UnixMilli() - 1
+	counts := map[string]int{}
+	total := 0
+	err = pageRequests(ctx, binID, f.within(start.UnixMilli(), until), func(req Request) (bool, error) {
+		counts[req.Path]++
+		total++
+		return true, nil
+	})
+	if err != nil {
+		return n, err
+	}
+	paths := make([]string, 0, len(counts))
+	for path := range counts {
+		paths = append(paths, path)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		if counts[paths[i]] != counts[paths[j]] {
+			return counts[paths[i]] > counts[paths[j]]
+		}
+		return paths[i] < paths[j]
+	})
+	var lines []string
+	for _, path := range paths {
+		if len(lines) == digestTopPaths {
+			break
+		}
+		lines = append(lines, fmt.Sprintf("%6d  %s", counts[path], path))
+	}
+
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var delivered, failed int
+	err = db.QueryRowContext(ctx, `
+        SELECT COALESCE(SUM(status = ?), 0), COALESCE(SUM(status = ?), 0) FROM deliveries
+        WHERE bin_id = ? AND kind = ? AND created_at BETWEEN ? AND ?`,
+		deliveryDelivered, deliveryFailed, binID, deliveryForward, start.UnixMilli(), until).Scan(&delivered, &failed)
+	if err != nil {
+		return n, err
+	}
+
+	if cfg.Digest == digestDaily {
+		n.Title = fmt.Sprintf("Daily digest: %s on %s", plural(total, "request"), start.Format("2006-01-02"))
+	} else {
+		n.Title = fmt.Sprintf("Hourly digest: %s from %s to %s UTC", plural(total, "request"), start.Format("15:04"), end.Format("15:04"))
+	}
+	if len(lines) > 0 {
+		lines = append([]string{"Top paths:"}, lines...)
+	}
+	if delivered+failed > 0 {
+		lines = append(lines, fmt.Sprintf("Forwards: %d delivered, %d failed (%.1f%% failed)",
+			delivered, failed, 100*float64(failed)/float64(delivered+failed)))
+	}
+	n.Snippet = strings.Join(lines, "\n")
+	if publicURL != "" {
+		n.Link = fmt.Sprintf("%s/api/bin/%s/req?since=%d&until=%d", strings.TrimSuffix(publicURL, "/"),
+			url.PathEscape(binID), start.UnixMilli(), until)
+		if cfg.Filter != "" {
+			n.Link += "&" + cfg.Filter
+		}
+		n.LinkText = "View requests"
+	}
+	return n, nil
+}
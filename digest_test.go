@@ -0,0 +1,75 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDigest(t *testing.T) {
+	clearDB(t)
+	chat, server := newFakeChat(t)
+	old := publicURL
+	t.Cleanup(func() { publicURL = old })
+	publicURL = "https://postbin.example.com"
+
+	now := time.Now()
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"notify": {"slack": {"webhookUrl": "`+server.URL+`"}, "digest": "hourly"}}`)
+	// The first check only notes where the digests start
+	if err := sendDueDigests(context.Background(), now); err != nil {
+		t.Fatal(err)
+	}
+
+	var reqID string
+	for _, path := range []string{"/a", "/b", "/a"} {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+path, nil))
+		reqID = w.Body.String()
+	}
+	for i, status := range []string{deliveryDelivered, deliveryDelivered, deliveryDelivered, deliveryFailed} {
+		d := Delivery{DeliveryID: string(rune('a' + i)), BinID: bin.BinID, ReqID: reqID, Kind: deliveryForward, Status: status, CreatedAt: now.UnixMilli()}
+		if err := insertDelivery(context.Background(), d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitForSinks(t)
+	if len(chat.payloads) != 0 {
+		t.Fatalf("Expected no message per capture, got %v", chat.payloads)
+	}
+
+	next := now.Add(time.Hour)
+	for i := 0; i < 2; i++ {
+		if err := sendDueDigests(context.Background(), next); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(chat.payloads) != 1 {
+		t.Fatalf("Expected one digest, got %v", chat.payloads)
+	}
+	start := now.UTC().Truncate(time.Hour)
+	title := "Hourly digest: 3 requests from " + start.Format("15:04") + " to " + start.Add(time.Hour).Format("15:04") + " UTC"
+	text := chat.payloads[0]["blocks"].([]interface{})[0].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+	for _, want := range []string{
+		"*" + title + "*",
+		"Top paths:\n     2  /" + bin.BinID + "/a\n     1  /" + bin.BinID + "/b\n",
+		"Forwards: 3 delivered, 1 failed (25.0% failed)",
+		"https://postbin.example.com/api/bin/" + bin.BinID + "/req?since=",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("Expected the digest to contain %q, got %q", want, text)
+		}
+	}
+}
+
+func TestDigestValidation(t *testing.T) {
+	cfg := NotifyConfig{Slack: &SlackNotifier{WebhookURL: "https://hooks.slack.com/x"}, Digest: "weekly"}
+	if (BinConfig{Notify: &cfg}).validate() == "" {
+		t.Error("Expected a weekly digest to be rejected")
+	}
+}
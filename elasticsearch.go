@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global Elasticsearch sink settings; overridable with command-line flags.
+// Credentials go in the URL's user info.
+var (
+	elasticsearchURL   string
+	elasticsearchIndex = defaultElasticsearchIndex
+)
+
+const (
+	defaultElasticsearchIndex = "postbin"
+	elasticsearchTimeout      = 30 * time.Second
+	elasticsearchBatchBytes   = 5 << 20
+	elasticsearchAttempts     = 5
+)
+
+var elasticsearchClient = &http.Client{Timeout: elasticsearchTimeout}
+
+// defaultElasticsearchMapping types the fields searches and dashboards need,
+// leaving the rest to dynamic mapping. Header, query and body field names
+// vary too much to be mapped automatically, so those are stored but not
+// indexed; rawBody is searchable as text instead.
+var defaultElasticsearchMapping = json.RawMessage(`{
+  "properties": {
+    "@timestamp": {"type": "date"},
+    "binId": {"type": "keyword"},
+    "reqId": {"type": "keyword"},
+    "method": {"type": "keyword"},
+    "path": {"type": "keyword"},
+    "subPath": {"type": "keyword"},
+    "ip": {"type": "keyword"},
+    "host": {"type": "keyword"},
+    "proto": {"type": "keyword"},
+    "contentLength": {"type": "long"},
+    "inserted": {"type": "date", "format": "epoch_millis"},
+    "headers": {"type": "object", "enabled": false},
+    "query": {"type": "object", "enabled": false},
+    "body": {"type": "object", "enabled": false},
+    "rawBody": {"type": "text"}
+  }
+}`)
+
+// ElasticsearchSinkConfig indexes each of a bin's captures into a daily
+// Elasticsearch or OpenSearch index named {index}-YYYY.MM.DD, so old days
+// can be dropped whole. Index may contain {binId}; index names are always
+// lower case. Mapping, when given, replaces the default mappings each new
+// daily index is created with. Credentials are either in the URL as
+// user:pass@ or an API key.
+type ElasticsearchSinkConfig struct {
+	URL     string          `json:"url"`
+	Index   string          `json:"index,omitempty"`
+	APIKey  string          `json:"apiKey,omitempty"`
+	Mapping json.RawMessage `json:"mapping,omitempty"`
+}
+
+func (c ElasticsearchSinkConfig) validate() string {
+	if u, err := url.Parse(c.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "elasticsearch url must be an absolute http or https URL"
+	}
+	name := c.indexName("bin0", time.Now())
+	if strings.ContainsAny(name, `\/*?"<>| ,#:`) || strings.IndexAny(name, "-_+.") == 0 || len(name) > 255 {
+		return "elasticsearch index must be a valid index name"
+	}
+	if len(c.Mapping) > 0 {
+		var mapping map[string]json.RawMessage
+		if json.Unmarshal(c.Mapping, &mapping) != nil {
+			return "elasticsearch mapping must be a JSON object"
+		}
+	}
+	return ""
+}
+
+// indexName is the daily index a capture of binID made at t goes in
+func (c ElasticsearchSinkConfig) indexName(binID string, t time.Time) string {
+	index := c.Index
+	if index == "" {
+		index = defaultElasticsearchIndex
+	}
+	index = strings.ReplaceAll(index, "{binId}", binID)
+	return strings.ToLower(index) + "-" + t.UTC().Format("2006.01.02")
+}
+
+func (c ElasticsearchSinkConfig) mapping() json.RawMessage {
+	if len(c.Mapping) > 0 {
+		return c.Mapping
+	}
+	return defaultElasticsearchMapping
+}
+
+// globalElasticsearchSink is the sink configured with --elasticsearch-url,
+// if any
+func globalElasticsearchSink() *ElasticsearchSinkConfig {
+	if elasticsearchURL == "" {
+		return nil
+	}
+	return &ElasticsearchSinkConfig{URL: elasticsearchURL, Index: elasticsearchIndex}
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "elasticsearch",
+		global: func() Sink {
+			if sink := globalElasticsearchSink(); sink != nil {
+				return *sink
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.Elasticsearch != nil {
+				return *c.Elasticsearch
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver indexes one capture
+func (c ElasticsearchSinkConfig) Deliver(ctx context.Context, req *Request) error {
+	return c.DeliverBatch(ctx, []*Request{req})
+}
+
+// DeliverBatch indexes captures with bulk calls of up to
+// elasticsearchBatchBytes each
+func (c ElasticsearchSinkConfig) DeliverBatch(ctx context.Context, reqs []*Request) error {
+	var docs []elasticsearchDoc
+	for _, req := range reqs {
+		body, err := elasticsearchDocument(req)
+		if err != nil {
+			return err
+		}
+		docs = append(docs, elasticsearchDoc{
+			index: c.indexName(req.BinID, time.UnixMilli(req.Inserted)),
+			id:    req.ReqID,
+			body:  body,
+		})
+	}
+
+	ix := elasticsearchIndexerFor(c)
+	for len(docs) > 0 {
+		n, size := 1, len(docs[0].body)
+		for n < len(docs) && size+len(docs[n].body) <= elasticsearchBatchBytes {
+			size += len(docs[n].body)
+			n++
+		}
+		if err := ix.send(ctx, docs[:n]); err != nil {
+			return err
+		}
+		docs = docs[n:]
+	}
+	return nil
+}
+
+// elasticsearchDocument is a capture as indexed: its JSON with the
+// @timestamp field Kibana uses by default
+func elasticsearchDocument(req *Request) ([]byte, error) {
+	raw, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	doc["@timestamp"], _ = json.Marshal(time.UnixMilli(req.Inserted).UTC().Format(time.RFC3339Nano))
+	return json.Marshal(doc)
+}
+
+type elasticsearchDoc struct {
+	index, id string
+	body      []byte
+}
+
+var (
+	elasticsearchIndexersMu sync.Mutex
+	elasticsearchIndexers   = map[string]*elasticsearchIndexer{}
+)
+
+// elasticsearchIndexer talks to one cluster, remembering which daily
+// indices it has already created with their mapping
+type elasticsearchIndexer struct {
+	sink ElasticsearchSinkConfig
+
+	mu      sync.Mutex
+	created map[string]bool
+}
+
+// elasticsearchIndexerFor returns the shared indexer for sink
+func elasticsearchIndexerFor(sink ElasticsearchSinkConfig) *elasticsearchIndexer {
+	key, _ := json.Marshal(sink)
+
+	elasticsearchIndexersMu.Lock()
+	defer elasticsearchIndexersMu.Unlock()
+	if ix := elasticsearchIndexers[string(key)]; ix != nil {
+		return ix
+	}
+	ix := &elasticsearchIndexer{sink: sink, created: map[string]bool{}}
+	elasticsearchIndexers[string(key)] = ix
+	return ix
+}
+
+// send indexes documents in one bulk call, retrying with backoff before
+// giving up on them
+func (ix *elasticsearchIndexer) send(ctx context.Context, docs []elasticsearchDoc) error {
+	var body bytes.Buffer
+	for _, doc := range docs {
+		ix.ensureIndex(ctx, doc.index)
+		action, _ := json.Marshal(map[string]map[string]string{"index": {"_index": doc.index, "_id": doc.id}})
+		body.Write(action)
+		body.WriteByte('\n')
+		body.Write(doc.body)
+		body.WriteByte('\n')
+	}
+
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := ix.bulk(ctx, body.Bytes())
+		if err == nil || !retry || attempt == elasticsearchAttempts || !sinkSleep(ctx, wait) {
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// ensureIndex creates a daily index the first time it's used. Indexing
+// goes ahead even if that fails, with whatever mapping the cluster picks.
+func (ix *elasticsearchIndexer) ensureIndex(ctx context.Context, index string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.created[index] {
+		return
+	}
+	if err := ix.createIndex(ctx, index); err != nil {
+		log.Printf("Creating Elasticsearch index %s failed: %v", index, err)
+	}
+	ix.created[index] = true
+}
+
+// createIndex creates a daily index with the sink's mapping, unless it
+// already exists
+func (ix *elasticsearchIndexer) createIndex(ctx context.Context, index string) error {
+	body, _ := json.Marshal(map[string]json.RawMessage{"mappings": ix.sink.mapping()})
+	resp, raw, err := ix.do(ctx, http.MethodPut, "/"+index, "application/json", body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusOK || elasticsearchErrorType(raw) == "resource_already_exists_exception" {
+		return nil
+	}
+	return elasticsearchError(resp, raw)
+}
+
+// bulk makes one _bulk call, reporting whether a failure is worth retrying.
+// Documents the cluster rejects individually fail the call without a retry.
+func (ix *elasticsearchIndexer) bulk(ctx context.Context, body []byte) (retry bool, err error) {
+	resp, raw, err := ix.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", body)
+	if err != nil {
+		return true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		return retry, elasticsearchError(resp, raw)
+	}
+
+	var result struct {
+		Errors bool `json:"errors"`
+		Items  []map[string]struct {
+			Status int `json:"status"`
+			Error  struct {
+				Type   string `json:"type"`
+				Reason string `json:"reason"`
+			} `json:"error"`
+		} `json:"items"`
+	}
+	if json.Unmarshal(raw, &result) != nil || !result.Errors {
+		return false, nil
+	}
+	failed, first := 0, ""
+	for _, item := range result.Items {
+		for _, outcome := range item {
+			if outcome.Status >= 300 {
+				if failed++; first == "" {
+					first = outcome.Error.Type + ": " + outcome.Error.Reason
+				}
+			}
+		}
+	}
+	return false, fmt.Errorf("elasticsearch: %d of %d documents rejected, first with %s", failed, len(result.Items), first)
+}
+
+func (ix *elasticsearchIndexer) do(ctx context.Context, method, path, contentType string, body []byte) (*http.Response, []byte, error) {
+	u, err := url.Parse(ix.sink.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	user := u.User
+	u.User = nil
+	u.Path = strings.TrimSuffix(u.Path, "/") + path
+
+	httpReq, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, nil, err
+	}
+	httpReq.Header.Set("Content-Type", contentType)
+	if ix.sink.APIKey != "" {
+		httpReq.Header.Set("Authorization", "ApiKey "+ix.sink.APIKey)
+	} else if user != nil {
+		pass, _ := user.Password()
+		httpReq.Header.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+pass)))
+	}
+	resp, err := elasticsearchClient.Do(httpReq)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	// Bulk responses list every item, so they can be long
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	return resp, raw, nil
+}
+
+func elasticsearchErrorType(raw []byte) string {
+	var parsed struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	json.Unmarshal(raw, &parsed)
+	return parsed.Error.Type
+}
+
+// elasticsearchError turns an error response into an error, using the
+// reason in its body when there is one
+func elasticsearchError(resp *http.Response, raw []byte) error {
+	var parsed struct {
+		Error struct {
+			Type   string `json:"type"`
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(raw, &parsed) == nil && parsed.Error.Type != "" {
+		return fmt.Errorf("elasticsearch: %s: %s: %s", resp.Status, parsed.Error.Type, parsed.Error.Reason)
+	}
+	if len(raw) > 512 {
+		raw = raw[:512]
+	}
+	return errors.New("elasticsearch: " + resp.Status + ": " + string(bytes.TrimSpace(raw)))
+}
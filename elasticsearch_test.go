@@ -0,0 +1,158 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeElasticsearch records the indices created, with their mappings, and
+// the documents indexed in bulk; reject fails every document
+type fakeElasticsearch struct {
+	mu       sync.Mutex
+	auth     []string
+	mappings map[string]json.RawMessage
+	docs     map[string]map[string]json.RawMessage
+	bulked   chan struct{}
+	reject   bool
+}
+
+func newFakeElasticsearch(t *testing.T) (*fakeElasticsearch, *httptest.Server) {
+	es := &fakeElasticsearch{
+		mappings: map[string]json.RawMessage{},
+		docs:     map[string]map[string]json.RawMessage{},
+		bulked:   make(chan struct{}, 16),
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		es.mu.Lock()
+		defer es.mu.Unlock()
+		es.auth = append(es.auth, r.Header.Get("Authorization"))
+		switch {
+		case r.Method == http.MethodPut:
+			index := strings.TrimPrefix(r.URL.Path, "/")
+			if _, ok := es.mappings[index]; ok {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":{"type":"resource_already_exists_exception","reason":"exists"},"status":400}`))
+				return
+			}
+			var body struct{ Mappings json.RawMessage }
+			json.NewDecoder(r.Body).Decode(&body)
+			es.mappings[index] = body.Mappings
+			w.Write([]byte(`{"acknowledged":true}`))
+		case r.URL.Path == "/_bulk":
+			if r.Header.Get("Content-Type") != "application/x-ndjson" {
+				t.Errorf("Unexpected bulk content type %q", r.Header.Get("Content-Type"))
+			}
+			sc := bufio.NewScanner(r.Body)
+			sc.Buffer(nil, 1<<20)
+			var items []string
+			for sc.Scan() {
+				var index map[string]map[string]string
+				json.Unmarshal(sc.Bytes(), &index)
+				sc.Scan()
+				if es.reject {
+					items = append(items, `{"index":{"status":400,"error":{"type":"mapper_parsing_exception","reason":"failed to parse field [ip]"}}}`)
+					continue
+				}
+				var doc map[string]json.RawMessage
+				json.Unmarshal(sc.Bytes(), &doc)
+				es.docs[index["index"]["_index"]+"/"+index["index"]["_id"]] = doc
+				items = append(items, `{"index":{"status":201}}`)
+			}
+			w.Write([]byte(`{"errors":` + map[bool]string{true: "true", false: "false"}[es.reject] + `,"items":[` + strings.Join(items, ",") + `]}`))
+			es.bulked <- struct{}{}
+		default:
+			io.Copy(io.Discard, r.Body)
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return es, server
+}
+
+func TestElasticsearchSink(t *testing.T) {
+	clearDB(t)
+	es, server := newFakeElasticsearch(t)
+
+	bin := createTestBin(t)
+	url := strings.Replace(server.URL, "http://", "http://elastic:changeme@", 1)
+	setTestConfig(t, bin.BinID, `{"elasticsearch": {"url": "`+url+`", "index": "Hooks-{binId}"}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hello")))
+
+	select {
+	case <-es.bulked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the bulk request")
+	}
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	index := "hooks-" + strings.ToLower(bin.BinID) + "-" + time.Now().UTC().Format("2006.01.02")
+	var want bytes.Buffer
+	json.Compact(&want, defaultElasticsearchMapping)
+	if !bytes.Equal(es.mappings[index], want.Bytes()) {
+		t.Errorf("Expected %s to be created with the default mapping, got %v", index, es.mappings)
+	}
+	doc := es.docs[index+"/"+w.Body.String()]
+	if doc == nil || string(doc["rawBody"]) != `"hello"` || doc["@timestamp"] == nil {
+		t.Errorf("Unexpected documents %v", es.docs)
+	}
+	for _, auth := range es.auth {
+		if auth != "Basic ZWxhc3RpYzpjaGFuZ2VtZQ==" {
+			t.Errorf("Unexpected Authorization %q", auth)
+		}
+	}
+}
+
+func TestElasticsearchIndexing(t *testing.T) {
+	es, server := newFakeElasticsearch(t)
+	es.mappings["postbin-2026.10.14"] = json.RawMessage(`{}`)
+	ix := &elasticsearchIndexer{
+		sink:    ElasticsearchSinkConfig{URL: server.URL, APIKey: "key", Mapping: json.RawMessage(`{"dynamic":false}`)},
+		created: map[string]bool{},
+	}
+	ix.send(context.Background(), []elasticsearchDoc{
+		{index: "postbin-2026.10.14", id: "a", body: []byte(`{"n":1}`)},
+		{index: "postbin-2026.10.15", id: "b", body: []byte(`{"n":2}`)},
+	})
+	<-es.bulked
+	if string(es.mappings["postbin-2026.10.15"]) != `{"dynamic":false}` || len(es.docs) != 2 {
+		t.Errorf("Expected a new index with the configured mapping and both documents, got %v and %v", es.mappings, es.docs)
+	}
+	if es.auth[0] != "ApiKey key" {
+		t.Errorf("Expected API key auth, got %q", es.auth[0])
+	}
+
+	es.mu.Lock()
+	es.reject = true
+	es.mu.Unlock()
+	retry, err := ix.bulk(context.Background(), []byte("{}\n{}\n"))
+	if retry || err == nil || !strings.Contains(err.Error(), "1 of 1 documents rejected, first with mapper_parsing_exception") {
+		t.Errorf("Expected the rejection to be reported, got %v, %v", retry, err)
+	}
+}
+
+func TestElasticsearchSinkValidation(t *testing.T) {
+	for _, cfg := range []ElasticsearchSinkConfig{
+		{},
+		{URL: "es:9200"},
+		{URL: "http://es:9200", Index: "_hooks"},
+		{URL: "http://es:9200", Index: "a/b"},
+		{URL: "http://es:9200", Mapping: json.RawMessage(`[]`)},
+	} {
+		if (BinConfig{Elasticsearch: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
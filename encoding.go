@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// maxDecodedBytes caps how large a compressed body may grow when decoded,
+// when --max-body-bytes doesn't already set a limit
+const maxDecodedBytes = 64 << 20
+
+// decodeBody undoes a Content-Encoding of gzip, deflate or br, including
+// stacked encodings such as "gzip, br". It reports false, leaving the body as
+// sent, for unknown encodings, corrupt data or bodies that decode too large.
+func decodeBody(contentEncoding string, body []byte) ([]byte, bool) {
+	limit := int64(maxDecodedBytes)
+	if maxBodyBytes > 0 {
+		limit = maxBodyBytes
+	}
+
+	// Encodings are listed in the order they were applied
+	codings := strings.Split(contentEncoding, ",")
+	decoded := body
+	for i := len(codings) - 1; i >= 0; i-- {
+		var r io.Reader
+		var err error
+		src := bytes.NewReader(decoded)
+		switch strings.ToLower(strings.TrimSpace(codings[i])) {
+		case "gzip", "x-gzip":
+			r, err = gzip.NewReader(src)
+		case "deflate":
+			// Meant to be zlib-wrapped, but often sent as bare deflate
+			if r, err = zlib.NewReader(src); err != nil {
+				r, err = flate.NewReader(bytes.NewReader(decoded)), nil
+			}
+		case "br":
+			r = brotli.NewReader(src)
+		case "identity", "":
+			continue
+		default:
+			return body, false
+		}
+		if err != nil {
+			return body, false
+		}
+
+		out, err := io.ReadAll(io.LimitReader(r, limit+1))
+		if err != nil || int64(len(out)) > limit {
+			return body, false
+		}
+		decoded = out
+	}
+	return decoded, true
+}
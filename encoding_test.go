@@ -0,0 +1,100 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func compress(t *testing.T, coding string, data []byte) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown coding %s", coding)
+	}
+	w.Write(data)
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestDecodeBody(t *testing.T) {
+	plain := []byte(`{"hello":"world"}`)
+	tests := []struct {
+		header string
+		body   []byte
+		ok     bool
+	}{
+		{"gzip", compress(t, "gzip", plain), true},
+		{"deflate", compress(t, "deflate", plain), true},
+		{"deflate", compress(t, "raw-deflate", plain), true},
+		{"br", compress(t, "br", plain), true},
+		{"gzip, br", compress(t, "br", compress(t, "gzip", plain)), true},
+		{"gzip", plain, false},
+		{"compress", plain, false},
+	}
+	for _, tt := range tests {
+		got, ok := decodeBody(tt.header, tt.body)
+		if ok != tt.ok {
+			t.Errorf("%s: expected ok=%v, got %v", tt.header, tt.ok, ok)
+			continue
+		}
+		if ok && !bytes.Equal(got, plain) {
+			t.Errorf("%s: expected %q, got %q", tt.header, plain, got)
+		}
+		if !ok && !bytes.Equal(got, tt.body) {
+			t.Errorf("%s: expected the body to be left as sent", tt.header)
+		}
+	}
+}
+
+func TestCaptureDecodesBody(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	sent := compress(t, "gzip", []byte(`{"event":"ping"}`))
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, bytes.NewReader(sent))
+	captureReq.Header.Set("Content-Type", "application/json")
+	captureReq.Header.Set("Content-Encoding", "gzip")
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	reqID := captureW.Body.String()
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID, nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var got Request
+	json.NewDecoder(getW.Body).Decode(&got)
+	if got.RawBody != `{"event":"ping"}` || got.DecodedFrom != "gzip" {
+		t.Errorf("Expected the decoded body, got %q (decodedFrom=%q)", got.RawBody, got.DecodedFrom)
+	}
+	if doc, _ := got.Body.(map[string]interface{}); doc["event"] != "ping" {
+		t.Errorf("Expected the decoded body to be parsed, got %v", got.Body)
+	}
+
+	origReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/body?original=true", nil)
+	origW := httptest.NewRecorder()
+	binAPIHandler(origW, origReq)
+	if !bytes.Equal(origW.Body.Bytes(), sent) || origW.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("Expected the original gzip body back")
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/scrypt"
+)
+
+// scryptN is the scrypt cost of turning a bin's passphrase into its key
+var scryptN = 1 << 15
+
+// errWrongBinKey is returned for an X-Bin-Key that doesn't open the bin
+var errWrongBinKey = errors.New("wrong key for this bin")
+
+// EncryptionConfig seals a bin's bodies on capture to an X25519 public key,
+// the same way as libsodium's crypto_box_seal, so only the holder of the
+// private key can read them. The server never keeps the private key: it's
+// given again, as X-Bin-Key, by readers that want bodies opened for them.
+// A bin created with Passphrase instead of PublicKey has its key pair derived
+// from the passphrase with scrypt; only the public half and Salt are kept.
+type EncryptionConfig struct {
+	PublicKey  string `json:"publicKey,omitempty"`
+	Passphrase string `json:"passphrase,omitempty"`
+	Salt       string `json:"salt,omitempty"`
+}
+
+func (c EncryptionConfig) validate() string {
+	if (c.PublicKey == "") == (c.Passphrase == "") {
+		return "encryption needs exactly one of publicKey and passphrase"
+	}
+	if c.PublicKey != "" {
+		if key, err := base64.StdEncoding.DecodeString(c.PublicKey); err != nil || len(key) != 32 {
+			return "encryption publicKey must be a base64 32-byte X25519 key"
+		}
+	}
+	return ""
+}
+
+// prepare swaps a passphrase for the public key it derives, so the
+// passphrase itself is never stored
+func (c *EncryptionConfig) prepare() error {
+	if c.Passphrase == "" {
+		return nil
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	private, err := scrypt.Key([]byte(c.Passphrase), salt, scryptN, 8, 1, 32)
+	if err != nil {
+		return err
+	}
+	public, err := curve25519.X25519(private, curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	c.PublicKey = base64.StdEncoding.EncodeToString(public)
+	c.Salt = base64.StdEncoding.EncodeToString(salt)
+	c.Passphrase = ""
+	return nil
+}
+
+// keyPair turns an X-Bin-Key, the passphrase or the base64 private key,
+// into the bin's key pair
+func (c EncryptionConfig) keyPair(key string) (public, private *[32]byte, err error) {
+	var secret []byte
+	if c.Salt != "" {
+		salt, err := base64.StdEncoding.DecodeString(c.Salt)
+		if err != nil {
+			return nil, nil, err
+		}
+		if secret, err = scrypt.Key([]byte(key), salt, scryptN, 8, 1, 32); err != nil {
+			return nil, nil, err
+		}
+	} else if secret, err = base64.StdEncoding.DecodeString(key); err != nil || len(secret) != 32 {
+		return nil, nil, errWrongBinKey
+	}
+	derived, err := curve25519.X25519(secret, curve25519.Basepoint)
+	if err != nil || base64.StdEncoding.EncodeToString(derived) != c.PublicKey {
+		return nil, nil, errWrongBinKey
+	}
+	public, private = new([32]byte), new([32]byte)
+	copy(public[:], derived)
+	copy(private[:], secret)
+	return public, private, nil
+}
+
+// seal encrypts a capture's body, which is all that's kept of it: parsed
+// documents, multipart parts and the encoded original would give it away.
+func (c EncryptionConfig) seal(req *Request, body []byte) error {
+	var public [32]byte
+	key, _ := base64.StdEncoding.DecodeString(c.PublicKey)
+	copy(public[:], key)
+	sealed, err := box.SealAnonymous(nil, body, &public, rand.Reader)
+	if err != nil {
+		return err
+	}
+	req.RawBody = base64.StdEncoding.EncodeToString(sealed)
+	req.Body = req.RawBody
+	req.parts, req.encodedBody, req.DecodedFrom = nil, nil, ""
+	req.Encrypted = true
+	return nil
+}
+
+// binKey is a bin's key pair, derived from an X-Bin-Key
+type binKey struct {
+	public, private *[32]byte
+}
+
+// readBinKey derives binID's key pair from the request's X-Bin-Key, replying
+// with an error and returning false if it's wrong. The key is nil without the
+// header, or for a bin that doesn't seal its bodies. Handlers that remove or
+// lease requests read it first, so a wrong key doesn't cost the consumer the
+// requests it was after.
+func readBinKey(w http.ResponseWriter, r *http.Request, binID string) (*binKey, bool) {
+	header := r.Header.Get("X-Bin-Key")
+	if header == "" {
+		return nil, true
+	}
+	bin, err := cachedBins.get(r.Context(), binID)
+	if err == sql.ErrNoRows || err == nil && bin.Config.Encryption == nil {
+		return nil, true
+	}
+	var key binKey
+	if err == nil {
+		key.public, key.private, err = bin.Config.Encryption.keyPair(header)
+	}
+	if err == errWrongBinKey {
+		http.Error(w, `{"msg":"Wrong key for this bin"}`, http.StatusForbidden)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return nil, false
+	}
+	return &key, true
+}
+
+// open opens sealed bodies in place, replying with an error and returning
+// false if one won't open. A nil key leaves them sealed.
+func (k *binKey) open(w http.ResponseWriter, reqs ...*Request) bool {
+	if k == nil {
+		return true
+	}
+	for _, req := range reqs {
+		if !req.Encrypted {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(req.RawBody)
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return false
+		}
+		body, ok := box.OpenAnonymous(nil, sealed, k.public, k.private)
+		if !ok {
+			http.Error(w, `{"msg":"Wrong key for this bin"}`, http.StatusForbidden)
+			return false
+		}
+		req.RawBody, req.Body, req.Encrypted = string(body), string(body), false
+		if doc, _ := parseBody(req.Headers.Get("Content-Type"), body); doc != nil {
+			req.Body = doc
+		}
+	}
+	return true
+}
+
+// openSealedBodies opens sealed bodies in place with the request's X-Bin-Key,
+// replying with an error and returning false if the key is wrong. Without
+// the header bodies are left sealed. Every request must be from one bin.
+func openSealedBodies(w http.ResponseWriter, r *http.Request, reqs ...*Request) bool {
+	if len(reqs) == 0 {
+		return true
+	}
+	key, ok := readBinKey(w, r, reqs[0].BinID)
+	return ok && key.open(w, reqs...)
+}
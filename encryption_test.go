@@ -0,0 +1,164 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// createEncryptedBin creates a bin sealing its bodies with enc
+func createEncryptedBin(t *testing.T, enc EncryptionConfig) string {
+	body, _ := json.Marshal(CreateBinRequest{Config: &BinConfig{Encryption: &enc}})
+	w := httptest.NewRecorder()
+	createBinHandler(w, httptest.NewRequest(http.MethodPost, "/api/bin", bytes.NewReader(body)))
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected the bin to be created, got %d: %s", w.Code, w.Body)
+	}
+	var bin BinResponse
+	json.NewDecoder(w.Body).Decode(&bin)
+	return bin.BinID
+}
+
+// readSealed fetches a path with an optional X-Bin-Key
+func readSealed(path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	if key != "" {
+		r.Header.Set("X-Bin-Key", key)
+	}
+	w := httptest.NewRecorder()
+	binAPIHandler(w, r)
+	return w
+}
+
+func TestSealedBodies(t *testing.T) {
+	clearDB(t)
+	public, private, _ := box.GenerateKey(rand.Reader)
+	binID := createEncryptedBin(t, EncryptionConfig{PublicKey: base64.StdEncoding.EncodeToString(public[:])})
+
+	capture := httptest.NewRequest(http.MethodPost, "/"+binID, strings.NewReader(`{"card":"4242"}`))
+	capture.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, capture)
+	reqID := w.Body.String()
+
+	var stored int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE body LIKE '%4242%' OR parsed_body LIKE '%4242%'").Scan(&stored)
+	if stored != 0 {
+		t.Errorf("Expected the body not to be stored in the clear")
+	}
+
+	var sealed Request
+	json.NewDecoder(readSealed("/api/bin/"+binID+"/req/"+reqID, "").Body).Decode(&sealed)
+	raw, _ := base64.StdEncoding.DecodeString(sealed.RawBody)
+	if body, ok := box.OpenAnonymous(nil, raw, public, private); !sealed.Encrypted || !ok || string(body) != `{"card":"4242"}` {
+		t.Errorf("Expected a box the private key opens, got %+v", sealed)
+	}
+
+	key := base64.StdEncoding.EncodeToString(private[:])
+	var opened []Request
+	json.NewDecoder(readSealed("/api/bin/"+binID+"/req", key).Body).Decode(&opened)
+	if len(opened) != 1 || opened[0].Encrypted || opened[0].RawBody != `{"card":"4242"}` {
+		t.Errorf("Expected the key to open the body, got %+v", opened)
+	}
+	if doc, _ := opened[0].Body.(map[string]interface{}); doc["card"] != "4242" {
+		t.Errorf("Expected the opened body parsed, got %v", opened[0].Body)
+	}
+
+	if w := readSealed("/api/bin/"+binID+"/req/"+reqID+"/body", ""); !bytes.Equal(w.Body.Bytes(), raw) {
+		t.Errorf("Expected the body endpoint to serve the box, got %q", w.Body)
+	}
+	_, other, _ := box.GenerateKey(rand.Reader)
+	if w := readSealed("/api/bin/"+binID+"/req/"+reqID, base64.StdEncoding.EncodeToString(other[:])); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the wrong key to be refused, got %d", w.Code)
+	}
+}
+
+func TestSealedBodiesTaken(t *testing.T) {
+	clearDB(t)
+	public, private, _ := box.GenerateKey(rand.Reader)
+	binID := createEncryptedBin(t, EncryptionConfig{PublicKey: base64.StdEncoding.EncodeToString(public[:])})
+	for _, body := range []string{"first", "second"} {
+		captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+binID, strings.NewReader(body)))
+	}
+	key := base64.StdEncoding.EncodeToString(private[:])
+
+	// A wrong key is refused before anything is taken
+	_, other, _ := box.GenerateKey(rand.Reader)
+	if w := readSealed("/api/bin/"+binID+"/req/shift", base64.StdEncoding.EncodeToString(other[:])); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the wrong key to be refused, got %d", w.Code)
+	}
+	if n, _ := store.CountRequests(context.Background(), binID, requestFilter{}); n != 2 {
+		t.Errorf("Expected a refused shift to leave both requests, got %d", n)
+	}
+
+	var leased Request
+	json.NewDecoder(readSealed("/api/bin/"+binID+"/req/lease", key).Body).Decode(&leased)
+	if leased.Encrypted || leased.RawBody != "first" {
+		t.Errorf("Expected the lease to open the body, got %+v", leased)
+	}
+	var shifted Request
+	json.NewDecoder(readSealed("/api/bin/"+binID+"/req/shift", key).Body).Decode(&shifted)
+	if shifted.Encrypted || shifted.RawBody != "second" {
+		t.Errorf("Expected the shift to open the body, got %+v", shifted)
+	}
+}
+
+func TestSealedBodiesWithPassphrase(t *testing.T) {
+	clearDB(t)
+	defer func(n int) { scryptN = n }(scryptN)
+	scryptN = 1 << 10
+	binID := createEncryptedBin(t, EncryptionConfig{Passphrase: "correct horse"})
+
+	bin, _ := store.GetBin(context.Background(), binID)
+	if enc := bin.Config.Encryption; enc.Passphrase != "" || enc.PublicKey == "" || enc.Salt == "" {
+		t.Fatalf("Expected only the public key and salt kept, got %+v", enc)
+	}
+
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+binID, strings.NewReader("secret=1")))
+	reqID := w.Body.String()
+	if w := readSealed("/api/bin/"+binID+"/req/"+reqID+"/body", "correct horse"); w.Body.String() != "secret=1" {
+		t.Errorf("Expected the passphrase to open the body, got %q", w.Body)
+	}
+	if w := readSealed("/api/bin/"+binID+"/req/"+reqID, "wrong horse"); w.Code != http.StatusForbidden {
+		t.Errorf("Expected the wrong passphrase to be refused, got %d", w.Code)
+	}
+
+	// Replacing the config keeps the bin's key, and won't take another
+	put := func(body string) int {
+		w := httptest.NewRecorder()
+		binConfigHandler(w, httptest.NewRequest(http.MethodPut, "/api/bin/"+binID+"/config", strings.NewReader(body)))
+		return w.Code
+	}
+	if code := put(`{"cors":{}}`); code != http.StatusOK {
+		t.Fatalf("Expected the config to be replaced, got %d", code)
+	}
+	if kept, _ := store.GetBin(context.Background(), binID); kept.Config.Encryption == nil || *kept.Config.Encryption != *bin.Config.Encryption {
+		t.Errorf("Expected the bin's key to be kept, got %+v", kept.Config.Encryption)
+	}
+	if code := put(`{"encryption":{"passphrase":"another"}}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a new key to be refused, got %d", code)
+	}
+}
+
+func TestEncryptionConfigValidate(t *testing.T) {
+	for _, cfg := range []BinConfig{
+		{Encryption: &EncryptionConfig{}},
+		{Encryption: &EncryptionConfig{PublicKey: "c2hvcnQ="}},
+		{Encryption: &EncryptionConfig{Passphrase: "x"}, Forward: &ForwardConfig{URL: "http://example.com"}},
+	} {
+		if cfg.validate() == "" {
+			t.Errorf("Expected %+v to be refused", cfg.Encryption)
+		}
+	}
+}
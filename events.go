@@ -0,0 +1,87 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// captureHub fans captured requests out to in-process subscribers such as
+// long-polling and live-tail clients. Delivery is best effort: a subscriber
+// that isn't keeping up misses events rather than stalling captures, and the
+// number it missed is tracked so it can be reported.
+type captureHub struct {
+	mu   sync.Mutex
+	subs map[string]map[*subscription]struct{}
+	// relay, when set, passes captures on to the cluster's other servers
+	relay func(Request)
+}
+
+// subscription receives captures for a single bin on C.
+type subscription struct {
+	C       <-chan Request
+	ch      chan Request
+	dropped uint64
+	hub     *captureHub
+	binID   string
+}
+
+var captures = &captureHub{subs: make(map[string]map[*subscription]struct{})}
+
+// subscribe registers interest in captures for binID, buffering up to buffer
+// events. Close must be called to release the subscription.
+func (h *captureHub) subscribe(binID string, buffer int) *subscription {
+	ch := make(chan Request, buffer)
+	sub := &subscription{C: ch, ch: ch, hub: h, binID: binID}
+
+	h.mu.Lock()
+	if h.subs[binID] == nil {
+		h.subs[binID] = make(map[*subscription]struct{})
+	}
+	h.subs[binID][sub] = struct{}{}
+	h.mu.Unlock()
+
+	return sub
+}
+
+// publish hands req to every subscriber of its bin, here and on the rest of
+// the cluster, without blocking.
+func (h *captureHub) publish(req Request) {
+	h.deliver(req)
+	h.mu.Lock()
+	relay := h.relay
+	h.mu.Unlock()
+	if relay != nil {
+		relay(req)
+	}
+}
+
+// deliver hands req to this server's subscribers of its bin without blocking.
+func (h *captureHub) deliver(req Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subs[req.BinID] {
+		select {
+		case sub.ch <- req:
+		default:
+			atomic.AddUint64(&sub.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns how many captures were discarded because the buffer was
+// full since the last call.
+func (s *subscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// Close unregisters the subscription.
+func (s *subscription) Close() {
+	h := s.hub
+	h.mu.Lock()
+	delete(h.subs[s.binID], s)
+	if len(h.subs[s.binID]) == 0 {
+		delete(h.subs, s.binID)
+	}
+	h.mu.Unlock()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// reclaimSpace returns freed pages to the filesystem, reporting how:
+// "incremental" for databases in auto_vacuum=INCREMENTAL mode, which new
+// databases are created in, or "full" for a VACUUM. Older databases are only
+// given a full VACUUM if full is set, as it rewrites the whole file while
+// holding the write lock; it also moves them to incremental mode, so it's
+// needed at most once. Either way vacuuming takes as long as the database is
+// big, so it isn't held to dbTimeout.
+func reclaimSpace(ctx context.Context, full bool) (string, error) {
+	var mode int
+	if err := db.QueryRowContext(ctx, "PRAGMA auto_vacuum").Scan(&mode); err != nil {
+		return "", err
+	}
+	if mode == 2 {
+		_, err := db.ExecContext(ctx, "PRAGMA incremental_vacuum")
+		return "incremental", err
+	}
+	if !full {
+		return "", nil
+	}
+	_, err := db.ExecContext(ctx, "VACUUM")
+	return "full", err
+}
+
+// MaintenanceResponse reports a maintenance run
+type MaintenanceResponse struct {
+	// Vacuum is how space was reclaimed, if it was: "incremental" or "full"
+	Vacuum      string `json:"vacuum,omitempty"`
+	BytesBefore int64  `json:"bytesBefore"`
+	BytesAfter  int64  `json:"bytesAfter"`
+}
+
+// maintainDatabase reclaims the space left by deleted rows, refreshes the
+// query planner's statistics, and truncates the write-ahead log, so the file
+// on disk shrinks along with the data. ANALYZE is limited to sampling each
+// index, which keeps it quick on big databases.
+func maintainDatabase(ctx context.Context, full bool) (MaintenanceResponse, error) {
+	resp := MaintenanceResponse{BytesBefore: dbSize(ctx)}
+	var err error
+	if resp.Vacuum, err = reclaimSpace(ctx, full); err != nil {
+		return resp, err
+	}
+	if _, err := db.ExecContext(ctx, "PRAGMA analysis_limit = 1000; ANALYZE"); err != nil {
+		return resp, err
+	}
+	if _, err := db.ExecContext(ctx, "PRAGMA wal_checkpoint(TRUNCATE)"); err != nil {
+		return resp, err
+	}
+	resp.BytesAfter = dbSize(ctx)
+	return resp, nil
+}
+
+// Expiry sweeper settings; overridable with command-line flags
+var (
+	sweepInterval  = time.Minute
+	sweepBatchSize = 500
+	// maintenanceAfter is how many swept requests set off maintainDatabase;
+	// 0 leaves maintenance to the admin API
+	maintenanceAfter int64 = 10000
+)
+
+// sweepExpired purges expired bins in batches of sweepBatchSize, committing
+// after each batch so captures aren't blocked behind one long transaction.
+func sweepExpired(ctx context.Context) (bins, requests int64, err error) {
+	for {
+		b, r, err := store.PurgeExpiredBins(ctx, sweepBatchSize)
+		if b > 0 {
+			cachedBins.clear()
+		}
+		bins += b
+		requests += r
+		if err != nil || b < int64(sweepBatchSize) {
+			return bins, requests, err
+		}
+	}
+}
+
+// startSweeper runs sweepExpired every interval until the returned function
+// is called.
+func startSweeper(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+
+	go func() {
+		// swept counts requests purged since maintenance last ran
+		var swept int64
+		for {
+			select {
+			case <-ticker.C:
+				bins, requests, err := sweepExpired(context.Background())
+				if err != nil {
+					log.Printf("Expiry sweep failed: %v", err)
+				} else if bins > 0 {
+					log.Printf("Expiry sweep removed %d bins and %d requests", bins, requests)
+				}
+				if _, err := collectBlobs(context.Background()); err != nil {
+					log.Printf("Blob cleanup failed: %v", err)
+				}
+				swept += requests
+				if storeIsSQLite() && maintenanceAfter > 0 && swept >= maintenanceAfter {
+					swept = 0
+					if resp, err := maintainDatabase(context.Background(), false); err != nil {
+						log.Printf("Database maintenance failed: %v", err)
+					} else {
+						log.Printf("Database maintenance took the database from %d to %d bytes", resp.BytesBefore, resp.BytesAfter)
+					}
+				}
+			case <-done:
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
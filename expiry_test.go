@@ -0,0 +1,111 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSweepExpired(t *testing.T) {
+	clearDB(t)
+
+	live := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+live.BinID, strings.NewReader("keep")))
+
+	// More expired bins than fit in one batch
+	defer func(n int) { sweepBatchSize = n }(sweepBatchSize)
+	sweepBatchSize = 2
+	for i := 0; i < 5; i++ {
+		binID := fmt.Sprintf("stale%d", i)
+		testDB.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES (?, 1, 2)", binID)
+		testDB.Exec(`INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
+            VALUES (?, ?, 'POST', '/', '{}', '{}', '""', '', 1)`, "r"+binID, binID)
+	}
+
+	bins, requests, err := sweepExpired(context.Background())
+	if err != nil {
+		t.Fatalf("Sweep failed: %v", err)
+	}
+	if bins != 5 || requests != 5 {
+		t.Errorf("Expected 5 bins and 5 requests swept, got %d and %d", bins, requests)
+	}
+
+	var remaining int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests").Scan(&remaining)
+	if remaining != 1 {
+		t.Errorf("Expected only the live bin's request to remain, got %d", remaining)
+	}
+}
+
+func TestSweeperRuns(t *testing.T) {
+	clearDB(t)
+
+	testDB.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES ('stale', 1, 2)")
+
+	stop := startSweeper(10 * time.Millisecond)
+	defer stop()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		var bins int
+		testDB.QueryRow("SELECT COUNT(*) FROM bins").Scan(&bins)
+		if bins == 0 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Error("Sweeper did not remove the expired bin")
+}
+
+func TestMaintainDatabase(t *testing.T) {
+	defer func(conn *sql.DB) { db = conn }(db)
+	dir := t.TempDir()
+
+	var err error
+	if db, err = openSQLite(filepath.Join(dir, "new.db"), true); err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES ('big', 1, 0)")
+	for i := 0; i < 200; i++ {
+		db.Exec(`INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
+            VALUES (?, 'big', 'POST', '/', '{}', '{}', ?, '', 1)`, fmt.Sprint(i), strings.Repeat("x", 4096))
+	}
+	db.Exec("DELETE FROM requests")
+
+	resp, err := maintainDatabase(context.Background(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Vacuum != "incremental" || resp.BytesAfter >= resp.BytesBefore {
+		t.Errorf("Expected a new database to shrink incrementally, got %+v", resp)
+	}
+
+	// A database from before incremental vacuuming is only converted on request
+	old, _ := sql.Open("sqlite3", filepath.Join(dir, "old.db"))
+	old.Exec("CREATE TABLE filler (x TEXT)")
+	old.Close()
+	db.Close()
+	if db, err = openSQLite(filepath.Join(dir, "old.db"), true); err != nil {
+		t.Fatal(err)
+	}
+	if resp, _ := maintainDatabase(context.Background(), false); resp.Vacuum != "" {
+		t.Errorf("Expected no VACUUM unless asked for, got %+v", resp)
+	}
+	if resp, _ := maintainDatabase(context.Background(), true); resp.Vacuum != "full" {
+		t.Errorf("Expected a full VACUUM, got %+v", resp)
+	}
+	var mode int
+	db.QueryRow("PRAGMA auto_vacuum").Scan(&mode)
+	if mode != 2 {
+		t.Errorf("Expected the VACUUM to switch to incremental mode, got %d", mode)
+	}
+}
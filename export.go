@@ -0,0 +1,152 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// loadExportRequests returns a bin's requests matching the listing filters,
+// oldest first. A nil slice with a nil error means the bin doesn't exist.
+func loadExportRequests(ctx context.Context, binID string, filter requestFilter) ([]Request, error) {
+	if _, err := loadBinResponse(ctx, binID); err == sql.ErrNoRows {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	reqs := []Request{}
+	err := pageRequests(ctx, binID, filter, func(req Request) (bool, error) {
+		reqs = append(reqs, req)
+		return true, nil
+	})
+	return reqs, err
+}
+
+// exportHandler serves GET /api/bin/{binId}/export?format=har|zip: every
+// captured request matching the listing filters, as a file to download.
+func exportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/export")]
+
+	format := r.URL.Query().Get("format")
+	if format != "har" && format != "zip" {
+		http.Error(w, `{"msg":"format must be har or zip"}`, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	reqs, err := loadExportRequests(r.Context(), binID, filter)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if reqs == nil {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	}
+
+	if format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, binID))
+		if err := writeZIPExport(r.Context(), w, reqs); err != nil {
+			log.Printf("Exporting bin %s: %v", binID, err)
+		}
+		return
+	}
+
+	har := newHARFile()
+	for _, req := range reqs {
+		body, err := readOriginalBody(r.Context(), req)
+		if err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		har.Log.Entries = append(har.Log.Entries, newHAREntry(req, body))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.har"`, binID))
+	json.NewEncoder(w).Encode(har)
+}
+
+// writeZIPExport writes an archive with a directory per request, holding its
+// metadata as request.json and its body as sent. The archive is streamed, so
+// a failure part way through leaves it truncated rather than reported.
+func writeZIPExport(ctx context.Context, w io.Writer, reqs []Request) error {
+	zw := zip.NewWriter(w)
+	for _, req := range reqs {
+		modified := time.UnixMilli(req.Inserted)
+
+		meta, err := json.MarshalIndent(req, "", "  ")
+		if err != nil {
+			return err
+		}
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: req.ReqID + "/request.json", Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(meta); err != nil {
+			return err
+		}
+
+		body, _, err := openOriginalBody(ctx, req)
+		if err != nil {
+			return err
+		}
+		f, err = zw.CreateHeader(&zip.FileHeader{Name: req.ReqID + "/" + bodyFileName(req), Method: zip.Deflate, Modified: modified})
+		if err == nil {
+			_, err = io.Copy(f, body)
+		}
+		body.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// bodyFileName names a body after its Content-Type, so the archive opens
+// with the right tools
+func bodyFileName(req Request) string {
+	ext := ".bin"
+	if mediaType, _, err := mime.ParseMediaType(req.Headers.Get("Content-Type")); err == nil {
+		switch mediaType {
+		case "application/json":
+			ext = ".json"
+		case "text/plain":
+			ext = ".txt"
+		default:
+			if exts, _ := mime.ExtensionsByType(mediaType); len(exts) > 0 {
+				ext = exts[0]
+			}
+		}
+	}
+	// Bodies are stored as sent, so they still carry their Content-Encoding
+	for _, coding := range strings.Split(req.DecodedFrom, ",") {
+		switch coding = strings.TrimSpace(coding); coding {
+		case "":
+		case "gzip", "x-gzip":
+			ext += ".gz"
+		default:
+			ext += "." + coding
+		}
+	}
+	return "body" + ext
+}
@@ -0,0 +1,85 @@
+//go:build cgo
+
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExportFormat(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/export?format=pcap", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown format, got %d", w.Code)
+	}
+
+	missing := httptest.NewRequest(http.MethodGet, "/api/bin/nosuchbin/export?format=har", nil)
+	missingW := httptest.NewRecorder()
+	binAPIHandler(missingW, missing)
+	if missingW.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing bin, got %d", missingW.Code)
+	}
+}
+
+func TestExportZIP(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(`{"ok":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, req)
+	reqID := captureW.Body.String()
+
+	gzipped := compress(t, "gzip", []byte("hello"))
+	binary := httptest.NewRequest(http.MethodPut, "/"+bin.BinID, bytes.NewReader(gzipped))
+	binary.Header.Set("Content-Encoding", "gzip")
+	binaryW := httptest.NewRecorder()
+	captureRequestHandler(binaryW, binary)
+	binaryID := binaryW.Body.String()
+
+	exportReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/export?format=zip", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, exportReq)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("Expected a zip, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if len(files) != 4 {
+		t.Errorf("Expected 4 files, got %d", len(files))
+	}
+	if string(files[reqID+"/body.json"]) != `{"ok":true}` {
+		t.Errorf("Unexpected body %q", files[reqID+"/body.json"])
+	}
+	if !bytes.Equal(files[binaryID+"/body.bin.gz"], gzipped) {
+		t.Errorf("Expected the gzipped body as sent, got %q", files[binaryID+"/body.bin.gz"])
+	}
+	var meta Request
+	if err := json.Unmarshal(files[reqID+"/request.json"], &meta); err != nil || meta.ReqID != reqID {
+		t.Errorf("Expected the request's metadata, got %+v (%v)", meta, err)
+	}
+}
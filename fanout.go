@@ -0,0 +1,142 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Cross-node fan-out settings; overridable with command-line flags. With
+// fanoutURL set, servers sharing a --db-driver backend relay their captures
+// to one another over NATS, so long-polling, live-tail and tunnel clients
+// see captures whichever server took them.
+var (
+	fanoutURL     string
+	fanoutSubject = "postbin.captures"
+)
+
+// fanoutBuffer is how many captures can wait to be relayed before more are
+// dropped
+const fanoutBuffer = 1024
+
+// fanoutEvent is a capture as relayed between servers
+type fanoutEvent struct {
+	Node    string  `json:"node"`
+	Request Request `json:"request"`
+}
+
+// fanout relays captures between servers through a NATS subject. Like the
+// capture hub it's best effort: captures are dropped rather than held up
+// while NATS is slow or unreachable.
+type fanout struct {
+	client  *natsClient
+	subject string
+	// node tells this server's events apart from the others'
+	node    string
+	queue   chan Request
+	dropped uint64
+	done    chan struct{}
+}
+
+// startFanout relays captures through subject on the NATS server at rawURL
+// until the returned function is called.
+func startFanout(rawURL, subject string) (stop func()) {
+	var id [8]byte
+	rand.Read(id[:])
+	f := &fanout{
+		client:  natsClientFor(rawURL),
+		subject: subject,
+		node:    hex.EncodeToString(id[:]),
+		queue:   make(chan Request, fanoutBuffer),
+		done:    make(chan struct{}),
+	}
+	go f.send()
+	go f.listen()
+
+	captures.mu.Lock()
+	captures.relay = f.relay
+	captures.mu.Unlock()
+	return func() {
+		captures.mu.Lock()
+		captures.relay = nil
+		captures.mu.Unlock()
+		close(f.done)
+	}
+}
+
+// relay queues a capture for the other servers without blocking
+func (f *fanout) relay(req Request) {
+	select {
+	case f.queue <- req:
+	default:
+		atomic.AddUint64(&f.dropped, 1)
+	}
+}
+
+// send publishes queued captures, logging when relaying starts and stops
+// failing rather than on every capture
+func (f *fanout) send() {
+	failing := false
+	for {
+		select {
+		case req := <-f.queue:
+			payload, err := json.Marshal(fanoutEvent{Node: f.node, Request: req})
+			if err == nil {
+				err = f.client.publish(f.subject, payload, nil, false)
+			}
+			if err != nil && !failing {
+				log.Printf("Relaying captures to other servers failed: %v", err)
+			} else if err == nil && failing {
+				log.Printf("Relaying captures to other servers again")
+			}
+			failing = err != nil
+			if dropped := atomic.SwapUint64(&f.dropped, 0); dropped > 0 {
+				log.Printf("Dropped %d captures while relaying to other servers fell behind", dropped)
+			}
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// listen subscribes to the other servers' captures, subscribing again
+// whenever the connection is redialled
+func (f *fanout) listen() {
+	for {
+		conn, err := f.client.connect()
+		if err == nil {
+			err = conn.subscribe(f.subject, f.receive)
+		}
+		if err != nil {
+			log.Printf("Subscribing to other servers' captures failed: %v", err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-f.done:
+				return
+			}
+		}
+		select {
+		case <-conn.closed:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+// receive hands another server's capture to this server's subscribers
+func (f *fanout) receive(payload []byte) {
+	select {
+	case <-f.done:
+		return
+	default:
+	}
+	var event fanoutEvent
+	if err := json.Unmarshal(payload, &event); err != nil || event.Node == f.node {
+		return
+	}
+	captures.deliver(event.Request)
+}
@@ -0,0 +1,148 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNATSBroker routes publishes to every connection subscribed to exactly
+// their subject, as HMSG
+func fakeNATSBroker(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	type sub struct {
+		conn net.Conn
+		sid  string
+	}
+	var mu sync.Mutex
+	subs := map[string][]sub{}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":1048576}\r\n")
+				rd := bufio.NewReader(conn)
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "PING":
+						io.WriteString(conn, "PONG\r\n")
+					case "SUB":
+						mu.Lock()
+						subs[fields[1]] = append(subs[fields[1]], sub{conn, fields[2]})
+						mu.Unlock()
+					case "HPUB":
+						hdrSize, _ := strconv.Atoi(fields[len(fields)-2])
+						total, _ := strconv.Atoi(fields[len(fields)-1])
+						buf := make([]byte, total+2)
+						io.ReadFull(rd, buf)
+						mu.Lock()
+						for _, s := range subs[fields[1]] {
+							fmt.Fprintf(s.conn, "HMSG %s %s %d %d\r\n%s", fields[1], s.sid, hdrSize, total, buf)
+						}
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + ln.Addr().String()
+}
+
+func TestFanout(t *testing.T) {
+	clearDB(t)
+	url := fakeNATSBroker(t)
+	stop := startFanout(url, "postbin.test.captures")
+	defer stop()
+
+	// Another server, on a connection of its own
+	other, err := dialNATS(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.fail(io.EOF)
+	relayed := make(chan fanoutEvent, 4)
+	other.subscribe("postbin.test.captures", func(payload []byte) {
+		var event fanoutEvent
+		json.Unmarshal(payload, &event)
+		relayed <- event
+	})
+	other.write("PING\r\n")
+
+	bin := createTestBin(t)
+	sub := captures.subscribe(bin.BinID, 16)
+	defer sub.Close()
+
+	// The broker has both subscriptions once the other server's capture
+	// comes back round to this one
+	remote, _ := json.Marshal(fanoutEvent{Node: "other", Request: Request{ReqID: "remote", BinID: bin.BinID}})
+	var got Request
+	deadline := time.After(5 * time.Second)
+	for got.ReqID == "" {
+		other.publish("postbin.test.captures", remote, nil, false)
+		select {
+		case got = <-sub.C:
+		case <-relayed:
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for the other server's capture")
+		}
+	}
+	if got.ReqID != "remote" {
+		t.Errorf("Expected the other server's capture, got %+v", got)
+	}
+
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("local")))
+	for {
+		select {
+		case event := <-relayed:
+			if event.Node == "other" {
+				continue
+			}
+			if event.Request.ReqID != w.Body.String() || event.Request.RawBody != "local" {
+				t.Errorf("Expected the local capture relayed, got %+v", event)
+			}
+		case <-deadline:
+			t.Fatal("Timed out waiting for the local capture to be relayed")
+		}
+		break
+	}
+
+	// This server's own capture comes back from the broker, but is only
+	// delivered the once
+	time.Sleep(50 * time.Millisecond)
+	delivered := 0
+	for len(sub.C) > 0 {
+		if req := <-sub.C; req.ReqID == w.Body.String() {
+			delivered++
+		}
+	}
+	if delivered != 1 {
+		t.Errorf("Expected the local capture delivered once, got %d", delivered)
+	}
+}
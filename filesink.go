@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// File sink settings; overridable with command-line flags. Unlike the other
+// sinks it can only be configured for the whole server, since bins mustn't
+// choose paths on its disk.
+var (
+	fileSinkPath     string
+	fileSinkMaxBytes int64 = 100 << 20
+	fileSinkKeep           = 10
+	fileSinkSync     bool
+)
+
+// fileSink appends captures to a file as NDJSON, one capture per line.
+// Once the file reaches maxBytes it's renamed with a timestamp suffix and a
+// new one started, and only the newest keep renamed files are kept.
+type fileSink struct {
+	path     string
+	maxBytes int64
+	keep     int
+	sync     bool
+
+	mu   sync.Mutex
+	file *os.File
+	size int64
+}
+
+var globalFileSink *fileSink
+
+// openFileSink opens path for appending, creating its directory if needed
+func openFileSink(path string, maxBytes int64, keep int, sync bool) (*fileSink, error) {
+	s := &fileSink{path: path, maxBytes: maxBytes, keep: keep, sync: sync}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.file, s.size = f, info.Size()
+	return nil
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "file",
+		global: func() Sink {
+			if globalFileSink != nil {
+				return globalFileSink
+			}
+			return nil
+		},
+		forBin: func(BinConfig) Sink { return nil },
+	})
+}
+
+// Deliver appends a capture to the file
+func (s *fileSink) Deliver(_ context.Context, req *Request) error {
+	return s.write(req)
+}
+
+func (s *fileSink) write(req *Request) error {
+	line, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		// A failed rotation left no file open; try again
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.maxBytes > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxBytes {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	if err == nil && s.sync {
+		err = s.file.Sync()
+	}
+	return err
+}
+
+// rotate renames the current file aside, removes the oldest renamed files
+// beyond keep, and starts a new file
+func (s *fileSink) rotate() error {
+	s.file.Close()
+	s.file = nil
+	rotated := s.path + "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	if err := os.Rename(s.path, rotated); err != nil {
+		return err
+	}
+	if old, err := filepath.Glob(s.path + ".*"); err == nil && len(old) > s.keep {
+		// The timestamps sort in the order the files were rotated
+		sort.Strings(old)
+		for _, name := range old[:len(old)-s.keep] {
+			if err := os.Remove(name); err != nil {
+				log.Printf("Removing rotated capture file %s failed: %v", name, err)
+			}
+		}
+	}
+	return s.open()
+}
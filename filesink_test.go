@@ -0,0 +1,87 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileSink(t *testing.T) {
+	clearDB(t)
+	path := filepath.Join(t.TempDir(), "logs", "captures.ndjson")
+	sink, err := openFileSink(path, 1<<20, 2, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	globalFileSink = sink
+	t.Cleanup(func() {
+		sink.file.Close()
+		globalFileSink = nil
+	})
+
+	bin := createTestBin(t)
+	var reqIDs []string
+	for _, body := range []string{"one", "two"} {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body)))
+		reqIDs = append(reqIDs, w.Body.String())
+	}
+	waitForSinks(t)
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var got []string
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		var req Request
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			t.Fatalf("Bad line %q: %v", sc.Text(), err)
+		}
+		got = append(got, req.ReqID)
+	}
+	if strings.Join(got, ",") != strings.Join(reqIDs, ",") {
+		t.Errorf("Expected lines for %v, got %v", reqIDs, got)
+	}
+}
+
+func TestFileSinkRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "captures.ndjson")
+	// Room for one capture per file
+	sink, err := openFileSink(path, 400, 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := sink.write(&Request{BinID: "bin", ReqID: strings.Repeat("r", 200)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rotated, _ := filepath.Glob(path + ".*")
+	if len(rotated) != 2 {
+		t.Errorf("Expected 2 rotated files to be kept, got %v", rotated)
+	}
+	for _, name := range append(rotated, path) {
+		raw, _ := os.ReadFile(name)
+		if strings.Count(string(raw), "\n") != 1 {
+			t.Errorf("Expected one capture in %s, got %q", name, raw)
+		}
+	}
+
+	// Reopening carries on appending to the current file
+	sink.file.Close()
+	if sink, err = openFileSink(path, 0, 2, false); err != nil || sink.size == 0 {
+		t.Errorf("Expected the existing file's size to be picked up, got %d, %v", sink.size, err)
+	}
+	sink.file.Close()
+}
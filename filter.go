@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// requestFilter narrows a bin's requests by what's set on it, parsed from
+// query parameters so clients don't have to download everything. Each
+// store turns it into conditions of its own.
+type requestFilter struct {
+	method     string
+	agent      string
+	valid      *bool
+	pathPrefix string
+	since      *int64
+	until      *int64
+	// headers are canonical name and value pairs
+	headers  [][2]string
+	jsonPath string
+	equals   *string
+}
+
+// bodyDocument is an SQL expression for the captured body as a JSON document,
+// or NULL when it has none. Requests from before bodies were parsed on capture
+// fall back to their raw body if it happens to be JSON.
+const bodyDocument = "CASE WHEN parsed_body != '' THEN parsed_body " +
+	"WHEN json_valid(json_extract(body, '$')) THEN json_extract(body, '$') END"
+
+// jsonPath accepts the subset of JSONPath that SQLite's json_extract understands:
+// member access by name or quoted name, and array indexes.
+var jsonPath = regexp.MustCompile(`^\$(\.[A-Za-z0-9_]+|\."[^"]*"|\[[0-9]+\])*$`)
+
+// parseRequestFilter understands method, agent (a UserAgent kind), valid
+// (against the bin's JSON Schema), pathPrefix (of the path after the bin ID),
+// since, until (both in milliseconds, inclusive), any number of header=Name:value parameters (which match any value of a repeated header),
+// and a jsonpath into the body that must exist or, with equals, have that value.
+func parseRequestFilter(q url.Values) (requestFilter, error) {
+	var f requestFilter
+
+	f.method = strings.ToUpper(q.Get("method"))
+	f.agent = strings.ToLower(q.Get("agent"))
+	if v := q.Get("valid"); v != "" {
+		valid, err := strconv.ParseBool(v)
+		if err != nil {
+			return f, fmt.Errorf("invalid valid, expected true or false")
+		}
+		f.valid = &valid
+	}
+	f.pathPrefix = q.Get("pathPrefix")
+	for _, name := range []string{"since", "until"} {
+		v := q.Get(name)
+		if v == "" {
+			continue
+		}
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return f, fmt.Errorf("invalid %s", name)
+		}
+		if name == "since" {
+			f.since = &ms
+		} else {
+			f.until = &ms
+		}
+	}
+	for _, v := range q["header"] {
+		name, value, ok := strings.Cut(v, ":")
+		if !ok || name == "" {
+			return f, fmt.Errorf("invalid header filter %q, expected Name:value", v)
+		}
+		f.headers = append(f.headers, [2]string{http.CanonicalHeaderKey(strings.TrimSpace(name)), strings.TrimSpace(value)})
+	}
+
+	if path := q.Get("jsonpath"); path != "" {
+		if !jsonPath.MatchString(path) {
+			return f, fmt.Errorf("invalid jsonpath %q", path)
+		}
+		f.jsonPath = path
+		if _, ok := q["equals"]; ok {
+			equals := q.Get("equals")
+			f.equals = &equals
+		}
+	} else if _, ok := q["equals"]; ok {
+		return f, fmt.Errorf("invalid equals without jsonpath")
+	}
+
+	return f, nil
+}
+
+// within narrows f to requests inserted from since until until, inclusive,
+// keeping whichever of its own bounds are tighter
+func (f requestFilter) within(since, until int64) requestFilter {
+	if f.since == nil || *f.since < since {
+		f.since = &since
+	}
+	if f.until == nil || *f.until > until {
+		f.until = &until
+	}
+	return f
+}
+
+// onlyTimes reports whether f narrows requests by nothing but when they
+// were inserted, so a store can go by its keys without decoding requests
+func (f requestFilter) onlyTimes() bool {
+	return f.method == "" && f.agent == "" && f.valid == nil && f.pathPrefix == "" &&
+		len(f.headers) == 0 && f.jsonPath == ""
+}
+
+// sqlConds collects a filter's conditions and their arguments
+type sqlConds struct {
+	conds []string
+	args  []interface{}
+}
+
+func (c *sqlConds) add(cond string, args ...interface{}) {
+	c.conds = append(c.conds, cond)
+	c.args = append(c.args, args...)
+}
+
+func (c sqlConds) suffix() (string, []interface{}) {
+	if len(c.conds) == 0 {
+		return "", nil
+	}
+	return " AND " + strings.Join(c.conds, " AND "), c.args
+}
+
+// where returns the conditions, in SQLite, as an "AND ..." suffix for a
+// query that already filters on bin_id, along with their arguments.
+func (f requestFilter) where() (string, []interface{}) {
+	var c sqlConds
+	if f.method != "" {
+		c.add("method = ?", f.method)
+	}
+	if f.agent != "" {
+		c.add("json_extract(user_agent, '$.kind') = ?", f.agent)
+	}
+	if f.valid != nil {
+		c.add("valid = ?", *f.valid)
+	}
+	if f.pathPrefix != "" {
+		c.add("substr(sub_path, 1, length(?)) = ?", f.pathPrefix, f.pathPrefix)
+	}
+	if f.since != nil {
+		c.add("inserted >= ?", *f.since)
+	}
+	if f.until != nil {
+		c.add("inserted <= ?", *f.until)
+	}
+	for _, h := range f.headers {
+		// Headers are stored under their canonical names, as an array of values
+		// (or a single string for requests captured by older versions)
+		c.add("EXISTS (SELECT 1 FROM json_each(headers, ?) WHERE value = ?)", fmt.Sprintf("$.%q", h[0]), h[1])
+	}
+	if f.jsonPath != "" {
+		if f.equals != nil {
+			// Compare on the value's text form, spelling JSON literals the way
+			// clients write them rather than as SQLite's 1/0
+			c.add(`CASE json_type(`+bodyDocument+`, ?)
+                WHEN 'true' THEN 'true' WHEN 'false' THEN 'false' WHEN 'null' THEN 'null'
+                ELSE CAST(json_extract(`+bodyDocument+`, ?) AS TEXT) END = ?`,
+				f.jsonPath, f.jsonPath, *f.equals)
+		} else {
+			c.add("json_type("+bodyDocument+", ?) IS NOT NULL", f.jsonPath)
+		}
+	}
+	return c.suffix()
+}
+
+// matches reports whether req passes the filter, for stores that hold
+// requests in Go rather than SQL. It agrees with where.
+func (f requestFilter) matches(req Request) bool {
+	if f.method != "" && req.Method != f.method {
+		return false
+	}
+	if f.agent != "" && (req.UserAgent == nil || req.UserAgent.Kind != f.agent) {
+		return false
+	}
+	if f.valid != nil && (req.Valid == nil || *req.Valid != *f.valid) {
+		return false
+	}
+	if !strings.HasPrefix(req.SubPath, f.pathPrefix) {
+		return false
+	}
+	if (f.since != nil && req.Inserted < *f.since) || (f.until != nil && req.Inserted > *f.until) {
+		return false
+	}
+	for _, h := range f.headers {
+		found := false
+		for _, v := range req.Headers[h[0]] {
+			found = found || v == h[1]
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.jsonPath != "" {
+		doc, ok := requestDocument(req)
+		var v interface{}
+		if ok {
+			v, ok = lookupJSONPath(doc, f.jsonPath)
+		}
+		if !ok || (f.equals != nil && jsonText(v) != *f.equals) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestDocument decodes a request's body as JSON, the way bodyDocument
+// does, reporting whether it is JSON
+func requestDocument(req Request) (interface{}, bool) {
+	raw, _ := req.Body.(json.RawMessage)
+	if len(raw) == 0 && !req.BodyOffloaded && json.Valid([]byte(req.RawBody)) {
+		raw = json.RawMessage(req.RawBody)
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if dec.Decode(&doc) != nil {
+		return nil, false
+	}
+	return doc, true
+}
+
+var jsonPathStep = regexp.MustCompile(`\.([A-Za-z0-9_]+)|\."([^"]*)"|\[([0-9]+)\]`)
+
+// lookupJSONPath follows a path jsonPath accepts into doc, reporting
+// whether anything, JSON null included, is there
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool) {
+	for _, step := range jsonPathStep.FindAllStringSubmatch(path[1:], -1) {
+		if step[3] != "" {
+			arr, ok := doc.([]interface{})
+			i, _ := strconv.Atoi(step[3])
+			if !ok || i >= len(arr) {
+				return nil, false
+			}
+			doc = arr[i]
+			continue
+		}
+		obj, ok := doc.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if doc, ok = obj[step[1]+step[2]]; !ok {
+			return nil, false
+		}
+	}
+	return doc, true
+}
+
+// jsonText is a JSON value's text form for equals: strings unquoted, and
+// non-integers in SQLite's spelling of a REAL
+func jsonText(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	if n, ok := v.(json.Number); ok {
+		if !strings.ContainsAny(n.String(), ".eE") {
+			return n.String()
+		}
+		f, _ := n.Float64()
+		s := strconv.FormatFloat(f, 'g', 15, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	}
+	b, _ := json.Marshal(v)
+	return string(b)
+}
@@ -0,0 +1,129 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListRequestsFiltered(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	sent := []struct {
+		method, path, event string
+	}{
+		{http.MethodPost, "/webhooks/github", "push"},
+		{http.MethodPost, "/webhooks/github", "issues"},
+		{http.MethodGet, "/health", ""},
+		{http.MethodPut, "/webhooks/other", "push"},
+	}
+	for _, c := range sent {
+		req := httptest.NewRequest(c.method, "/"+bin.BinID+c.path, nil)
+		if c.event != "" {
+			req.Header.Set("X-Event", c.event)
+		}
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"", 4},
+		{"method=post", 2},
+		{"pathPrefix=/webhooks", 3},
+		{"pathPrefix=/webhooks/github", 2},
+		{"pathPrefix=/" + bin.BinID, 0},
+		{"header=x-event:push", 2},
+		{"method=POST&header=X-Event:push", 1},
+		{"since=0&until=" + strconv.FormatInt(1<<62, 10), 4},
+		{"since=" + strconv.FormatInt(1<<62, 10), 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status code %d, got %d", tt.query, http.StatusOK, w.Code)
+			continue
+		}
+		var reqs []Request
+		json.NewDecoder(w.Body).Decode(&reqs)
+		if len(reqs) != tt.want {
+			t.Errorf("%q: expected %d requests, got %d", tt.query, tt.want, len(reqs))
+		}
+		if total := w.Header().Get("X-Total-Count"); total != strconv.Itoa(tt.want) {
+			t.Errorf("%q: expected X-Total-Count %d, got %s", tt.query, tt.want, total)
+		}
+	}
+
+	for _, query := range []string{"since=yesterday", "header=novalue"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?"+query, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status code %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), "invalid") {
+			t.Errorf("%q: expected an explanation, got %s", query, w.Body.String())
+		}
+	}
+}
+
+func TestListRequestsJSONPath(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{
+		`{"event":{"type":"charge.succeeded","amount":500,"live":true}}`,
+		`{"event":{"type":"charge.failed","amount":500,"live":false}}`,
+		`{"event":{"type":"charge.succeeded","amount":1500}}`,
+		`not json at all`,
+	} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	tests := []struct {
+		query string
+		want  int
+	}{
+		{"jsonpath=$.event.type&equals=charge.succeeded", 2},
+		{"jsonpath=$.event.amount&equals=500", 2},
+		{"jsonpath=$.event.live&equals=true", 1},
+		{"jsonpath=$.event.live", 2},
+		{"jsonpath=$.missing", 0},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?"+tt.query, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status code %d, got %d", tt.query, http.StatusOK, w.Code)
+			continue
+		}
+		var reqs []Request
+		json.NewDecoder(w.Body).Decode(&reqs)
+		if len(reqs) != tt.want {
+			t.Errorf("%q: expected %d requests, got %d", tt.query, tt.want, len(reqs))
+		}
+	}
+
+	for _, query := range []string{"jsonpath=event.type", "jsonpath=$..type", "equals=x"} {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?"+query, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: expected status code %d, got %d", query, http.StatusBadRequest, w.Code)
+		}
+	}
+}
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ForwardConfig relays every capture to its targets as soon as it's stored,
+// with the capture's sub-path and query appended, turning the bin into a
+// tee. URL is shorthand for a single target named "default". Failed sends
+// are retried up to MaxAttempts times in all, waiting BackoffMs and then
+// twice as long each time.
+type ForwardConfig struct {
+	URL         string          `json:"url,omitempty"`
+	Targets     []ForwardTarget `json:"targets,omitempty"`
+	TimeoutMs   int             `json:"timeoutMs,omitempty"`
+	MaxAttempts int             `json:"maxAttempts,omitempty"`
+	BackoffMs   int             `json:"backoffMs,omitempty"`
+}
+
+// ForwardTarget is one destination of a bin's forwards. Disabled targets
+// are kept in the config but not sent to.
+type ForwardTarget struct {
+	Name     string `json:"name"`
+	URL      string `json:"url"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+const (
+	defaultForwardTimeout     = 10 * time.Second
+	defaultForwardMaxAttempts = 5
+	maxForwardAttempts        = 20
+	defaultForwardBackoff     = time.Second
+	maxForwardBackoff         = 10 * time.Minute
+)
+
+// targets lists every configured target, the URL shorthand first
+func (c ForwardConfig) targets() []ForwardTarget {
+	if c.URL == "" {
+		return c.Targets
+	}
+	return append([]ForwardTarget{{Name: "default", URL: c.URL}}, c.Targets...)
+}
+
+func (c ForwardConfig) validate() string {
+	targets := c.targets()
+	if len(targets) == 0 {
+		return "forward needs a url or targets"
+	}
+	names := map[string]bool{}
+	for _, t := range targets {
+		if t.Name == "" {
+			return "forward targets need a name"
+		}
+		if names[t.Name] {
+			return fmt.Sprintf("forward target %q is listed twice", t.Name)
+		}
+		names[t.Name] = true
+		if _, err := resendURL(Request{}, t.URL); err != nil {
+			return fmt.Sprintf("forward target %q: %v", t.Name, err)
+		}
+	}
+	if c.TimeoutMs < 0 || time.Duration(c.TimeoutMs)*time.Millisecond > maxReplayTimeout {
+		return fmt.Sprintf("forward timeoutMs must be between 0 and %d", maxReplayTimeout/time.Millisecond)
+	}
+	if c.MaxAttempts < 0 || c.MaxAttempts > maxForwardAttempts {
+		return fmt.Sprintf("forward maxAttempts must be between 0 and %d", maxForwardAttempts)
+	}
+	if c.BackoffMs < 0 || time.Duration(c.BackoffMs)*time.Millisecond > maxForwardBackoff {
+		return fmt.Sprintf("forward backoffMs must be between 0 and %d", maxForwardBackoff/time.Millisecond)
+	}
+	return ""
+}
+
+func (c ForwardConfig) timeout() time.Duration {
+	if c.TimeoutMs == 0 {
+		return defaultForwardTimeout
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+func (c ForwardConfig) maxAttempts() int {
+	if c.MaxAttempts == 0 {
+		return defaultForwardMaxAttempts
+	}
+	return c.MaxAttempts
+}
+
+// backoff is how long to wait after the given number of failed attempts
+func (c ForwardConfig) backoff(attempts int) time.Duration {
+	wait := defaultForwardBackoff
+	if c.BackoffMs > 0 {
+		wait = time.Duration(c.BackoffMs) * time.Millisecond
+	}
+	for i := 1; i < attempts && wait < maxForwardBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxForwardBackoff {
+		wait = maxForwardBackoff
+	}
+	return wait
+}
+
+// target finds an enabled target by name
+func (c ForwardConfig) target(name string) (ForwardTarget, bool) {
+	for _, t := range c.targets() {
+		if t.Name == name && !t.Disabled {
+			return t, true
+		}
+	}
+	return ForwardTarget{}, false
+}
+
+// Delivery statuses. A delivery is retrying between attempts and failed
+// once it has used them all up; failed deliveries stay dead-lettered until
+// they're re-driven.
+const (
+	deliveryRetrying  = "retrying"
+	deliveryDelivered = "delivered"
+	deliveryFailed    = "failed"
+)
+
+// Delivery kinds: a capture sent on by forwarding, by a replay or down a
+// tunnel, or an SNS subscription confirmed. Only forwards are retried.
+const (
+	deliveryForward    = "forward"
+	deliveryReplay     = "replay"
+	deliveryTunnel     = "tunnel"
+	deliverySNSConfirm = "confirm"
+)
+
+// Delivery records the outcome of sending a capture to one target. For
+// replays, Target is "replay" or "job:{jobId}"; for tunnels it's "tunnel";
+// for SNS confirmations it's the topic's ARN.
+type Delivery struct {
+	DeliveryID      string  `json:"deliveryId"`
+	BinID           string  `json:"binId"`
+	ReqID           string  `json:"reqId"`
+	Kind            string  `json:"kind"`
+	Target          string  `json:"target"`
+	URL             string  `json:"url"`
+	Status          string  `json:"status"`
+	StatusCode      int     `json:"statusCode"`
+	Error           string  `json:"error,omitempty"`
+	Attempts        int     `json:"attempts"`
+	NextAttemptAt   int64   `json:"nextAttemptAt,omitempty"`
+	LatencyMs       float64 `json:"latencyMs"`
+	ResponseSnippet string  `json:"responseSnippet,omitempty"`
+	CreatedAt       int64   `json:"createdAt"`
+	UpdatedAt       int64   `json:"updatedAt"`
+}
+
+const deliveryColumns = "delivery_id, bin_id, req_id, kind, target, url, status, status_code, error, attempts, " +
+	"next_attempt_at, latency_ms, response_snippet, created_at, updated_at"
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (Delivery, error) {
+	var d Delivery
+	err := row.Scan(&d.DeliveryID, &d.BinID, &d.ReqID, &d.Kind, &d.Target, &d.URL, &d.Status, &d.StatusCode,
+		&d.Error, &d.Attempts, &d.NextAttemptAt, &d.LatencyMs, &d.ResponseSnippet, &d.CreatedAt, &d.UpdatedAt)
+	return d, err
+}
+
+// insertDelivery records a delivery. Replays, tunnels and SNS confirmations
+// still work where noLocalTables rules deliveries out, so theirs simply
+// aren't recorded; the deliveries endpoints say why.
+func insertDelivery(ctx context.Context, d Delivery) error {
+	if noLocalTables != nil {
+		return nil
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, err := db.ExecContext(ctx, `
+        INSERT INTO deliveries (`+deliveryColumns+`)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		d.DeliveryID, d.BinID, d.ReqID, d.Kind, d.Target, d.URL, d.Status, d.StatusCode, d.Error, d.Attempts,
+		d.NextAttemptAt, d.LatencyMs, d.ResponseSnippet, d.CreatedAt, d.UpdatedAt)
+	return err
+}
+
+// resultDelivery is the delivery a single send produced
+func resultDelivery(req Request, result ReplayResult) Delivery {
+	now := time.Now().UnixMilli()
+	d := Delivery{
+		DeliveryID:      generateRequestID(),
+		BinID:           req.BinID,
+		ReqID:           req.ReqID,
+		Kind:            deliveryReplay,
+		URL:             result.URL,
+		Status:          deliveryDelivered,
+		StatusCode:      result.Status,
+		Error:           result.Error,
+		Attempts:        1,
+		LatencyMs:       result.LatencyMs,
+		ResponseSnippet: result.snippet,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if !result.ok() {
+		d.Status = deliveryFailed
+		if d.Error == "" {
+			d.Error = fmt.Sprintf("target responded %d", result.Status)
+		}
+	}
+	return d
+}
+
+// recordReplayDeliveries stores a delivery for every result of a replay of
+// binID's requests.
+func recordReplayDeliveries(ctx context.Context, binID, target string, results []ReplayResult) {
+	for _, result := range results {
+		d := resultDelivery(Request{BinID: binID, ReqID: result.ReqID}, result)
+		d.Target = target
+		if err := insertDelivery(ctx, d); err != nil {
+			log.Printf("Recording replay of %s/%s failed: %v", binID, result.ReqID, err)
+		}
+	}
+}
+
+// queryDeliveries runs a SELECT over deliveryColumns and collects the rows
+func queryDeliveries(ctx context.Context, query string, args ...interface{}) ([]Delivery, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(ctx, "SELECT "+deliveryColumns+" FROM deliveries "+query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deliveries := []Delivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, rows.Err()
+}
+
+// forwardCapture sends a stored capture on to every enabled target at once,
+// retrying each until it succeeds or runs out of attempts, and records the
+// outcome as one delivery per target. It runs in the background, so
+// failures are only logged.
+func forwardCapture(cfg ForwardConfig, req Request) {
+	if noLocalTables != nil {
+		log.Printf("Not forwarding %s/%s: forward isn't available: %v", req.BinID, req.ReqID, noLocalTables)
+		return
+	}
+	var wg sync.WaitGroup
+	for _, target := range cfg.targets() {
+		if target.Disabled {
+			continue
+		}
+		now := time.Now().UnixMilli()
+		d := Delivery{
+			DeliveryID: generateRequestID(),
+			BinID:      req.BinID,
+			ReqID:      req.ReqID,
+			Kind:       deliveryForward,
+			Target:     target.Name,
+			URL:        target.URL,
+			Status:     deliveryRetrying,
+			CreatedAt:  now,
+			UpdatedAt:  now,
+		}
+		if err := insertDelivery(context.Background(), d); err != nil {
+			log.Printf("Recording delivery of %s/%s to %s failed: %v", req.BinID, req.ReqID, target.Name, err)
+			continue
+		}
+
+		wg.Add(1)
+		go func(target ForwardTarget, d Delivery) {
+			defer wg.Done()
+			deliver(cfg, req, target, d)
+		}(target, d)
+	}
+	wg.Wait()
+}
+
+// deliver sends req to target until it succeeds or d has used up its
+// attempts, updating d after each one.
+func deliver(cfg ForwardConfig, req Request, target ForwardTarget, d Delivery) {
+	client := replayClient(cfg.timeout())
+	for failures := 0; ; failures++ {
+		result := replayOne(context.Background(), client, req, target.URL, nil)
+		sent := resultDelivery(req, result)
+		d.Attempts++
+		d.StatusCode, d.Error = sent.StatusCode, sent.Error
+		d.LatencyMs, d.ResponseSnippet = sent.LatencyMs, sent.ResponseSnippet
+		if sent.URL != "" {
+			d.URL = sent.URL
+		}
+		d.NextAttemptAt = 0
+
+		var wait time.Duration
+		switch {
+		case result.ok():
+			d.Status = deliveryDelivered
+		case failures+1 >= cfg.maxAttempts():
+			d.Status = deliveryFailed
+			log.Printf("Forwarding %s/%s to %s failed after %d attempts: %s",
+				req.BinID, req.ReqID, target.Name, d.Attempts, d.Error)
+		default:
+			d.Status = deliveryRetrying
+			wait = cfg.backoff(failures + 1)
+			d.NextAttemptAt = time.Now().Add(wait).UnixMilli()
+		}
+
+		d.UpdatedAt = time.Now().UnixMilli()
+		ctx, cancel := dbContext(context.Background())
+		_, err := db.ExecContext(ctx, `
+            UPDATE deliveries SET url = ?, status = ?, status_code = ?, error = ?, attempts = ?,
+                next_attempt_at = ?, latency_ms = ?, response_snippet = ?, updated_at = ?
+            WHERE delivery_id = ?`,
+			d.URL, d.Status, d.StatusCode, d.Error, d.Attempts, d.NextAttemptAt, d.LatencyMs, d.ResponseSnippet,
+			d.UpdatedAt, d.DeliveryID)
+		cancel()
+		if err != nil {
+			log.Printf("Recording delivery of %s/%s to %s failed: %v", req.BinID, req.ReqID, target.Name, err)
+			return
+		}
+		if d.Status != deliveryRetrying {
+			return
+		}
+		time.Sleep(wait)
+	}
+}
+
+// failInterruptedDeliveries dead-letters deliveries that were still being
+// retried when the server last stopped, so they can be re-driven.
+func failInterruptedDeliveries() {
+	_, err := db.Exec("UPDATE deliveries SET status = ?, next_attempt_at = 0, error = ? WHERE status = ?",
+		deliveryFailed, "interrupted by a restart", deliveryRetrying)
+	if err != nil {
+		log.Printf("Failing interrupted deliveries failed: %v", err)
+	}
+}
+
+// requestDeliveriesHandler serves GET /api/bin/{id}/req/{reqId}/deliveries:
+// where a capture was forwarded and how each attempt went.
+func requestDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if refuseLocalFeature(w, "Deliveries") {
+		return
+	}
+
+	binID, reqID := leasePath(r.URL.Path)
+	if _, err := store.GetRequest(r.Context(), binID, reqID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"Request not found"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	deliveries, err := queryDeliveries(r.Context(), "WHERE req_id = ? ORDER BY created_at, target", reqID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// binDeliveriesHandler serves GET /api/bin/{id}/deliveries, newest first,
+// optionally only those with ?status=retrying|delivered|failed and
+// ?kind=forward|replay|tunnel.
+func binDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if refuseLocalFeature(w, "Deliveries") {
+		return
+	}
+
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/deliveries")
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	query, args := "WHERE bin_id = ?", []interface{}{binID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		switch status {
+		case deliveryRetrying, deliveryDelivered, deliveryFailed:
+		default:
+			http.Error(w, `{"msg":"status must be retrying, delivered or failed"}`, http.StatusBadRequest)
+			return
+		}
+		query += " AND status = ?"
+		args = append(args, status)
+	}
+	if kind := r.URL.Query().Get("kind"); kind != "" {
+		if kind != deliveryForward && kind != deliveryReplay && kind != deliveryTunnel && kind != deliverySNSConfirm {
+			http.Error(w, `{"msg":"kind must be forward, replay, tunnel or confirm"}`, http.StatusBadRequest)
+			return
+		}
+		query += " AND kind = ?"
+		args = append(args, kind)
+	}
+	deliveries, err := queryDeliveries(r.Context(), query+" ORDER BY created_at DESC, target", args...)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
+
+// redriveDeliveryHandler serves POST /api/bin/{id}/deliveries/{deliveryId}/redrive:
+// it sends a dead-lettered delivery's capture to the target of the same
+// name in the bin's current forward config, with a fresh set of attempts.
+// The retries run in the background; the delivery is returned as it starts.
+func redriveDeliveryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if refuseLocalFeature(w, "Deliveries") {
+		return
+	}
+
+	parts := strings.Split(r.URL.Path[len("/api/bin/"):], "/")
+	binID, deliveryID := parts[0], parts[2]
+	found, err := queryDeliveries(r.Context(), "WHERE bin_id = ? AND delivery_id = ?", binID, deliveryID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if len(found) == 0 {
+		http.Error(w, `{"msg":"Delivery not found"}`, http.StatusNotFound)
+		return
+	}
+	d := found[0]
+	if d.Kind != deliveryForward || d.Status != deliveryFailed {
+		http.Error(w, `{"msg":"Only failed forwards can be re-driven"}`, http.StatusConflict)
+		return
+	}
+
+	bin, err := store.GetBin(r.Context(), binID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	cfg := bin.Config.Forward
+	var target ForwardTarget
+	ok := false
+	if cfg != nil {
+		target, ok = cfg.target(d.Target)
+	}
+	if !ok {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, "Forward target "+d.Target+" is no longer enabled"), http.StatusConflict)
+		return
+	}
+	req, err := store.GetRequest(r.Context(), binID, d.ReqID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	d.Status = deliveryRetrying
+	d.UpdatedAt = time.Now().UnixMilli()
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+	res, err := db.ExecContext(ctx, "UPDATE deliveries SET status = ?, updated_at = ? WHERE delivery_id = ? AND status = ?",
+		d.Status, d.UpdatedAt, d.DeliveryID, deliveryFailed)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, `{"msg":"Only failed forwards can be re-driven"}`, http.StatusConflict)
+		return
+	}
+	go deliver(*cfg, req, target, d)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(d)
+}
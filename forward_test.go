@@ -0,0 +1,219 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setTestConfig(t *testing.T, binID, config string) {
+	req := httptest.NewRequest(http.MethodPut, "/api/bin/"+binID+"/config", strings.NewReader(config))
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 setting the config, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// waitForDeliveries polls a request's deliveries until n have finished
+// retrying
+func waitForDeliveries(t *testing.T, binID, reqID string, n int) []Delivery {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+binID+"/req/"+reqID+"/deliveries", nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		var deliveries []Delivery
+		json.NewDecoder(w.Body).Decode(&deliveries)
+		done := 0
+		for _, d := range deliveries {
+			if d.Status != deliveryRetrying {
+				done++
+			}
+		}
+		if done >= n {
+			return deliveries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d deliveries, got %d", n, len(deliveries))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestForwardCapture(t *testing.T) {
+	clearDB(t)
+
+	type delivery struct {
+		uri, body, header string
+	}
+	got := make(chan delivery, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- delivery{r.URL.RequestURI(), string(body), r.Header.Get("X-Event")}
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"forward": {"url": "`+srv.URL+`/staging"}}`)
+
+	capture := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hooks?x=1", strings.NewReader("payload"))
+	capture.Header.Set("X-Event", "push")
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, capture)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the capture to succeed, got %d", w.Code)
+	}
+
+	select {
+	case d := <-got:
+		if d.uri != "/staging/hooks?x=1" || d.body != "payload" || d.header != "push" {
+			t.Errorf("Unexpected forwarded request %+v", d)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the forwarded request")
+	}
+
+	deliveries := waitForDeliveries(t, bin.BinID, w.Body.String(), 1)
+	if deliveries[0].Target != "default" || deliveries[0].Status != deliveryDelivered || deliveries[0].StatusCode != 200 ||
+		deliveries[0].Attempts != 1 {
+		t.Errorf("Unexpected delivery %+v", deliveries[0])
+	}
+}
+
+func TestForwardFanOut(t *testing.T) {
+	clearDB(t)
+
+	hits := make(chan string, 3)
+	ok := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- r.URL.Path
+	}))
+	defer ok.Close()
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits <- r.URL.Path
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer broken.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"forward": {"maxAttempts": 1, "targets": [
+		{"name": "staging", "url": "`+ok.URL+`/staging"},
+		{"name": "qa", "url": "`+broken.URL+`/qa"},
+		{"name": "paused", "url": "`+ok.URL+`/paused", "disabled": true}
+	]}}`)
+
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("x")))
+
+	deliveries := waitForDeliveries(t, bin.BinID, w.Body.String(), 2)
+	statuses := map[string]string{}
+	for _, d := range deliveries {
+		statuses[d.Target] = d.Status
+	}
+	if len(deliveries) != 2 || statuses["staging"] != deliveryDelivered || statuses["qa"] != deliveryFailed {
+		t.Errorf("Expected staging delivered and qa failed, got %+v", deliveries)
+	}
+	close(hits)
+	for path := range hits {
+		if path == "/paused" {
+			t.Error("Expected the disabled target to be skipped")
+		}
+	}
+}
+
+func TestForwardRetryAndRedrive(t *testing.T) {
+	clearDB(t)
+
+	var mu sync.Mutex
+	failures := 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if failures > 0 {
+			failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"forward": {"url": "`+srv.URL+`", "maxAttempts": 3, "backoffMs": 1}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("x")))
+	d := waitForDeliveries(t, bin.BinID, w.Body.String(), 1)[0]
+	if d.Status != deliveryDelivered || d.Attempts != 3 {
+		t.Errorf("Expected delivery on the third attempt, got %+v", d)
+	}
+
+	// Run out of attempts, then re-drive once the target has recovered
+	mu.Lock()
+	failures = 2
+	mu.Unlock()
+	setTestConfig(t, bin.BinID, `{"forward": {"url": "`+srv.URL+`", "maxAttempts": 2, "backoffMs": 1}}`)
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("y")))
+	reqID := w.Body.String()
+	d = waitForDeliveries(t, bin.BinID, reqID, 1)[0]
+	if d.Status != deliveryFailed || d.Attempts != 2 || d.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected the delivery to be dead-lettered, got %+v", d)
+	}
+
+	list := httptest.NewRecorder()
+	binAPIHandler(list, httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/deliveries?status=failed", nil))
+	var failed []Delivery
+	json.NewDecoder(list.Body).Decode(&failed)
+	if len(failed) != 1 || failed[0].DeliveryID != d.DeliveryID {
+		t.Fatalf("Expected just the dead-lettered delivery, got %+v", failed)
+	}
+
+	redrive := httptest.NewRecorder()
+	binAPIHandler(redrive, httptest.NewRequest(http.MethodPost,
+		"/api/bin/"+bin.BinID+"/deliveries/"+d.DeliveryID+"/redrive", nil))
+	if redrive.Code != http.StatusAccepted {
+		t.Fatalf("Expected 202 re-driving, got %d: %s", redrive.Code, redrive.Body.String())
+	}
+	d = waitForDeliveries(t, bin.BinID, reqID, 1)[0]
+	if d.Status != deliveryDelivered || d.Attempts != 3 {
+		t.Errorf("Expected the re-drive to deliver, got %+v", d)
+	}
+
+	again := httptest.NewRecorder()
+	binAPIHandler(again, httptest.NewRequest(http.MethodPost,
+		"/api/bin/"+bin.BinID+"/deliveries/"+d.DeliveryID+"/redrive", nil))
+	if again.Code != http.StatusConflict {
+		t.Errorf("Expected 409 re-driving a delivered delivery, got %d", again.Code)
+	}
+}
+
+func TestForwardBackoff(t *testing.T) {
+	cfg := ForwardConfig{BackoffMs: 100}
+	for attempts, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond,
+		4: 800 * time.Millisecond, 30: maxForwardBackoff} {
+		if got := cfg.backoff(attempts); got != want {
+			t.Errorf("backoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+func TestForwardConfigValidation(t *testing.T) {
+	for _, cfg := range []ForwardConfig{
+		{},
+		{URL: "/relative"},
+		{URL: "http://x", TimeoutMs: -1},
+		{Targets: []ForwardTarget{{URL: "http://x"}}},
+		{URL: "http://x", Targets: []ForwardTarget{{Name: "default", URL: "http://y"}}},
+		{URL: "http://x", MaxAttempts: maxForwardAttempts + 1},
+		{URL: "http://x", BackoffMs: -1},
+	} {
+		if (BinConfig{Forward: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -2,4 +2,19 @@ module requestlogger
 
 go 1.18
 
-require github.com/mattn/go-sqlite3 v1.14.24
+require (
+	github.com/andybalholm/brotli v1.1.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/jackc/pgx/v5 v5.2.0
+	github.com/mattn/go-sqlite3 v1.14.24
+	go.etcd.io/bbolt v1.3.7
+	go.starlark.net v0.0.0-20240123142251-f86470692795
+	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90
+)
+
+require (
+	github.com/jackc/pgpassfile v1.0.0 // indirect
+	github.com/jackc/pgservicefile v0.0.0-20200714003250-2b9c44734f2b // indirect
+	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/text v0.3.8 // indirect
+)
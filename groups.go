@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// groupName constrains consumer group names passed as ?group=
+var groupName = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Consumer groups read a bin without deleting from it. Each group keeps its
+// own cursor (the requestCursor of the last request it consumed), so
+// independent systems can drain the same stream without stealing each
+// other's requests. A group's cursor starts at the beginning of the bin the
+// first time the group is used. Cursors and group leases live in the local
+// SQLite database while the requests come from store, so they're updated on
+// condition that nothing moved them in between rather than in one
+// transaction.
+
+// groupCursor returns the position of a group in a bin, reporting false for
+// a group that hasn't consumed anything yet.
+func groupCursor(ctx context.Context, binID, group string) (requestCursor, bool, error) {
+	var c requestCursor
+	err := db.QueryRowContext(ctx, "SELECT cursor_inserted, cursor_req_id FROM consumer_groups WHERE bin_id = ? AND name = ?",
+		binID, group).Scan(&c.Inserted, &c.ReqID)
+	if err == sql.ErrNoRows {
+		return requestCursor{}, false, nil
+	}
+	return c, err == nil, err
+}
+
+// advanceGroup reads up to count requests past the group's cursor and moves
+// the cursor past them, reading again from wherever another consumer in the
+// group left it if one got there first.
+func advanceGroup(ctx context.Context, binID, group string, count int) ([]Request, error) {
+	for {
+		cursor, found, err := groupCursor(ctx, binID, group)
+		if err != nil {
+			return nil, err
+		}
+		reqs, err := store.RequestsAfter(ctx, binID, cursor, requestFilter{}, count)
+		if err != nil || len(reqs) == 0 {
+			return reqs, err
+		}
+
+		next := cursorAt(reqs[len(reqs)-1])
+		var res sql.Result
+		if found {
+			res, err = db.ExecContext(ctx, `
+                UPDATE consumer_groups SET cursor_inserted = ?, cursor_req_id = ?
+                WHERE bin_id = ? AND name = ? AND cursor_inserted = ? AND cursor_req_id = ?`,
+				next.Inserted, next.ReqID, binID, group, cursor.Inserted, cursor.ReqID)
+		} else {
+			res, err = db.ExecContext(ctx, `
+                INSERT INTO consumer_groups (bin_id, name, cursor_inserted, cursor_req_id) VALUES (?, ?, ?, ?)
+                ON CONFLICT(bin_id, name) DO NOTHING`,
+				binID, group, next.Inserted, next.ReqID)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			return reqs, nil
+		}
+	}
+}
+
+// groupShift returns the next count requests for a group without deleting them.
+func groupShift(ctx context.Context, binID, group string, count int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return advanceGroup(ctx, binID, group, count)
+}
+
+// groupLease leases the next request for a group. Requests whose lease lapsed
+// without an ack are redelivered, oldest first, before the cursor moves on.
+func groupLease(ctx context.Context, binID, group string, ttl time.Duration) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+
+	now := time.Now().UnixMilli()
+	until := now + ttl.Milliseconds()
+	lapsed, err := lapsedGroupLeases(ctx, binID, group, now)
+	if err != nil {
+		return Request{}, err
+	}
+	for _, req := range lapsed {
+		res, err := db.ExecContext(ctx, `
+            UPDATE group_leases SET leased_until = ?
+            WHERE bin_id = ? AND name = ? AND req_id = ? AND leased_until <= ?`,
+			until, binID, group, req.ReqID, now)
+		if err != nil {
+			return Request{}, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			req.LeasedUntil = until
+			return req, nil
+		}
+	}
+
+	reqs, err := advanceGroup(ctx, binID, group, 1)
+	if err != nil {
+		return Request{}, err
+	}
+	if len(reqs) == 0 {
+		return Request{}, sql.ErrNoRows
+	}
+	req := reqs[0]
+	req.LeasedUntil = until
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO group_leases (bin_id, name, req_id, leased_until) VALUES (?, ?, ?, ?)
+        ON CONFLICT(bin_id, name, req_id) DO UPDATE SET leased_until = excluded.leased_until`,
+		binID, group, req.ReqID, req.LeasedUntil)
+	if err != nil {
+		return Request{}, err
+	}
+	return req, nil
+}
+
+// lapsedGroupLeases returns the requests whose group lease lapsed by now, in
+// cursor order. Leases on requests that have since gone are dropped.
+func lapsedGroupLeases(ctx context.Context, binID, group string, now int64) ([]Request, error) {
+	rows, err := db.QueryContext(ctx, "SELECT req_id FROM group_leases WHERE bin_id = ? AND name = ? AND leased_until <= ?",
+		binID, group, now)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var reqs []Request
+	for _, id := range ids {
+		req, err := store.GetRequest(ctx, binID, id)
+		if err == sql.ErrNoRows {
+			_, err = db.ExecContext(ctx, "DELETE FROM group_leases WHERE bin_id = ? AND name = ? AND req_id = ?", binID, group, id)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	sort.Slice(reqs, func(i, j int) bool { return cursorAt(reqs[j]).precedes(reqs[i]) })
+	return reqs, nil
+}
+
+// settleGroupLease acks a group's lease on a request, or releases it, with
+// the same errors as Store.SettleLease
+func settleGroupLease(ctx context.Context, binID, reqID, group string, release bool) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	stmt := "DELETE FROM group_leases"
+	if release {
+		stmt = "UPDATE group_leases SET leased_until = 0"
+	}
+	res, err := db.ExecContext(ctx, stmt+" WHERE bin_id = ? AND name = ? AND req_id = ? AND leased_until >= ?",
+		binID, group, reqID, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var exists int
+	err = db.QueryRowContext(ctx, "SELECT COUNT(*) FROM group_leases WHERE bin_id = ? AND name = ? AND req_id = ?",
+		binID, group, reqID).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+	return errLeaseLapsed
+}
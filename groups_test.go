@@ -0,0 +1,125 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsumerGroupShift(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{"first", "second", "third"} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	shift := func(group string) Request {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift?group="+group, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		var got Request
+		json.NewDecoder(w.Body).Decode(&got)
+		return got
+	}
+
+	// Each group walks the bin independently
+	if got := shift("worker-a").Body; got != "first" {
+		t.Errorf("worker-a: expected %q, got %v", "first", got)
+	}
+	if got := shift("worker-a").Body; got != "second" {
+		t.Errorf("worker-a: expected %q, got %v", "second", got)
+	}
+	if got := shift("worker-b").Body; got != "first" {
+		t.Errorf("worker-b: expected %q, got %v", "first", got)
+	}
+
+	// Group reads don't remove anything
+	var entries int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&entries)
+	if entries != 3 {
+		t.Errorf("Expected 3 entries to remain, got %d", entries)
+	}
+
+	// Batches continue from the cursor
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift?group=worker-a&count=10", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	var rest []Request
+	json.NewDecoder(w.Body).Decode(&rest)
+	if len(rest) != 1 || rest[0].Body != "third" {
+		t.Errorf("Expected only the third request to remain for worker-a, got %v", rest)
+	}
+
+	// Groups are not supported for pop
+	req = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/pop?group=worker-a", nil)
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestConsumerGroupLease(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{"first", "second"} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	lease := func(group, ttl string) (Request, int) {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/lease?group="+group+"&ttl="+ttl, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		var got Request
+		json.NewDecoder(w.Body).Decode(&got)
+		return got, w.Code
+	}
+
+	first, _ := lease("worker-a", "10ms")
+	if first.Body != "first" {
+		t.Fatalf("Expected %q, got %v", "first", first.Body)
+	}
+
+	// Another group sees the same request
+	if other, _ := lease("worker-b", "60s"); other.ReqID != first.ReqID {
+		t.Errorf("Expected worker-b to lease %s too, got %s", first.ReqID, other.ReqID)
+	}
+
+	// An unacked lease is redelivered to its group before anything newer
+	time.Sleep(20 * time.Millisecond)
+	again, _ := lease("worker-a", "60s")
+	if again.ReqID != first.ReqID {
+		t.Errorf("Expected %s to be redelivered, got %s", first.ReqID, again.ReqID)
+	}
+
+	ackReq := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/req/"+again.ReqID+"/ack?group=worker-a", nil)
+	ackW := httptest.NewRecorder()
+	binAPIHandler(ackW, ackReq)
+	if ackW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, ackW.Code)
+	}
+
+	next, _ := lease("worker-a", "60s")
+	if next.Body != "second" {
+		t.Errorf("Expected %q after ack, got %v", "second", next.Body)
+	}
+	if _, code := lease("worker-a", "60s"); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d once drained, got %d", http.StatusNotFound, code)
+	}
+
+	// Group acks don't delete the shared request
+	var entries int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&entries)
+	if entries != 2 {
+		t.Errorf("Expected 2 entries to remain, got %d", entries)
+	}
+}
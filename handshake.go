@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// HandshakeConfig answers the checks providers make before they'll send
+// webhooks to a URL, so a bin can be registered with them as it is. Each
+// is switched on by name. Captures are stored whether or not they were a
+// handshake, and a handshake's answer replaces the bin's usual reply.
+type HandshakeConfig struct {
+	// Slack echoes the challenge of Events API url_verification requests
+	Slack bool `json:"slack,omitempty"`
+	// Graph echoes the validationToken Microsoft Graph subscriptions send
+	Graph bool `json:"graph,omitempty"`
+	// Meta echoes hub.challenge to Facebook, Instagram and WhatsApp's
+	// subscription checks, when hub.verify_token is MetaVerifyToken if set
+	Meta            bool   `json:"meta,omitempty"`
+	MetaVerifyToken string `json:"metaVerifyToken,omitempty"`
+	// Twilio replies to its webhooks with empty TwiML, so calls and
+	// messages aren't logged as failures for want of instructions
+	Twilio bool `json:"twilio,omitempty"`
+	// SNS confirms the subscriptions AWS SNS topics ask to make
+	SNS bool `json:"sns,omitempty"`
+}
+
+// emptyTwiML tells Twilio to do nothing more with a call or message
+const emptyTwiML = `<?xml version="1.0" encoding="UTF-8"?><Response></Response>`
+
+func (c HandshakeConfig) validate() string {
+	if c.MetaVerifyToken != "" && !c.Meta {
+		return "handshake metaVerifyToken needs meta"
+	}
+	return ""
+}
+
+// respond answers req if it's a handshake the bin has switched on,
+// reporting whether it did
+func (c HandshakeConfig) respond(ctx context.Context, w http.ResponseWriter, req Request) bool {
+	if c.SNS && confirmSNSSubscription(ctx, w, req) {
+		return true
+	}
+	if c.Slack && req.Method == http.MethodPost {
+		var event struct {
+			Type      string `json:"type"`
+			Challenge string `json:"challenge"`
+		}
+		if json.Unmarshal([]byte(req.RawBody), &event) == nil && event.Type == "url_verification" {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]string{"challenge": event.Challenge})
+			return true
+		}
+	}
+	if token, ok := req.Query["validationToken"]; c.Graph && ok {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(token))
+		return true
+	}
+	if c.Meta && req.Method == http.MethodGet && req.Query["hub.mode"] == "subscribe" {
+		if c.MetaVerifyToken != "" && req.Query["hub.verify_token"] != c.MetaVerifyToken {
+			http.Error(w, "Verify token doesn't match", http.StatusForbidden)
+			return true
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(req.Query["hub.challenge"]))
+		return true
+	}
+	if c.Twilio && req.Headers.Get("X-Twilio-Signature") != "" {
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(emptyTwiML))
+		return true
+	}
+	return false
+}
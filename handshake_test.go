@@ -0,0 +1,66 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandshakes(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"handshake": {"slack": true, "graph": true, "meta": true, "metaVerifyToken": "s3cret", "twilio": true},
+		"response": {"body": "usual"}}`)
+
+	capture := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/"+bin.BinID+target, strings.NewReader(body))
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		name    string
+		w       *httptest.ResponseRecorder
+		status  int
+		body    string
+		content string
+	}{
+		{"slack", capture(http.MethodPost, "", `{"token": "t", "challenge": "3eZbrw1a", "type": "url_verification"}`,
+			map[string]string{"Content-Type": "application/json"}), 200, `{"challenge":"3eZbrw1a"}` + "\n", "application/json"},
+		{"slack event", capture(http.MethodPost, "", `{"type": "event_callback"}`, nil), 200, "usual", ""},
+		{"graph", capture(http.MethodPost, "?validationToken=Validation%3A+Testing", "", nil), 200, "Validation: Testing", "text/plain"},
+		{"meta", capture(http.MethodGet, "?hub.mode=subscribe&hub.challenge=1158201444&hub.verify_token=s3cret", "", nil),
+			200, "1158201444", "text/plain"},
+		{"meta wrong token", capture(http.MethodGet, "?hub.mode=subscribe&hub.challenge=1&hub.verify_token=guess", "", nil),
+			403, "Verify token doesn't match\n", "text/plain; charset=utf-8"},
+		{"twilio", capture(http.MethodPost, "", "Body=hi", map[string]string{"X-Twilio-Signature": "sig"}), 200, emptyTwiML, "text/xml"},
+	} {
+		if tc.w.Code != tc.status || tc.w.Body.String() != tc.body || tc.w.Header().Get("Content-Type") != tc.content {
+			t.Errorf("%s: unexpected response %d %v %q", tc.name, tc.w.Code, tc.w.Header(), tc.w.Body)
+		}
+	}
+
+	var stored int
+	db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&stored)
+	if stored != 6 {
+		t.Errorf("Expected every handshake to be stored, got %d", stored)
+	}
+}
+
+func TestHandshakesOff(t *testing.T) {
+	w := httptest.NewRecorder()
+	if (HandshakeConfig{Graph: true}).respond(context.Background(), w, Request{Method: http.MethodPost, RawBody: `{"type": "url_verification"}`}) {
+		t.Errorf("Expected only switched on handshakes to be answered")
+	}
+	if (HandshakeConfig{MetaVerifyToken: "x"}).validate() == "" {
+		t.Errorf("Expected a verify token without meta to be rejected")
+	}
+}
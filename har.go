@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR 1.2 documents, as described at http://www.softwareishard.com/blog/har-12-spec/.
+// Only the fields postbin can fill in are modelled; the spec's required ones
+// are always written.
+type harFile struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string      `json:"version"`
+	Creator harCreator  `json:"creator"`
+	Entries []*harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	QueryString []harNameValue `json:"queryString"`
+	PostData    *harPostData   `json:"postData,omitempty"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+// harPostData carries a body as text, or as form params in some imported
+// files. Bodies that aren't UTF-8 are base64 encoded and flagged with the
+// custom _encoding field, mirroring the spec's content.encoding for responses.
+type harPostData struct {
+	MimeType string         `json:"mimeType"`
+	Text     string         `json:"text"`
+	Params   []harNameValue `json:"params,omitempty"`
+	Encoding string         `json:"_encoding,omitempty"`
+}
+
+type harResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []harNameValue `json:"cookies"`
+	Headers     []harNameValue `json:"headers"`
+	Content     harContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int64          `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+}
+
+type harNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func newHARFile() harFile {
+	return harFile{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "postbin", Version: "1.0"},
+		Entries: []*harEntry{},
+	}}
+}
+
+// requestTarget returns the path and query a request was sent to, taking the
+// original request target from its raw head when there is one so repeated
+// query parameters survive
+func requestTarget(req Request) (path, rawPath, rawQuery string) {
+	if line, _, ok := strings.Cut(req.rawHead, "\r\n"); ok {
+		if parts := strings.Split(line, " "); len(parts) == 3 {
+			if target, err := url.ParseRequestURI(parts[1]); err == nil {
+				return target.Path, target.RawPath, target.RawQuery
+			}
+		}
+	}
+	q := url.Values{}
+	for key, value := range req.Query {
+		q.Set(key, value)
+	}
+	return req.Path, "", q.Encode()
+}
+
+// captureURL rebuilds the URL a request was sent to
+func captureURL(req Request) string {
+	u := url.URL{Scheme: "http", Host: req.Host}
+	if req.TLS != nil {
+		u.Scheme = "https"
+	}
+	u.Path, u.RawPath, u.RawQuery = requestTarget(req)
+	return u.String()
+}
+
+// newHAREntry describes a captured request, with postbin's reply (the
+// request ID) as the response. body is the request body as it was sent.
+func newHAREntry(req Request, body []byte) *harEntry {
+	started := time.Unix(0, req.ReceivedAt)
+	if req.ReceivedAt == 0 {
+		started = time.UnixMilli(req.Inserted)
+	}
+	proto := req.Proto
+	if proto == "" {
+		proto = "HTTP/1.1"
+	}
+
+	rawURL := captureURL(req)
+	entry := &harEntry{
+		StartedDateTime: started.UTC().Format(time.RFC3339Nano),
+		Time:            req.ReadDurationMs,
+		Request: harRequest{
+			Method:      req.Method,
+			URL:         rawURL,
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     harHeaders(req.Headers),
+			QueryString: []harNameValue{},
+			HeadersSize: -1,
+			BodySize:    int64(len(body)),
+		},
+		Response: harResponse{
+			Status:      http.StatusOK,
+			StatusText:  http.StatusText(http.StatusOK),
+			HTTPVersion: proto,
+			Cookies:     []harNameValue{},
+			Headers:     []harNameValue{},
+			Content:     harContent{Size: int64(len(req.ReqID)), MimeType: "text/plain", Text: req.ReqID},
+			RedirectURL: "",
+			HeadersSize: -1,
+			BodySize:    int64(len(req.ReqID)),
+		},
+		Timings: harTimings{Receive: req.ReadDurationMs},
+	}
+
+	for _, c := range (&http.Request{Header: req.Headers}).Cookies() {
+		entry.Request.Cookies = append(entry.Request.Cookies, harNameValue{Name: c.Name, Value: c.Value})
+	}
+	if u, err := url.Parse(rawURL); err == nil {
+		q := u.Query()
+		keys := make([]string, 0, len(q))
+		for key := range q {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			for _, value := range q[key] {
+				entry.Request.QueryString = append(entry.Request.QueryString, harNameValue{Name: key, Value: value})
+			}
+		}
+	}
+	if len(body) > 0 {
+		post := &harPostData{MimeType: req.Headers.Get("Content-Type"), Text: string(body)}
+		if !utf8.Valid(body) {
+			post.Text = base64.StdEncoding.EncodeToString(body)
+			post.Encoding = "base64"
+		}
+		entry.Request.PostData = post
+	}
+	return entry
+}
+
+// harHeaders lists headers by name, keeping repeated values in order
+func harHeaders(h http.Header) []harNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := []harNameValue{}
+	for _, name := range names {
+		for _, value := range h[name] {
+			out = append(out, harNameValue{Name: name, Value: value})
+		}
+	}
+	return out
+}
+
+// readOriginalBody reads a request's body as it was sent, from the blob
+// store if need be
+func readOriginalBody(ctx context.Context, req Request) ([]byte, error) {
+	body, _, err := openOriginalBody(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
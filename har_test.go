@@ -0,0 +1,80 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportHAR(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hooks?tag=a&tag=b", strings.NewReader(`{"ok":true}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cookie", "session=abc")
+	req.Header.Add("X-Trace", "1")
+	req.Header.Add("X-Trace", "2")
+	captureRequestHandler(httptest.NewRecorder(), req)
+
+	// A gzipped body is exported as sent, which isn't text
+	gzipped := compress(t, "gzip", []byte("hello"))
+	binary := httptest.NewRequest(http.MethodPut, "/"+bin.BinID, bytes.NewReader(gzipped))
+	binary.Header.Set("Content-Encoding", "gzip")
+	captureRequestHandler(httptest.NewRecorder(), binary)
+
+	exportReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/export?format=har", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, exportReq)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if cd := w.Header().Get("Content-Disposition"); !strings.Contains(cd, bin.BinID+".har") {
+		t.Errorf("Expected a .har attachment, got %q", cd)
+	}
+
+	var har harFile
+	if err := json.NewDecoder(w.Body).Decode(&har); err != nil {
+		t.Fatal(err)
+	}
+	if har.Log.Version != "1.2" || len(har.Log.Entries) != 2 {
+		t.Fatalf("Expected a HAR 1.2 log with 2 entries, got %+v", har.Log)
+	}
+
+	entry := har.Log.Entries[0].Request
+	if entry.Method != http.MethodPost || entry.URL != "http://example.com/"+bin.BinID+"/hooks?tag=a&tag=b" {
+		t.Errorf("Unexpected request line %s %s", entry.Method, entry.URL)
+	}
+	if len(entry.QueryString) != 2 || entry.QueryString[1].Value != "b" {
+		t.Errorf("Expected both tag values, got %+v", entry.QueryString)
+	}
+	if len(entry.Cookies) != 1 || entry.Cookies[0].Value != "abc" {
+		t.Errorf("Expected the session cookie, got %+v", entry.Cookies)
+	}
+	traces := 0
+	for _, h := range entry.Headers {
+		if h.Name == "X-Trace" {
+			traces++
+		}
+	}
+	if traces != 2 {
+		t.Errorf("Expected both X-Trace values, got %d", traces)
+	}
+	if entry.PostData == nil || entry.PostData.Text != `{"ok":true}` || entry.PostData.MimeType != "application/json" {
+		t.Errorf("Unexpected postData %+v", entry.PostData)
+	}
+	if _, err := time.Parse(time.RFC3339Nano, har.Log.Entries[0].StartedDateTime); err != nil {
+		t.Errorf("Expected an ISO 8601 startedDateTime: %v", err)
+	}
+	if post := har.Log.Entries[1].Request.PostData; post == nil || post.Encoding != "base64" ||
+		post.Text != base64.StdEncoding.EncodeToString(gzipped) {
+		t.Errorf("Expected the binary body base64 encoded, got %+v", post)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/hex"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Bin ID generation settings; overridable with command-line flags
+var (
+	binIDBytes    = 4
+	binIDAlphabet = "hex"
+)
+
+// maxBinIDAttempts bounds how often a colliding bin ID is redrawn
+const maxBinIDAttempts = 5
+
+const base62 = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+var lowerBase32 = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// validateBinIDFormat checks the --bin-id-bytes and --bin-id-alphabet flags
+func validateBinIDFormat(bytes int, alphabet string) error {
+	if bytes < 2 || bytes > 32 {
+		return fmt.Errorf("bin ID bytes must be between 2 and 32, got %d", bytes)
+	}
+	switch alphabet {
+	case "hex", "base32", "base62":
+		return nil
+	}
+	return fmt.Errorf("unknown bin ID alphabet %q, expected hex, base32 or base62", alphabet)
+}
+
+// generateBinID returns binIDBytes random bytes spelled in binIDAlphabet,
+// avoiding reserved names.
+func generateBinID() string {
+	for {
+		b := make([]byte, binIDBytes)
+		rand.Read(b)
+		id := encodeBinID(b, binIDAlphabet)
+		if !reservedBinIDs[id] {
+			return id
+		}
+	}
+}
+
+func encodeBinID(b []byte, alphabet string) string {
+	switch alphabet {
+	case "base32":
+		return lowerBase32.EncodeToString(b)
+	case "base62":
+		// Pad to the length the largest value needs, so IDs are fixed width
+		width := int(math.Ceil(float64(len(b)*8) / math.Log2(62)))
+		n := new(big.Int).SetBytes(b)
+		out := make([]byte, width)
+		mod := new(big.Int)
+		for i := width - 1; i >= 0; i-- {
+			n.DivMod(n, big.NewInt(62), mod)
+			out[i] = base62[mod.Int64()]
+		}
+		return string(out)
+	}
+	return hex.EncodeToString(b)
+}
+
+// crockford is the base32 alphabet used by ULIDs; it sorts in byte order
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// ulidSource generates monotonic ULIDs: a 48-bit millisecond timestamp
+// followed by 80 random bits, incremented rather than redrawn within the same
+// millisecond so IDs from one process always sort in generation order.
+type ulidSource struct {
+	mu      sync.Mutex
+	lastMs  uint64
+	entropy [10]byte
+}
+
+var requestIDs ulidSource
+
+// generateRequestID returns a new ULID for a captured request.
+func generateRequestID() string {
+	return requestIDs.next(time.Now())
+}
+
+func (s *ulidSource) next(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := uint64(now.UnixMilli())
+	if ms <= s.lastMs {
+		// Same millisecond (or the clock went back): keep the time and count up
+		ms = s.lastMs
+		for i := len(s.entropy) - 1; i >= 0; i-- {
+			s.entropy[i]++
+			if s.entropy[i] != 0 {
+				break
+			}
+		}
+	} else {
+		rand.Read(s.entropy[:])
+		s.lastMs = ms
+	}
+
+	var id [16]byte
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	copy(id[6:], s.entropy[:])
+	return encodeULID(id)
+}
+
+// encodeULID writes 128 bits as 26 base32 characters, most significant first
+func encodeULID(id [16]byte) string {
+	out := make([]byte, 26)
+	// 130 bits of output for 128 of input: the first character holds 3 bits
+	var acc uint32
+	bits := 2 // pad to 130 bits on the left
+	pos := 0
+	for _, b := range id {
+		acc = acc<<8 | uint32(b)
+		bits += 8
+		for bits >= 5 {
+			bits -= 5
+			out[pos] = crockford[(acc>>uint(bits))&31]
+			pos++
+		}
+	}
+	return string(out)
+}
+
+// ulidTime returns the millisecond timestamp a ULID starts with, reporting
+// false for anything that isn't one
+func ulidTime(id string) (int64, bool) {
+	if len(id) != 26 || id[0] > '7' {
+		return 0, false
+	}
+	for i := 0; i < len(id); i++ {
+		if strings.IndexByte(crockford, id[i]) < 0 {
+			return 0, false
+		}
+	}
+	// The first 10 characters are the 2 bits of padding and the 48-bit time
+	var ms int64
+	for i := 0; i < 10; i++ {
+		ms = ms<<5 | int64(strings.IndexByte(crockford, id[i]))
+	}
+	return ms, true
+}
@@ -0,0 +1,103 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGenerateRequestID(t *testing.T) {
+	var id [16]byte
+	ms := uint64(1469918176385)
+	for i := 0; i < 6; i++ {
+		id[i] = byte(ms >> (40 - 8*i))
+	}
+	if got := encodeULID(id); got != "01ARYZ6S410000000000000000" {
+		t.Errorf("Expected the reference ULID encoding, got %s", got)
+	}
+
+	var src ulidSource
+	now := time.Now()
+	prev := src.next(now)
+	for i := 0; i < 1000; i++ {
+		// Half the IDs share a millisecond, which must still sort in order
+		next := src.next(now.Add(time.Duration(i/2) * time.Millisecond))
+		if len(next) != 26 {
+			t.Fatalf("Expected a 26 character ID, got %q", next)
+		}
+		if next <= prev {
+			t.Fatalf("Expected %s to sort after %s", next, prev)
+		}
+		prev = next
+	}
+}
+
+func TestEncodeBinID(t *testing.T) {
+	tests := []struct {
+		alphabet string
+		bytes    []byte
+		want     string
+	}{
+		{"hex", []byte{0xde, 0xad, 0xbe, 0xef}, "deadbeef"},
+		{"base32", []byte{0xde, 0xad, 0xbe, 0xef}, "32w353y"},
+		{"base62", []byte{0, 0, 0, 1}, "000001"},
+		{"base62", []byte{0xff, 0xff, 0xff, 0xff}, "4gfFC3"},
+	}
+	for _, tt := range tests {
+		if got := encodeBinID(tt.bytes, tt.alphabet); got != tt.want {
+			t.Errorf("%s %x: expected %q, got %q", tt.alphabet, tt.bytes, tt.want, got)
+		}
+	}
+
+	if err := validateBinIDFormat(4, "base64"); err == nil {
+		t.Error("Expected an unknown alphabet to be rejected")
+	}
+}
+
+func TestCreateBinIDCollision(t *testing.T) {
+	clearDB(t)
+	defer func() { binIDBytes = 4 }()
+
+	// With one byte of ID space, fill every possible ID
+	binIDBytes = 1
+	for i := 0; i < 256; i++ {
+		testDB.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES (?, 0, 0)", encodeBinID([]byte{byte(i)}, "hex"))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", nil)
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d once every ID is taken, got %d", http.StatusServiceUnavailable, w.Code)
+	}
+
+	testDB.Exec("DELETE FROM bins")
+	binIDAlphabet = "base62"
+	defer func() { binIDAlphabet = "hex" }()
+	binIDBytes = 8
+
+	w = httptest.NewRecorder()
+	createBinHandler(w, httptest.NewRequest(http.MethodPost, "/api/bin", nil))
+	var bin BinResponse
+	json.NewDecoder(w.Body).Decode(&bin)
+	if w.Code != http.StatusCreated || len(bin.BinID) != 11 {
+		t.Errorf("Expected an 11 character base62 bin ID, got %d %q", w.Code, bin.BinID)
+	}
+}
+
+func TestULIDTime(t *testing.T) {
+	now := time.UnixMilli(1700000000123)
+	var s ulidSource
+	if ms, ok := ulidTime(s.next(now)); !ok || ms != now.UnixMilli() {
+		t.Errorf("Expected %d back, got %d %v", now.UnixMilli(), ms, ok)
+	}
+	for _, id := range []string{"", "not-a-ulid", "8ZZZZZZZZZZZZZZZZZZZZZZZZZ", "01ARZ3NDEKTSV4RRFFQ69G5FAU"} {
+		if _, ok := ulidTime(id); ok {
+			t.Errorf("Expected %q refused", id)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxImportBytes bounds the size of an uploaded HAR file
+const maxImportBytes = 64 << 20
+
+// ImportResponse lists the requests created by an import, in entry order
+type ImportResponse struct {
+	BinID    string   `json:"binId"`
+	Imported int      `json:"imported"`
+	ReqIDs   []string `json:"reqIds"`
+}
+
+// harEntryRequest rebuilds the http.Request a HAR entry describes, as if it
+// had been sent to the bin with the entry's path as its sub-path
+func harEntryRequest(binID string, entry *harEntry) (*http.Request, time.Time, error) {
+	u, err := url.Parse(entry.Request.URL)
+	if err != nil || u.Host == "" {
+		return nil, time.Time{}, fmt.Errorf("invalid url %q", entry.Request.URL)
+	}
+	if entry.Request.Method == "" {
+		return nil, time.Time{}, errors.New("missing method")
+	}
+
+	var body []byte
+	if post := entry.Request.PostData; post != nil {
+		switch {
+		case post.Encoding == "base64":
+			if body, err = base64.StdEncoding.DecodeString(post.Text); err != nil {
+				return nil, time.Time{}, errors.New("invalid base64 postData")
+			}
+		case post.Text == "" && len(post.Params) > 0:
+			form := url.Values{}
+			for _, p := range post.Params {
+				form.Add(p.Name, p.Value)
+			}
+			body = []byte(form.Encode())
+		default:
+			body = []byte(post.Text)
+		}
+	}
+
+	subPath := u.EscapedPath()
+	if subPath == "/" {
+		subPath = ""
+	}
+	target := "/" + binID + subPath
+	if u.RawQuery != "" {
+		target += "?" + u.RawQuery
+	}
+	r, err := http.NewRequest(entry.Request.Method, target, bytes.NewReader(body))
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("invalid request: %v", err)
+	}
+	r.RequestURI = target
+	r.Host = u.Host
+	if v := entry.Request.HTTPVersion; strings.HasPrefix(v, "HTTP/") {
+		r.Proto = v
+	}
+	for _, h := range entry.Request.Headers {
+		// HTTP/2 pseudo-headers are already covered by the method and URL
+		if !strings.HasPrefix(h.Name, ":") {
+			r.Header.Add(h.Name, h.Value)
+		}
+	}
+	if post := entry.Request.PostData; post != nil && post.MimeType != "" && r.Header.Get("Content-Type") == "" {
+		r.Header.Set("Content-Type", post.MimeType)
+	}
+
+	started, err := time.Parse(time.RFC3339Nano, entry.StartedDateTime)
+	if err != nil {
+		started = time.Now()
+	}
+	return r, started, nil
+}
+
+// importHandler serves POST /api/bin/{binId}/import: each entry of an
+// uploaded HAR file is stored as a captured request, in order, going through
+// the same body decoding, parsing and verification as a live capture.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/import")]
+
+	bin, err := store.GetBin(r.Context(), binID)
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if binExpired(bin.ExpiresAt) {
+		http.Error(w, `{"msg":"Bin expired"}`, http.StatusGone)
+		return
+	}
+
+	var har harFile
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxImportBytes)).Decode(&har); err != nil {
+		http.Error(w, `{"msg":"Invalid HAR file"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Check every entry before storing any, so a bad file imports nothing
+	type pending struct {
+		r       *http.Request
+		started time.Time
+	}
+	var entries []pending
+	for i, entry := range har.Log.Entries {
+		req, started, err := harEntryRequest(binID, entry)
+		if err != nil {
+			http.Error(w, fmt.Sprintf(`{"msg":%q}`, fmt.Sprintf("entry %d: %v", i, err)), http.StatusBadRequest)
+			return
+		}
+		entries = append(entries, pending{req, started})
+	}
+
+	resp := ImportResponse{BinID: binID, ReqIDs: []string{}}
+	for i, entry := range entries {
+		subPath := strings.TrimPrefix(entry.r.URL.Path, "/"+binID)
+		req, err := captureRequest(w, entry.r, binID, subPath, bin.MaxEntries, bin.Config, entry.started)
+		if err != nil {
+			msg, code := "Internal Server Error", http.StatusInternalServerError
+			switch {
+			case errors.Is(err, errBodyTooLarge):
+				msg, code = "body too large", http.StatusRequestEntityTooLarge
+			case err == errInsufficientStorage:
+				msg, code = "storage quota exceeded", http.StatusInsufficientStorage
+			}
+			http.Error(w, fmt.Sprintf(`{"msg":"entry %d: %s; %d entries were imported"}`, i, msg, resp.Imported),
+				code)
+			return
+		}
+		captures.publish(req)
+		resp.Imported++
+		resp.ReqIDs = append(resp.ReqIDs, req.ReqID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(resp)
+}
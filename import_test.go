@@ -0,0 +1,124 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestImportHAR(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	har := `{"log": {"version": "1.2", "creator": {"name": "devtools", "version": "1"}, "entries": [
+		{"startedDateTime": "2024-05-01T12:00:00.000Z", "request": {
+			"method": "POST", "url": "https://api.example.com/webhooks/stripe?v=2", "httpVersion": "HTTP/2.0",
+			"headers": [{"name": ":authority", "value": "api.example.com"}, {"name": "Content-Type", "value": "application/json"},
+				{"name": "User-Agent", "value": "Stripe/1.0"}],
+			"postData": {"mimeType": "application/json", "text": "{\"type\":\"charge.succeeded\"}"}}},
+		{"startedDateTime": "2024-05-01T12:00:01.000Z", "request": {
+			"method": "POST", "url": "https://api.example.com/login", "headers": [],
+			"postData": {"mimeType": "application/x-www-form-urlencoded", "params": [{"name": "user", "value": "ann"}]}}}
+	]}}`
+	req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/import", strings.NewReader(har))
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", w.Code, w.Body.String())
+	}
+	var resp ImportResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if resp.Imported != 2 || len(resp.ReqIDs) != 2 {
+		t.Fatalf("Expected 2 imported requests, got %+v", resp)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(reqs))
+	}
+
+	first := reqs[0]
+	if first.ReqID != resp.ReqIDs[0] || first.SubPath != "/webhooks/stripe" || first.Query["v"] != "2" ||
+		first.Host != "api.example.com" || first.Proto != "HTTP/2.0" {
+		t.Errorf("Unexpected request %+v", first)
+	}
+	if _, ok := first.Headers[":authority"]; ok {
+		t.Error("Expected pseudo-headers to be dropped")
+	}
+	if doc, _ := json.Marshal(first.Body); string(doc) != `{"type":"charge.succeeded"}` {
+		t.Errorf("Expected the JSON body to be parsed, got %s", doc)
+	}
+	if first.UserAgent == nil || first.UserAgent.Kind != "webhook" {
+		t.Errorf("Expected the User-Agent to be classified, got %+v", first.UserAgent)
+	}
+	if first.ReceivedAt/1e9 != 1714564800 {
+		t.Errorf("Expected receivedAt from startedDateTime, got %d", first.ReceivedAt)
+	}
+	if reqs[1].RawBody != "user=ann" || reqs[1].Headers.Get("Content-Type") != "application/x-www-form-urlencoded" {
+		t.Errorf("Expected the form params as the body, got %q", reqs[1].RawBody)
+	}
+}
+
+func TestImportHARRoundTrip(t *testing.T) {
+	clearDB(t)
+
+	src := createTestBin(t)
+	capture := httptest.NewRequest(http.MethodPut, "/"+src.BinID+"/a?x=1&x=2", bytes.NewReader(compress(t, "gzip", []byte("hello"))))
+	capture.Header.Set("Content-Encoding", "gzip")
+	captureRequestHandler(httptest.NewRecorder(), capture)
+
+	exportReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+src.BinID+"/export?format=har", nil)
+	exportW := httptest.NewRecorder()
+	binAPIHandler(exportW, exportReq)
+
+	dst := createTestBin(t)
+	importReq := httptest.NewRequest(http.MethodPost, "/api/bin/"+dst.BinID+"/import", exportW.Body)
+	importW := httptest.NewRecorder()
+	binAPIHandler(importW, importReq)
+	if importW.Code != http.StatusCreated {
+		t.Fatalf("Expected 201, got %d: %s", importW.Code, importW.Body.String())
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+dst.BinID+"/req", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 1 || reqs[0].RawBody != "hello" || reqs[0].DecodedFrom != "gzip" ||
+		reqs[0].SubPath != "/"+src.BinID+"/a" {
+		t.Errorf("Expected the gzipped capture to survive the round trip, got %+v", reqs)
+	}
+}
+
+func TestImportHARInvalid(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{
+		`not json`,
+		`{"log": {"entries": [{"request": {"method": "GET", "url": "/relative"}}]}}`,
+		`{"log": {"entries": [{"request": {"url": "http://example.com/"}}]}}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/import", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+
+	var count int
+	db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&count)
+	if count != 0 {
+		t.Errorf("Expected nothing imported, got %d requests", count)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+)
+
+// maxSchemaSamples bounds how many bodies a schema is inferred from; the
+// oldest are used, since they're the ones a contract was first seen with
+const maxSchemaSamples = 1000
+
+// inferredSchema accumulates what was seen at one position in the sampled
+// documents. Counts let required properties be told apart from optional ones.
+type inferredSchema struct {
+	types      map[string]int
+	objects    int
+	properties map[string]*inferredSchema
+	items      *inferredSchema
+}
+
+func newInferredSchema() *inferredSchema {
+	return &inferredSchema{types: map[string]int{}}
+}
+
+// add merges one decoded JSON value into the schema
+func (s *inferredSchema) add(value interface{}) {
+	t := jsonTypeOf(value)
+	s.types[t]++
+	switch value := value.(type) {
+	case map[string]interface{}:
+		s.objects++
+		if s.properties == nil {
+			s.properties = map[string]*inferredSchema{}
+		}
+		for name, v := range value {
+			prop, ok := s.properties[name]
+			if !ok {
+				prop = newInferredSchema()
+				s.properties[name] = prop
+			}
+			prop.add(v)
+		}
+	case []interface{}:
+		if s.items == nil {
+			s.items = newInferredSchema()
+		}
+		for _, v := range value {
+			s.items.add(v)
+		}
+	}
+}
+
+// present counts the documents a property appeared in
+func (s *inferredSchema) present() int {
+	n := 0
+	for _, count := range s.types {
+		n += count
+	}
+	return n
+}
+
+// schema renders the accumulated observations as a JSON Schema. Properties
+// seen in every object are required; integers widen to numbers when both
+// were seen.
+func (s *inferredSchema) schema() map[string]interface{} {
+	out := map[string]interface{}{}
+
+	var types []string
+	for t := range s.types {
+		if t == "integer" && s.types["number"] > 0 {
+			continue
+		}
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	switch len(types) {
+	case 0:
+	case 1:
+		out["type"] = types[0]
+	default:
+		out["type"] = types
+	}
+
+	if s.properties != nil {
+		props := map[string]interface{}{}
+		var required []string
+		for name, prop := range s.properties {
+			props[name] = prop.schema()
+			if prop.present() == s.objects {
+				required = append(required, name)
+			}
+		}
+		sort.Strings(required)
+		out["properties"] = props
+		if len(required) > 0 {
+			out["required"] = required
+		}
+	}
+	if s.items != nil && s.items.present() > 0 {
+		out["items"] = s.items.schema()
+	}
+	return out
+}
+
+// inferSchemaHandler serves GET /api/bin/{binId}/schema: a JSON Schema
+// inferred from the bodies captured so far, or with format=openapi, an
+// OpenAPI 3.1 requestBody wrapping it. The listing filters apply, so one
+// event type can be described at a time.
+func inferSchemaHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/schema")]
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "jsonschema" && format != "openapi" {
+		http.Error(w, `{"msg":"format must be jsonschema or openapi"}`, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	inferred := newInferredSchema()
+	samples := 0
+	err = pageRequests(r.Context(), binID, filter, func(req Request) (bool, error) {
+		if doc, ok := requestDocument(req); ok {
+			inferred.add(doc)
+			samples++
+		}
+		return samples < maxSchemaSamples, nil
+	})
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	schema := inferred.schema()
+	schema["description"] = fmt.Sprintf("Inferred from %d captured bodies", samples)
+
+	var resp interface{}
+	if format == "openapi" {
+		resp = map[string]interface{}{
+			"requestBody": map[string]interface{}{
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": schema},
+				},
+			},
+		}
+	} else {
+		schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+		resp = schema
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,89 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInferSchema(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{
+		`{"id": 1, "action": "opened", "tags": ["a"], "score": 2}`,
+		`{"id": 2, "action": "closed", "tags": [], "score": 2.5, "sender": null}`,
+		`not json`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/schema", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", w.Code)
+	}
+
+	var got map[string]interface{}
+	json.NewDecoder(w.Body).Decode(&got)
+	want := map[string]interface{}{
+		"$schema":     "https://json-schema.org/draft/2020-12/schema",
+		"description": "Inferred from 2 captured bodies",
+		"type":        "object",
+		"required":    []interface{}{"action", "id", "score", "tags"},
+		"properties": map[string]interface{}{
+			"id":     map[string]interface{}{"type": "integer"},
+			"action": map[string]interface{}{"type": "string"},
+			"tags":   map[string]interface{}{"type": "array", "items": map[string]interface{}{"type": "string"}},
+			"score":  map[string]interface{}{"type": "number"},
+			"sender": map[string]interface{}{"type": "null"},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+
+	// The inferred schema accepts the bodies it came from
+	raw, _ := json.Marshal(got)
+	schema, err := compileJSONSchema(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if errs := schema.validate(json.RawMessage(`{"id": 3, "action": "x", "tags": ["b"], "score": 1}`)); errs != nil {
+		t.Errorf("Expected a matching body to validate, got %q", errs)
+	}
+
+	openapiReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/schema?format=openapi", nil)
+	openapiW := httptest.NewRecorder()
+	binAPIHandler(openapiW, openapiReq)
+	var openapi struct {
+		RequestBody struct {
+			Content map[string]struct {
+				Schema map[string]interface{} `json:"schema"`
+			} `json:"content"`
+		} `json:"requestBody"`
+	}
+	json.NewDecoder(openapiW.Body).Decode(&openapi)
+	if s := openapi.RequestBody.Content["application/json"].Schema; s["type"] != "object" {
+		t.Errorf("Expected an OpenAPI requestBody wrapping the schema, got %v", openapi)
+	}
+}
+
+func TestInferSchemaMissingBin(t *testing.T) {
+	clearDB(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/nosuchbin/schema", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404, got %d", w.Code)
+	}
+}
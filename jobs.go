@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// jobInterval is how often due replay jobs are looked for; overridable with
+// a command-line flag
+var jobInterval = 15 * time.Second
+
+// Replay job statuses. Recurring jobs go back to scheduled after each run;
+// one-off jobs end up done.
+const (
+	jobScheduled = "scheduled"
+	jobRunning   = "running"
+	jobDone      = "done"
+)
+
+// ReplayJob replays a bin's backlog on a cron schedule or once at RunAt.
+// Filter is a query string of listing filters, such as "method=POST".
+// With OnlyNew, each run only sends requests captured since the last one.
+type ReplayJob struct {
+	JobID     string        `json:"jobId"`
+	BinID     string        `json:"binId"`
+	Replay    ReplayOptions `json:"replay"`
+	Filter    string        `json:"filter,omitempty"`
+	Cron      string        `json:"cron,omitempty"`
+	RunAt     int64         `json:"runAt,omitempty"`
+	OnlyNew   bool          `json:"onlyNew,omitempty"`
+	Status    string        `json:"status"`
+	NextRunAt int64         `json:"nextRunAt,omitempty"`
+	LastRunAt int64         `json:"lastRunAt,omitempty"`
+	Runs      int           `json:"runs"`
+	LastRun   *JobRun       `json:"lastRun,omitempty"`
+	CreatedAt int64         `json:"createdAt"`
+}
+
+// JobRun summarises a job's latest run
+type JobRun struct {
+	Replayed  int    `json:"replayed"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+	Error     string `json:"error,omitempty"`
+}
+
+const jobColumns = "job_id, bin_id, options, filter, cron, run_at, only_new, status, next_run_at, last_run_at, runs, last_run, created_at"
+
+func scanJob(row interface{ Scan(...interface{}) error }) (ReplayJob, error) {
+	var job ReplayJob
+	var options, lastRun string
+	err := row.Scan(&job.JobID, &job.BinID, &options, &job.Filter, &job.Cron, &job.RunAt, &job.OnlyNew,
+		&job.Status, &job.NextRunAt, &job.LastRunAt, &job.Runs, &lastRun, &job.CreatedAt)
+	if err != nil {
+		return job, err
+	}
+	json.Unmarshal([]byte(options), &job.Replay)
+	if lastRun != "" {
+		json.Unmarshal([]byte(lastRun), &job.LastRun)
+	}
+	return job, nil
+}
+
+// nextJobRun is when a job should next run after t, or 0 when it shouldn't
+func nextJobRun(job ReplayJob, t time.Time) int64 {
+	if job.Cron == "" {
+		return 0
+	}
+	s, err := parseCron(job.Cron)
+	if err != nil {
+		return 0
+	}
+	next := s.next(t.UTC())
+	if next.IsZero() {
+		return 0
+	}
+	return next.UnixMilli()
+}
+
+// runJob replays a job's backlog and records the outcome
+func runJob(ctx context.Context, job ReplayJob, now time.Time) JobRun {
+	var run JobRun
+	q, _ := url.ParseQuery(job.Filter)
+	filter, err := parseRequestFilter(q)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	if job.OnlyNew && job.LastRunAt > 0 {
+		// since is inclusive, and inserted is in whole milliseconds
+		if after := job.LastRunAt + 1; filter.since == nil || *filter.since < after {
+			filter.since = &after
+		}
+	}
+	rw, err := job.Replay.Rules.compile()
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	reqs, err := loadExportRequests(ctx, job.BinID, filter)
+	if err != nil {
+		run.Error = err.Error()
+		return run
+	}
+	if job.Replay.Order == "newest" {
+		for i, j := 0, len(reqs)-1; i < j; i, j = i+1, j-1 {
+			reqs[i], reqs[j] = reqs[j], reqs[i]
+		}
+	}
+
+	results := replay(ctx, reqs, job.Replay, rw)
+	recordReplayDeliveries(ctx, job.BinID, "job:"+job.JobID, results)
+	for _, result := range results {
+		run.Replayed++
+		if result.ok() {
+			run.Succeeded++
+		} else {
+			run.Failed++
+		}
+	}
+	return run
+}
+
+// runDueJobs runs every scheduled job whose time has come, one at a time.
+// Each job is claimed by moving it to running first, so a job is never run
+// twice at once.
+func runDueJobs(ctx context.Context, now time.Time) (int, error) {
+	qctx, cancel := dbContext(ctx)
+	defer cancel()
+	rows, err := db.QueryContext(qctx, "SELECT "+jobColumns+" FROM replay_jobs WHERE status = ? AND next_run_at <= ? ORDER BY next_run_at",
+		jobScheduled, now.UnixMilli())
+	if err != nil {
+		return 0, err
+	}
+	var due []ReplayJob
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		due = append(due, job)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	ran := 0
+	for _, job := range due {
+		qctx, cancel := dbContext(ctx)
+		res, err := db.ExecContext(qctx, "UPDATE replay_jobs SET status = ? WHERE job_id = ? AND status = ?",
+			jobRunning, job.JobID, jobScheduled)
+		cancel()
+		if err != nil {
+			return ran, err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			continue
+		}
+
+		run := runJob(ctx, job, now)
+		// A run that overlaps the next scheduled time skips it
+		after := time.Now()
+		if now.After(after) {
+			after = now
+		}
+		status, next := jobDone, nextJobRun(job, after)
+		if next != 0 {
+			status = jobScheduled
+		}
+		runJSON, _ := json.Marshal(run)
+		// The job may have been deleted while it ran, in which case this is a
+		// no-op. It's recorded even if the runner is stopping, so the job isn't
+		// left running.
+		qctx, cancel = dbContext(context.Background())
+		_, err = db.ExecContext(qctx, `
+            UPDATE replay_jobs SET status = ?, next_run_at = ?, last_run_at = ?, runs = runs + 1, last_run = ?
+            WHERE job_id = ?`, status, next, now.UnixMilli(), string(runJSON), job.JobID)
+		cancel()
+		if err != nil {
+			return ran, err
+		}
+		ran++
+	}
+	return ran, nil
+}
+
+// startJobRunner runs due replay jobs every interval until the returned
+// function is called. Jobs left running by a previous process are
+// rescheduled first.
+func startJobRunner(interval time.Duration) (stop func()) {
+	if _, err := db.Exec("UPDATE replay_jobs SET status = ? WHERE status = ?", jobScheduled, jobRunning); err != nil {
+		log.Printf("Rescheduling interrupted jobs failed: %v", err)
+	}
+
+	ticker := time.NewTicker(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go func() {
+		for {
+			select {
+			case now := <-ticker.C:
+				if _, err := runDueJobs(ctx, now); err != nil {
+					log.Printf("Running replay jobs failed: %v", err)
+				}
+			case <-ctx.Done():
+				ticker.Stop()
+				return
+			}
+		}
+	}()
+
+	return cancel
+}
+
+// jobsHandler serves /api/bin/{binId}/jobs: GET lists a bin's replay jobs
+// and POST creates one.
+func jobsHandler(w http.ResponseWriter, r *http.Request) {
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/jobs")
+	if refuseLocalFeature(w, "Replay jobs") {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+			http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		ctx, cancel := dbContext(r.Context())
+		defer cancel()
+		rows, err := db.QueryContext(ctx, "SELECT "+jobColumns+" FROM replay_jobs WHERE bin_id = ? ORDER BY created_at, job_id", binID)
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		jobs := []ReplayJob{}
+		for rows.Next() {
+			job, err := scanJob(rows)
+			if err != nil {
+				http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+				return
+			}
+			jobs = append(jobs, job)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jobs)
+
+	case http.MethodPost:
+		createJobHandler(w, r, binID)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createJobHandler(w http.ResponseWriter, r *http.Request, binID string) {
+	var job ReplayJob
+	if err := json.NewDecoder(r.Body).Decode(&job); err != nil {
+		http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	switch {
+	case (job.Cron == "") == (job.RunAt == 0):
+		http.Error(w, `{"msg":"Give exactly one of cron or runAt"}`, http.StatusBadRequest)
+		return
+	case job.Cron != "":
+		if _, err := parseCron(job.Cron); err != nil {
+			http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+			return
+		}
+		job.NextRunAt = nextJobRun(job, now)
+	default:
+		job.NextRunAt = job.RunAt
+	}
+	if msg := job.Replay.validate(); msg != "" {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+	if _, err := job.Replay.Rules.compile(); err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, "rules: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	q, err := url.ParseQuery(job.Filter)
+	if err == nil {
+		_, err = parseRequestFilter(q)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, "filter: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	job.JobID = generateRequestID()
+	job.BinID = binID
+	job.Status = jobScheduled
+	job.Runs, job.LastRunAt, job.LastRun = 0, 0, nil
+	job.CreatedAt = now.UnixMilli()
+	options, _ := json.Marshal(job.Replay)
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+	_, err = db.ExecContext(ctx, `
+        INSERT INTO replay_jobs (job_id, bin_id, options, filter, cron, run_at, only_new, status, next_run_at, created_at)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		job.JobID, job.BinID, string(options), job.Filter, job.Cron, job.RunAt, job.OnlyNew,
+		job.Status, job.NextRunAt, job.CreatedAt)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(job)
+}
+
+// jobHandler serves GET and DELETE /api/bin/{binId}/jobs/{jobId}. Deleting a
+// running job lets its current run finish but stops it from being recorded.
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len("/api/bin/"):], "/")
+	binID, jobID := parts[0], parts[2]
+	if refuseLocalFeature(w, "Replay jobs") {
+		return
+	}
+	ctx, cancel := dbContext(r.Context())
+	defer cancel()
+
+	switch r.Method {
+	case http.MethodGet:
+		job, err := scanJob(db.QueryRowContext(ctx, "SELECT "+jobColumns+" FROM replay_jobs WHERE bin_id = ? AND job_id = ?",
+			binID, jobID))
+		if err == sql.ErrNoRows {
+			http.Error(w, `{"msg":"Job not found"}`, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(job)
+
+	case http.MethodDelete:
+		res, err := db.ExecContext(ctx, "DELETE FROM replay_jobs WHERE bin_id = ? AND job_id = ?", binID, jobID)
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, `{"msg":"Job not found"}`, http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"msg":"Job Deleted"}`)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
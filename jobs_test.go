@@ -0,0 +1,118 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func createTestJob(t *testing.T, binID, body string) (int, ReplayJob) {
+	req := httptest.NewRequest(http.MethodPost, "/api/bin/"+binID+"/jobs", strings.NewReader(body))
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	var job ReplayJob
+	json.NewDecoder(w.Body).Decode(&job)
+	return w.Code, job
+}
+
+func TestReplayJobs(t *testing.T) {
+	clearDB(t)
+
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil))
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+
+	now := time.Now()
+	code, once := createTestJob(t, bin.BinID, `{"replay": {"target": "`+srv.URL+`"}, "filter": "method=POST", "runAt": 1}`)
+	if code != http.StatusCreated || once.Status != jobScheduled || once.NextRunAt != 1 {
+		t.Fatalf("Expected a scheduled job, got %d %+v", code, once)
+	}
+	code, recurring := createTestJob(t, bin.BinID, `{"replay": {"target": "`+srv.URL+`"}, "cron": "*/5 * * * *", "onlyNew": true}`)
+	if code != http.StatusCreated || recurring.NextRunAt <= now.UnixMilli() {
+		t.Fatalf("Expected a recurring job due in the future, got %d %+v", code, recurring)
+	}
+
+	if ran, err := runDueJobs(context.Background(), now); err != nil || ran != 1 {
+		t.Fatalf("Expected only the one-off job to run, got %d (%v)", ran, err)
+	}
+	if hits != 1 {
+		t.Errorf("Expected the filtered backlog of 1 request to be replayed, got %d", hits)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/jobs/"+once.JobID, nil)
+	getW := httptest.NewRecorder()
+	binAPIHandler(getW, getReq)
+	var done ReplayJob
+	json.NewDecoder(getW.Body).Decode(&done)
+	if done.Status != jobDone || done.Runs != 1 || done.LastRun == nil || done.LastRun.Succeeded != 1 {
+		t.Errorf("Expected the job to be done after one successful run, got %+v", done)
+	}
+
+	// Run the recurring job twice; the second run only sees newer captures
+	later := time.UnixMilli(recurring.NextRunAt)
+	if ran, _ := runDueJobs(context.Background(), later); ran != 1 || hits != 3 {
+		t.Fatalf("Expected the recurring job to replay both requests, ran %d with %d hits", ran, hits)
+	}
+	// Everything captured so far was captured before the last run; the clock
+	// hasn't moved on enough for the test to rely on it
+	db.Exec("UPDATE replay_jobs SET last_run_at = (SELECT MAX(inserted) FROM requests) WHERE job_id = ?", recurring.JobID)
+	time.Sleep(2 * time.Millisecond)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPut, "/"+bin.BinID, nil))
+
+	var job ReplayJob
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/jobs", nil)
+	listW := httptest.NewRecorder()
+	binAPIHandler(listW, listReq)
+	var jobs []ReplayJob
+	json.NewDecoder(listW.Body).Decode(&jobs)
+	if len(jobs) != 2 {
+		t.Fatalf("Expected 2 jobs, got %d", len(jobs))
+	}
+	job = jobs[1]
+	if job.Status != jobScheduled || job.NextRunAt <= later.UnixMilli() {
+		t.Fatalf("Expected the recurring job to be rescheduled, got %+v", job)
+	}
+	if ran, _ := runDueJobs(context.Background(), time.UnixMilli(job.NextRunAt)); ran != 1 || hits != 4 {
+		t.Errorf("Expected only the new capture to be replayed, ran %d with %d hits", ran, hits)
+	}
+
+	delReq := httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID+"/jobs/"+job.JobID, nil)
+	delW := httptest.NewRecorder()
+	binAPIHandler(delW, delReq)
+	if delW.Code != http.StatusOK {
+		t.Errorf("Expected 200 deleting the job, got %d", delW.Code)
+	}
+}
+
+func TestCreateReplayJobErrors(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{
+		`{"replay": {"target": "http://localhost:1"}}`,
+		`{"replay": {"target": "http://localhost:1"}, "cron": "* * * * *", "runAt": 1}`,
+		`{"replay": {"target": "http://localhost:1"}, "cron": "every minute"}`,
+		`{"replay": {}, "runAt": 1}`,
+		`{"replay": {"target": "http://localhost:1"}, "runAt": 1, "filter": "since=yesterday"}`,
+	} {
+		if code, _ := createTestJob(t, bin.BinID, body); code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, code)
+		}
+	}
+	if code, _ := createTestJob(t, "nosuchbin", `{"replay": {"target": "http://localhost:1"}, "runAt": 1}`); code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing bin, got %d", code)
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonSchema validates documents against the commonly used subset of JSON
+// Schema: type, enum, const, the object, array, string and number
+// constraints, allOf/anyOf/oneOf/not and local $refs. Other keywords, such
+// as format, are ignored.
+type jsonSchema struct {
+	root     interface{}
+	patterns map[string]*regexp.Regexp
+}
+
+// maxValidationErrors caps how many errors are kept for a single document
+const maxValidationErrors = 50
+
+var jsonSchemaTypes = map[string]bool{
+	"null": true, "boolean": true, "object": true, "array": true,
+	"number": true, "integer": true, "string": true,
+}
+
+// compileJSONSchema parses a schema and checks that its keywords are usable
+func compileJSONSchema(raw json.RawMessage) (*jsonSchema, error) {
+	s := &jsonSchema{patterns: map[string]*regexp.Regexp{}}
+	if err := json.Unmarshal(raw, &s.root); err != nil {
+		return nil, fmt.Errorf("schema is not valid JSON")
+	}
+	if err := s.check(s.root, "#"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *jsonSchema) check(node interface{}, at string) error {
+	if _, ok := node.(bool); ok {
+		return nil
+	}
+	schema, ok := node.(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("schema at %s must be an object or boolean", at)
+	}
+
+	switch t := schema["type"].(type) {
+	case nil:
+	case string:
+		if !jsonSchemaTypes[t] {
+			return fmt.Errorf("schema at %s has unknown type %q", at, t)
+		}
+	case []interface{}:
+		for _, name := range t {
+			if name, _ := name.(string); !jsonSchemaTypes[name] {
+				return fmt.Errorf("schema at %s has unknown type %v", at, name)
+			}
+		}
+	default:
+		return fmt.Errorf("schema at %s has an invalid type", at)
+	}
+	if p, ok := schema["pattern"].(string); ok {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return fmt.Errorf("schema at %s has an invalid pattern: %v", at, err)
+		}
+		s.patterns[p] = re
+	}
+	if ref, ok := schema["$ref"].(string); ok {
+		if _, err := s.resolve(ref); err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{"properties", "definitions", "$defs"} {
+		children, _ := schema[key].(map[string]interface{})
+		for name, child := range children {
+			if err := s.check(child, at+"/"+key+"/"+name); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"items", "additionalProperties", "not"} {
+		if child, ok := schema[key]; ok {
+			if err := s.check(child, at+"/"+key); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range []string{"allOf", "anyOf", "oneOf"} {
+		children, _ := schema[key].([]interface{})
+		for i, child := range children {
+			if err := s.check(child, fmt.Sprintf("%s/%s/%d", at, key, i)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// resolve follows a local $ref such as "#/definitions/user"
+func (s *jsonSchema) resolve(ref string) (interface{}, error) {
+	if ref != "#" && !strings.HasPrefix(ref, "#/") {
+		return nil, fmt.Errorf("schema $ref %q must point into the schema itself", ref)
+	}
+	node := s.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#"), "/")[1:] {
+		part = strings.NewReplacer("~1", "/", "~0", "~").Replace(part)
+		m, ok := node.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("schema $ref %q does not resolve", ref)
+		}
+		if node, ok = m[part]; !ok {
+			return nil, fmt.Errorf("schema $ref %q does not resolve", ref)
+		}
+	}
+	return node, nil
+}
+
+// validate returns the ways doc breaks the schema, each prefixed with the
+// JSONPath of the offending value; nil means the document is valid.
+func (s *jsonSchema) validate(doc json.RawMessage) []string {
+	var value interface{}
+	if err := decodeJSONNumbers(doc, &value); err != nil {
+		return []string{"$: body is not a JSON document"}
+	}
+	v := schemaValidation{schema: s}
+	v.validate(s.root, value, "$", 0)
+	return v.errors
+}
+
+// decodeJSONNumbers unmarshals JSON keeping numbers as json.Number, so that
+// integers can be told apart from other numbers
+func decodeJSONNumbers(data []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+type schemaValidation struct {
+	schema *jsonSchema
+	errors []string
+}
+
+func (v *schemaValidation) fail(at, format string, args ...interface{}) {
+	if len(v.errors) < maxValidationErrors {
+		v.errors = append(v.errors, at+": "+fmt.Sprintf(format, args...))
+	}
+}
+
+// matches reports whether value satisfies node without recording errors
+func (v *schemaValidation) matches(node, value interface{}, depth int) bool {
+	sub := schemaValidation{schema: v.schema}
+	sub.validate(node, value, "$", depth)
+	return len(sub.errors) == 0
+}
+
+func (v *schemaValidation) validate(node, value interface{}, at string, depth int) {
+	if depth > 64 {
+		v.fail(at, "schema nests too deeply")
+		return
+	}
+	if b, ok := node.(bool); ok {
+		if !b {
+			v.fail(at, "no value is allowed here")
+		}
+		return
+	}
+	schema, _ := node.(map[string]interface{})
+
+	if ref, ok := schema["$ref"].(string); ok {
+		target, err := v.schema.resolve(ref)
+		if err != nil {
+			v.fail(at, "%v", err)
+			return
+		}
+		v.validate(target, value, at, depth+1)
+	}
+
+	if t, ok := schema["type"]; ok && !matchesType(t, value) {
+		v.fail(at, "expected %s, got %s", describeTypes(t), jsonTypeOf(value))
+		return
+	}
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(at, "value is not one of the allowed values")
+		}
+	}
+	if c, ok := schema["const"]; ok && !jsonEqual(c, value) {
+		v.fail(at, "value does not equal the required constant")
+	}
+
+	switch value := value.(type) {
+	case map[string]interface{}:
+		v.validateObject(schema, value, at, depth)
+	case []interface{}:
+		v.validateArray(schema, value, at, depth)
+	case string:
+		length := float64(len([]rune(value)))
+		if min, ok := schemaNumber(schema, "minLength"); ok && length < min {
+			v.fail(at, "shorter than %v characters", min)
+		}
+		if max, ok := schemaNumber(schema, "maxLength"); ok && length > max {
+			v.fail(at, "longer than %v characters", max)
+		}
+		if p, ok := schema["pattern"].(string); ok && !v.schema.patterns[p].MatchString(value) {
+			v.fail(at, "does not match pattern %q", p)
+		}
+	case json.Number:
+		n, _ := value.Float64()
+		if min, ok := schemaNumber(schema, "minimum"); ok && n < min {
+			v.fail(at, "less than the minimum %v", min)
+		}
+		if max, ok := schemaNumber(schema, "maximum"); ok && n > max {
+			v.fail(at, "greater than the maximum %v", max)
+		}
+		if min, ok := schemaNumber(schema, "exclusiveMinimum"); ok && n <= min {
+			v.fail(at, "not greater than %v", min)
+		}
+		if max, ok := schemaNumber(schema, "exclusiveMaximum"); ok && n >= max {
+			v.fail(at, "not less than %v", max)
+		}
+		if m, ok := schemaNumber(schema, "multipleOf"); ok && m > 0 {
+			if q := n / m; math.Abs(q-math.Round(q)) > 1e-9 {
+				v.fail(at, "not a multiple of %v", m)
+			}
+		}
+	}
+
+	if all, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range all {
+			v.validate(sub, value, at, depth+1)
+		}
+	}
+	if anyOf, ok := schema["anyOf"].([]interface{}); ok {
+		matched := false
+		for _, sub := range anyOf {
+			if v.matches(sub, value, depth+1) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			v.fail(at, "does not match any schema in anyOf")
+		}
+	}
+	if oneOf, ok := schema["oneOf"].([]interface{}); ok {
+		matched := 0
+		for _, sub := range oneOf {
+			if v.matches(sub, value, depth+1) {
+				matched++
+			}
+		}
+		if matched != 1 {
+			v.fail(at, "matches %d schemas in oneOf, expected exactly 1", matched)
+		}
+	}
+	if not, ok := schema["not"]; ok && v.matches(not, value, depth+1) {
+		v.fail(at, "matches a schema it must not")
+	}
+}
+
+func (v *schemaValidation) validateObject(schema, obj map[string]interface{}, at string, depth int) {
+	required, _ := schema["required"].([]interface{})
+	for _, name := range required {
+		if name, ok := name.(string); ok {
+			if _, present := obj[name]; !present {
+				v.fail(at, "missing required property %q", name)
+			}
+		}
+	}
+	if min, ok := schemaNumber(schema, "minProperties"); ok && float64(len(obj)) < min {
+		v.fail(at, "fewer than %v properties", min)
+	}
+	if max, ok := schemaNumber(schema, "maxProperties"); ok && float64(len(obj)) > max {
+		v.fail(at, "more than %v properties", max)
+	}
+
+	// Walk properties in order so errors come out the same way every time
+	names := make([]string, 0, len(obj))
+	for name := range obj {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	properties, _ := schema["properties"].(map[string]interface{})
+	additional, hasAdditional := schema["additionalProperties"]
+	for _, name := range names {
+		if sub, ok := properties[name]; ok {
+			v.validate(sub, obj[name], memberPath(at, name), depth+1)
+		} else if hasAdditional {
+			if b, ok := additional.(bool); ok && !b {
+				v.fail(at, "unexpected property %q", name)
+			} else {
+				v.validate(additional, obj[name], memberPath(at, name), depth+1)
+			}
+		}
+	}
+}
+
+func (v *schemaValidation) validateArray(schema map[string]interface{}, arr []interface{}, at string, depth int) {
+	if min, ok := schemaNumber(schema, "minItems"); ok && float64(len(arr)) < min {
+		v.fail(at, "fewer than %v items", min)
+	}
+	if max, ok := schemaNumber(schema, "maxItems"); ok && float64(len(arr)) > max {
+		v.fail(at, "more than %v items", max)
+	}
+	if unique, _ := schema["uniqueItems"].(bool); unique {
+		for i := range arr {
+			for j := 0; j < i; j++ {
+				if jsonEqual(arr[i], arr[j]) {
+					v.fail(at, "items %d and %d are equal", j, i)
+				}
+			}
+		}
+	}
+	if items, ok := schema["items"]; ok {
+		for i, item := range arr {
+			v.validate(items, item, at+"["+strconv.Itoa(i)+"]", depth+1)
+		}
+	}
+}
+
+// memberPath appends a property to a JSONPath, quoting names that aren't
+// plain identifiers the way the jsonpath filter expects
+func memberPath(at, name string) string {
+	if name == "" {
+		return at + `.""`
+	}
+	for _, r := range name {
+		if !(r == '_' || r >= '0' && r <= '9' || r >= 'A' && r <= 'Z' || r >= 'a' && r <= 'z') {
+			return at + "." + strconv.Quote(name)
+		}
+	}
+	return at + "." + name
+}
+
+func schemaNumber(schema map[string]interface{}, key string) (float64, bool) {
+	n, ok := schema[key].(float64)
+	return n, ok
+}
+
+func jsonTypeOf(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		if f, err := value.Float64(); err == nil && f == math.Trunc(f) {
+			return "integer"
+		}
+		return "number"
+	}
+	return "unknown"
+}
+
+func matchesType(t, value interface{}) bool {
+	actual := jsonTypeOf(value)
+	ok := func(name interface{}) bool {
+		return name == actual || name == "number" && actual == "integer"
+	}
+	if names, isList := t.([]interface{}); isList {
+		for _, name := range names {
+			if ok(name) {
+				return true
+			}
+		}
+		return false
+	}
+	return ok(t)
+}
+
+func describeTypes(t interface{}) string {
+	if names, ok := t.([]interface{}); ok {
+		parts := make([]string, len(names))
+		for i, name := range names {
+			parts[i] = fmt.Sprint(name)
+		}
+		return strings.Join(parts, " or ")
+	}
+	return fmt.Sprint(t)
+}
+
+// jsonEqual compares decoded JSON values, treating numbers by value whether
+// they came from the schema (float64) or the document (json.Number)
+func jsonEqual(a, b interface{}) bool {
+	return reflect.DeepEqual(normalizeJSON(a), normalizeJSON(b))
+}
+
+func normalizeJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case json.Number:
+		f, _ := value.Float64()
+		return f
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, v := range value {
+			out[k] = normalizeJSON(v)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(value))
+		for i, v := range value {
+			out[i] = normalizeJSON(v)
+		}
+		return out
+	}
+	return value
+}
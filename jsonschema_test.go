@@ -0,0 +1,131 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+	schema, err := compileJSONSchema(json.RawMessage(`{
+		"type": "object",
+		"required": ["id", "action"],
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"action": {"enum": ["opened", "closed"]},
+			"labels": {"type": "array", "items": {"$ref": "#/$defs/label"}, "maxItems": 2},
+			"sender": {"type": "object", "additionalProperties": false, "properties": {"login": {"type": "string"}}}
+		},
+		"$defs": {"label": {"type": "string", "pattern": "^[a-z]+$"}}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		doc  string
+		want []string
+	}{
+		{`{"id": 3, "action": "opened", "labels": ["bug"], "sender": {"login": "octocat"}}`, nil},
+		{`{"id": 2.0, "action": "closed"}`, nil},
+		{`{"id": 0, "action": "merged"}`, []string{
+			"$.action: value is not one of the allowed values",
+			"$.id: less than the minimum 1",
+		}},
+		{`{"action": "opened", "labels": ["Bug", 4, "ok"]}`, []string{
+			`$: missing required property "id"`,
+			"$.labels: more than 2 items",
+			`$.labels[0]: does not match pattern "^[a-z]+$"`,
+			"$.labels[1]: expected string, got integer",
+		}},
+		{`{"id": 1.5, "action": "opened", "sender": {"login": "x", "site-admin": true}}`, []string{
+			"$.id: expected integer, got number",
+			`$.sender: unexpected property "site-admin"`,
+		}},
+		{`[1, 2]`, []string{"$: expected object, got array"}},
+	}
+	for _, tt := range tests {
+		if got := schema.validate(json.RawMessage(tt.doc)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: expected %q, got %q", tt.doc, tt.want, got)
+		}
+	}
+}
+
+func TestJSONSchemaCombinators(t *testing.T) {
+	schema, err := compileJSONSchema(json.RawMessage(`{
+		"oneOf": [{"type": "string", "maxLength": 3}, {"type": "number", "multipleOf": 5}],
+		"not": {"const": "bad"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for doc, valid := range map[string]bool{
+		`"abc"`: true, `15`: true, `"abcd"`: false, `7`: false, `"bad"`: false, `null`: false,
+	} {
+		if got := schema.validate(json.RawMessage(doc)) == nil; got != valid {
+			t.Errorf("%s: expected valid=%v", doc, valid)
+		}
+	}
+}
+
+func TestCompileJSONSchemaErrors(t *testing.T) {
+	for _, raw := range []string{
+		`{"type": "text"}`,
+		`{"properties": {"name": {"pattern": "("}}}`,
+		`{"$ref": "#/definitions/missing"}`,
+		`{"$ref": "https://example.com/schema.json"}`,
+		`[]`,
+		`{`,
+	} {
+		if _, err := compileJSONSchema(json.RawMessage(raw)); err == nil {
+			t.Errorf("Expected %s to be rejected", raw)
+		}
+	}
+}
+
+func TestCaptureSchemaValidation(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	putReq := httptest.NewRequest(http.MethodPut, "/api/bin/"+bin.BinID+"/config",
+		strings.NewReader(`{"schema": {"type": "object", "required": ["id"]}}`))
+	putW := httptest.NewRecorder()
+	binAPIHandler(putW, putReq)
+	if putW.Code != http.StatusOK {
+		t.Fatalf("Expected 200 setting the schema, got %d", putW.Code)
+	}
+
+	for _, body := range []string{`{"id": 1}`, `{"name": "x"}`, `not json`} {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?valid=false", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 invalid requests, got %d", len(reqs))
+	}
+	if reqs[0].Valid == nil || *reqs[0].Valid ||
+		!reflect.DeepEqual(reqs[0].ValidationErrors, []string{`$: missing required property "id"`}) {
+		t.Errorf("Unexpected validation result %v %q", reqs[0].Valid, reqs[0].ValidationErrors)
+	}
+	if reqs[1].RawBody != "not json" || len(reqs[1].ValidationErrors) != 1 {
+		t.Errorf("Expected the non-JSON body to fail validation, got %q", reqs[1].ValidationErrors)
+	}
+
+	badReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?valid=maybe", nil)
+	badW := httptest.NewRecorder()
+	listRequestsHandler(badW, badReq)
+	if badW.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for valid=maybe, got %d", badW.Code)
+	}
+}
@@ -0,0 +1,43 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestJWTClaims(t *testing.T) {
+	clearDB(t)
+
+	enc := base64.RawURLEncoding.EncodeToString
+	token := enc([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + enc([]byte(`{"sub":"user-1","iss":"provider"}`)) + ".sig"
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil)
+	captureReq.Header.Set("Authorization", "Bearer "+token)
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var got struct {
+		JWTHeader map[string]string `json:"jwtHeader"`
+		JWTClaims map[string]string `json:"jwtClaims"`
+	}
+	json.NewDecoder(getW.Body).Decode(&got)
+	if got.JWTHeader["alg"] != "HS256" || got.JWTClaims["sub"] != "user-1" {
+		t.Errorf("Expected the token to be decoded, got header %v claims %v", got.JWTHeader, got.JWTClaims)
+	}
+
+	for _, auth := range []string{"", "Basic dXNlcjpwYXNz", "Bearer opaque-token", "Bearer a.b.c"} {
+		if header, claims := decodeJWT(auth); header != nil || claims != nil {
+			t.Errorf("%q: expected no JWT, got %s %s", auth, header, claims)
+		}
+	}
+}
@@ -0,0 +1,544 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global Kafka sink settings; overridable with command-line flags. When
+// kafkaBrokers is set every capture, in any bin, is published.
+var (
+	kafkaBrokers string
+	kafkaTopic   = defaultKafkaTopic
+)
+
+const (
+	defaultKafkaTopic = "postbin"
+	kafkaClientID     = "postbin"
+	kafkaTimeout      = 10 * time.Second
+)
+
+// KafkaSinkConfig publishes each of a bin's captures to a Kafka topic as
+// JSON, keyed by bin ID so a bin's captures stay in order on one partition.
+// Topic may contain {binId}.
+type KafkaSinkConfig struct {
+	Brokers []string `json:"brokers"`
+	Topic   string   `json:"topic,omitempty"`
+}
+
+func (c KafkaSinkConfig) validate() string {
+	if len(c.Brokers) == 0 {
+		return "kafka needs brokers"
+	}
+	for _, b := range c.Brokers {
+		if _, _, err := net.SplitHostPort(b); err != nil {
+			return fmt.Sprintf("kafka broker %q must be host:port", b)
+		}
+	}
+	if c.Topic != "" && !validKafkaTopic(expandKafkaTopic(c.Topic, "bin")) {
+		return "kafka topic may only use letters, digits, '.', '_', '-' and {binId}"
+	}
+	return ""
+}
+
+func validKafkaTopic(topic string) bool {
+	if topic == "" || len(topic) > 249 {
+		return false
+	}
+	for _, c := range topic {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-') {
+			return false
+		}
+	}
+	return true
+}
+
+func expandKafkaTopic(template, binID string) string {
+	if template == "" {
+		template = defaultKafkaTopic
+	}
+	return strings.ReplaceAll(template, "{binId}", binID)
+}
+
+// globalKafkaSink is the sink configured with --kafka-brokers, if any
+func globalKafkaSink() *KafkaSinkConfig {
+	if kafkaBrokers == "" {
+		return nil
+	}
+	return &KafkaSinkConfig{Brokers: strings.Split(kafkaBrokers, ","), Topic: kafkaTopic}
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "kafka",
+		global: func() Sink {
+			if sink := globalKafkaSink(); sink != nil {
+				return *sink
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.Kafka != nil {
+				return *c.Kafka
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver publishes a capture as one record keyed by its bin ID. The
+// producer has its own timeouts.
+func (c KafkaSinkConfig) Deliver(_ context.Context, req *Request) error {
+	value, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return kafkaProducerFor(c.Brokers).produce(expandKafkaTopic(c.Topic, req.BinID), []byte(req.BinID), value,
+		map[string]string{"reqId": req.ReqID}, time.UnixMilli(req.Inserted))
+}
+
+var (
+	kafkaProducersMu sync.Mutex
+	kafkaProducers   = map[string]*kafkaProducer{}
+)
+
+// kafkaProducerFor returns the shared producer for a set of brokers
+func kafkaProducerFor(brokers []string) *kafkaProducer {
+	key := strings.Join(brokers, ",")
+	kafkaProducersMu.Lock()
+	defer kafkaProducersMu.Unlock()
+	p := kafkaProducers[key]
+	if p == nil {
+		p = &kafkaProducer{bootstrap: brokers, conns: map[string]*kafkaConn{}, topics: map[string][]string{}}
+		kafkaProducers[key] = p
+	}
+	return p
+}
+
+// kafkaProducer is a minimal Kafka client: just enough of the wire protocol
+// (Metadata v4 and Produce v3 with uncompressed v2 record batches) to
+// publish single records with acks=1, which every broker from 0.11 on
+// understands.
+type kafkaProducer struct {
+	bootstrap []string
+
+	mu    sync.Mutex
+	conns map[string]*kafkaConn
+	// topics maps each topic to the leader address of each partition
+	topics map[string][]string
+}
+
+// produce publishes one record, picking its partition from the key the way
+// the Java client's default partitioner does. Stale metadata is refreshed
+// and the send retried once.
+func (p *kafkaProducer) produce(topic string, key, value []byte, headers map[string]string, ts time.Time) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var leaders []string
+		if leaders, err = p.partitions(topic, attempt > 0); err != nil {
+			continue
+		}
+		partition := int32(kafkaMurmur2(key)&0x7fffffff) % int32(len(leaders))
+		if leaders[partition] == "" {
+			err = fmt.Errorf("kafka: partition %d of %s has no leader", partition, topic)
+			continue
+		}
+		batch := kafkaRecordBatch(key, value, headers, ts)
+		if err = p.send(leaders[partition], topic, partition, batch); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// partitions returns the leader of each of topic's partitions, from cache
+// unless refresh is set
+func (p *kafkaProducer) partitions(topic string, refresh bool) ([]string, error) {
+	p.mu.Lock()
+	leaders := p.topics[topic]
+	p.mu.Unlock()
+	if leaders != nil && !refresh {
+		return leaders, nil
+	}
+
+	var err error
+	for _, addr := range p.bootstrap {
+		var resp []byte
+		resp, err = p.roundTrip(addr, 3, 4, func(e *kafkaEncoder) {
+			e.int32(1)
+			e.string(topic)
+			e.bool(true) // allow_auto_topic_creation
+		})
+		if err != nil {
+			continue
+		}
+		if leaders, err = parseKafkaMetadata(resp, topic); err == nil {
+			p.mu.Lock()
+			p.topics[topic] = leaders
+			p.mu.Unlock()
+			return leaders, nil
+		}
+	}
+	return nil, err
+}
+
+func parseKafkaMetadata(resp []byte, topic string) ([]string, error) {
+	d := &kafkaDecoder{b: resp}
+	d.int32() // throttle_time_ms
+	brokers := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string() // rack
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.string() // cluster_id
+	d.int32()  // controller_id
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, name := d.int16(), d.string()
+		d.bool() // is_internal
+		var leaders []string
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int16() // partition error_code
+			index, leader := d.int32(), d.int32()
+			d.int32Array() // replica_nodes
+			d.int32Array() // isr_nodes
+			for int(index) >= len(leaders) {
+				leaders = append(leaders, "")
+			}
+			leaders[index] = brokers[leader]
+		}
+		if d.err != nil {
+			break
+		}
+		if name != topic {
+			continue
+		}
+		if code != 0 {
+			return nil, kafkaError(code)
+		}
+		if len(leaders) == 0 {
+			return nil, fmt.Errorf("kafka: topic %s has no partitions", topic)
+		}
+		return leaders, nil
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return nil, fmt.Errorf("kafka: no metadata for topic %s", topic)
+}
+
+func (p *kafkaProducer) send(addr, topic string, partition int32, batch []byte) error {
+	resp, err := p.roundTrip(addr, 0, 3, func(e *kafkaEncoder) {
+		e.int16(-1) // transactional_id
+		e.int16(1)  // acks
+		e.int32(int32(kafkaTimeout / time.Millisecond))
+		e.int32(1)
+		e.string(topic)
+		e.int32(1)
+		e.int32(partition)
+		e.bytes(batch)
+	})
+	if err != nil {
+		return err
+	}
+
+	d := &kafkaDecoder{b: resp}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int32()
+			if code := d.int16(); code != 0 && d.err == nil {
+				return kafkaError(code)
+			}
+			d.int64() // base_offset
+			d.int64() // log_append_time
+		}
+	}
+	return d.err
+}
+
+// roundTrip sends one request to addr and returns the response body after
+// its correlation ID. A connection that fails is dropped.
+func (p *kafkaProducer) roundTrip(addr string, apiKey, apiVersion int16, body func(*kafkaEncoder)) ([]byte, error) {
+	p.mu.Lock()
+	conn := p.conns[addr]
+	if conn == nil {
+		conn = &kafkaConn{addr: addr}
+		p.conns[addr] = conn
+	}
+	p.mu.Unlock()
+
+	resp, err := conn.roundTrip(apiKey, apiVersion, body)
+	if err != nil {
+		conn.close()
+	}
+	return resp, err
+}
+
+// kafkaConn is one broker connection. Requests on it are serialised.
+type kafkaConn struct {
+	addr string
+
+	mu          sync.Mutex
+	conn        net.Conn
+	rd          *bufio.Reader
+	correlation int32
+}
+
+func (c *kafkaConn) roundTrip(apiKey, apiVersion int16, body func(*kafkaEncoder)) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		conn, err := net.DialTimeout("tcp", c.addr, kafkaTimeout)
+		if err != nil {
+			return nil, err
+		}
+		c.conn, c.rd = conn, bufio.NewReader(conn)
+	}
+	c.correlation++
+
+	e := &kafkaEncoder{}
+	e.int32(0) // size, filled in below
+	e.int16(apiKey)
+	e.int16(apiVersion)
+	e.int32(c.correlation)
+	e.string(kafkaClientID)
+	body(e)
+	msg := e.buf.Bytes()
+	binary.BigEndian.PutUint32(msg, uint32(len(msg)-4))
+
+	c.conn.SetDeadline(time.Now().Add(kafkaTimeout))
+	if _, err := c.conn.Write(msg); err != nil {
+		return nil, err
+	}
+	var size int32
+	if err := binary.Read(c.rd, binary.BigEndian, &size); err != nil {
+		return nil, err
+	}
+	if size < 4 {
+		return nil, errors.New("kafka: short response")
+	}
+	resp := make([]byte, size)
+	if _, err := io.ReadFull(c.rd, resp); err != nil {
+		return nil, err
+	}
+	if int32(binary.BigEndian.Uint32(resp)) != c.correlation {
+		return nil, errors.New("kafka: response out of order")
+	}
+	return resp[4:], nil
+}
+
+func (c *kafkaConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+}
+
+// kafkaRecordBatch encodes a v2 record batch holding a single record
+func kafkaRecordBatch(key, value []byte, headers map[string]string, ts time.Time) []byte {
+	rec := &kafkaEncoder{}
+	rec.buf.WriteByte(0) // attributes
+	rec.varint(0)        // timestamp delta
+	rec.varint(0)        // offset delta
+	rec.varbytes(key)
+	rec.varbytes(value)
+	rec.varint(int64(len(headers)))
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rec.varbytes([]byte(name))
+		rec.varbytes([]byte(headers[name]))
+	}
+
+	// Everything from attributes on is covered by the CRC
+	tail := &kafkaEncoder{}
+	tail.int16(0) // attributes: no compression, create time
+	tail.int32(0) // last offset delta
+	tail.int64(ts.UnixMilli())
+	tail.int64(ts.UnixMilli())
+	tail.int64(-1) // producer_id
+	tail.int16(-1) // producer_epoch
+	tail.int32(-1) // base_sequence
+	tail.int32(1)
+	tail.varint(int64(rec.buf.Len()))
+	tail.buf.Write(rec.buf.Bytes())
+
+	batch := &kafkaEncoder{}
+	batch.int64(0)                                 // base offset
+	batch.int32(int32(4 + 1 + 4 + tail.buf.Len())) // batch length
+	batch.int32(-1)                                // partition leader epoch
+	batch.buf.WriteByte(2)                         // magic
+	batch.int32(int32(crc32.Checksum(tail.buf.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf.Write(tail.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+// kafkaMurmur2 is the hash the Java client partitions keys with
+func kafkaMurmur2(data []byte) uint32 {
+	const m, r = 0x5bd1e995, 24
+	h := uint32(0x9747b28c) ^ uint32(len(data))
+	for len(data) >= 4 {
+		k := binary.LittleEndian.Uint32(data)
+		k *= m
+		k ^= k >> r
+		k *= m
+		h = h*m ^ k
+		data = data[4:]
+	}
+	switch len(data) {
+	case 3:
+		h ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		h ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		h ^= uint32(data[0])
+		h *= m
+	}
+	h ^= h >> 13
+	h *= m
+	h ^= h >> 15
+	return h
+}
+
+type kafkaError int16
+
+func (e kafkaError) Error() string {
+	switch e {
+	case 3:
+		return "kafka: unknown topic or partition"
+	case 6:
+		return "kafka: not leader for partition"
+	case 10:
+		return "kafka: message too large"
+	case 17:
+		return "kafka: invalid topic"
+	case 29:
+		return "kafka: topic authorization failed"
+	}
+	return fmt.Sprintf("kafka: error code %d", int16(e))
+}
+
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int16(v int16) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(&e.buf, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *kafkaEncoder) string(s string) {
+	e.int16(int16(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *kafkaEncoder) bytes(b []byte) {
+	e.int32(int32(len(b)))
+	e.buf.Write(b)
+}
+
+// varint writes a zig-zag encoded variable-length integer
+func (e *kafkaEncoder) varint(v int64) {
+	var tmp [binary.MaxVarintLen64]byte
+	e.buf.Write(tmp[:binary.PutVarint(tmp[:], v)])
+}
+
+// varbytes writes b with a varint length; nil is written as null
+func (e *kafkaEncoder) varbytes(b []byte) {
+	if b == nil {
+		e.varint(-1)
+		return
+	}
+	e.varint(int64(len(b)))
+	e.buf.Write(b)
+}
+
+// kafkaDecoder reads big-endian fields, remembering the first error so a
+// whole response can be read before checking.
+type kafkaDecoder struct {
+	b   []byte
+	err error
+}
+
+func (d *kafkaDecoder) take(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(d.b) {
+		d.err = errors.New("kafka: truncated response")
+		return nil
+	}
+	out := d.b[:n]
+	d.b = d.b[n:]
+	return out
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.take(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.take(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.take(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) bool() bool {
+	b := d.take(1)
+	return b != nil && b[0] != 0
+}
+
+// string reads a possibly null string; null comes back empty
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.take(int(n)))
+}
+
+func (d *kafkaDecoder) int32Array() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
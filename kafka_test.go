@@ -0,0 +1,225 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// kafkaRecord is a record as the fake broker received it
+type kafkaRecord struct {
+	topic     string
+	partition int32
+	key       string
+	value     []byte
+	headers   map[string]string
+}
+
+// fakeKafkaBroker answers Metadata and Produce requests on a local port,
+// claiming to lead every partition of every topic, and passes on each
+// record it's sent.
+func fakeKafkaBroker(t *testing.T, partitions int) (addr string, records <-chan kafkaRecord) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	host, portStr, _ := net.SplitHostPort(ln.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	out := make(chan kafkaRecord, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				rd := bufio.NewReader(conn)
+				for {
+					var size int32
+					if binary.Read(rd, binary.BigEndian, &size) != nil {
+						return
+					}
+					msg := make([]byte, size)
+					if _, err := io.ReadFull(rd, msg); err != nil {
+						return
+					}
+					d := &kafkaDecoder{b: msg}
+					apiKey, version, correlation := d.int16(), d.int16(), d.int32()
+					d.string()
+
+					e := &kafkaEncoder{}
+					e.int32(correlation)
+					switch {
+					case apiKey == 3 && version == 4:
+						d.int32()
+						topic := d.string()
+						e.int32(0)
+						e.int32(1)
+						e.int32(7)
+						e.string(host)
+						e.int32(int32(port))
+						e.int16(-1)
+						e.int16(-1)
+						e.int32(7)
+						e.int32(1)
+						e.int16(0)
+						e.string(topic)
+						e.bool(false)
+						e.int32(int32(partitions))
+						for i := 0; i < partitions; i++ {
+							e.int16(0)
+							e.int32(int32(i))
+							e.int32(7)
+							e.int32(0)
+							e.int32(0)
+						}
+					case apiKey == 0 && version == 3:
+						d.int16()
+						if acks := d.int16(); acks != 1 {
+							t.Errorf("Expected acks=1, got %d", acks)
+						}
+						d.int32()
+						d.int32()
+						topic := d.string()
+						d.int32()
+						partition := d.int32()
+						batch := d.take(int(d.int32()))
+						rec := parseTestRecordBatch(t, batch)
+						rec.topic, rec.partition = topic, partition
+						out <- rec
+
+						e.int32(1)
+						e.string(topic)
+						e.int32(1)
+						e.int32(partition)
+						e.int16(0)
+						e.int64(0)
+						e.int64(-1)
+						e.int32(0)
+					default:
+						t.Errorf("Unexpected request %d v%d", apiKey, version)
+						return
+					}
+					resp := e.buf.Bytes()
+					binary.Write(conn, binary.BigEndian, int32(len(resp)))
+					conn.Write(resp)
+				}
+			}()
+		}
+	}()
+	return ln.Addr().String(), out
+}
+
+func parseTestRecordBatch(t *testing.T, batch []byte) kafkaRecord {
+	d := &kafkaDecoder{b: batch}
+	d.int64()
+	if length := d.int32(); int(length) != len(batch)-12 {
+		t.Errorf("Batch length %d doesn't match %d", length, len(batch)-12)
+	}
+	d.int32()
+	if magic := d.take(1); magic[0] != 2 {
+		t.Errorf("Expected magic 2, got %d", magic[0])
+	}
+	crc := uint32(d.int32())
+	if want := crc32.Checksum(d.b, crc32.MakeTable(crc32.Castagnoli)); crc != want {
+		t.Errorf("Bad batch CRC %x, want %x", crc, want)
+	}
+	d.take(2 + 4 + 8 + 8 + 8 + 2 + 4)
+	if n := d.int32(); n != 1 {
+		t.Fatalf("Expected one record, got %d", n)
+	}
+
+	r := bytes.NewReader(d.b)
+	varint := func() int64 { v, _ := binary.ReadVarint(r); return v }
+	varbytes := func() []byte {
+		b := make([]byte, varint())
+		io.ReadFull(r, b)
+		return b
+	}
+	varint()
+	r.ReadByte()
+	varint()
+	varint()
+	rec := kafkaRecord{key: string(varbytes()), value: varbytes(), headers: map[string]string{}}
+	for n := varint(); n > 0; n-- {
+		name := string(varbytes())
+		rec.headers[name] = string(varbytes())
+	}
+	return rec
+}
+
+func TestKafkaMurmur2(t *testing.T) {
+	// Reference values from the Java client's own tests
+	for in, want := range map[string]int32{
+		"21":                         -973932308,
+		"foobar":                     -790332482,
+		"a-little-bit-long-string":   -985981536,
+		"a-little-bit-longer-string": -1486304829,
+		"lkjh234lh9fiuh90y23oiuhsafujhadof229phr9h19h89h8": -58897971,
+		"abc": 479470107,
+	} {
+		if got := int32(kafkaMurmur2([]byte(in))); got != want {
+			t.Errorf("murmur2(%q) = %d, want %d", in, got, want)
+		}
+	}
+}
+
+func TestKafkaSink(t *testing.T) {
+	clearDB(t)
+	addr, records := fakeKafkaBroker(t, 3)
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"kafka": {"brokers": ["`+addr+`"], "topic": "hooks.{binId}"}}`)
+	w := httptest.NewRecorder()
+	capture := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/a", strings.NewReader(`{"id": 1}`))
+	capture.Header.Set("Content-Type", "application/json")
+	captureRequestHandler(w, capture)
+
+	select {
+	case rec := <-records:
+		var req Request
+		if err := json.Unmarshal(rec.value, &req); err != nil {
+			t.Fatalf("Expected a JSON capture, got %q", rec.value)
+		}
+		want := int32(kafkaMurmur2([]byte(bin.BinID))&0x7fffffff) % 3
+		if rec.topic != "hooks."+bin.BinID || rec.key != bin.BinID || rec.partition != want ||
+			rec.headers["reqId"] != w.Body.String() {
+			t.Errorf("Unexpected record %+v", rec)
+		}
+		if req.ReqID != w.Body.String() || req.SubPath != "/a" || req.RawBody != `{"id": 1}` {
+			t.Errorf("Unexpected capture %+v", req)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the Kafka record")
+	}
+}
+
+func TestKafkaSinkValidation(t *testing.T) {
+	for _, cfg := range []KafkaSinkConfig{
+		{},
+		{Brokers: []string{"localhost"}},
+		{Brokers: []string{"localhost:9092"}, Topic: "bad topic"},
+	} {
+		if (BinConfig{Kafka: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+	if msg := (BinConfig{Kafka: &KafkaSinkConfig{Brokers: []string{"k:9092"}, Topic: "a.{binId}"}}).validate(); msg != "" {
+		t.Errorf("Expected a templated topic to be accepted, got %q", msg)
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Visibility timeout bounds for leased requests
+const (
+	defaultLeaseTTL = 30 * time.Second
+	maxLeaseTTL     = 12 * time.Hour
+)
+
+// leaseRequestHandler hands out the oldest visible request and hides it from
+// other consumers for the lease TTL. The consumer acks it to delete it, or
+// nacks it (or simply lets the lease lapse) to make it visible again.
+func leaseRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/req/lease")]
+
+	ttl, err := parseDurationParam(r.URL.Query().Get("ttl"), defaultLeaseTTL, maxLeaseTTL)
+	if err != nil || ttl == 0 {
+		http.Error(w, `{"msg":"Invalid ttl"}`, http.StatusBadRequest)
+		return
+	}
+	key, ok := readBinKey(w, r, binID)
+	if !ok {
+		return
+	}
+
+	var req Request
+	if group := r.URL.Query().Get("group"); group != "" {
+		if !groupName.MatchString(group) {
+			http.Error(w, `{"msg":"Invalid group"}`, http.StatusBadRequest)
+			return
+		}
+		if refuseLocalFeature(w, "Consumer groups") {
+			return
+		}
+		req, err = groupLease(r.Context(), binID, group, ttl)
+	} else {
+		req, err = store.LeaseRequest(r.Context(), binID, time.Now().Add(ttl).UnixMilli())
+	}
+	if err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No requests in this bin"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !key.open(w, &req) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+// leasePath splits /api/bin/{binId}/req/{reqId}/{action} into its IDs.
+func leasePath(path string) (binID, reqID string) {
+	parts := strings.Split(path[len("/api/bin/"):], "/")
+	return parts[0], parts[2]
+}
+
+func ackRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID, reqID := leasePath(r.URL.Path)
+	if group := r.URL.Query().Get("group"); group != "" {
+		if !refuseLocalFeature(w, "Consumer groups") {
+			settleLease(w, settleGroupLease(r.Context(), binID, reqID, group, false), "Request Acked")
+		}
+		return
+	}
+	settleLease(w, store.SettleLease(r.Context(), binID, reqID, false), "Request Acked")
+}
+
+func nackRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID, reqID := leasePath(r.URL.Path)
+	if group := r.URL.Query().Get("group"); group != "" {
+		if !refuseLocalFeature(w, "Consumer groups") {
+			settleLease(w, settleGroupLease(r.Context(), binID, reqID, group, true), "Request Released")
+		}
+		return
+	}
+	settleLease(w, store.SettleLease(r.Context(), binID, reqID, true), "Request Released")
+}
+
+// settleLease reports how settling a lease went. Once a lease has lapsed the
+// request may already belong to another consumer, so settling it is refused
+// with 409.
+func settleLease(w http.ResponseWriter, err error, msg string) {
+	switch err {
+	case nil:
+	case sql.ErrNoRows:
+		http.Error(w, `{"msg":"Request not found"}`, http.StatusNotFound)
+		return
+	case errLeaseLapsed:
+		http.Error(w, `{"msg":"Request is not leased or the lease has expired"}`, http.StatusConflict)
+		return
+	default:
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"msg":%q}`, msg)
+}
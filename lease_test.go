@@ -0,0 +1,114 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLeaseAndAck(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	for _, body := range []string{"first", "second"} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	leaseReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/lease?ttl=60s", nil)
+	leaseW := httptest.NewRecorder()
+	binAPIHandler(leaseW, leaseReq)
+
+	if leaseW.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, leaseW.Code)
+	}
+	var leased Request
+	if err := json.NewDecoder(leaseW.Body).Decode(&leased); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if leased.Body != "first" {
+		t.Errorf("Expected body %q, got %v", "first", leased.Body)
+	}
+	if leased.LeasedUntil <= time.Now().UnixMilli() {
+		t.Errorf("Expected leasedUntil in the future, got %d", leased.LeasedUntil)
+	}
+
+	// The leased request is hidden from other consumers
+	shiftReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift", nil)
+	shiftW := httptest.NewRecorder()
+	binAPIHandler(shiftW, shiftReq)
+	var shifted Request
+	json.NewDecoder(shiftW.Body).Decode(&shifted)
+	if shifted.Body != "second" {
+		t.Errorf("Expected shift to skip the leased request, got %v", shifted.Body)
+	}
+
+	ackReq := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/req/"+leased.ReqID+"/ack", nil)
+	ackW := httptest.NewRecorder()
+	binAPIHandler(ackW, ackReq)
+	if ackW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, ackW.Code)
+	}
+
+	// Acking again finds nothing
+	ackW = httptest.NewRecorder()
+	binAPIHandler(ackW, ackReq)
+	if ackW.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, ackW.Code)
+	}
+}
+
+func TestLeaseExpiryAndNack(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("retry me"))
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	lease := func(ttl string) (Request, int) {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/lease?ttl="+ttl, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		var leased Request
+		json.NewDecoder(w.Body).Decode(&leased)
+		return leased, w.Code
+	}
+
+	// A lapsed lease makes the request visible again, and the old holder can't ack it
+	first, _ := lease("10ms")
+	time.Sleep(20 * time.Millisecond)
+
+	ackReq := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/req/"+first.ReqID+"/ack", nil)
+	ackW := httptest.NewRecorder()
+	binAPIHandler(ackW, ackReq)
+	if ackW.Code != http.StatusConflict {
+		t.Errorf("Expected status code %d for a lapsed lease, got %d", http.StatusConflict, ackW.Code)
+	}
+
+	second, code := lease("60s")
+	if code != http.StatusOK || second.ReqID != first.ReqID {
+		t.Fatalf("Expected the request to reappear after its lease lapsed, got status %d", code)
+	}
+
+	// While leased, nothing else is available
+	if _, code := lease("60s"); code != http.StatusNotFound {
+		t.Errorf("Expected status code %d while leased, got %d", http.StatusNotFound, code)
+	}
+
+	// A nack releases it immediately
+	nackReq := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/req/"+second.ReqID+"/nack", nil)
+	nackW := httptest.NewRecorder()
+	binAPIHandler(nackW, nackReq)
+	if nackW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, nackW.Code)
+	}
+	if _, code := lease("60s"); code != http.StatusOK {
+		t.Errorf("Expected the request to be leasable after a nack, got %d", code)
+	}
+}
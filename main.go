@@ -1,67 +1,325 @@
 package main
 
 import (
-	"crypto/rand"
+	"context"
+	"crypto/tls"
 	"database/sql"
-	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Bin struct {
-	BinID   string `json:"binId"`
-	Now     int64  `json:"now"`
-	Expires int64  `json:"expires"`
+	BinID      string `json:"binId"`
+	Now        int64  `json:"now"`
+	Expires    int64  `json:"expires"`
+	MaxEntries int    `json:"maxEntries,omitempty"`
 }
 
 // Create a response struct that includes the count
 type BinResponse struct {
-	BinID   string `json:"binId"`
-	Now     int64  `json:"now"`
-	Expires int64  `json:"expires"`
-	Entries int    `json:"entries"`
+	BinID      string `json:"binId"`
+	Now        int64  `json:"now"`
+	Expires    int64  `json:"expires"`
+	Entries    int    `json:"entries"`
+	MaxEntries int    `json:"maxEntries,omitempty"`
 }
 
 type Request struct {
 	Method   string            `json:"method"`
 	Path     string            `json:"path"`
-	Headers  map[string]string `json:"headers"`
+	SubPath  string            `json:"subPath"`
+	Headers  http.Header       `json:"headers"`
 	Query    map[string]string `json:"query"`
 	Body     interface{}       `json:"body"`
+	RawBody  string            `json:"rawBody"`
 	IP       string            `json:"ip"`
 	BinID    string            `json:"binId"`
 	ReqID    string            `json:"reqId"`
 	Inserted int64             `json:"inserted"`
+
+	// Connection details, for debugging proxies and protocol issues.
+	// ContentLength is -1 when the sender didn't declare one. Hops is the
+	// forwarding chain, client first and ending with the connecting peer,
+	// when the request carried forwarding headers.
+	Host          string   `json:"host"`
+	Proto         string   `json:"proto"`
+	ContentLength int64    `json:"contentLength"`
+	TLS           *TLSInfo `json:"tls,omitempty"`
+	Hops          []string `json:"hops,omitempty"`
+
+	// ReceivedAt is when the handler started, in Unix nanoseconds, and
+	// ReadDurationMs how long reading the body took
+	ReceivedAt     int64   `json:"receivedAt"`
+	ReadDurationMs float64 `json:"readDurationMs"`
+
+	// LeasedUntil is set while a consumer holds a lease on the request
+	LeasedUntil int64 `json:"leasedUntil,omitempty"`
+
+	// Truncated is set when the body was cut at --max-body-bytes
+	Truncated bool `json:"truncated,omitempty"`
+
+	// Bodies over --blob-threshold are kept in the blob store and served from
+	// /req/{reqId}/body; Body is then null
+	BodyOffloaded bool  `json:"bodyOffloaded,omitempty"`
+	BodySize      int64 `json:"bodySize,omitempty"`
+	blobKey       string
+
+	// rawHead is the start line and headers in wire format, for /raw
+	rawHead string
+	// parts of a multipart body, stored alongside the request on capture
+	parts []bodyPart
+
+	// SignatureValid is set when the bin checks webhook signatures, unless the
+	// body was offloaded before it could be checked
+	SignatureValid *bool `json:"signatureValid,omitempty"`
+	// Valid is set when the bin has a JSON Schema, with ValidationErrors
+	// listing how the body breaks it
+	Valid            *bool    `json:"valid,omitempty"`
+	ValidationErrors []string `json:"validationErrors,omitempty"`
+
+	// Response is the upstream's reply when the bin proxies its captures
+	Response *UpstreamResponse `json:"response,omitempty"`
+
+	// UserAgent classifies the User-Agent header at capture time
+	UserAgent *UserAgent `json:"userAgent,omitempty"`
+
+	// JWTHeader and JWTClaims are decoded, unverified, from a bearer token in
+	// the Authorization header
+	JWTHeader json.RawMessage `json:"jwtHeader,omitempty"`
+	JWTClaims json.RawMessage `json:"jwtClaims,omitempty"`
+
+	// DecodedFrom is the Content-Encoding removed from the body before it was
+	// stored; the body as sent is kept in encodedBody
+	DecodedFrom string `json:"decodedFrom,omitempty"`
+	encodedBody []byte
+
+	// Encrypted is set while RawBody holds the bin's sealed box, base64
+	// encoded, rather than the body
+	Encrypted bool `json:"encrypted,omitempty"`
+}
+
+// TLSInfo describes the TLS connection a request arrived on
+type TLSInfo struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipherSuite"`
+	ServerName  string `json:"serverName,omitempty"`
+}
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// newTLSInfo summarises a connection state, returning nil for plain HTTP.
+func newTLSInfo(state *tls.ConnectionState) *TLSInfo {
+	if state == nil {
+		return nil
+	}
+	version, ok := tlsVersions[state.Version]
+	if !ok {
+		version = fmt.Sprintf("0x%04x", state.Version)
+	}
+	return &TLSInfo{
+		Version:     version,
+		CipherSuite: tls.CipherSuiteName(state.CipherSuite),
+		ServerName:  state.ServerName,
+	}
 }
 
 var db *sql.DB
 
-func generateID() string {
-	bytes := make([]byte, 4)
-	rand.Read(bytes)
-	return hex.EncodeToString(bytes)
+// Bin lifetime settings; overridable with command-line flags
+var (
+	defaultTTL     = 30 * time.Minute
+	maxTTL         = 7 * 24 * time.Hour
+	allowPermanent = false
+)
+
+// Capture body limits; overridable with command-line flags. A maxBodyBytes of
+// zero means bodies of any size are accepted.
+var (
+	maxBodyBytes   int64
+	truncateBodies = false
+)
+
+// neverExpires is stored in bins.expires_at for permanent bins
+const neverExpires = 0
+
+// binExpired reports whether a bin with the given expires_at is past its lifetime.
+func binExpired(expires int64) bool {
+	return expires != neverExpires && time.Now().UnixMilli() > expires
+}
+
+// extendedExpiry is when a bin expiring at expires does once extended by ms,
+// from now if it has already lapsed, but no later than latest. An expiry
+// already past latest is kept rather than brought forward, and permanent
+// bins are left alone.
+func extendedExpiry(expires, now, ms, latest int64) int64 {
+	if expires == neverExpires {
+		return expires
+	}
+	base := expires
+	if base < now {
+		base = now
+	}
+	// Compared this way round, a huge ms can't overflow
+	next := latest
+	if ms < latest-base {
+		next = base + ms
+	}
+	if next < expires {
+		next = expires
+	}
+	return next
+}
+
+// Paging bounds for the request listing endpoint
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// requestColumns lists the requests table columns in the order scanRequest expects them.
+const requestColumns = "method, path, headers, query, body, ip, bin_id, req_id, inserted, leased_until, truncated, blob_key, blob_size, sub_path, host, proto, content_length, tls, hops, received_at, read_duration_ns, raw_head, parsed_body, decoded_from, user_agent, signature_valid, valid, validation_errors, upstream_response, encrypted"
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows.
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRequest reads a single row selected with requestColumns into a Request,
+// decoding the JSON-encoded headers, query and body columns.
+func scanRequest(row rowScanner) (Request, error) {
+	var req Request
+	var headersStr, queryStr, bodyStr, tlsStr, hopsStr, parsedStr, uaStr string
+	var readNs int64
+	var signatureValid, valid sql.NullBool
+	var validationStr, responseStr string
+	err := row.Scan(&req.Method, &req.Path, &headersStr, &queryStr, &bodyStr, &req.IP, &req.BinID,
+		&req.ReqID, &req.Inserted, &req.LeasedUntil, &req.Truncated,
+		&req.blobKey, &req.BodySize, &req.SubPath, &req.Host, &req.Proto, &req.ContentLength, &tlsStr,
+		&hopsStr, &req.ReceivedAt, &readNs, &req.rawHead,
+		&parsedStr, &req.DecodedFrom, &uaStr, &signatureValid, &valid, &validationStr, &responseStr, &req.Encrypted)
+	if err != nil {
+		return req, err
+	}
+
+	if err := json.Unmarshal([]byte(headersStr), &req.Headers); err != nil {
+		// Requests captured by older versions kept a single value per header
+		var single map[string]string
+		if json.Unmarshal([]byte(headersStr), &single) == nil {
+			req.Headers = make(http.Header, len(single))
+			for name, value := range single {
+				req.Headers[name] = []string{value}
+			}
+		}
+	}
+	json.Unmarshal([]byte(queryStr), &req.Query)
+	json.Unmarshal([]byte(bodyStr), &req.RawBody)
+	req.BodyOffloaded = req.blobKey != ""
+	switch {
+	case req.BodyOffloaded:
+		req.Body = nil
+	case parsedStr != "":
+		req.Body = json.RawMessage(parsedStr)
+	default:
+		req.Body = req.RawBody
+	}
+	if tlsStr != "" {
+		json.Unmarshal([]byte(tlsStr), &req.TLS)
+	}
+	if hopsStr != "" {
+		json.Unmarshal([]byte(hopsStr), &req.Hops)
+	}
+	if uaStr != "" {
+		json.Unmarshal([]byte(uaStr), &req.UserAgent)
+	}
+	if signatureValid.Valid {
+		req.SignatureValid = &signatureValid.Bool
+	}
+	if valid.Valid {
+		req.Valid = &valid.Bool
+	}
+	if validationStr != "" {
+		json.Unmarshal([]byte(validationStr), &req.ValidationErrors)
+	}
+	if responseStr != "" {
+		json.Unmarshal([]byte(responseStr), &req.Response)
+	}
+	req.ReadDurationMs = float64(readNs) / float64(time.Millisecond)
+	req.JWTHeader, req.JWTClaims = decodeJWT(req.Headers.Get("Authorization"))
+	return req, nil
 }
 
-func init() {
+// SQLite settings; overridable with command-line flags. WAL lets captures
+// be read while others are written, and writers wait out each other's locks
+// for up to the busy timeout instead of failing with "database is locked".
+var (
+	sqlitePath         = "./postbin.db"
+	sqliteJournalMode  = "WAL"
+	sqliteBusyTimeout  = 5 * time.Second
+	sqliteMaxOpenConns = 8
+)
+
+// openSQLite opens an SQLite database with the configured settings and
+// creates its tables. Transactions take the write lock as they begin, so
+// two of them can't both read and then deadlock upgrading to write. With a
+// key, a file database is encrypted with SQLCipher.
+func openSQLite(path string, foreignKeys bool) (*sql.DB, error) {
+	fk := "off"
+	if foreignKeys {
+		fk = "on"
+	}
+	var conn *sql.DB
 	var err error
-	db, err = sql.Open("sqlite3", "./postbin.db")
+	if sqliteKey != "" && path != ":memory:" {
+		conn, err = openKeyedSQLite(path, fk)
+	} else {
+		conn, err = sql.Open("sqlite3", fmt.Sprintf("%s?_auto_vacuum=incremental&_journal_mode=%s&_busy_timeout=%d&_foreign_keys=%s&_txlock=immediate",
+			path, url.QueryEscape(sqliteJournalMode), sqliteBusyTimeout.Milliseconds(), fk))
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	if path == ":memory:" {
+		// Every connection to :memory: gets a database of its own
+		conn.SetMaxOpenConns(1)
+	} else if sqliteMaxOpenConns > 0 {
+		conn.SetMaxOpenConns(sqliteMaxOpenConns)
+	}
+	if err := initSchema(conn); err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return conn, nil
+}
 
-	// Create tables
-	_, err = db.Exec(`
+// schema is the baseline migration's tables
+const schema = `
         CREATE TABLE IF NOT EXISTS bins (
             bin_id TEXT PRIMARY KEY,
             created_at INTEGER,
-            expires_at INTEGER
+            expires_at INTEGER,
+            max_entries INTEGER NOT NULL DEFAULT 0,
+            config TEXT NOT NULL DEFAULT ''
         );
         CREATE TABLE IF NOT EXISTS requests (
             req_id TEXT PRIMARY KEY,
@@ -73,12 +331,194 @@ func init() {
             body TEXT,
             ip TEXT,
             inserted INTEGER,
-            FOREIGN KEY(bin_id) REFERENCES bins(bin_id)
+            leased_until INTEGER NOT NULL DEFAULT 0,
+            truncated INTEGER NOT NULL DEFAULT 0,
+            blob_key TEXT NOT NULL DEFAULT '',
+            blob_size INTEGER NOT NULL DEFAULT 0,
+            sub_path TEXT NOT NULL DEFAULT '',
+            host TEXT NOT NULL DEFAULT '',
+            proto TEXT NOT NULL DEFAULT '',
+            content_length INTEGER NOT NULL DEFAULT -1,
+            tls TEXT NOT NULL DEFAULT '',
+            hops TEXT NOT NULL DEFAULT '',
+            received_at INTEGER NOT NULL DEFAULT 0,
+            read_duration_ns INTEGER NOT NULL DEFAULT 0,
+            raw_head TEXT NOT NULL DEFAULT '',
+            parsed_body TEXT NOT NULL DEFAULT '',
+            decoded_from TEXT NOT NULL DEFAULT '',
+            encoded_body BLOB NOT NULL DEFAULT x'',
+            user_agent TEXT NOT NULL DEFAULT '',
+            signature_valid INTEGER,
+            valid INTEGER,
+            validation_errors TEXT NOT NULL DEFAULT '',
+            upstream_response TEXT NOT NULL DEFAULT '',
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
         );
-    `)
-	if err != nil {
-		log.Fatal(err)
+        -- Request IDs are ULIDs, so this orders a bin's requests by capture time.
+        -- IDs from older versions are random hex; they stay valid but don't sort.
+        CREATE INDEX IF NOT EXISTS requests_bin_req_id ON requests(bin_id, req_id);
+        -- Listing, counting, shifting and evicting all go by a bin's requests in
+        -- capture order; the rowid that breaks ties comes with the index.
+        CREATE INDEX IF NOT EXISTS requests_bin_inserted ON requests(bin_id, inserted);
+        CREATE TABLE IF NOT EXISTS request_parts (
+            bin_id TEXT,
+            req_id TEXT,
+            idx INTEGER,
+            name TEXT NOT NULL,
+            filename TEXT NOT NULL DEFAULT '',
+            content_type TEXT NOT NULL DEFAULT '',
+            data BLOB,
+            PRIMARY KEY(req_id, idx),
+            FOREIGN KEY(req_id) REFERENCES requests(req_id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS deliveries (
+            delivery_id TEXT PRIMARY KEY,
+            bin_id TEXT NOT NULL,
+            req_id TEXT NOT NULL,
+            target TEXT NOT NULL,
+            url TEXT NOT NULL,
+            status TEXT NOT NULL,
+            status_code INTEGER NOT NULL DEFAULT 0,
+            error TEXT NOT NULL DEFAULT '',
+            kind TEXT NOT NULL DEFAULT 'forward',
+            attempts INTEGER NOT NULL DEFAULT 0,
+            next_attempt_at INTEGER NOT NULL DEFAULT 0,
+            latency_ms REAL NOT NULL DEFAULT 0,
+            response_snippet TEXT NOT NULL DEFAULT '',
+            created_at INTEGER NOT NULL,
+            updated_at INTEGER NOT NULL,
+            FOREIGN KEY(req_id) REFERENCES requests(req_id) ON DELETE CASCADE
+        );
+        CREATE INDEX IF NOT EXISTS deliveries_req_id ON deliveries(req_id);
+        CREATE INDEX IF NOT EXISTS deliveries_bin_status ON deliveries(bin_id, status);
+        CREATE TABLE IF NOT EXISTS replay_jobs (
+            job_id TEXT PRIMARY KEY,
+            bin_id TEXT NOT NULL,
+            options TEXT NOT NULL,
+            filter TEXT NOT NULL DEFAULT '',
+            cron TEXT NOT NULL DEFAULT '',
+            run_at INTEGER NOT NULL DEFAULT 0,
+            only_new INTEGER NOT NULL DEFAULT 0,
+            status TEXT NOT NULL,
+            next_run_at INTEGER NOT NULL DEFAULT 0,
+            last_run_at INTEGER NOT NULL DEFAULT 0,
+            runs INTEGER NOT NULL DEFAULT 0,
+            last_run TEXT NOT NULL DEFAULT '',
+            created_at INTEGER NOT NULL,
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+        CREATE INDEX IF NOT EXISTS replay_jobs_due ON replay_jobs(status, next_run_at);
+        CREATE TABLE IF NOT EXISTS consumer_groups (
+            bin_id TEXT,
+            name TEXT,
+            cursor_inserted INTEGER NOT NULL DEFAULT 0,
+            cursor_rowid INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY(bin_id, name),
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+        CREATE TABLE IF NOT EXISTS group_leases (
+            bin_id TEXT,
+            name TEXT,
+            req_id TEXT,
+            leased_until INTEGER NOT NULL DEFAULT 0,
+            PRIMARY KEY(bin_id, name, req_id),
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+    `
+
+// schemaUpgrades are columns introduced after the original schema but
+// before migrations, added by the baseline migration to databases created by
+// older versions. Columns added since have a migration of their own.
+var schemaUpgrades = []struct {
+	table, column, definition string
+}{
+	{"requests", "leased_until", "INTEGER NOT NULL DEFAULT 0"},
+	{"bins", "max_entries", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "truncated", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "blob_key", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "blob_size", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "sub_path", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "host", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "proto", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "content_length", "INTEGER NOT NULL DEFAULT -1"},
+	{"requests", "tls", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "hops", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "received_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "read_duration_ns", "INTEGER NOT NULL DEFAULT 0"},
+	{"requests", "raw_head", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "parsed_body", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "decoded_from", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "encoded_body", "BLOB NOT NULL DEFAULT x''"},
+	{"requests", "user_agent", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "signature_valid", "INTEGER"},
+	{"bins", "config", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "valid", "INTEGER"},
+	{"requests", "validation_errors", "TEXT NOT NULL DEFAULT ''"},
+	{"requests", "upstream_response", "TEXT NOT NULL DEFAULT ''"},
+	{"deliveries", "attempts", "INTEGER NOT NULL DEFAULT 0"},
+	{"deliveries", "next_attempt_at", "INTEGER NOT NULL DEFAULT 0"},
+	{"deliveries", "kind", "TEXT NOT NULL DEFAULT 'forward'"},
+	{"deliveries", "latency_ms", "REAL NOT NULL DEFAULT 0"},
+	{"deliveries", "response_snippet", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// initSchema migrates the database to this build's schema, then sets up the
+// search index and quota triggers, which depend on how it was built.
+func initSchema(conn *sql.DB) error {
+	if err := sqliteMigrations.run(conn); err != nil {
+		return err
+	}
+	if err := initSearchIndex(conn); err != nil {
+		return err
+	}
+	if err := initQuota(conn); err != nil {
+		return err
+	}
+
+	// Older versions left requests behind when their bin was deleted
+	for _, table := range binDataTables {
+		_, err := conn.Exec("DELETE FROM " + table + " WHERE bin_id NOT IN (SELECT bin_id FROM bins)")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateBinRequest is the optional body accepted by POST /api/bin
+type CreateBinRequest struct {
+	BinID      string `json:"binId"`
+	TTLSeconds int64  `json:"ttlSeconds"`
+	Permanent  bool   `json:"permanent"`
+
+	// MaxEntries caps how many requests the bin keeps; the oldest are evicted
+	// to make room. Zero means unlimited.
+	MaxEntries int `json:"maxEntries"`
+
+	// Config sets the bin's optional capture behaviour, as with PUT /config
+	Config *BinConfig `json:"config"`
+}
+
+// customBinID constrains client-chosen bin IDs to URL-safe characters
+var customBinID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_-]{2,63}$`)
+
+// reservedBinIDs can't be claimed as custom bin IDs because they collide with
+// server routes.
+var reservedBinIDs = map[string]bool{
+	"api":   true,
+	"admin": true,
+}
+
+// validateBinID reports why a client-chosen bin ID is unacceptable, or returns
+// an empty string when it is fine to use.
+func validateBinID(binID string) string {
+	if !customBinID.MatchString(binID) {
+		return "binId must be 3-64 characters of letters, digits, '-' or '_'"
 	}
+	if reservedBinIDs[strings.ToLower(binID)] {
+		return "binId is reserved"
+	}
+	return ""
 }
 
 func createBinHandler(w http.ResponseWriter, r *http.Request) {
@@ -87,23 +527,102 @@ func createBinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	binID := generateID()
-	now := time.Now().UnixMilli()
-	expires := now + (30 * 60 * 1000) // 30 minutes
+	// The body is optional; an empty one means "use the defaults"
+	var opts CreateBinRequest
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && err != io.EOF {
+		http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
 
-	_, err := db.Exec("INSERT INTO bins (bin_id, created_at, expires_at) VALUES (?, ?, ?)",
-		binID, now, expires)
-	if err != nil {
-		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+	ttl := defaultTTL
+	if opts.TTLSeconds < 0 {
+		http.Error(w, `{"msg":"ttlSeconds must be positive"}`, http.StatusBadRequest)
+		return
+	}
+	if opts.TTLSeconds > 0 {
+		ttl = time.Duration(opts.TTLSeconds) * time.Second
+	}
+	if ttl > maxTTL {
+		http.Error(w, fmt.Sprintf(`{"msg":"ttlSeconds may not exceed %d"}`, int64(maxTTL/time.Second)),
+			http.StatusBadRequest)
+		return
+	}
+
+	if opts.Permanent && !allowPermanent {
+		http.Error(w, `{"msg":"Permanent bins are disabled on this server"}`, http.StatusForbidden)
 		return
 	}
+	if opts.Permanent && opts.TTLSeconds != 0 {
+		http.Error(w, `{"msg":"ttlSeconds can't be combined with permanent"}`, http.StatusBadRequest)
+		return
+	}
+
+	if opts.MaxEntries < 0 {
+		http.Error(w, `{"msg":"maxEntries must be positive"}`, http.StatusBadRequest)
+		return
+	}
+
+	var config BinConfig
+	if opts.Config != nil {
+		config = *opts.Config
+		if msg := config.validate(); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"msg":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+		if config.Encryption != nil {
+			if err := config.Encryption.prepare(); err != nil {
+				http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
+	if opts.BinID != "" {
+		if msg := validateBinID(opts.BinID); msg != "" {
+			http.Error(w, fmt.Sprintf(`{"msg":%q}`, msg), http.StatusBadRequest)
+			return
+		}
+	}
+	now := time.Now().UnixMilli()
+	expires := now + ttl.Milliseconds()
+	if opts.Permanent {
+		expires = neverExpires
+	}
+
+	// A generated ID that collides with an existing bin is simply drawn again;
+	// a client-chosen one that's taken is the client's problem
+	var binID string
+	for attempt := 0; ; attempt++ {
+		binID = opts.BinID
+		if binID == "" {
+			binID = generateBinID()
+		}
+		created, err := store.CreateBin(r.Context(), BinRecord{BinID: binID, CreatedAt: now, ExpiresAt: expires,
+			MaxEntries: opts.MaxEntries, Config: config})
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if created {
+			break
+		}
+		if opts.BinID != "" {
+			http.Error(w, `{"msg":"Bin already exists"}`, http.StatusConflict)
+			return
+		}
+		if attempt == maxBinIDAttempts-1 {
+			http.Error(w, `{"msg":"Could not generate a unique bin ID"}`, http.StatusServiceUnavailable)
+			return
+		}
+	}
 
 	// Create response with entries count (will be 0 for new bin)
 	response := BinResponse{
-		BinID:   binID,
-		Now:     now,
-		Expires: expires,
-		Entries: 0,
+		BinID:      binID,
+		Now:        now,
+		Expires:    expires,
+		Entries:    0,
+		MaxEntries: opts.MaxEntries,
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -118,10 +637,7 @@ func getBinHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	binID := r.URL.Path[len("/api/bin/"):]
-	var bin Bin
-	err := db.QueryRow("SELECT bin_id, created_at, expires_at FROM bins WHERE bin_id = ?", binID).
-		Scan(&bin.BinID, &bin.Now, &bin.Expires)
-
+	response, err := loadBinResponse(r.Context(), binID)
 	if err == sql.ErrNoRows {
 		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
 		return
@@ -131,20 +647,79 @@ func getBinHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// loadBinResponse fetches a bin along with its current entry count. It returns
+// sql.ErrNoRows when the bin does not exist.
+func loadBinResponse(ctx context.Context, binID string) (BinResponse, error) {
+	bin, err := store.GetBin(ctx, binID)
+	if err != nil {
+		return BinResponse{}, err
+	}
+
 	// Get the count of entries for this bin
-	var entries int
-	err = db.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", binID).Scan(&entries)
+	entries, err := store.CountRequests(ctx, binID, requestFilter{})
+	if err != nil {
+		return BinResponse{}, err
+	}
+
+	// Create response with entries count
+	return BinResponse{
+		BinID:      bin.BinID,
+		Now:        bin.CreatedAt,
+		Expires:    bin.ExpiresAt,
+		Entries:    entries,
+		MaxEntries: bin.MaxEntries,
+	}, nil
+}
+
+// PatchBinRequest is the body accepted by PATCH /api/bin/{binId}
+type PatchBinRequest struct {
+	ExtendMs int64 `json:"extendMs"`
+}
+
+func patchBinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPatch {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/"):]
+
+	var patch PatchBinRequest
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+		http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if patch.ExtendMs <= 0 {
+		http.Error(w, `{"msg":"extendMs must be positive"}`, http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UnixMilli()
+	if patch.ExtendMs > math.MaxInt64-now {
+		http.Error(w, `{"msg":"extendMs is too large"}`, http.StatusBadRequest)
+		return
+	}
+
+	// Extend from now if the bin has already lapsed, so the extension is never wasted,
+	// but no further than a new bin could be given. Permanent bins are left alone.
+	found, err := store.ExtendBin(r.Context(), binID, patch.ExtendMs, now+maxTTL.Milliseconds())
+	cachedBins.forget(binID)
 	if err != nil {
 		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
 		return
 	}
+	if !found {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	}
 
-	// Create response with entries count
-	response := BinResponse{
-		BinID:   bin.BinID,
-		Now:     bin.Now,
-		Expires: bin.Expires,
-		Entries: entries,
+	response, err := loadBinResponse(r.Context(), binID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -158,7 +733,8 @@ func deleteBinHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	binID := r.URL.Path[len("/api/bin/"):]
-	_, err := db.Exec("DELETE FROM bins WHERE bin_id = ?", binID)
+	err := store.DeleteBin(r.Context(), binID)
+	cachedBins.forget(binID)
 	if err != nil {
 		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
 		return
@@ -169,47 +745,306 @@ func deleteBinHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func captureRequestHandler(w http.ResponseWriter, r *http.Request) {
-	binID := r.URL.Path[1:] // Remove leading slash
+	receivedAt := time.Now()
+
+	// The first path segment names the bin; anything after it is captured as
+	// the sub-path, for senders that insist on their own URL suffix
+	binID, subPath := r.URL.Path[1:], ""
+	if i := strings.Index(binID, "/"); i >= 0 {
+		binID, subPath = binID[:i], binID[i:]
+	}
 
 	// Check if bin exists and not expired
-	var expires int64
-	err := db.QueryRow("SELECT expires_at FROM bins WHERE bin_id = ?", binID).Scan(&expires)
+	bin, err := cachedBins.get(r.Context(), binID)
 	if err == sql.ErrNoRows {
 		http.Error(w, "Bin not found", http.StatusNotFound)
 		return
 	}
-	if time.Now().UnixMilli() > expires {
+	if err != nil {
+		http.Error(w, "Error looking up bin", http.StatusInternalServerError)
+		return
+	}
+	if binExpired(bin.ExpiresAt) {
 		http.Error(w, "Bin expired", http.StatusGone)
 		return
 	}
 
-	// Read and store request
-	body, _ := io.ReadAll(r.Body)
-	headers := make(map[string]string)
-	for name, values := range r.Header {
-		headers[name] = values[0]
+	override, err := parseResponseOverride(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	config := bin.Config
+	req, err := captureRequest(w, r, binID, subPath, bin.MaxEntries, config, receivedAt)
+	switch {
+	case errors.Is(err, errBodyTooLarge):
+		http.Error(w, "Request body too large", http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, errReadingBody):
+		http.Error(w, "Error storing request body", http.StatusInternalServerError)
+		return
+	case err == errInsufficientStorage:
+		http.Error(w, "Storage quota exceeded", http.StatusInsufficientStorage)
+		return
+	case err != nil:
+		http.Error(w, "Error storing request", http.StatusInternalServerError)
+		return
+	}
+	captures.publish(req)
+	captureRate.record()
+	if config.Forward != nil {
+		go forwardCapture(*config.Forward, req)
+	}
+	deliverToSinks(config, req)
+	if config.CORS != nil && config.CORS.apply(w, r) {
+		return
+	}
+	if config.Handshake != nil && config.Handshake.respond(r.Context(), w, req) {
+		return
+	}
+	if override != nil && override.apply(r.Context(), w, req) {
+		return
+	}
+	if config.Chaos != nil && config.Chaos.inject(w) {
+		return
+	}
+	if (r.Method == http.MethodGet || r.Method == http.MethodHead) && serveBinAsset(w, r, binID) {
+		return
+	}
+	if config.Proxy != nil {
+		proxyCapture(w, r, *config.Proxy, req)
+		return
+	}
+
+	writeCaptureResponse(r.Context(), w, config.Response, req)
+}
+
+// errReadingBody wraps failures reading or offloading a capture's body
+var errReadingBody = errors.New("error reading request body")
+
+// captureRequest reads r's body and stores it as a request in the bin, along
+// with everything derived from it. It fails with errBodyTooLarge,
+// errReadingBody, errInsufficientStorage or a database error.
+func captureRequest(w http.ResponseWriter, r *http.Request, binID, subPath string, maxEntries int,
+	config BinConfig, receivedAt time.Time) (Request, error) {
+	reqID := generateRequestID()
+	bodyReader := newBodyReader(w, r)
+	readStart := time.Now()
+	var body []byte
+	var offloaded int64
+	var err error
+	if config.Encryption != nil {
+		// Sealed bodies stay inline; the blob store would keep them in the clear
+		body, err = io.ReadAll(bodyReader)
+	} else {
+		body, offloaded, err = readCaptureBody(bodyReader, binID+"/"+reqID)
+	}
+	readDuration := time.Since(readStart)
+	if errors.Is(err, errBodyTooLarge) {
+		return Request{}, err
 	}
+	if err != nil {
+		return Request{}, fmt.Errorf("%w: %v", errReadingBody, err)
+	}
+
+	// Compressed bodies are stored decoded so they can be read and searched
+	var encoded []byte
+	var decodedFrom string
+	if enc := r.Header.Get("Content-Encoding"); enc != "" && offloaded == 0 {
+		if decoded, ok := decodeBody(enc, body); ok {
+			encoded, body, decodedFrom = body, decoded, enc
+		}
+	}
+
+	headers := r.Header.Clone()
 	query := make(map[string]string)
 	for key, values := range r.URL.Query() {
 		query[key] = values[0]
 	}
 
-	reqID := generateID()
-	headersJSON, _ := json.Marshal(headers)
-	queryJSON, _ := json.Marshal(query)
-	bodyJSON, _ := json.Marshal(string(body))
+	ip, hops := clientIP(r)
+	req := Request{
+		Method:   r.Method,
+		Path:     r.URL.Path,
+		SubPath:  subPath,
+		Headers:  headers,
+		Query:    query,
+		Body:     string(body),
+		RawBody:  string(body),
+		IP:       ip,
+		BinID:    binID,
+		ReqID:    reqID,
+		Inserted: time.Now().UnixMilli(),
+
+		Host:          r.Host,
+		Proto:         r.Proto,
+		ContentLength: r.ContentLength,
+		TLS:           newTLSInfo(r.TLS),
+		Hops:          hops,
 
-	_, err = db.Exec(`
-        INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
-        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
-		reqID, binID, r.Method, r.URL.Path, string(headersJSON), string(queryJSON), string(bodyJSON),
-		r.RemoteAddr, time.Now().UnixMilli())
+		ReceivedAt:     receivedAt.UnixNano(),
+		ReadDurationMs: float64(readDuration) / float64(time.Millisecond),
+
+		Truncated: bodyReader.truncated,
+		rawHead:   wireHead(r),
+
+		DecodedFrom: decodedFrom,
+		encodedBody: encoded,
+		UserAgent:   parseUserAgent(r.UserAgent()),
+	}
+	req.JWTHeader, req.JWTClaims = decodeJWT(r.Header.Get("Authorization"))
+	if doc, parts := parseBody(r.Header.Get("Content-Type"), body); doc != nil {
+		req.Body = doc
+		req.parts = parts
+	}
+	if config.Signature != nil && offloaded == 0 {
+		// Signatures are over the body as sent, before any decoding
+		sent := body
+		if encoded != nil {
+			sent = encoded
+		}
+		valid := config.Signature.verify(r.Header, sent)
+		req.SignatureValid = &valid
+	}
+	if config.Schema != nil && offloaded == 0 {
+		if schema, err := compileJSONSchema(config.Schema); err == nil {
+			doc, _ := req.Body.(json.RawMessage)
+			if doc == nil {
+				req.ValidationErrors = []string{"$: body is not a JSON document"}
+			} else {
+				req.ValidationErrors = schema.validate(doc)
+			}
+			valid := len(req.ValidationErrors) == 0
+			req.Valid = &valid
+		}
+	}
+	if offloaded > 0 {
+		req.Body = nil
+		req.BodyOffloaded = true
+		req.BodySize = offloaded
+		req.blobKey = binID + "/" + reqID
+	}
+	if config.Encryption != nil {
+		if err := config.Encryption.seal(&req, body); err != nil {
+			return Request{}, err
+		}
+	}
+	// Forwarding and proxying record against the stored row, so those bins
+	// can't be answered before it's written
+	wait := config.Forward != nil || config.Proxy != nil
+	if err := insertCapture(r.Context(), req, maxEntries, wait); err != nil {
+		if req.BodyOffloaded {
+			blobs.Delete(req.blobKey)
+		}
+		return Request{}, err
+	}
+	return req, nil
+}
+
+// errBodyTooLarge is returned while reading a body past maxBodyBytes
+var errBodyTooLarge = errors.New("request body too large")
+
+// bodyReader reads a capture's body up to maxBodyBytes. Reading further fails
+// with errBodyTooLarge unless truncateBodies is set, in which case the body
+// ends at the limit and truncated is set.
+type bodyReader struct {
+	r         io.Reader
+	n         int64
+	truncated bool
+}
+
+func newBodyReader(w http.ResponseWriter, r *http.Request) *bodyReader {
+	if maxBodyBytes <= 0 {
+		return &bodyReader{r: r.Body}
+	}
+	return &bodyReader{r: http.MaxBytesReader(w, r.Body, maxBodyBytes)}
+}
+
+func (b *bodyReader) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+
+	// MaxBytesReader only fails once the limit has been reached and there is
+	// more to read; any other read error ends the body, as it always has
+	if maxBodyBytes > 0 && b.n >= maxBodyBytes {
+		if !truncateBodies {
+			return n, errBodyTooLarge
+		}
+		b.truncated = true
+	}
+	return n, io.EOF
+}
+
+func listRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/req")
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, `{"msg":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		limit = n
+	}
+	offset := 0
+	if v := r.URL.Query().Get("offset"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, `{"msg":"Invalid offset"}`, http.StatusBadRequest)
+			return
+		}
+		offset = n
+	}
+
+	if _, err := store.GetBin(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseRequestFilter(r.URL.Query())
 	if err != nil {
-		http.Error(w, "Error storing request", http.StatusInternalServerError)
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+	total, err := store.CountRequests(r.Context(), binID, filter)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
 		return
 	}
 
-	w.Write([]byte(reqID))
+	// Always an array, even when the page is empty
+	reqs, err := store.ListRequests(r.Context(), binID, filter, limit, offset)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	sealed := make([]*Request, len(reqs))
+	for i := range reqs {
+		sealed[i] = &reqs[i]
+	}
+	if !openSealedBodies(w, r, sealed...) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	json.NewEncoder(w).Encode(reqs)
 }
 
 func getRequestHandler(w http.ResponseWriter, r *http.Request) {
@@ -227,14 +1062,7 @@ func getRequestHandler(w http.ResponseWriter, r *http.Request) {
 	binID := parts[0]
 	reqID := parts[1]
 
-	var req Request
-	var headersStr, queryStr, bodyStr string
-	err := db.QueryRow(`
-        SELECT method, path, headers, query, body, ip, bin_id, req_id, inserted
-        FROM requests WHERE bin_id = ? AND req_id = ?`, binID, reqID).
-		Scan(&req.Method, &req.Path, &headersStr, &queryStr, &bodyStr, &req.IP, &req.BinID,
-			&req.ReqID, &req.Inserted)
-
+	req, err := store.GetRequest(r.Context(), binID, reqID)
 	if err == sql.ErrNoRows {
 		http.Error(w, `{"msg":"Request not found"}`, http.StatusNotFound)
 		return
@@ -243,15 +1071,43 @@ func getRequestHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
 		return
 	}
-
-	json.Unmarshal([]byte(headersStr), &req.Headers)
-	json.Unmarshal([]byte(queryStr), &req.Query)
-	json.Unmarshal([]byte(bodyStr), &req.Body)
+	if !openSealedBodies(w, r, &req) {
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(req)
 }
 
+func deleteRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	path := r.URL.Path[len("/api/bin/"):]
+	parts := strings.Split(path, "/req/")
+	if len(parts) != 2 {
+		http.Error(w, `{"msg":"Invalid path format"}`, http.StatusBadRequest)
+		return
+	}
+	binID := parts[0]
+	reqID := parts[1]
+
+	found, err := store.DeleteRequest(r.Context(), binID, reqID)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, `{"msg":"Request not found"}`, http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	fmt.Fprintf(w, `{"msg":"Request Deleted"}`)
+}
+
 func shiftRequestHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -259,72 +1115,453 @@ func shiftRequestHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/req/shift")]
+	takeRequestHandler(w, r, binID, false)
+}
 
-	var req Request
-	var headersStr, queryStr, bodyStr string
-	err := db.QueryRow(`
-        SELECT method, path, headers, query, body, ip, bin_id, req_id, inserted
-        FROM requests WHERE bin_id = ? ORDER BY inserted ASC LIMIT 1`, binID).
-		Scan(&req.Method, &req.Path, &headersStr, &queryStr, &bodyStr, &req.IP, &req.BinID,
-			&req.ReqID, &req.Inserted)
+func popRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 
-	if err == sql.ErrNoRows {
-		http.Error(w, `{"msg":"No requests in this bin"}`, http.StatusNotFound)
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/req/pop")]
+	takeRequestHandler(w, r, binID, true)
+}
+
+// Long-poll timeout bounds for /req/next
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 2 * time.Minute
+)
+
+// shutdownTimeout is how long requests in flight get to finish once the
+// server is told to stop; overridable with --shutdown-timeout
+var shutdownTimeout = 30 * time.Second
+
+// nextRequestHandler long-polls for a request. Without remove=true it returns
+// the oldest request after since (default: now), either a timestamp, after
+// which requests are considered, or a cursor "{inserted}:{reqId}", so a client
+// can walk forward by passing the previous request's without skipping others
+// captured in the same millisecond. With remove=true it behaves like a
+// blocking shift.
+func nextRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		return
 	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/req/next")]
+	q := r.URL.Query()
+
+	timeout, err := parseDurationParam(q.Get("timeout"), defaultPollTimeout, maxPollTimeout)
 	if err != nil {
-		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		http.Error(w, `{"msg":"Invalid timeout"}`, http.StatusBadRequest)
 		return
 	}
 
-	// Delete the request we just retrieved
-	_, err = db.Exec("DELETE FROM requests WHERE req_id = ?", req.ReqID)
-	if err != nil {
+	remove := q.Get("remove") == "true"
+	after := requestCursor{Inserted: time.Now().UnixMilli() + 1}
+	if v := q.Get("since"); v != "" {
+		inserted, reqID, cursor := strings.Cut(v, ":")
+		n, err := strconv.ParseInt(inserted, 10, 64)
+		if err != nil {
+			http.Error(w, `{"msg":"Invalid since"}`, http.StatusBadRequest)
+			return
+		}
+		// A bare timestamp is past everything inserted in that millisecond
+		after = requestCursor{Inserted: n, ReqID: reqID}
+		if !cursor {
+			after.Inserted++
+		}
+	}
+
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
 		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
 		return
 	}
+	key, ok := readBinKey(w, r, binID)
+	if !ok {
+		return
+	}
 
-	json.Unmarshal([]byte(headersStr), &req.Headers)
-	json.Unmarshal([]byte(queryStr), &req.Query)
-	json.Unmarshal([]byte(bodyStr), &req.Body)
+	// Subscribe before looking, so a capture landing in between isn't missed
+	sub := captures.subscribe(binID, 1)
+	defer sub.Close()
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(req)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+
+	for {
+		var reqs []Request
+		var err error
+		if remove {
+			reqs, err = store.TakeRequests(r.Context(), binID, false, 1)
+		} else {
+			reqs, err = store.RequestsAfter(r.Context(), binID, after, requestFilter{}, 1)
+		}
+		if err != nil {
+			http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+			return
+		}
+		if len(reqs) > 0 {
+			if !key.open(w, &reqs[0]) {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(reqs[0])
+			return
+		}
+
+		select {
+		case <-sub.C:
+		case <-deadline.C:
+			http.Error(w, `{"msg":"No request arrived before the timeout"}`, http.StatusNotFound)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
 }
 
-func main() {
-	// API routes
-	http.HandleFunc("/api/bin", createBinHandler)
-	http.HandleFunc("/api/bin/", func(w http.ResponseWriter, r *http.Request) {
-		if r.URL.Path == "/api/bin/" {
-			http.NotFound(w, r)
+// parseDurationParam parses a query parameter such as "30s" or a bare number of
+// seconds, falling back to def when empty and clamping to max.
+func parseDurationParam(v string, def, max time.Duration) (time.Duration, error) {
+	if v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		n, nerr := strconv.Atoi(v)
+		if nerr != nil {
+			return 0, err
+		}
+		d = time.Duration(n) * time.Second
+	}
+	if d < 0 {
+		return 0, fmt.Errorf("negative duration %q", v)
+	}
+	if d > max {
+		d = max
+	}
+	return d, nil
+}
+
+// takeRequestHandler removes the oldest, or with newest the newest, request
+// from a bin and writes it as the response. With a count query
+// parameter, up to that many requests are removed and returned as an array.
+func takeRequestHandler(w http.ResponseWriter, r *http.Request, binID string, newest bool) {
+	count := 1
+	batch := r.URL.Query().Get("count") != ""
+	if batch {
+		n, err := strconv.Atoi(r.URL.Query().Get("count"))
+		if err != nil || n < 1 {
+			http.Error(w, `{"msg":"Invalid count"}`, http.StatusBadRequest)
+			return
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		count = n
+	}
+	key, ok := readBinKey(w, r, binID)
+	if !ok {
+		return
+	}
+
+	var reqs []Request
+	var err error
+	if group := r.URL.Query().Get("group"); group != "" {
+		if newest {
+			http.Error(w, `{"msg":"Consumer groups only support shift"}`, http.StatusBadRequest)
+			return
+		}
+		if !groupName.MatchString(group) {
+			http.Error(w, `{"msg":"Invalid group"}`, http.StatusBadRequest)
 			return
 		}
+		if refuseLocalFeature(w, "Consumer groups") {
+			return
+		}
+		reqs, err = groupShift(r.Context(), binID, group, count)
+	} else {
+		reqs, err = store.TakeRequests(r.Context(), binID, newest, count)
+	}
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	taken := make([]*Request, len(reqs))
+	for i := range reqs {
+		taken[i] = &reqs[i]
+	}
+	if !key.open(w, taken...) {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(reqs)
+		return
+	}
+	if len(reqs) == 0 {
+		http.Error(w, `{"msg":"No requests in this bin"}`, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(reqs[0])
+}
+
+// binAPIHandler dispatches everything under /api/bin/{binId} based on the
+// path segments that follow the bin ID.
+func binAPIHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(r.URL.Path[len("/api/bin/"):], "/")
+	if parts[0] == "" {
+		http.NotFound(w, r)
+		return
+	}
 
-		if r.Method == http.MethodDelete {
+	switch {
+	case len(parts) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			getBinHandler(w, r)
+		case http.MethodPatch:
+			patchBinHandler(w, r)
+		case http.MethodDelete:
 			deleteBinHandler(w, r)
-		} else if r.Method == http.MethodGet {
-			if len(r.URL.Path) > len("/api/bin/")+8 {
-				if r.URL.Path[len(r.URL.Path)-len("/req/shift"):] == "/req/shift" {
-					shiftRequestHandler(w, r)
-				} else if r.URL.Path[len("/api/bin/")+8:len("/api/bin/")+8+len("/req/")] == "/req/" {
-					getRequestHandler(w, r)
-				} else {
-					http.NotFound(w, r)
-				}
-			} else {
-				getBinHandler(w, r)
-			}
-		} else {
+		default:
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 		}
-	})
+	case len(parts) == 2 && parts[1] == "req":
+		listRequestsHandler(w, r)
+	case len(parts) == 2 && parts[1] == "ws":
+		liveTailHandler(w, r)
+	case len(parts) == 2 && parts[1] == "tunnel":
+		tunnelHandler(w, r)
+	case len(parts) == 2 && parts[1] == "search":
+		searchRequestsHandler(w, r)
+	case len(parts) == 2 && parts[1] == "config":
+		binConfigHandler(w, r)
+	case len(parts) == 2 && parts[1] == "asset":
+		binAssetHandler(w, r)
+	case len(parts) == 2 && parts[1] == "schema":
+		inferSchemaHandler(w, r)
+	case len(parts) == 2 && parts[1] == "export":
+		exportHandler(w, r)
+	case len(parts) == 2 && parts[1] == "import":
+		importHandler(w, r)
+	case len(parts) == 2 && parts[1] == "replay":
+		replayHandler(w, r)
+	case len(parts) == 2 && parts[1] == "jobs":
+		jobsHandler(w, r)
+	case len(parts) == 3 && parts[1] == "jobs" && parts[2] != "":
+		jobHandler(w, r)
+	case len(parts) == 2 && parts[1] == "deliveries":
+		binDeliveriesHandler(w, r)
+	case len(parts) == 4 && parts[1] == "deliveries" && parts[3] == "redrive":
+		redriveDeliveryHandler(w, r)
+	case len(parts) == 2 && parts[1] == "timeseries":
+		timeseriesHandler(w, r)
+	case len(parts) == 3 && parts[1] == "req" && parts[2] == "shift":
+		shiftRequestHandler(w, r)
+	case len(parts) == 3 && parts[1] == "req" && parts[2] == "pop":
+		popRequestHandler(w, r)
+	case len(parts) == 3 && parts[1] == "req" && parts[2] == "next":
+		nextRequestHandler(w, r)
+	case len(parts) == 3 && parts[1] == "req" && parts[2] == "lease":
+		leaseRequestHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "ack":
+		ackRequestHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "nack":
+		nackRequestHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "body":
+		requestBodyHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "raw":
+		rawRequestHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "curl":
+		curlHandler(w, r)
+	case len(parts) == 4 && parts[1] == "req" && parts[3] == "deliveries":
+		requestDeliveriesHandler(w, r)
+	case len(parts) >= 5 && parts[1] == "req" && parts[3] == "part":
+		requestPartHandler(w, r)
+	case len(parts) == 3 && parts[1] == "req" && parts[2] != "":
+		switch r.Method {
+		case http.MethodGet:
+			getRequestHandler(w, r)
+		case http.MethodDelete:
+			deleteRequestHandler(w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "tunnel" {
+		if err := runTunnel(os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	flag.DurationVar(&defaultTTL, "default-ttl", defaultTTL, "lifetime of bins created without a ttlSeconds")
+	flag.DurationVar(&maxTTL, "max-ttl", maxTTL, "longest lifetime a client may request for a bin")
+	flag.BoolVar(&allowPermanent, "allow-permanent", allowPermanent, "allow clients to create bins that never expire")
+	flag.StringVar(&adminToken, "admin-token", adminToken, "bearer token for /api/admin (default $POSTBIN_ADMIN_TOKEN)")
+	flag.DurationVar(&sweepInterval, "sweep-interval", sweepInterval, "how often expired bins are deleted (0 disables)")
+	flag.DurationVar(&jobInterval, "job-interval", jobInterval, "how often scheduled replay jobs are checked for (0 disables them)")
+	flag.DurationVar(&alertInterval, "alert-interval", alertInterval, "how often notify rule thresholds are checked between captures, and digests sent (0 disables both)")
+	flag.IntVar(&sweepBatchSize, "sweep-batch", sweepBatchSize, "expired bins deleted per sweep transaction")
+	flag.Int64Var(&maintenanceAfter, "maintenance-after", maintenanceAfter, "expired requests swept between automatic vacuum/ANALYZE runs (0 disables them)")
+	flag.Int64Var(&maxStorageBytes, "max-storage-bytes", maxStorageBytes, "cap on stored request bytes across all bins (0 is unlimited)")
+	flag.StringVar(&storagePolicy, "storage-policy", storagePolicy, "what to do when the storage cap is hit: reject or evict")
+	flag.Int64Var(&maxBodyBytes, "max-body-bytes", maxBodyBytes, "largest request body a bin will capture (0 is unlimited)")
+	flag.BoolVar(&truncateBodies, "truncate-bodies", truncateBodies, "store oversized bodies cut at --max-body-bytes instead of rejecting them with 413")
+	flag.Int64Var(&blobThreshold, "blob-threshold", blobThreshold, "bodies larger than this many bytes are offloaded to blob storage (0 disables)")
+	flag.StringVar(&blobDir, "blob-dir", blobDir, "directory for offloaded bodies when no S3 bucket is set")
+	flag.StringVar(&blobS3Bucket, "blob-s3-bucket", blobS3Bucket, "S3 bucket for offloaded bodies (credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&blobS3Region, "blob-s3-region", blobS3Region, "region of --blob-s3-bucket")
+	flag.StringVar(&blobS3Endpoint, "blob-s3-endpoint", blobS3Endpoint, "endpoint of an S3-compatible service, such as MinIO")
+	flag.StringVar(&kafkaBrokers, "kafka-brokers", kafkaBrokers, "comma-separated host:port Kafka brokers every capture is published to")
+	flag.StringVar(&kafkaTopic, "kafka-topic", kafkaTopic, "topic for --kafka-brokers; {binId} is replaced with the capture's bin")
+	flag.StringVar(&natsURL, "nats-url", natsURL, "nats:// server every capture is published to")
+	flag.StringVar(&natsSubject, "nats-subject", natsSubject, "subject for --nats-url; {binId} is replaced with the capture's bin")
+	flag.BoolVar(&natsJetStream, "nats-jetstream", natsJetStream, "wait for a JetStream ack for each --nats-url publish")
+	flag.StringVar(&fanoutURL, "fanout-nats-url", fanoutURL, "nats:// server through which servers sharing a backend relay captures to each other's streaming clients")
+	flag.StringVar(&fanoutSubject, "fanout-subject", fanoutSubject, "subject for --fanout-nats-url")
+	flag.StringVar(&sqsQueueURL, "sqs-queue-url", sqsQueueURL, "SQS queue every capture is sent to (credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&snsTopicARN, "sns-topic-arn", snsTopicARN, "SNS topic every capture is published to (credentials as for --sqs-queue-url)")
+	flag.StringVar(&amqpURL, "amqp-url", amqpURL, "amqp:// broker every capture is published to")
+	flag.StringVar(&amqpExchange, "amqp-exchange", amqpExchange, "exchange for --amqp-url; the default exchange routes to the queue named by the routing key")
+	flag.StringVar(&amqpRoutingKey, "amqp-routing-key", amqpRoutingKey, "routing key for --amqp-url; {binId} is replaced with the capture's bin")
+	flag.StringVar(&pubsubTopic, "pubsub-topic", pubsubTopic, "Pub/Sub topic every capture is published to (credentials from $GOOGLE_APPLICATION_CREDENTIALS); {binId} is replaced with the capture's bin")
+	flag.StringVar(&elasticsearchURL, "elasticsearch-url", elasticsearchURL, "Elasticsearch or OpenSearch cluster every capture is indexed in, with any credentials as user:pass@")
+	flag.StringVar(&elasticsearchIndex, "elasticsearch-index", elasticsearchIndex, "daily index prefix for --elasticsearch-url; {binId} is replaced with the capture's bin")
+	flag.StringVar(&fileSinkPath, "file-sink", fileSinkPath, "file every capture is appended to as NDJSON")
+	flag.Int64Var(&fileSinkMaxBytes, "file-sink-max-bytes", fileSinkMaxBytes, "size at which --file-sink is rotated (0 never rotates)")
+	flag.IntVar(&fileSinkKeep, "file-sink-keep", fileSinkKeep, "rotated --file-sink files to keep")
+	flag.BoolVar(&fileSinkSync, "file-sink-sync", fileSinkSync, "fsync --file-sink after every capture")
+	flag.StringVar(&publicURL, "public-url", publicURL, "URL postbin is reached at, for links in notifications; defaults to the Host each capture was sent to")
+	flag.StringVar(&sqliteJournalMode, "sqlite-journal-mode", sqliteJournalMode, "SQLite journal mode, such as WAL or DELETE")
+	flag.DurationVar(&sqliteBusyTimeout, "sqlite-busy-timeout", sqliteBusyTimeout, "how long an SQLite write waits for another to finish before failing")
+	flag.IntVar(&sqliteMaxOpenConns, "sqlite-max-open-conns", sqliteMaxOpenConns, "cap on open SQLite connections (0 is unlimited)")
+	flag.StringVar(&sqliteKeyEnv, "sqlite-key-env", sqliteKeyEnv, "environment variable holding a passphrase to encrypt the SQLite database with (needs SQLCipher)")
+	flag.StringVar(&sqliteKeyKMS, "sqlite-key-kms", sqliteKeyKMS, "base64 AWS KMS ciphertext of a 32-byte key to encrypt the SQLite database with (needs SQLCipher)")
+	flag.StringVar(&kmsRegion, "kms-region", kmsRegion, "region of the --sqlite-key-kms key (credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&kmsEndpoint, "kms-endpoint", kmsEndpoint, "endpoint of a KMS-compatible service, such as LocalStack")
+	flag.StringVar(&dbDriver, "db-driver", dbDriver, "where bins and requests are stored: sqlite, postgres, memory, bolt or dynamodb")
+	flag.StringVar(&dbDSN, "dsn", dbDSN, "connection string for --db-driver=postgres, file for bolt (default ./postbin.bolt), or table for dynamodb")
+	flag.DurationVar(&dbTimeout, "db-timeout", dbTimeout, "longest a database call may take before it's given up (0 is unlimited)")
+	flag.StringVar(&dynamoRegion, "dynamodb-region", dynamoRegion, "region of the --db-driver=dynamodb table (credentials from $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY)")
+	flag.StringVar(&dynamoEndpoint, "dynamodb-endpoint", dynamoEndpoint, "endpoint of a DynamoDB-compatible service, such as DynamoDB Local")
+	flag.DurationVar(&binCacheTTL, "bin-cache-ttl", binCacheTTL, "how long captures may use a bin looked up for an earlier one (0 looks it up every time)")
+	flag.IntVar(&insertBatchSize, "insert-batch", insertBatchSize, "most captures written per transaction by a single writer (0 writes each as it arrives)")
+	flag.DurationVar(&insertFlushInterval, "insert-flush-interval", insertFlushInterval, "longest a capture waits for its --insert-batch to fill")
+	flag.IntVar(&insertQueueSize, "insert-queue", insertQueueSize, "captures that may wait for the --insert-batch writer before more are held up")
+	flag.BoolVar(&insertAsync, "insert-async", insertAsync, "answer captures once queued for --insert-batch, risking the queue on a crash")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", shutdownTimeout, "how long requests in flight get to finish on SIGINT or SIGTERM before they're cut off")
+	flag.IntVar(&binIDBytes, "bin-id-bytes", binIDBytes, "random bytes in generated bin IDs")
+	flag.StringVar(&binIDAlphabet, "bin-id-alphabet", binIDAlphabet, "spelling of generated bin IDs: hex, base32 or base62")
+	proxies := flag.String("trusted-proxies", "", "comma-separated CIDRs of reverse proxies whose X-Forwarded-For and Forwarded headers are trusted")
+	flag.Parse()
+
+	if err := validateStoragePolicy(storagePolicy); err != nil {
+		log.Fatal(err)
+	}
+	if err := validateBinIDFormat(binIDBytes, binIDAlphabet); err != nil {
+		log.Fatal(err)
+	}
+	var err error
+	if trustedProxies, err = parseTrustedProxies(*proxies); err != nil {
+		log.Fatal(err)
+	}
+	if err := loadSQLiteKey(context.Background()); err != nil {
+		log.Fatal(err)
+	}
+	if err := openStore(dbDriver, dbDSN); err != nil {
+		log.Fatal(err)
+	}
+	if insertAsync && insertBatchSize <= 0 {
+		log.Fatal("--insert-async needs --insert-batch")
+	}
+	if insertBatchSize > 0 {
+		inserts = startInsertBatcher(insertBatchSize, insertFlushInterval, insertQueueSize)
+	}
+	if pubsubTopic != "" {
+		if globalPubSub, err = loadGlobalPubSubSink(pubsubTopic); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if fileSinkPath != "" {
+		if globalFileSink, err = openFileSink(fileSinkPath, fileSinkMaxBytes, fileSinkKeep, fileSinkSync); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if blobThreshold > 0 {
+		if blobs, err = newBlobStore(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if fanoutURL != "" {
+		if msg := (NATSSinkConfig{URL: fanoutURL, Subject: fanoutSubject}).validate(); msg != "" {
+			log.Fatalf("--fanout-nats-url: %s", msg)
+		}
+		startFanout(fanoutURL, fanoutSubject)
+	}
+	if sweepInterval > 0 {
+		startSweeper(sweepInterval)
+	}
+	// Replay jobs and deliveries are refused without local tables, so
+	// there's nothing to run or recover
+	if noLocalTables == nil {
+		if jobInterval > 0 {
+			startJobRunner(jobInterval)
+		}
+		failInterruptedDeliveries()
+	}
+	if alertInterval > 0 {
+		startAlertChecker(alertInterval)
+	}
+
+	// API routes
+	http.HandleFunc("/api/bin", createBinHandler)
+	http.HandleFunc("/api/bin/", binAPIHandler)
+	http.HandleFunc("/api/admin/", adminAPIHandler)
 
 	// Capture all other requests
 	http.HandleFunc("/", captureRequestHandler)
 
+	// On SIGINT or SIGTERM, stop taking requests and let those in flight
+	// finish, for up to shutdownTimeout, before the queued captures are
+	// written and the store closed
+	srv := &http.Server{Addr: ":8080"}
+	shutdown := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Printf("Waiting for requests to finish failed: %v", err)
+			srv.Close()
+		}
+		close(shutdown)
+	}()
+
 	log.Println("Server starting on :8080...")
-	if err := http.ListenAndServe(":8080", nil); err != nil {
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatal(err)
 	}
+	<-shutdown
+	if inserts != nil {
+		inserts.stop()
+	}
+	closeStore()
 }
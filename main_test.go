@@ -1,12 +1,18 @@
+//go:build cgo
+
 package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -19,35 +25,23 @@ var testDB *sql.DB
 func TestMain(m *testing.M) {
 	// Use in-memory SQLite for testing
 	var err error
-	testDB, err = sql.Open("sqlite3", ":memory:")
+	testDB, err = sql.Open("sqlite3", ":memory:?_foreign_keys=on")
 	if err != nil {
 		panic(err)
 	}
 
+	// Every pooled connection to ":memory:" would get its own empty database,
+	// so pin the pool to a single connection
+	testDB.SetMaxOpenConns(1)
+
 	// Set the global db variable to our test database
 	db = testDB
 
 	// Create tables
-	_, err = testDB.Exec(`
-		CREATE TABLE IF NOT EXISTS bins (
-			bin_id TEXT PRIMARY KEY,
-			created_at INTEGER,
-			expires_at INTEGER
-		);
-		CREATE TABLE IF NOT EXISTS requests (
-			req_id TEXT PRIMARY KEY,
-			bin_id TEXT,
-			method TEXT,
-			path TEXT,
-			headers TEXT,
-			query TEXT,
-			body TEXT,
-			ip TEXT,
-			inserted INTEGER,
-			FOREIGN KEY(bin_id) REFERENCES bins(bin_id)
-		);
-	`)
-	if err != nil {
+	if err := initSchema(testDB); err != nil {
+		panic(err)
+	}
+	if store, err = newSQLiteStore(testDB); err != nil {
 		panic(err)
 	}
 
@@ -61,13 +55,11 @@ func TestMain(m *testing.M) {
 
 // Helper function to clear the database between tests
 func clearDB(t *testing.T) {
-	_, err := testDB.Exec("DELETE FROM requests")
-	if err != nil {
-		t.Fatalf("Failed to clear requests table: %v", err)
-	}
-	_, err = testDB.Exec("DELETE FROM bins")
-	if err != nil {
-		t.Fatalf("Failed to clear bins table: %v", err)
+	cachedBins.clear()
+	for _, table := range []string{"group_leases", "consumer_groups", "requests", "bins"} {
+		if _, err := testDB.Exec("DELETE FROM " + table); err != nil {
+			t.Fatalf("Failed to clear %s table: %v", table, err)
+		}
 	}
 }
 
@@ -151,8 +143,8 @@ func TestCaptureRequest(t *testing.T) {
 	}
 
 	reqID := w.Body.String()
-	if len(reqID) != 8 {
-		t.Errorf("Expected reqID length 8, got %d", len(reqID))
+	if len(reqID) != 26 {
+		t.Errorf("Expected reqID length 26, got %d", len(reqID))
 	}
 }
 
@@ -234,11 +226,38 @@ func TestDeleteBin(t *testing.T) {
 	}
 }
 
+func TestDeleteBinCascades(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for i := 0; i < 3; i++ {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("test"))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+	groupReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift?group=worker", nil)
+	binAPIHandler(httptest.NewRecorder(), groupReq)
+
+	req := httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID, nil)
+	w := httptest.NewRecorder()
+	deleteBinHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	for _, table := range binDataTables {
+		var n int
+		testDB.QueryRow("SELECT COUNT(*) FROM "+table+" WHERE bin_id = ?", bin.BinID).Scan(&n)
+		if n != 0 {
+			t.Errorf("Expected no %s rows left for the deleted bin, got %d", table, n)
+		}
+	}
+}
+
 func TestExpiredBin(t *testing.T) {
 	clearDB(t)
 
 	// Create a bin that's already expired
-	binID := generateID()
+	binID := generateBinID()
 	now := time.Now().UnixMilli()
 	expires := now - 1000 // expired 1 second ago
 
@@ -296,3 +315,702 @@ func TestBinEntries(t *testing.T) {
 		t.Errorf("Expected 3 entries after adding requests, got %d", updatedBin.Entries)
 	}
 }
+
+// Helper function to create a bin through the API
+func createTestBin(t *testing.T) BinResponse {
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", nil)
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+
+	var bin BinResponse
+	if err := json.NewDecoder(w.Body).Decode(&bin); err != nil {
+		t.Fatalf("Failed to decode created bin: %v", err)
+	}
+	return bin
+}
+
+func TestListRequests(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	// Add some requests to the bin
+	for i := 0; i < 5; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"?n="+strconv.Itoa(i), nil)
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, req)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?limit=2&offset=1", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	if total := w.Header().Get("X-Total-Count"); total != "5" {
+		t.Errorf("Expected X-Total-Count 5, got %q", total)
+	}
+
+	var reqs []Request
+	if err := json.NewDecoder(w.Body).Decode(&reqs); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(reqs))
+	}
+	if reqs[0].Query["n"] != "1" || reqs[1].Query["n"] != "2" {
+		t.Errorf("Expected requests 1 and 2 in insertion order, got %v and %v", reqs[0].Query, reqs[1].Query)
+	}
+
+	// Listing must not consume anything
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID, nil)
+	getW := httptest.NewRecorder()
+	getBinHandler(getW, getReq)
+
+	var updatedBin BinResponse
+	json.NewDecoder(getW.Body).Decode(&updatedBin)
+	if updatedBin.Entries != 5 {
+		t.Errorf("Expected 5 entries after listing, got %d", updatedBin.Entries)
+	}
+
+	// Unknown bins are a 404
+	req = httptest.NewRequest(http.MethodGet, "/api/bin/nosuchbin/req", nil)
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestDeleteRequest(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("first"))
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	reqID := captureW.Body.String()
+
+	captureReq = httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("second"))
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	// Delete the first request only
+	req := httptest.NewRequest(http.MethodDelete, "/api/bin/"+bin.BinID+"/req/"+reqID, nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	// The deleted request is gone
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID, nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+	if getW.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, getW.Code)
+	}
+
+	// The other request is untouched
+	var entries int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&entries)
+	if entries != 1 {
+		t.Errorf("Expected 1 remaining entry, got %d", entries)
+	}
+
+	// Deleting again is a 404
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestExtendBin(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	body := strings.NewReader(`{"extendMs": 1800000}`)
+	req := httptest.NewRequest(http.MethodPatch, "/api/bin/"+bin.BinID, body)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var patched BinResponse
+	if err := json.NewDecoder(w.Body).Decode(&patched); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if patched.Expires != bin.Expires+1800000 {
+		t.Errorf("Expected expires %d, got %d", bin.Expires+1800000, patched.Expires)
+	}
+
+	// Non-positive extensions are rejected
+	req = httptest.NewRequest(http.MethodPatch, "/api/bin/"+bin.BinID, strings.NewReader(`{"extendMs": 0}`))
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+
+	// Extensions stop at --max-ttl from now
+	req = httptest.NewRequest(http.MethodPatch, "/api/bin/"+bin.BinID, strings.NewReader(`{"extendMs": 31536000000000}`))
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	json.NewDecoder(w.Body).Decode(&patched)
+	if limit := time.Now().Add(maxTTL).UnixMilli(); w.Code != http.StatusOK || patched.Expires > limit || patched.Expires < limit-60000 {
+		t.Errorf("Expected the expiry capped at --max-ttl, got %d: %d", w.Code, patched.Expires)
+	}
+
+	// As do ones that would overflow, which leave the bin usable
+	req = httptest.NewRequest(http.MethodPatch, "/api/bin/"+bin.BinID, strings.NewReader(`{"extendMs": 9223372036854775000}`))
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("still here")))
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected the bin to still take captures, got %d", w.Code)
+	}
+
+	// Unknown bins are a 404
+	req = httptest.NewRequest(http.MethodPatch, "/api/bin/nosuchbin", strings.NewReader(`{"extendMs": 1000}`))
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestCreateBinTTL(t *testing.T) {
+	clearDB(t)
+
+	body := strings.NewReader(`{"ttlSeconds": 86400}`)
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", body)
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	var bin BinResponse
+	if err := json.NewDecoder(w.Body).Decode(&bin); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if bin.Expires-bin.Now != 86400*1000 {
+		t.Errorf("Expected a 24h lifetime, got %dms", bin.Expires-bin.Now)
+	}
+
+	// TTLs beyond the server maximum are rejected
+	tooLong := strconv.FormatInt(int64(maxTTL/time.Second)+1, 10)
+	req = httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"ttlSeconds": `+tooLong+`}`))
+	w = httptest.NewRecorder()
+	createBinHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestCreateCustomBinID(t *testing.T) {
+	clearDB(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"binId": "my-stripe-webhooks"}`))
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	var bin BinResponse
+	json.NewDecoder(w.Body).Decode(&bin)
+	if bin.BinID != "my-stripe-webhooks" {
+		t.Errorf("Expected binID my-stripe-webhooks, got %s", bin.BinID)
+	}
+
+	// Captures work against the vanity ID
+	captureReq := httptest.NewRequest(http.MethodPost, "/my-stripe-webhooks", strings.NewReader("test"))
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	if captureW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, captureW.Code)
+	}
+
+	tests := []struct {
+		binID string
+		code  int
+	}{
+		{"my-stripe-webhooks", http.StatusConflict},
+		{"api", http.StatusBadRequest},
+		{"API", http.StatusBadRequest},
+		{"ab", http.StatusBadRequest},
+		{"has/slash", http.StatusBadRequest},
+		{"-leading-dash", http.StatusBadRequest},
+		{strings.Repeat("x", 65), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"binId": "`+tt.binID+`"}`))
+		w := httptest.NewRecorder()
+		createBinHandler(w, req)
+		if w.Code != tt.code {
+			t.Errorf("binId %q: expected status code %d, got %d", tt.binID, tt.code, w.Code)
+		}
+	}
+}
+
+func TestPermanentBin(t *testing.T) {
+	clearDB(t)
+
+	// Disabled unless the server opts in
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"permanent": true}`))
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected status code %d, got %d", http.StatusForbidden, w.Code)
+	}
+
+	allowPermanent = true
+	defer func() { allowPermanent = false }()
+
+	req = httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"permanent": true}`))
+	w = httptest.NewRecorder()
+	createBinHandler(w, req)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected status code %d, got %d", http.StatusCreated, w.Code)
+	}
+
+	var bin BinResponse
+	json.NewDecoder(w.Body).Decode(&bin)
+	if bin.Expires != 0 {
+		t.Errorf("Expected expires 0 for a permanent bin, got %d", bin.Expires)
+	}
+
+	// Captures are accepted
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("test"))
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	if captureW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, captureW.Code)
+	}
+
+	// Extending a permanent bin must not give it an expiry
+	patchReq := httptest.NewRequest(http.MethodPatch, "/api/bin/"+bin.BinID, strings.NewReader(`{"extendMs": 1000}`))
+	patchW := httptest.NewRecorder()
+	patchBinHandler(patchW, patchReq)
+
+	var patched BinResponse
+	json.NewDecoder(patchW.Body).Decode(&patched)
+	if patched.Expires != 0 {
+		t.Errorf("Expected expires to stay 0 after extending, got %d", patched.Expires)
+	}
+}
+
+func TestPopRequest(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	for _, body := range []string{"first", "second", "third"} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	popReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/pop", nil)
+	popW := httptest.NewRecorder()
+	binAPIHandler(popW, popReq)
+
+	if popW.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, popW.Code)
+	}
+
+	var req Request
+	if err := json.NewDecoder(popW.Body).Decode(&req); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if req.Body != "third" {
+		t.Errorf("Expected the newest request body %q, got %v", "third", req.Body)
+	}
+
+	// Shift still returns the oldest, so pop and shift meet in the middle
+	shiftReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift", nil)
+	shiftW := httptest.NewRecorder()
+	binAPIHandler(shiftW, shiftReq)
+	json.NewDecoder(shiftW.Body).Decode(&req)
+	if req.Body != "first" {
+		t.Errorf("Expected the oldest request body %q, got %v", "first", req.Body)
+	}
+
+	popW = httptest.NewRecorder()
+	binAPIHandler(popW, popReq)
+	json.NewDecoder(popW.Body).Decode(&req)
+	if req.Body != "second" {
+		t.Errorf("Expected the remaining request body %q, got %v", "second", req.Body)
+	}
+
+	popW = httptest.NewRecorder()
+	binAPIHandler(popW, popReq)
+	if popW.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, popW.Code)
+	}
+}
+
+func TestBatchShift(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	for i := 0; i < 5; i++ {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"?n="+strconv.Itoa(i), nil)
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	shiftReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift?count=3", nil)
+	shiftW := httptest.NewRecorder()
+	binAPIHandler(shiftW, shiftReq)
+
+	if shiftW.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, shiftW.Code)
+	}
+
+	var reqs []Request
+	if err := json.NewDecoder(shiftW.Body).Decode(&reqs); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests, got %d", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.Query["n"] != strconv.Itoa(i) {
+			t.Errorf("Expected request %d at position %d, got %v", i, i, req.Query)
+		}
+	}
+
+	// Asking for more than remain returns what is left
+	shiftW = httptest.NewRecorder()
+	binAPIHandler(shiftW, shiftReq)
+	json.NewDecoder(shiftW.Body).Decode(&reqs)
+	if len(reqs) != 2 {
+		t.Errorf("Expected 2 remaining requests, got %d", len(reqs))
+	}
+
+	// An empty bin yields an empty array rather than a 404
+	shiftW = httptest.NewRecorder()
+	binAPIHandler(shiftW, shiftReq)
+	if shiftW.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, shiftW.Code)
+	}
+	if body := strings.TrimSpace(shiftW.Body.String()); body != "[]" {
+		t.Errorf("Expected an empty array, got %s", body)
+	}
+}
+
+func TestNextRequest(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	// Nothing arrives: the poll times out
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/next?timeout=50ms", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d on timeout, got %d", http.StatusNotFound, w.Code)
+	}
+
+	// A capture arriving while polling is returned and, with remove=true, consumed
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/next?timeout=5s&remove=true", nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		done <- w
+	}()
+
+	time.Sleep(50 * time.Millisecond)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hello"))
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	select {
+	case w = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Long poll did not return after a capture")
+	}
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+	var got Request
+	if err := json.NewDecoder(w.Body).Decode(&got); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if got.Body != "hello" {
+		t.Errorf("Expected body %q, got %v", "hello", got.Body)
+	}
+
+	var entries int
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&entries)
+	if entries != 0 {
+		t.Errorf("Expected the request to be removed, %d entries remain", entries)
+	}
+
+	// Without remove, existing requests after since are returned immediately
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("kept")))
+	req = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/next?timeout=1s&since=0", nil)
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	json.NewDecoder(w.Body).Decode(&got)
+	if got.Body != "kept" {
+		t.Errorf("Expected body %q, got %v", "kept", got.Body)
+	}
+	testDB.QueryRow("SELECT COUNT(*) FROM requests WHERE bin_id = ?", bin.BinID).Scan(&entries)
+	if entries != 1 {
+		t.Errorf("Expected the request to be kept, got %d entries", entries)
+	}
+
+	// Walking by cursor reaches requests captured in the same millisecond
+	later := time.Now().UnixMilli() + 60000
+	for _, id := range []string{"same1", "same2"} {
+		store.InsertRequest(context.Background(), Request{BinID: bin.BinID, ReqID: id, Inserted: later}, 0)
+	}
+	next := func(since string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		binAPIHandler(w, httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/next?timeout=50ms&since="+since, nil))
+		return w
+	}
+	for since, want := range map[string]string{strconv.FormatInt(later-1, 10): "same1", fmt.Sprintf("%d:same1", later): "same2"} {
+		got = Request{}
+		json.NewDecoder(next(since).Body).Decode(&got)
+		if got.ReqID != want {
+			t.Errorf("Expected %s after %s, got %q", want, since, got.ReqID)
+		}
+	}
+	if w := next(fmt.Sprintf("%d:same2", later)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected nothing after the last request, got %d", w.Code)
+	}
+	if w := next(strconv.FormatInt(later, 10)); w.Code != http.StatusNotFound {
+		t.Errorf("Expected a bare timestamp to pass its millisecond, got %d", w.Code)
+	}
+}
+
+func TestMaxEntriesEviction(t *testing.T) {
+	clearDB(t)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"maxEntries": 3}`))
+	w := httptest.NewRecorder()
+	createBinHandler(w, req)
+
+	var bin BinResponse
+	json.NewDecoder(w.Body).Decode(&bin)
+	if bin.MaxEntries != 3 {
+		t.Fatalf("Expected maxEntries 3, got %d", bin.MaxEntries)
+	}
+
+	for i := 0; i < 5; i++ {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"?n="+strconv.Itoa(i), nil)
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 3 {
+		t.Fatalf("Expected 3 requests to be kept, got %d", len(reqs))
+	}
+	for i, req := range reqs {
+		if req.Query["n"] != strconv.Itoa(i+2) {
+			t.Errorf("Expected the oldest requests to be evicted, position %d has %v", i, req.Query)
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/api/bin", strings.NewReader(`{"maxEntries": -1}`))
+	w = httptest.NewRecorder()
+	createBinHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d, got %d", http.StatusBadRequest, w.Code)
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	clearDB(t)
+	defer func() { maxBodyBytes, truncateBodies = 0, false }()
+
+	bin := createTestBin(t)
+	maxBodyBytes = 10
+
+	req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("0123456789"))
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a body at the limit to be captured, got %d", w.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("0123456789abc"))
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, req)
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status code %d, got %d", http.StatusRequestEntityTooLarge, w.Code)
+	}
+
+	truncateBodies = true
+	req = httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("0123456789abc"))
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+w.Body.String(), nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var stored Request
+	json.NewDecoder(getW.Body).Decode(&stored)
+	if stored.Body != "0123456789" || !stored.Truncated {
+		t.Errorf("Expected a truncated body of 10 bytes, got %q (truncated=%v)", stored.Body, stored.Truncated)
+	}
+}
+
+func TestMultiValueHeaders(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil)
+	captureReq.Header.Add("X-Forwarded-For", "10.0.0.1")
+	captureReq.Header.Add("X-Forwarded-For", "10.0.0.2")
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	// Requests stored by older versions have one string per header
+	testDB.Exec(`INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
+        VALUES ('legacy', ?, 'GET', '/', '{"X-Forwarded-For":"10.0.0.2"}', '{}', '""', '', 0)`, bin.BinID)
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?header=X-Forwarded-For:10.0.0.2", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected both requests to match the second value, got %d", len(reqs))
+	}
+	if got := reqs[0].Headers["X-Forwarded-For"]; len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Errorf("Expected the legacy header as a one-value list, got %v", got)
+	}
+	if got := reqs[1].Headers["X-Forwarded-For"]; len(got) != 2 || got[0] != "10.0.0.1" {
+		t.Errorf("Expected both header values in order, got %v", got)
+	}
+}
+
+func TestCaptureSubPath(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hooks/github?x=1", nil)
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	if captureW.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, captureW.Code)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var req Request
+	json.NewDecoder(getW.Body).Decode(&req)
+	if req.SubPath != "/hooks/github" || req.BinID != bin.BinID {
+		t.Errorf("Expected sub-path /hooks/github in bin %s, got %q in %s", bin.BinID, req.SubPath, req.BinID)
+	}
+
+	captureReq = httptest.NewRequest(http.MethodPost, "/nosuchbin/hooks/github", nil)
+	captureW = httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+	if captureW.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, captureW.Code)
+	}
+}
+
+func TestCaptureConnectionInfo(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "https://hooks.example.com/"+bin.BinID, strings.NewReader("12345"))
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var req Request
+	json.NewDecoder(getW.Body).Decode(&req)
+	if req.Host != "hooks.example.com" || req.Proto != "HTTP/1.1" || req.ContentLength != 5 {
+		t.Errorf("Expected host, proto and length to be recorded, got %q %q %d", req.Host, req.Proto, req.ContentLength)
+	}
+	if req.TLS == nil || req.TLS.Version != "TLS 1.2" || req.TLS.ServerName != "hooks.example.com" {
+		t.Errorf("Expected TLS details to be recorded, got %+v", req.TLS)
+	}
+
+	captureReq = httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil)
+	captureW = httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+
+	getReq = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+	getW = httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	req = Request{}
+	json.NewDecoder(getW.Body).Decode(&req)
+	if req.TLS != nil {
+		t.Errorf("Expected no TLS details for plain HTTP, got %+v", req.TLS)
+	}
+}
+
+// slowReader delivers its data in small chunks with a pause before each
+type slowReader struct {
+	data  string
+	pause time.Duration
+}
+
+func (s *slowReader) Read(p []byte) (int, error) {
+	if s.data == "" {
+		return 0, io.EOF
+	}
+	time.Sleep(s.pause)
+	n := copy(p[:1], s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func TestReceiveTiming(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	before := time.Now().UnixNano()
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, &slowReader{data: "abcd", pause: 10 * time.Millisecond})
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String(), nil)
+	getW := httptest.NewRecorder()
+	getRequestHandler(getW, getReq)
+
+	var req Request
+	json.NewDecoder(getW.Body).Decode(&req)
+	if req.ReceivedAt < before || req.ReceivedAt > time.Now().UnixNano() {
+		t.Errorf("Expected receivedAt between %d and now, got %d", before, req.ReceivedAt)
+	}
+	if req.ReadDurationMs < 40 {
+		t.Errorf("Expected the slow body to take at least 40ms to read, got %.3fms", req.ReadDurationMs)
+	}
+}
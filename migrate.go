@@ -0,0 +1,170 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Schema changes are versioned migrations, each applied once and recorded in
+// schema_migrations. Appending a migration is how a column or table is added
+// to existing deployments; a released migration is never edited, as
+// databases that already ran it won't run it again.
+const migrationsSchema = `
+        CREATE TABLE IF NOT EXISTS schema_migrations (
+            version BIGINT PRIMARY KEY,
+            name TEXT NOT NULL,
+            applied_at BIGINT NOT NULL
+        )`
+
+// migration is one change to the schema, run in a transaction of its own
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+// execMigration is a migration that runs a fixed set of statements
+func execMigration(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// migrator applies migrations to one kind of database
+type migrator struct {
+	migrations []migration
+	// rebind adapts the runner's ? placeholders, where the driver needs it
+	rebind func(string) string
+	// lock, run first in each migration's transaction, stops servers
+	// starting at once from running the same migration twice
+	lock string
+}
+
+// sqliteMigrations builds the local database. SQLite's transactions are
+// opened with _txlock=immediate, which already serializes migrations.
+var sqliteMigrations = migrator{
+	migrations: []migration{
+		// Databases from before migrations get whatever tables and columns
+		// they're missing, so this is safe to run over any of them
+		{1, "baseline", migrateSQLiteBaseline},
+		{2, "sealed bodies", execMigration("ALTER TABLE requests ADD COLUMN encrypted INTEGER NOT NULL DEFAULT 0")},
+		// Group cursors named a request by rowid, which only SQLite has
+		{3, "group cursor request ids", execMigration(`
+            ALTER TABLE consumer_groups ADD COLUMN cursor_req_id TEXT NOT NULL DEFAULT '';
+            UPDATE consumer_groups SET cursor_req_id = COALESCE((
+                SELECT MAX(req_id) FROM requests r WHERE r.bin_id = consumer_groups.bin_id
+                    AND r.inserted = consumer_groups.cursor_inserted AND r.rowid <= consumer_groups.cursor_rowid), '')`)},
+	},
+}
+
+// postgresMigrations builds the shared Postgres database
+var postgresMigrations = migrator{
+	migrations: []migration{
+		{1, "baseline", execMigration(postgresSchema)},
+		{2, "sealed bodies", execMigration("ALTER TABLE requests ADD COLUMN encrypted BOOLEAN NOT NULL DEFAULT false")},
+		{3, "storage usage", execMigration(postgresUsageSchema)},
+	},
+	rebind: rebind,
+	lock:   "SELECT pg_advisory_xact_lock(7270706)",
+}
+
+// migrateSQLiteBaseline creates the schema as it was when migrations were
+// introduced.
+func migrateSQLiteBaseline(tx *sql.Tx) error {
+	if _, err := tx.Exec(schema); err != nil {
+		return err
+	}
+	for _, up := range schemaUpgrades {
+		var exists int
+		err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?", up.table, up.column).
+			Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			_, err := tx.Exec("ALTER TABLE " + up.table + " ADD COLUMN " + up.column + " " + up.definition)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for _, statements := range []string{blobSchema, digestSchema, responseCursorSchema, assetSchema} {
+		if _, err := tx.Exec(statements); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// latest is the version the migrations bring a database to
+func (m migrator) latest() int {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+func (m migrator) bind(query string) string {
+	if m.rebind == nil {
+		return query
+	}
+	return m.rebind(query)
+}
+
+// run applies every migration the database hasn't had yet, in order. A
+// database migrated by a newer build is refused rather than being run with a
+// schema this build doesn't know.
+func (m migrator) run(conn *sql.DB) error {
+	if _, err := conn.Exec(migrationsSchema); err != nil {
+		return err
+	}
+	var version int
+	if err := conn.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_migrations").Scan(&version); err != nil {
+		return err
+	}
+	if version > m.latest() {
+		return fmt.Errorf("database schema is at version %d, newer than this build's %d", version, m.latest())
+	}
+
+	for _, mig := range m.migrations {
+		if mig.version <= version {
+			continue
+		}
+		if err := m.apply(conn, mig); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", mig.version, mig.name, err)
+		}
+	}
+	return nil
+}
+
+// apply runs a migration unless another server got to it first
+func (m migrator) apply(conn *sql.DB, mig migration) error {
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.lock != "" {
+		if _, err := tx.Exec(m.lock); err != nil {
+			return err
+		}
+	}
+	var applied int
+	err = tx.QueryRow(m.bind("SELECT COUNT(*) FROM schema_migrations WHERE version = ?"), mig.version).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+
+	if err := mig.up(tx); err != nil {
+		return err
+	}
+	_, err = tx.Exec(m.bind("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)"),
+		mig.version, mig.name, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
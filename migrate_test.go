@@ -0,0 +1,104 @@
+//go:build cgo
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func openMigrateTestDB(t *testing.T) *sql.DB {
+	conn, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "postbin.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMigrateOldDatabase(t *testing.T) {
+	// As created by a version from before most columns existed
+	conn := openMigrateTestDB(t)
+	_, err := conn.Exec(`
+        CREATE TABLE bins (bin_id TEXT PRIMARY KEY, created_at INTEGER, expires_at INTEGER);
+        CREATE TABLE requests (req_id TEXT PRIMARY KEY, bin_id TEXT, method TEXT, path TEXT,
+            headers TEXT, query TEXT, body TEXT, ip TEXT, inserted INTEGER);
+        INSERT INTO bins VALUES ('old', 0, 0);
+        INSERT INTO requests VALUES ('r1', 'old', 'GET', '/', '{}', '{}', '', '', 0);
+        CREATE TABLE consumer_groups (bin_id TEXT, name TEXT, cursor_inserted INTEGER NOT NULL DEFAULT 0,
+            cursor_rowid INTEGER NOT NULL DEFAULT 0, PRIMARY KEY(bin_id, name));
+        INSERT INTO consumer_groups VALUES ('old', 'g', 0, 1);`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := initSchema(conn); err != nil {
+		t.Fatal(err)
+	}
+	var tls string
+	if err := conn.QueryRow("SELECT tls FROM requests WHERE req_id = 'r1'").Scan(&tls); err != nil {
+		t.Errorf("Expected the missing columns to be added, got %v", err)
+	}
+	var cursor string
+	conn.QueryRow("SELECT cursor_req_id FROM consumer_groups WHERE name = 'g'").Scan(&cursor)
+	if cursor != "r1" {
+		t.Errorf("Expected the group's cursor to name r1, got %q", cursor)
+	}
+	var version int
+	conn.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if version != sqliteMigrations.latest() {
+		t.Errorf("Expected version %d recorded, got %d", sqliteMigrations.latest(), version)
+	}
+
+	// Starting again finds nothing to do
+	if err := initSchema(conn); err != nil {
+		t.Errorf("Expected a migrated database to start again, got %v", err)
+	}
+}
+
+func TestMigrator(t *testing.T) {
+	conn := openMigrateTestDB(t)
+	runs := 0
+	m := migrator{migrations: []migration{
+		{1, "things", execMigration("CREATE TABLE things (id INTEGER PRIMARY KEY)")},
+		{2, "count", func(tx *sql.Tx) error {
+			runs++
+			_, err := tx.Exec("ALTER TABLE things ADD COLUMN n INTEGER NOT NULL DEFAULT 0")
+			return err
+		}},
+	}}
+	for i := 0; i < 2; i++ {
+		if err := m.run(conn); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if runs != 1 {
+		t.Errorf("Expected the migration to run once, ran %d times", runs)
+	}
+
+	// A failed migration leaves nothing behind, so it's tried again
+	failed := errors.New("failed")
+	m.migrations = append(m.migrations, migration{3, "broken", func(tx *sql.Tx) error {
+		tx.Exec("CREATE TABLE half (id INTEGER)")
+		return failed
+	}})
+	if err := m.run(conn); !errors.Is(err, failed) {
+		t.Errorf("Expected the migration's error, got %v", err)
+	}
+	var tables int
+	conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE name = 'half'").Scan(&tables)
+	var version int
+	conn.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version)
+	if tables != 0 || version != 2 {
+		t.Errorf("Expected the failed migration to be rolled back, got %d tables at version %d", tables, version)
+	}
+
+	// An older build refuses a database a newer one migrated
+	m.migrations = m.migrations[:1]
+	if err := m.run(conn); err == nil || !strings.Contains(err.Error(), "newer") {
+		t.Errorf("Expected a newer database to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,459 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global NATS sink settings; overridable with command-line flags. When
+// natsURL is set every capture, in any bin, is published.
+var (
+	natsURL       string
+	natsSubject   = defaultNATSSubject
+	natsJetStream bool
+)
+
+const (
+	defaultNATSSubject = "postbin.{binId}"
+	natsTimeout        = 10 * time.Second
+)
+
+// NATSSinkConfig publishes each of a bin's captures to a NATS subject as
+// JSON. Subject may contain {binId}. With JetStream set each publish waits
+// for a stream to acknowledge it, and the request ID is sent as
+// Nats-Msg-Id so redeliveries are deduplicated.
+type NATSSinkConfig struct {
+	URL       string `json:"url"`
+	Subject   string `json:"subject,omitempty"`
+	JetStream bool   `json:"jetStream,omitempty"`
+}
+
+func (c NATSSinkConfig) validate() string {
+	if u, err := url.Parse(c.URL); err != nil || u.Scheme != "nats" || u.Host == "" {
+		return "nats url must look like nats://host:4222"
+	}
+	if c.Subject != "" && !validNATSSubject(expandNATSSubject(c.Subject, "bin")) {
+		return "nats subject must be dot-separated tokens without spaces or wildcards"
+	}
+	return ""
+}
+
+func validNATSSubject(subject string) bool {
+	for _, token := range strings.Split(subject, ".") {
+		if token == "" || token == "*" || token == ">" || strings.ContainsAny(token, " \t\r\n") {
+			return false
+		}
+	}
+	return true
+}
+
+func expandNATSSubject(template, binID string) string {
+	if template == "" {
+		template = defaultNATSSubject
+	}
+	return strings.ReplaceAll(template, "{binId}", binID)
+}
+
+// globalNATSSink is the sink configured with --nats-url, if any
+func globalNATSSink() *NATSSinkConfig {
+	if natsURL == "" {
+		return nil
+	}
+	return &NATSSinkConfig{URL: natsURL, Subject: natsSubject, JetStream: natsJetStream}
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "nats",
+		global: func() Sink {
+			if sink := globalNATSSink(); sink != nil {
+				return *sink
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.NATS != nil {
+				return *c.NATS
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver publishes a capture, waiting for its JetStream ack if the sink
+// asks for one. The client has its own timeouts.
+func (c NATSSinkConfig) Deliver(_ context.Context, req *Request) error {
+	value, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return natsClientFor(c.URL).publish(expandNATSSubject(c.Subject, req.BinID), value,
+		map[string]string{"Nats-Msg-Id": req.ReqID, "Postbin-Bin-Id": req.BinID}, c.JetStream)
+}
+
+var (
+	natsClientsMu sync.Mutex
+	natsClients   = map[string]*natsClient{}
+)
+
+// natsClientFor returns the shared client for a server URL
+func natsClientFor(rawURL string) *natsClient {
+	natsClientsMu.Lock()
+	defer natsClientsMu.Unlock()
+	c := natsClients[rawURL]
+	if c == nil {
+		c = &natsClient{url: rawURL}
+		natsClients[rawURL] = c
+	}
+	return c
+}
+
+// natsClient is a minimal NATS client: one connection, redialled when it
+// breaks, that publishes with headers and collects JetStream acks through a
+// wildcard inbox subscription.
+type natsClient struct {
+	url string
+
+	mu   sync.Mutex
+	conn *natsConn
+}
+
+// publish sends payload to subject, and with jetStream waits for the
+// stream's ack. A broken connection is redialled and the publish retried
+// once.
+func (c *natsClient) publish(subject string, payload []byte, headers map[string]string, jetStream bool) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var conn *natsConn
+		if conn, err = c.connect(); err != nil {
+			continue
+		}
+		if err = conn.publish(subject, payload, headers, jetStream); err == nil || !conn.broken() {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *natsClient) connect() (*natsConn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn != nil && !c.conn.broken() {
+		return c.conn, nil
+	}
+	conn, err := dialNATS(c.url)
+	if err != nil {
+		return nil, err
+	}
+	c.conn = conn
+	return conn, nil
+}
+
+// natsConn is a single connection to a NATS server. A background reader
+// answers pings, hands inbox messages to whoever is waiting on them, and
+// passes other messages to their subscription's handler.
+type natsConn struct {
+	conn  net.Conn
+	inbox string
+	// maxPayload is the largest message the server takes; it drops the
+	// connection over a bigger one
+	maxPayload int
+	// closed is closed when the connection breaks
+	closed chan struct{}
+
+	writeMu sync.Mutex
+
+	mu      sync.Mutex
+	err     error
+	next    int
+	waiting map[string]chan natsReply
+	subs    map[string]func([]byte)
+}
+
+// natsReply is a message received on the inbox: its status line, when it
+// had headers, and payload
+type natsReply struct {
+	status  string
+	payload []byte
+}
+
+func dialNATS(rawURL string) (*natsConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	raw, err := net.DialTimeout("tcp", host, natsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	raw.SetDeadline(time.Now().Add(natsTimeout))
+	rd := bufio.NewReader(raw)
+
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		raw.Close()
+		return nil, fmt.Errorf("nats: unexpected greeting %q", strings.TrimSpace(line))
+	}
+	var info struct {
+		Headers    bool `json:"headers"`
+		MaxPayload int  `json:"max_payload"`
+	}
+	json.Unmarshal([]byte(line[len("INFO "):]), &info)
+	if !info.Headers {
+		raw.Close()
+		return nil, errors.New("nats: server doesn't support headers (needs 2.2 or later)")
+	}
+
+	opts := map[string]interface{}{
+		"verbose": false, "pedantic": false, "name": "postbin", "lang": "go", "version": "1",
+		"protocol": 1, "headers": true, "no_responders": true,
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			opts["user"], opts["pass"] = u.User.Username(), pass
+		} else {
+			opts["auth_token"] = u.User.Username()
+		}
+	}
+	connect, _ := json.Marshal(opts)
+
+	var id [8]byte
+	rand.Read(id[:])
+	c := &natsConn{
+		conn:       raw,
+		inbox:      "_INBOX." + hex.EncodeToString(id[:]),
+		maxPayload: info.MaxPayload,
+		closed:     make(chan struct{}),
+		waiting:    map[string]chan natsReply{},
+		subs:       map[string]func([]byte){},
+	}
+	if _, err := fmt.Fprintf(raw, "CONNECT %s\r\nSUB %s.* 1\r\nPING\r\n", connect, c.inbox); err != nil {
+		raw.Close()
+		return nil, err
+	}
+	// The first PONG confirms the server accepted CONNECT
+	line, err = rd.ReadString('\n')
+	if err != nil {
+		raw.Close()
+		return nil, err
+	}
+	if strings.HasPrefix(line, "-ERR") {
+		raw.Close()
+		return nil, fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+	}
+	if strings.TrimSpace(line) != "PONG" {
+		raw.Close()
+		return nil, fmt.Errorf("nats: unexpected reply %q", strings.TrimSpace(line))
+	}
+	raw.SetDeadline(time.Time{})
+
+	go c.read(rd)
+	return c, nil
+}
+
+func (c *natsConn) broken() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.err != nil
+}
+
+// fail marks the connection unusable and wakes everyone waiting on it
+func (c *natsConn) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	c.conn.Close()
+	close(c.closed)
+	for inbox, ch := range c.waiting {
+		close(ch)
+		delete(c.waiting, inbox)
+	}
+}
+
+func (c *natsConn) write(s string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(natsTimeout))
+	_, err := c.conn.Write([]byte(s))
+	if err != nil {
+		c.fail(err)
+	}
+	return err
+}
+
+func (c *natsConn) read(rd *bufio.Reader) {
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "PING":
+			c.write("PONG\r\n")
+		case "-ERR":
+			c.fail(fmt.Errorf("nats: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR"))))
+			return
+		case "MSG", "HMSG":
+			reply, err := readNATSMessage(rd, fields)
+			if err != nil {
+				c.fail(err)
+				return
+			}
+			c.mu.Lock()
+			ch := c.waiting[fields[1]]
+			delete(c.waiting, fields[1])
+			handler := c.subs[fields[2]]
+			c.mu.Unlock()
+			if ch != nil {
+				ch <- reply
+			} else if handler != nil {
+				handler(reply.payload)
+			}
+		}
+	}
+}
+
+// readNATSMessage reads the rest of a MSG or HMSG whose control line was
+// split into fields: MSG subject sid [reply] size, or HMSG subject sid
+// [reply] hdrSize totalSize.
+func readNATSMessage(rd *bufio.Reader, fields []string) (natsReply, error) {
+	var reply natsReply
+	hdrSize := 0
+	total, err := strconv.Atoi(fields[len(fields)-1])
+	if err == nil && fields[0] == "HMSG" {
+		hdrSize, err = strconv.Atoi(fields[len(fields)-2])
+	}
+	if err != nil || hdrSize > total || total > 64<<20 {
+		return reply, fmt.Errorf("nats: bad message line %q", strings.Join(fields, " "))
+	}
+	buf := make([]byte, total+2)
+	if _, err := io.ReadFull(rd, buf); err != nil {
+		return reply, err
+	}
+	if hdrSize > 0 {
+		// NATS/1.0 [status [description]]
+		status := strings.SplitN(string(buf[:hdrSize]), "\r\n", 2)[0]
+		reply.status = strings.TrimSpace(strings.TrimPrefix(status, "NATS/1.0"))
+	}
+	reply.payload = buf[hdrSize:total]
+	return reply, nil
+}
+
+// subscribe has handler called, on the reader's goroutine, with the payload
+// of every message on subject. The subscription lasts as long as the
+// connection.
+func (c *natsConn) subscribe(subject string, handler func([]byte)) error {
+	c.mu.Lock()
+	if err := c.err; err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	// sid 1 is the inbox
+	sid := strconv.Itoa(len(c.subs) + 2)
+	c.subs[sid] = handler
+	c.mu.Unlock()
+	return c.write("SUB " + subject + " " + sid + "\r\n")
+}
+
+func (c *natsConn) publish(subject string, payload []byte, headers map[string]string, jetStream bool) error {
+	var hdr strings.Builder
+	hdr.WriteString("NATS/1.0\r\n")
+	for name, value := range headers {
+		hdr.WriteString(name + ": " + value + "\r\n")
+	}
+	hdr.WriteString("\r\n")
+	if size := hdr.Len() + len(payload); c.maxPayload > 0 && size > c.maxPayload {
+		return fmt.Errorf("nats: a %d-byte message is over the server's %d-byte limit", size, c.maxPayload)
+	}
+
+	reply := ""
+	var ack chan natsReply
+	if jetStream {
+		c.mu.Lock()
+		if err := c.err; err != nil {
+			c.mu.Unlock()
+			return err
+		}
+		c.next++
+		reply = c.inbox + "." + strconv.Itoa(c.next)
+		ack = make(chan natsReply, 1)
+		c.waiting[reply] = ack
+		c.mu.Unlock()
+		reply += " "
+	}
+
+	msg := fmt.Sprintf("HPUB %s %s%d %d\r\n%s%s\r\n", subject, reply, hdr.Len(), hdr.Len()+len(payload), hdr.String(), payload)
+	if err := c.write(msg); err != nil {
+		return err
+	}
+	if !jetStream {
+		return nil
+	}
+
+	select {
+	case r, ok := <-ack:
+		if !ok {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.err
+		}
+		return parseJetStreamAck(r)
+	case <-time.After(natsTimeout):
+		c.mu.Lock()
+		delete(c.waiting, strings.TrimSpace(reply))
+		c.mu.Unlock()
+		return errors.New("nats: timed out waiting for a JetStream ack")
+	}
+}
+
+func parseJetStreamAck(r natsReply) error {
+	if strings.HasPrefix(r.status, "503") {
+		return errors.New("nats: no JetStream stream is listening on the subject")
+	}
+	var ack struct {
+		Stream string `json:"stream"`
+		Error  *struct {
+			Code        int    `json:"code"`
+			Description string `json:"description"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(r.payload, &ack); err != nil {
+		return fmt.Errorf("nats: unexpected JetStream ack %q", r.payload)
+	}
+	if ack.Error != nil {
+		return fmt.Errorf("nats: JetStream error %d: %s", ack.Error.Code, ack.Error.Description)
+	}
+	if ack.Stream == "" {
+		return fmt.Errorf("nats: unexpected JetStream ack %q", r.payload)
+	}
+	return nil
+}
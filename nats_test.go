@@ -0,0 +1,144 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// natsMessage is a publish as the fake server received it
+type natsMessage struct {
+	subject, reply, headers string
+	payload                 []byte
+}
+
+// fakeNATSServer speaks enough of the NATS protocol to accept publishes.
+// Messages with a reply subject are answered with ack, as JetStream would.
+func fakeNATSServer(t *testing.T, ack string) (url string, msgs <-chan natsMessage) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	out := make(chan natsMessage, 16)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				fmt.Fprintf(conn, "INFO {\"server_id\":\"test\",\"headers\":true,\"max_payload\":1048576}\r\n")
+				rd := bufio.NewReader(conn)
+				sid := ""
+				for {
+					line, err := rd.ReadString('\n')
+					if err != nil {
+						return
+					}
+					fields := strings.Fields(line)
+					switch fields[0] {
+					case "CONNECT":
+					case "PING":
+						io.WriteString(conn, "PONG\r\n")
+					case "SUB":
+						sid = fields[2]
+					case "HPUB":
+						hdrSize, _ := strconv.Atoi(fields[len(fields)-2])
+						total, _ := strconv.Atoi(fields[len(fields)-1])
+						buf := make([]byte, total+2)
+						io.ReadFull(rd, buf)
+						msg := natsMessage{subject: fields[1], headers: string(buf[:hdrSize]), payload: buf[hdrSize:total]}
+						if len(fields) == 5 {
+							msg.reply = fields[2]
+							fmt.Fprintf(conn, "MSG %s %s %d\r\n%s\r\n", msg.reply, sid, len(ack), ack)
+						}
+						out <- msg
+					default:
+						t.Errorf("Unexpected NATS command %q", line)
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return "nats://" + ln.Addr().String(), out
+}
+
+func TestNATSSink(t *testing.T) {
+	clearDB(t)
+	url, msgs := fakeNATSServer(t, `{"stream":"POSTBIN","seq":1}`)
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"nats": {"url": "`+url+`"}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hello")))
+
+	select {
+	case msg := <-msgs:
+		var req Request
+		json.Unmarshal(msg.payload, &req)
+		if msg.subject != "postbin."+bin.BinID || msg.reply != "" || req.ReqID != w.Body.String() || req.RawBody != "hello" {
+			t.Errorf("Unexpected message %+v", msg)
+		}
+		if !strings.HasPrefix(msg.headers, "NATS/1.0\r\n") || !strings.Contains(msg.headers, "Nats-Msg-Id: "+req.ReqID+"\r\n") {
+			t.Errorf("Unexpected headers %q", msg.headers)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the NATS message")
+	}
+}
+
+func TestNATSJetStreamAck(t *testing.T) {
+	url, msgs := fakeNATSServer(t, `{"stream":"POSTBIN","seq":7}`)
+	client := natsClientFor(url)
+	if err := client.publish("postbin.x", []byte("{}"), nil, true); err != nil {
+		t.Fatalf("Expected the ack to be accepted, got %v", err)
+	}
+	if msg := <-msgs; msg.reply == "" {
+		t.Error("Expected a JetStream publish to ask for a reply")
+	}
+
+	url, _ = fakeNATSServer(t, `{"error":{"code":400,"description":"bad"}}`)
+	err := natsClientFor(url).publish("postbin.x", []byte("{}"), nil, true)
+	if err == nil || !strings.Contains(err.Error(), "bad") {
+		t.Errorf("Expected the JetStream error, got %v", err)
+	}
+}
+
+func TestNATSSinkValidation(t *testing.T) {
+	for _, cfg := range []NATSSinkConfig{
+		{},
+		{URL: "http://localhost:4222"},
+		{URL: "nats://localhost:4222", Subject: "a.>"},
+		{URL: "nats://localhost:4222", Subject: "a..b"},
+	} {
+		if (BinConfig{NATS: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
+
+func TestNATSMaxPayload(t *testing.T) {
+	url, _ := fakeNATSServer(t, "")
+	client := natsClientFor(url)
+	err := client.publish("postbin.x", make([]byte, 2<<20), nil, false)
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Errorf("Expected a message over max_payload to be refused, got %v", err)
+	}
+	if err := client.publish("postbin.x", []byte("{}"), nil, false); err != nil {
+		t.Errorf("Expected the connection to survive, got %v", err)
+	}
+}
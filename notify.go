@@ -0,0 +1,345 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// publicURL is where postbin is reached from outside, for links in
+// notifications; overridable with a command-line flag. Without it links are
+// built from the Host each capture was sent to.
+var publicURL string
+
+const (
+	notifyTimeout = 10 * time.Second
+	// notifySnippet is the most of a body a notification quotes, in bytes
+	notifySnippet = 300
+)
+
+var notifyClient = &http.Client{Timeout: notifyTimeout}
+
+// telegramAPI is the Bot API's address; tests point it at a fake
+var telegramAPI = "https://api.telegram.org"
+
+// NotifyConfig posts a short message about each of a bin's captures to
+// chat, or only those matching Filter: a query string of listing filters
+// such as "method=POST&pathPrefix=/stripe". Any number of the notifiers may
+// be set.
+type NotifyConfig struct {
+	Slack    *SlackNotifier    `json:"slack,omitempty"`
+	Discord  *DiscordNotifier  `json:"discord,omitempty"`
+	Telegram *TelegramNotifier `json:"telegram,omitempty"`
+	Filter   string            `json:"filter,omitempty"`
+	// Rules replace notifying of every capture
+	Rules []AlertRule `json:"rules,omitempty"`
+	// Digest is "hourly" or "daily", to be sent a summary of the captures
+	// instead of a message about each one
+	Digest string `json:"digest,omitempty"`
+}
+
+// SlackNotifier posts to a Slack incoming webhook
+type SlackNotifier struct {
+	WebhookURL string `json:"webhookUrl"`
+}
+
+// DiscordNotifier posts to a Discord channel webhook
+type DiscordNotifier struct {
+	WebhookURL string `json:"webhookUrl"`
+}
+
+// TelegramNotifier sends messages as a Telegram bot. ChatID is a chat's
+// numeric ID or a public channel's @username.
+type TelegramNotifier struct {
+	BotToken string `json:"botToken"`
+	ChatID   string `json:"chatId"`
+}
+
+func (c NotifyConfig) validate() string {
+	if len(c.notifiers()) == 0 {
+		return "notify needs a notifier: slack, discord or telegram"
+	}
+	if c.Slack != nil {
+		if msg := validateWebhookURL("notify slack webhookUrl", c.Slack.WebhookURL); msg != "" {
+			return msg
+		}
+	}
+	if c.Discord != nil {
+		if msg := validateWebhookURL("notify discord webhookUrl", c.Discord.WebhookURL); msg != "" {
+			return msg
+		}
+	}
+	if c.Telegram != nil {
+		if c.Telegram.BotToken == "" || strings.ContainsAny(c.Telegram.BotToken, "/?#") {
+			return "notify telegram needs the botToken BotFather gave you"
+		}
+		if c.Telegram.ChatID == "" {
+			return "notify telegram needs a chatId"
+		}
+	}
+	q, err := url.ParseQuery(c.Filter)
+	if err == nil {
+		_, err = parseRequestFilter(q)
+	}
+	if err != nil {
+		return "notify filter: " + err.Error()
+	}
+	if c.Digest != "" && c.Digest != digestHourly && c.Digest != digestDaily {
+		return "notify digest must be hourly or daily"
+	}
+	if len(c.Rules) > 0 && c.Filter != "" {
+		return "notify filter can't be combined with rules; give the rules a match instead"
+	}
+	names := map[string]bool{}
+	for _, rule := range c.Rules {
+		if names[rule.Name] {
+			return fmt.Sprintf("notify rule %q is listed twice", rule.Name)
+		}
+		names[rule.Name] = true
+		if msg := rule.validate(); msg != "" {
+			return msg
+		}
+	}
+	return ""
+}
+
+// validateWebhookURL checks a URL postbin will post to; name says which
+func validateWebhookURL(name, raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return name + " must be an absolute http or https URL"
+	}
+	return ""
+}
+
+func init() {
+	registerSink(sinkKind{
+		name:   "notify",
+		global: func() Sink { return nil },
+		forBin: func(c BinConfig) Sink {
+			if c.Notify != nil {
+				return *c.Notify
+			}
+			return nil
+		},
+	})
+}
+
+// notifier is a chat service a notification can be posted to
+type notifier interface {
+	notify(ctx context.Context, n notification) error
+}
+
+func (c NotifyConfig) notifiers() []notifier {
+	var out []notifier
+	if c.Slack != nil {
+		out = append(out, c.Slack)
+	}
+	if c.Discord != nil {
+		out = append(out, c.Discord)
+	}
+	if c.Telegram != nil {
+		out = append(out, c.Telegram)
+	}
+	return out
+}
+
+// notification is a message about captures, formatted by each notifier in
+// its own markup. Snippet and Link may be empty.
+type notification struct {
+	Title   string
+	Snippet string
+	Link    string
+	// LinkText describes Link; it defaults to "View request"
+	LinkText string
+}
+
+func (n notification) linkText() string {
+	if n.LinkText == "" {
+		return "View request"
+	}
+	return n.LinkText
+}
+
+func newCaptureNotification(req *Request) notification {
+	return notification{
+		Title:   req.Method + " " + req.Path,
+		Snippet: bodySnippet(req.RawBody),
+		Link:    requestLink(req),
+	}
+}
+
+// bodySnippet quotes the start of a body, or describes it when it isn't text
+func bodySnippet(body string) string {
+	if body == "" {
+		return ""
+	}
+	if !utf8.ValidString(body) || strings.ContainsRune(body, 0) {
+		return fmt.Sprintf("(%d bytes of binary data)", len(body))
+	}
+	if len(body) <= notifySnippet {
+		return body
+	}
+	cut := notifySnippet
+	for !utf8.RuneStart(body[cut]) {
+		cut--
+	}
+	return body[:cut] + "…"
+}
+
+// requestLink is the URL of a capture in the API
+func requestLink(req *Request) string {
+	return apiBase(req) + "/api/bin/" + url.PathEscape(req.BinID) + "/req/" + url.PathEscape(req.ReqID)
+}
+
+// apiBase is the scheme and host links are built on: --public-url, or else
+// where req was sent. It's "" when there's neither.
+func apiBase(req *Request) string {
+	switch {
+	case publicURL != "":
+		return strings.TrimSuffix(publicURL, "/")
+	case req == nil || req.Host == "":
+		return ""
+	case req.TLS != nil:
+		return "https://" + req.Host
+	default:
+		return "http://" + req.Host
+	}
+}
+
+// Deliver posts a notification about a capture to every notifier, if it
+// matches the filter, or checks it against the rules when there are some.
+// Bins with a digest and no rules aren't sent each capture.
+func (c NotifyConfig) Deliver(ctx context.Context, req *Request) error {
+	if c.Filter != "" {
+		matched, err := captureMatches(ctx, req, c.Filter)
+		if err != nil || !matched {
+			return err
+		}
+	}
+	if len(c.Rules) > 0 {
+		return c.checkRules(ctx, req)
+	}
+	if c.Digest != "" {
+		return nil
+	}
+	return c.send(ctx, newCaptureNotification(req))
+}
+
+// send posts a notification to every notifier. Every notifier is tried;
+// the first failure is returned.
+func (c NotifyConfig) send(ctx context.Context, n notification) error {
+	var first error
+	for _, nt := range c.notifiers() {
+		if err := nt.notify(ctx, n); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// captureMatches reports whether a stored capture matches a query string of
+// listing filters
+func captureMatches(ctx context.Context, req *Request, filter string) (bool, error) {
+	q, _ := url.ParseQuery(filter)
+	f, err := parseRequestFilter(q)
+	if err != nil {
+		return false, err
+	}
+	return f.matches(storedRequest(*req)), nil
+}
+
+func (s *SlackNotifier) notify(ctx context.Context, n notification) error {
+	text := "*" + slackEscape(n.Title) + "*"
+	if n.Snippet != "" {
+		text += "\n```" + slackEscape(n.Snippet) + "```"
+	}
+	if n.Link != "" {
+		text += "\n<" + n.Link + "|" + n.linkText() + ">"
+	}
+	return postNotification(ctx, "slack", s.WebhookURL, map[string]interface{}{
+		"text": n.Title,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{"type": "mrkdwn", "text": text},
+			},
+		},
+	})
+}
+
+// slackEscape escapes the characters Slack's mrkdwn treats as markup
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func (d *DiscordNotifier) notify(ctx context.Context, n notification) error {
+	embed := map[string]string{"title": n.Title}
+	if n.Link != "" {
+		embed["url"] = n.Link
+	}
+	if n.Snippet != "" {
+		// Backticks in the body would end the code block early
+		embed["description"] = "```\n" + strings.ReplaceAll(n.Snippet, "```", "`\u200b``") + "\n```"
+	}
+	return postNotification(ctx, "discord", d.WebhookURL, map[string]interface{}{
+		"embeds": []interface{}{embed},
+		// Bodies can contain @everyone; it shouldn't ping anyone
+		"allowed_mentions": map[string][]string{"parse": {}},
+	})
+}
+
+func (t *TelegramNotifier) notify(ctx context.Context, n notification) error {
+	text := "<b>" + html.EscapeString(n.Title) + "</b>"
+	if n.Snippet != "" {
+		text += "\n<pre>" + html.EscapeString(n.Snippet) + "</pre>"
+	}
+	if n.Link != "" {
+		text += "\n<a href=\"" + html.EscapeString(n.Link) + "\">" + n.linkText() + "</a>"
+	}
+	err := postNotification(ctx, "telegram", telegramAPI+"/bot"+t.BotToken+"/sendMessage", map[string]interface{}{
+		"chat_id":                  t.ChatID,
+		"text":                     text,
+		"parse_mode":               "HTML",
+		"disable_web_page_preview": true,
+	})
+	// The token is part of the URL, which mustn't end up in logs or stats
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = telegramAPI + "/bot…/sendMessage"
+	}
+	return err
+}
+
+// postNotification sends a JSON payload, failing unless the service
+// replies with a 2xx status
+func postNotification(ctx context.Context, service, target string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	resp, err := notifyClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s: %s", service, resp.Status, bytes.TrimSpace(raw))
+	}
+	return nil
+}
@@ -0,0 +1,150 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeChat records the JSON payloads posted to it
+type fakeChat struct {
+	mu       sync.Mutex
+	payloads []map[string]interface{}
+	status   int
+}
+
+func newFakeChat(t *testing.T) (*fakeChat, *httptest.Server) {
+	chat := &fakeChat{status: http.StatusOK}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		chat.mu.Lock()
+		defer chat.mu.Unlock()
+		var payload map[string]interface{}
+		if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+			t.Errorf("Expected a JSON payload: %v", err)
+		}
+		payload["path"] = r.URL.Path
+		chat.payloads = append(chat.payloads, payload)
+		w.WriteHeader(chat.status)
+	}))
+	t.Cleanup(server.Close)
+	return chat, server
+}
+
+func TestSlackNotification(t *testing.T) {
+	clearDB(t)
+	chat, server := newFakeChat(t)
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"notify": {"slack": {"webhookUrl": "`+server.URL+`/hook"}, "filter": "method=POST"}}`)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "http://example.com/"+bin.BinID+"/orders", strings.NewReader(`{"total": "<5 & up>"}`)))
+	waitForSinks(t)
+
+	chat.mu.Lock()
+	defer chat.mu.Unlock()
+	if len(chat.payloads) != 1 {
+		t.Fatalf("Expected only the POST to notify, got %v", chat.payloads)
+	}
+	payload := chat.payloads[0]
+	if payload["path"] != "/hook" || payload["text"] != "POST /"+bin.BinID+"/orders" {
+		t.Errorf("Unexpected payload %v", payload)
+	}
+	text := payload["blocks"].([]interface{})[0].(map[string]interface{})["text"].(map[string]interface{})["text"].(string)
+	link := "http://example.com/api/bin/" + bin.BinID + "/req/" + w.Body.String()
+	if !strings.Contains(text, "```{\"total\": \"&lt;5 &amp; up&gt;\"}```") || !strings.Contains(text, "<"+link+"|View request>") {
+		t.Errorf("Unexpected message %q", text)
+	}
+}
+
+func TestNotifyFailure(t *testing.T) {
+	chat, server := newFakeChat(t)
+	chat.status = http.StatusNotFound
+	cfg := NotifyConfig{Slack: &SlackNotifier{WebhookURL: server.URL}}
+	err := cfg.Deliver(context.Background(), &Request{Method: "POST", Path: "/bin", BinID: "bin", ReqID: "req"})
+	if err == nil || !strings.HasPrefix(err.Error(), "slack: 404") {
+		t.Errorf("Expected the failed post to be reported, got %v", err)
+	}
+}
+
+func TestDiscordAndTelegramNotifications(t *testing.T) {
+	chat, server := newFakeChat(t)
+	old := telegramAPI
+	t.Cleanup(func() { telegramAPI = old })
+	telegramAPI = server.URL
+
+	cfg := NotifyConfig{
+		Discord:  &DiscordNotifier{WebhookURL: server.URL + "/discord"},
+		Telegram: &TelegramNotifier{BotToken: "123:abc", ChatID: "@hooks"},
+	}
+	req := &Request{Method: "POST", Path: "/bin/x", RawBody: "a ``` <b>", Host: "example.com", BinID: "bin", ReqID: "req"}
+	if err := cfg.Deliver(context.Background(), req); err != nil {
+		t.Fatal(err)
+	}
+	if len(chat.payloads) != 2 {
+		t.Fatalf("Expected a post to each, got %v", chat.payloads)
+	}
+
+	discord := chat.payloads[0]
+	embed := discord["embeds"].([]interface{})[0].(map[string]interface{})
+	if discord["path"] != "/discord" || embed["title"] != "POST /bin/x" || embed["url"] != "http://example.com/api/bin/bin/req/req" ||
+		embed["description"] != "```\na `\u200b`` <b>\n```" {
+		t.Errorf("Unexpected Discord payload %v", discord)
+	}
+
+	telegram := chat.payloads[1]
+	want := "<b>POST /bin/x</b>\n<pre>a ``` &lt;b&gt;</pre>\n<a href=\"http://example.com/api/bin/bin/req/req\">View request</a>"
+	if telegram["path"] != "/bot123:abc/sendMessage" || telegram["chat_id"] != "@hooks" || telegram["parse_mode"] != "HTML" || telegram["text"] != want {
+		t.Errorf("Unexpected Telegram payload %v", telegram)
+	}
+}
+
+func TestTelegramErrorHidesToken(t *testing.T) {
+	old := telegramAPI
+	t.Cleanup(func() { telegramAPI = old })
+	telegramAPI = "http://127.0.0.1:1"
+	err := (&TelegramNotifier{BotToken: "123:secret", ChatID: "1"}).notify(context.Background(), notification{})
+	if err == nil || strings.Contains(err.Error(), "secret") {
+		t.Errorf("Expected an error without the token, got %v", err)
+	}
+}
+
+func TestBodySnippet(t *testing.T) {
+	long := strings.Repeat("é", notifySnippet)
+	if got := bodySnippet(long); len(got) > notifySnippet+len("…") || !strings.HasSuffix(got, "é…") {
+		t.Errorf("Expected a truncated snippet, got %q", got)
+	}
+	if got := bodySnippet("\x00\x01\xff"); got != "(3 bytes of binary data)" {
+		t.Errorf("Unexpected snippet for a binary body %q", got)
+	}
+}
+
+func TestRequestLink(t *testing.T) {
+	old := publicURL
+	t.Cleanup(func() { publicURL = old })
+	publicURL = "https://postbin.example.com/"
+	if got := requestLink(&Request{Host: "internal:8080", BinID: "b", ReqID: "r"}); got != "https://postbin.example.com/api/bin/b/req/r" {
+		t.Errorf("Unexpected link %q", got)
+	}
+}
+
+func TestNotifyValidation(t *testing.T) {
+	for _, cfg := range []NotifyConfig{
+		{},
+		{Slack: &SlackNotifier{WebhookURL: "hooks.slack.com/services/x"}},
+		{Discord: &DiscordNotifier{}},
+		{Telegram: &TelegramNotifier{BotToken: "123:abc"}},
+		{Telegram: &TelegramNotifier{BotToken: "../getMe?", ChatID: "1"}},
+		{Slack: &SlackNotifier{WebhookURL: "https://hooks.slack.com/services/x"}, Filter: "since=yesterday"},
+	} {
+		if (BinConfig{Notify: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
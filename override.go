@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Reserved query parameters that shape the reply to a single capture,
+// for ad hoc failures without changing the bin's config. They're stored
+// with the rest of the query.
+const (
+	overrideStatusParam = "__status"
+	overrideDelayParam  = "__delay"
+)
+
+// responseOverride is a capture's own say over its reply
+type responseOverride struct {
+	status int
+	delay  time.Duration
+}
+
+// parseResponseOverride reads the reserved parameters from a capture's
+// query, returning nil when there are none. __delay is a Go duration such
+// as 2s or 150ms, or a bare number of milliseconds.
+func parseResponseOverride(q url.Values) (*responseOverride, error) {
+	var o responseOverride
+	if v := q.Get(overrideStatusParam); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 200 || status > 599 {
+			return nil, fmt.Errorf("%s must be a status between 200 and 599", overrideStatusParam)
+		}
+		o.status = status
+	}
+	if v := q.Get(overrideDelayParam); v != "" {
+		delay, err := time.ParseDuration(v)
+		if ms, msErr := strconv.Atoi(v); msErr == nil {
+			delay, err = time.Duration(ms)*time.Millisecond, nil
+		}
+		if err != nil || delay < 0 || delay > maxResponseDelay {
+			return nil, fmt.Errorf("%s must be a duration between 0 and %s", overrideDelayParam, maxResponseDelay)
+		}
+		o.delay = delay
+	}
+	if o == (responseOverride{}) {
+		return nil, nil
+	}
+	return &o, nil
+}
+
+// apply holds the reply back by the override's delay, then with a status
+// answers the capture itself, with its request ID, reporting whether it
+// did. The bin's own response, proxy or chaos only run when it didn't.
+func (o responseOverride) apply(ctx context.Context, w http.ResponseWriter, req Request) bool {
+	if o.delay > 0 && !sinkSleep(ctx, o.delay) {
+		return true
+	}
+	if o.status == 0 {
+		return false
+	}
+	w.WriteHeader(o.status)
+	w.Write([]byte(req.ReqID))
+	return true
+}
@@ -0,0 +1,53 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestResponseOverride(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"response": {"status": 201, "body": "configured"}}`)
+
+	start := time.Now()
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"?__status=503&__delay=50ms", nil))
+	if w.Code != http.StatusServiceUnavailable || w.Body.String() == "configured" {
+		t.Errorf("Expected the override's status, got %d %s", w.Code, w.Body)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Errorf("Expected the reply to be held back by __delay")
+	}
+
+	var query string
+	if err := db.QueryRow("SELECT query FROM requests WHERE req_id = ?", w.Body.String()).Scan(&query); err != nil {
+		t.Fatalf("Expected the capture to be stored under the ID it was answered with: %v", err)
+	}
+	if query != `{"__delay":"50ms","__status":"503"}` {
+		t.Errorf("Expected the reserved parameters to be stored, got %s", query)
+	}
+
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"?__delay=10", nil))
+	if w.Code != http.StatusCreated || w.Body.String() != "configured" {
+		t.Errorf("Expected a delay alone to keep the configured response, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestResponseOverrideValidation(t *testing.T) {
+	for _, raw := range []string{"__status=abc", "__status=99", "__delay=soon", "__delay=-1s", "__delay=1h"} {
+		q, _ := url.ParseQuery(raw)
+		if _, err := parseResponseOverride(q); err == nil {
+			t.Errorf("Expected %s to be rejected", raw)
+		}
+	}
+	if o, err := parseResponseOverride(url.Values{"keep": {"1"}}); o != nil || err != nil {
+		t.Errorf("Expected no override without reserved parameters, got %+v %v", o, err)
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the networks whose forwarding headers are believed;
+// set with --trusted-proxies.
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies reads a comma-separated list of CIDRs or bare IPs.
+func parseTrustedProxies(list string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", entry)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func isTrustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// stripPort removes a port and IPv6 brackets from a forwarded address
+func stripPort(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(addr, "["), "]")
+}
+
+// forwardedChain returns the addresses a request passed through, client
+// first, from the Forwarded header or, failing that, X-Forwarded-For.
+func forwardedChain(h http.Header) []string {
+	var chain []string
+	for _, value := range h.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					chain = append(chain, stripPort(strings.Trim(v, `"`)))
+				}
+			}
+		}
+	}
+	if len(chain) > 0 {
+		return chain
+	}
+
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, addr := range strings.Split(value, ",") {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				chain = append(chain, stripPort(addr))
+			}
+		}
+	}
+	return chain
+}
+
+// clientIP works out who sent a request. Forwarding headers are only
+// believed when the connection comes from a trusted proxy, and are then
+// walked from the nearest hop outwards to the first untrusted address. The
+// full chain of hops, ending with the connecting peer, is returned as well.
+func clientIP(r *http.Request) (ip string, hops []string) {
+	chain := forwardedChain(r.Header)
+	if len(chain) == 0 {
+		return r.RemoteAddr, nil
+	}
+
+	peer := stripPort(r.RemoteAddr)
+	hops = append(chain, peer)
+	if !isTrustedProxy(peer) {
+		return r.RemoteAddr, hops
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		if !isTrustedProxy(chain[i]) {
+			return chain[i], hops
+		}
+	}
+	// Every hop is a trusted proxy; the furthest one is the best we know
+	return chain[0], hops
+}
@@ -0,0 +1,56 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	var err error
+	trustedProxies, err = parseTrustedProxies("10.0.0.0/8, 192.168.1.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { trustedProxies = nil }()
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		value      string
+		wantIP     string
+		wantHops   []string
+	}{
+		{"no forwarding", "203.0.113.9:5000", "", "", "203.0.113.9:5000", nil},
+		{"untrusted peer", "203.0.113.9:5000", "X-Forwarded-For", "1.2.3.4", "203.0.113.9:5000",
+			[]string{"1.2.3.4", "203.0.113.9"}},
+		{"trusted peer", "10.0.0.5:5000", "X-Forwarded-For", "1.2.3.4", "1.2.3.4",
+			[]string{"1.2.3.4", "10.0.0.5"}},
+		{"spoofed prefix", "192.168.1.1:5000", "X-Forwarded-For", "6.6.6.6, 1.2.3.4, 10.1.1.1", "1.2.3.4",
+			[]string{"6.6.6.6", "1.2.3.4", "10.1.1.1", "192.168.1.1"}},
+		{"forwarded header", "10.0.0.5:5000", "Forwarded", `for="[2001:db8::1]:4711";proto=https, for=10.2.2.2`,
+			"2001:db8::1", []string{"2001:db8::1", "10.2.2.2", "10.0.0.5"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPost, "/bin", nil)
+		req.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			req.Header.Set(tt.header, tt.value)
+		}
+		ip, hops := clientIP(req)
+		if ip != tt.wantIP {
+			t.Errorf("%s: expected client IP %q, got %q", tt.name, tt.wantIP, ip)
+		}
+		if !reflect.DeepEqual(hops, tt.wantHops) {
+			t.Errorf("%s: expected hops %v, got %v", tt.name, tt.wantHops, hops)
+		}
+	}
+
+	if _, err := parseTrustedProxies("10.0.0.0/33"); err == nil {
+		t.Error("Expected an invalid CIDR to be rejected")
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Global Pub/Sub sink settings; overridable with command-line flags. The
+// sink authenticates with the service account key in
+// $GOOGLE_APPLICATION_CREDENTIALS, or talks to the emulator at
+// $PUBSUB_EMULATOR_HOST.
+var (
+	pubsubTopic  string
+	globalPubSub *PubSubSinkConfig
+)
+
+const (
+	defaultPubSubEndpoint = "https://pubsub.googleapis.com"
+	pubsubAudience        = "https://pubsub.googleapis.com/"
+	pubsubTimeout         = 10 * time.Second
+	pubsubBatchBytes      = 5 << 20
+	pubsubAttempts        = 5
+)
+
+var pubsubClient = &http.Client{Timeout: pubsubTimeout}
+
+var pubsubTopicPattern = regexp.MustCompile(`^projects/[a-z][-a-z0-9]{4,28}[a-z0-9]/topics/[A-Za-z][-A-Za-z0-9_.~+%]{2,254}$`)
+
+// PubSubSinkConfig publishes each of a bin's captures to a Google Cloud
+// Pub/Sub topic as JSON, with binId and reqId attributes. Topic is a full
+// name such as projects/my-project/topics/webhooks and may contain {binId}
+// for a topic per bin. Messages are published in capture order with the
+// bin ID as ordering key, so subscriptions with ordering enabled see each
+// bin's captures in the order they arrived.
+type PubSubSinkConfig struct {
+	Topic string `json:"topic"`
+	// Credentials is a service account key, as downloaded from the console
+	Credentials json.RawMessage `json:"credentials,omitempty"`
+	// Endpoint replaces pubsub.googleapis.com, e.g. with the emulator's
+	// http://localhost:8085, which needs no credentials
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+func (c PubSubSinkConfig) validate() string {
+	if !pubsubTopicPattern.MatchString(expandPubSubTopic(c.Topic, "bin0")) {
+		return "pubsub topic must look like projects/{project}/topics/{topic}"
+	}
+	if c.Endpoint != "" {
+		if !strings.HasPrefix(c.Endpoint, "http://") && !strings.HasPrefix(c.Endpoint, "https://") {
+			return "pubsub endpoint must be an absolute http or https URL"
+		}
+	} else if len(c.Credentials) == 0 {
+		return "pubsub needs service account credentials"
+	}
+	if len(c.Credentials) > 0 {
+		if _, err := parseGoogleServiceAccount(c.Credentials); err != nil {
+			return err.Error()
+		}
+	}
+	return ""
+}
+
+func expandPubSubTopic(template, binID string) string {
+	return strings.ReplaceAll(template, "{binId}", binID)
+}
+
+// loadGlobalPubSubSink sets up the sink for --pubsub-topic from the
+// environment, failing if it couldn't be used
+func loadGlobalPubSubSink(topic string) (*PubSubSinkConfig, error) {
+	sink := &PubSubSinkConfig{Topic: topic}
+	if host := os.Getenv("PUBSUB_EMULATOR_HOST"); host != "" {
+		sink.Endpoint = "http://" + host
+	} else if file := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); file != "" {
+		raw, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		sink.Credentials = raw
+	}
+	if msg := sink.validate(); msg != "" {
+		return nil, errors.New("--pubsub-topic: " + msg)
+	}
+	return sink, nil
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "pubsub",
+		global: func() Sink {
+			if globalPubSub != nil {
+				return *globalPubSub
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.PubSub != nil {
+				return *c.PubSub
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver publishes one capture
+func (c PubSubSinkConfig) Deliver(ctx context.Context, req *Request) error {
+	return c.DeliverBatch(ctx, []*Request{req})
+}
+
+// DeliverBatch publishes captures in order, with one call per topic for up
+// to pubsubBatchBytes of them. It stops at the first failure, since
+// publishing later captures would break their ordering.
+func (c PubSubSinkConfig) DeliverBatch(ctx context.Context, reqs []*Request) error {
+	p, err := pubsubPublisherFor(c)
+	if err != nil {
+		return err
+	}
+	var topics []string
+	byTopic := map[string][]pubsubMessage{}
+	for _, req := range reqs {
+		data, err := json.Marshal(req)
+		if err != nil {
+			return err
+		}
+		topic := expandPubSubTopic(c.Topic, req.BinID)
+		if _, ok := byTopic[topic]; !ok {
+			topics = append(topics, topic)
+		}
+		byTopic[topic] = append(byTopic[topic], pubsubMessage{
+			Data:        data,
+			Attributes:  map[string]string{"binId": req.BinID, "reqId": req.ReqID},
+			OrderingKey: req.BinID,
+		})
+	}
+
+	for _, topic := range topics {
+		for msgs := byTopic[topic]; len(msgs) > 0; {
+			n, size := 1, len(msgs[0].Data)
+			for n < len(msgs) && size+len(msgs[n].Data) <= pubsubBatchBytes {
+				size += len(msgs[n].Data)
+				n++
+			}
+			if err := p.send(ctx, topic, msgs[:n]); err != nil {
+				return err
+			}
+			msgs = msgs[n:]
+		}
+	}
+	return nil
+}
+
+// pubsubMessage is a message in a publish call; Data is sent base64-encoded
+type pubsubMessage struct {
+	Data        []byte            `json:"data"`
+	Attributes  map[string]string `json:"attributes"`
+	OrderingKey string            `json:"orderingKey,omitempty"`
+}
+
+var (
+	pubsubPublishersMu sync.Mutex
+	pubsubPublishers   = map[string]*pubsubPublisher{}
+)
+
+// pubsubPublisher makes publish calls to one endpoint with one service
+// account, whose tokens it reuses
+type pubsubPublisher struct {
+	endpoint string
+	account  *googleServiceAccount
+}
+
+// pubsubPublisherFor returns the shared publisher for a sink's endpoint and
+// credentials
+func pubsubPublisherFor(sink PubSubSinkConfig) (*pubsubPublisher, error) {
+	endpoint := sink.Endpoint
+	if endpoint == "" {
+		endpoint = defaultPubSubEndpoint
+	}
+	key := endpoint + "\x00" + string(sink.Credentials)
+
+	pubsubPublishersMu.Lock()
+	defer pubsubPublishersMu.Unlock()
+	if p := pubsubPublishers[key]; p != nil {
+		return p, nil
+	}
+	p := &pubsubPublisher{endpoint: strings.TrimSuffix(endpoint, "/")}
+	if len(sink.Credentials) > 0 {
+		account, err := parseGoogleServiceAccount(sink.Credentials)
+		if err != nil {
+			return nil, err
+		}
+		p.account = account
+	}
+	pubsubPublishers[key] = p
+	return p, nil
+}
+
+// send publishes messages to topic, retrying with backoff before giving up
+func (p *pubsubPublisher) send(ctx context.Context, topic string, msgs []pubsubMessage) error {
+	body, err := json.Marshal(map[string][]pubsubMessage{"messages": msgs})
+	if err != nil {
+		return err
+	}
+	wait := time.Second
+	for attempt := 1; ; attempt++ {
+		retry, err := p.publish(ctx, topic, body)
+		if err == nil || !retry || attempt == pubsubAttempts || !sinkSleep(ctx, wait) {
+			return err
+		}
+		wait *= 2
+	}
+}
+
+// publish makes one publish call, reporting whether a failure is worth
+// retrying
+func (p *pubsubPublisher) publish(ctx context.Context, topic string, body []byte) (retry bool, err error) {
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.endpoint+"/v1/"+topic+":publish", bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	if p.account != nil {
+		token, err := p.account.token(pubsubAudience)
+		if err != nil {
+			return false, err
+		}
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := pubsubClient.Do(httpReq)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode == http.StatusOK {
+		return false, nil
+	}
+	var parsed struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	msg := string(bytes.TrimSpace(raw))
+	if json.Unmarshal(raw, &parsed) == nil && parsed.Error.Message != "" {
+		msg = parsed.Error.Message
+	}
+	retry = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+	return retry, fmt.Errorf("pubsub: %s: %s", resp.Status, msg)
+}
+
+// googleServiceAccount signs its own access tokens: Google APIs accept a
+// JWT signed with the account's key in place of an OAuth token, so no
+// token exchange is needed.
+type googleServiceAccount struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+
+	key     *rsa.PrivateKey
+	mu      sync.Mutex
+	jwt     string
+	expires time.Time
+}
+
+func parseGoogleServiceAccount(raw []byte) (*googleServiceAccount, error) {
+	var account googleServiceAccount
+	if err := json.Unmarshal(raw, &account); err != nil || account.ClientEmail == "" {
+		return nil, errors.New("pubsub credentials must be a service account key")
+	}
+	block, _ := pem.Decode([]byte(account.PrivateKey))
+	if block == nil {
+		return nil, errors.New("pubsub credentials have no private_key")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if err != nil || !ok {
+		return nil, errors.New("pubsub credentials private_key must be an RSA key")
+	}
+	account.key = rsaKey
+	return &account, nil
+}
+
+// token returns a JWT for audience, reusing one until shortly before it
+// expires
+func (a *googleServiceAccount) token(audience string) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	if a.jwt != "" && now.Before(a.expires.Add(-5*time.Minute)) {
+		return a.jwt, nil
+	}
+
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": a.PrivateKeyID})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss": a.ClientEmail,
+		"sub": a.ClientEmail,
+		"aud": audience,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Hour).Unix(),
+	})
+	signing := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signing))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, a.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	a.jwt = signing + "." + base64.RawURLEncoding.EncodeToString(sig)
+	a.expires = now.Add(time.Hour)
+	return a.jwt, nil
+}
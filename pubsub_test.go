@@ -0,0 +1,151 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testServiceAccount returns a service account key and its public half
+func testServiceAccount(t *testing.T) (json.RawMessage, *rsa.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, _ := x509.MarshalPKCS8PrivateKey(key)
+	raw, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "postbin@my-project.iam.gserviceaccount.com",
+		"private_key_id": "key1",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	return raw, &key.PublicKey
+}
+
+func TestPubSubSink(t *testing.T) {
+	clearDB(t)
+	creds, pub := testServiceAccount(t)
+
+	type publishCall struct {
+		path     string
+		messages []pubsubMessage
+	}
+	calls := make(chan publishCall, 16)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), ".")
+		if len(parts) != 3 {
+			t.Errorf("Unexpected Authorization %q", r.Header.Get("Authorization"))
+			http.Error(w, "", http.StatusUnauthorized)
+			return
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+			t.Errorf("Bad token signature: %v", err)
+		}
+		var claims map[string]interface{}
+		raw, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		json.Unmarshal(raw, &claims)
+		if claims["aud"] != pubsubAudience || claims["iss"] != "postbin@my-project.iam.gserviceaccount.com" {
+			t.Errorf("Unexpected claims %v", claims)
+		}
+
+		var body struct{ Messages []pubsubMessage }
+		json.NewDecoder(r.Body).Decode(&body)
+		calls <- publishCall{r.URL.Path, body.Messages}
+		w.Write([]byte(`{"messageIds":["1"]}`))
+	}))
+	defer server.Close()
+
+	bin := createTestBin(t)
+	cfg, _ := json.Marshal(map[string]interface{}{"pubsub": PubSubSinkConfig{
+		Topic:       "projects/my-project/topics/bin-{binId}",
+		Credentials: creds,
+		Endpoint:    server.URL,
+	}})
+	setTestConfig(t, bin.BinID, string(cfg))
+
+	var reqIDs []string
+	for i := 0; i < 5; i++ {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hello")))
+		reqIDs = append(reqIDs, w.Body.String())
+	}
+
+	var got []string
+	for len(got) < len(reqIDs) {
+		select {
+		case call := <-calls:
+			if call.path != "/v1/projects/my-project/topics/bin-"+bin.BinID+":publish" {
+				t.Errorf("Unexpected publish to %s", call.path)
+			}
+			for _, msg := range call.messages {
+				var req Request
+				json.Unmarshal(msg.Data, &req)
+				if msg.OrderingKey != bin.BinID || msg.Attributes["binId"] != bin.BinID || msg.Attributes["reqId"] != req.ReqID {
+					t.Errorf("Unexpected message %+v", msg)
+				}
+				got = append(got, req.ReqID)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for Pub/Sub messages, got %v", got)
+		}
+	}
+	if strings.Join(got, ",") != strings.Join(reqIDs, ",") {
+		t.Errorf("Expected captures in order %v, got %v", reqIDs, got)
+	}
+}
+
+func TestPubSubPublishErrors(t *testing.T) {
+	status := http.StatusServiceUnavailable
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		w.Write([]byte(`{"error":{"code":404,"message":"Resource not found (resource=webhooks)."}}`))
+	}))
+	defer server.Close()
+
+	p := &pubsubPublisher{endpoint: server.URL}
+	if retry, err := p.publish(context.Background(), "projects/my-project/topics/webhooks", []byte(`{}`)); !retry || err == nil {
+		t.Errorf("Expected a 503 to be retried, got %v, %v", retry, err)
+	}
+	status = http.StatusNotFound
+	if retry, err := p.publish(context.Background(), "projects/my-project/topics/webhooks", []byte(`{}`)); retry || err == nil || !strings.Contains(err.Error(), "Resource not found") {
+		t.Errorf("Expected a 404 to fail with its message, got %v, %v", retry, err)
+	}
+}
+
+func TestPubSubSinkValidation(t *testing.T) {
+	creds, _ := testServiceAccount(t)
+	for _, cfg := range []PubSubSinkConfig{
+		{},
+		{Topic: "webhooks", Credentials: creds},
+		{Topic: "projects/my-project/topics/webhooks"},
+		{Topic: "projects/my-project/topics/webhooks", Credentials: json.RawMessage(`{"client_email":"x"}`)},
+		{Topic: "projects/my-project/topics/webhooks", Endpoint: "localhost:8085"},
+	} {
+		if (BinConfig{PubSub: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+	for _, cfg := range []PubSubSinkConfig{
+		{Topic: "projects/my-project/topics/webhooks", Credentials: creds},
+		{Topic: "projects/my-project/topics/{binId}", Endpoint: "http://localhost:8085"},
+	} {
+		if msg := cfg.validate(); msg != "" {
+			t.Errorf("Expected %+v to be accepted, got %q", cfg, msg)
+		}
+	}
+}
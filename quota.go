@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Storage quota settings; overridable with command-line flags. A maxStorageBytes
+// of zero disables the quota.
+var (
+	maxStorageBytes int64
+	storagePolicy   = "reject"
+)
+
+// errInsufficientStorage is returned when a capture doesn't fit in the quota
+var errInsufficientStorage = errors.New("storage quota exceeded")
+
+// quotaSchema returns the storage_usage table, holding a running total of
+// requestBytes across all requests, and the triggers keeping it current so
+// every insert and delete path is accounted for. The triggers are recreated on
+// startup so they always match requestBytes.
+func quotaSchema() string {
+	return `
+        CREATE TABLE IF NOT EXISTS storage_usage (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            bytes INTEGER NOT NULL
+        );
+        DROP TRIGGER IF EXISTS requests_usage_ai;
+        DROP TRIGGER IF EXISTS requests_usage_ad;
+        DROP TRIGGER IF EXISTS requests_usage_au;
+        CREATE TRIGGER requests_usage_ai AFTER INSERT ON requests BEGIN
+            UPDATE storage_usage SET bytes = bytes + (` + rowBytes("new.") + `);
+        END;
+        CREATE TRIGGER requests_usage_ad AFTER DELETE ON requests BEGIN
+            UPDATE storage_usage SET bytes = bytes - (` + rowBytes("old.") + `);
+        END;
+        CREATE TRIGGER requests_usage_au AFTER UPDATE OF ` + strings.Join(storedColumns, ", ") + `, blob_size ON requests BEGIN
+            UPDATE storage_usage SET bytes = bytes - (` + rowBytes("old.") + `) + (` + rowBytes("new.") + `);
+        END;
+    `
+}
+
+// initQuota creates the usage table and triggers, recounting usage from scratch
+// so the total is right even if the database was modified by other tools.
+func initQuota(conn *sql.DB) error {
+	if _, err := conn.Exec(quotaSchema()); err != nil {
+		return err
+	}
+	_, err := conn.Exec("INSERT OR REPLACE INTO storage_usage (id, bytes) SELECT 1, COALESCE(SUM(" +
+		requestBytes + "), 0) FROM requests")
+	return err
+}
+
+// validateStoragePolicy checks the --storage-policy flag
+func validateStoragePolicy(policy string) error {
+	if policy != "reject" && policy != "evict" {
+		return fmt.Errorf("unknown storage policy %q, expected reject or evict", policy)
+	}
+	return nil
+}
+
+// enforceQuota makes room for size more bytes within tx. Under the "evict"
+// policy the oldest requests across all bins are deleted until the new one
+// fits; under "reject", or when it can never fit, errInsufficientStorage is
+// returned.
+func enforceQuota(ctx context.Context, tx *sql.Tx, size int64) error {
+	if maxStorageBytes <= 0 {
+		return nil
+	}
+	if size > maxStorageBytes {
+		return errInsufficientStorage
+	}
+
+	for {
+		var used int64
+		if err := tx.QueryRowContext(ctx, "SELECT bytes FROM storage_usage WHERE id = 1").Scan(&used); err != nil {
+			return err
+		}
+		if used+size <= maxStorageBytes {
+			return nil
+		}
+		if storagePolicy != "evict" {
+			return errInsufficientStorage
+		}
+
+		res, err := tx.ExecContext(ctx, `
+            DELETE FROM requests WHERE rowid IN (
+                SELECT rowid FROM requests ORDER BY inserted ASC, rowid ASC LIMIT 100)`)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errInsufficientStorage
+		}
+	}
+}
+
+// requestSize is the storage a request uses, counted as requestBytes counts
+// a row, for stores that keep their usage in Go
+func requestSize(req Request) int64 {
+	headersJSON, _ := json.Marshal(req.Headers)
+	queryJSON, _ := json.Marshal(req.Query)
+	bodyJSON, _ := json.Marshal(req.RawBody)
+	parsed, _ := req.Body.(json.RawMessage)
+	return int64(len(headersJSON)+len(queryJSON)+len(bodyJSON)+len(parsed)+len(req.encodedBody)) + req.BodySize
+}
+
+// makeRoom is enforceQuota for the other stores: used reads their running
+// total, and evictOldest deletes the oldest requests in any bin, reporting
+// false once there are none.
+func makeRoom(size int64, used func() (int64, error), evictOldest func() (bool, error)) error {
+	if maxStorageBytes <= 0 {
+		return nil
+	}
+	if size > maxStorageBytes {
+		return errInsufficientStorage
+	}
+	for {
+		n, err := used()
+		if err != nil || n+size <= maxStorageBytes {
+			return err
+		}
+		if storagePolicy != "evict" {
+			return errInsufficientStorage
+		}
+		if evicted, err := evictOldest(); err != nil {
+			return err
+		} else if !evicted {
+			return errInsufficientStorage
+		}
+	}
+}
@@ -0,0 +1,77 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStorageUsageTracking(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for i := 0; i < 3; i++ {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("payload"))
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+	shiftReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift", nil)
+	binAPIHandler(httptest.NewRecorder(), shiftReq)
+
+	var tracked, actual int64
+	testDB.QueryRow("SELECT bytes FROM storage_usage").Scan(&tracked)
+	testDB.QueryRow("SELECT COALESCE(SUM(" + requestBytes + "), 0) FROM requests").Scan(&actual)
+	if tracked != actual || actual == 0 {
+		t.Errorf("Expected tracked usage to match the %d bytes stored, got %d", actual, tracked)
+	}
+}
+
+func TestStorageQuota(t *testing.T) {
+	clearDB(t)
+	defer func() { maxStorageBytes, storagePolicy = 0, "reject" }()
+
+	bin := createTestBin(t)
+	capture := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, req)
+		return w.Code
+	}
+
+	// Size the quota to fit two captures
+	capture(strings.Repeat("x", 100))
+	var one int64
+	testDB.QueryRow("SELECT bytes FROM storage_usage").Scan(&one)
+	maxStorageBytes = 2 * one
+
+	storagePolicy = "reject"
+	if code := capture(strings.Repeat("x", 100)); code != http.StatusOK {
+		t.Fatalf("Expected the second capture to fit, got %d", code)
+	}
+	if code := capture(strings.Repeat("x", 100)); code != http.StatusInsufficientStorage {
+		t.Errorf("Expected status code %d once full, got %d", http.StatusInsufficientStorage, code)
+	}
+
+	storagePolicy = "evict"
+	if code := capture(strings.Repeat("y", 100)); code != http.StatusOK {
+		t.Fatalf("Expected eviction to make room, got %d", code)
+	}
+	var entries int
+	var used int64
+	testDB.QueryRow("SELECT COUNT(*), (SELECT bytes FROM storage_usage) FROM requests").Scan(&entries, &used)
+	if used > maxStorageBytes {
+		t.Errorf("Expected usage within %d bytes, got %d", maxStorageBytes, used)
+	}
+	var newest string
+	testDB.QueryRow("SELECT body FROM requests ORDER BY rowid DESC LIMIT 1").Scan(&newest)
+	if !strings.Contains(newest, "yyy") {
+		t.Errorf("Expected the new capture to be stored, newest is %s", newest)
+	}
+
+	// A request larger than the whole quota never fits
+	if code := capture(strings.Repeat("z", 1000)); code != http.StatusInsufficientStorage {
+		t.Errorf("Expected status code %d for an oversized capture, got %d", http.StatusInsufficientStorage, code)
+	}
+}
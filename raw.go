@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// wireHead renders a request's start line and headers in HTTP/1.1 wire
+// format. Go's server has already parsed them, so header names come out
+// canonicalised and sorted. Framing headers are left out; rawRequestHandler
+// adds a Content-Length matching the stored body.
+func wireHead(r *http.Request) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s %s %s\r\n", r.Method, r.RequestURI, r.Proto)
+	fmt.Fprintf(&b, "Host: %s\r\n", r.Host)
+	r.Header.WriteSubset(&b, map[string]bool{"Content-Length": true, "Transfer-Encoding": true})
+	return b.String()
+}
+
+// rawRequestHandler serves GET /api/bin/{id}/req/{reqId}/raw: the captured
+// request as a message/http document that can be replayed with other tools.
+func rawRequestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req, ok := lookupRequest(w, r)
+	if !ok {
+		return
+	}
+	if req.rawHead == "" {
+		http.Error(w, `{"msg":"Request was captured without its raw form"}`, http.StatusNotFound)
+		return
+	}
+	body, size, err := openOriginalBody(r.Context(), req)
+	if err != nil {
+		writeBodyError(w, err)
+		return
+	}
+	defer body.Close()
+
+	w.Header().Set("Content-Type", "message/http")
+	io.WriteString(w, req.rawHead)
+	if size > 0 || req.ContentLength >= 0 {
+		fmt.Fprintf(w, "Content-Length: %d\r\n", size)
+	}
+	io.WriteString(w, "\r\n")
+	io.Copy(w, body)
+}
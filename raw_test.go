@@ -0,0 +1,49 @@
+//go:build cgo
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRawRequest(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hook?a=1&a=2", strings.NewReader(`{"ok":true}`))
+	captureReq.Header.Set("Content-Type", "application/json")
+	captureReq.Header.Add("X-Trace", "one")
+	captureReq.Header.Add("X-Trace", "two")
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, captureReq)
+
+	rawReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+captureW.Body.String()+"/raw", nil)
+	rawW := httptest.NewRecorder()
+	binAPIHandler(rawW, rawReq)
+	if rawW.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, rawW.Code)
+	}
+	if ct := rawW.Header().Get("Content-Type"); ct != "message/http" {
+		t.Errorf("Expected Content-Type message/http, got %q", ct)
+	}
+
+	// The raw form must parse back into the same request
+	replayed, err := http.ReadRequest(bufio.NewReader(rawW.Body))
+	if err != nil {
+		t.Fatalf("Expected a parseable request, got %v", err)
+	}
+	if replayed.Method != http.MethodPost || replayed.RequestURI != "/"+bin.BinID+"/hook?a=1&a=2" {
+		t.Errorf("Expected the original request line, got %s %s", replayed.Method, replayed.RequestURI)
+	}
+	if got := replayed.Header.Values("X-Trace"); len(got) != 2 || got[1] != "two" {
+		t.Errorf("Expected both X-Trace values, got %v", got)
+	}
+	if body, _ := io.ReadAll(replayed.Body); string(body) != `{"ok":true}` {
+		t.Errorf("Expected the original body, got %q", body)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replay limits; a replay runs inside the API call, so it is bounded
+const (
+	maxReplayConcurrency = 32
+	defaultReplayTimeout = 10 * time.Second
+	maxReplayTimeout     = time.Minute
+)
+
+// resendSkippedHeaders are left out when a capture is sent again: the client
+// sets them from the URL and body, or they only describe the hop the request
+// was captured on
+var resendSkippedHeaders = map[string]bool{
+	"Host":              true,
+	"Content-Length":    true,
+	"Transfer-Encoding": true,
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Upgrade":           true,
+	"Te":                true,
+	"Trailer":           true,
+}
+
+// resendURL is where a capture is sent again: the captured URL, or when
+// target is given, target with the capture's sub-path and query appended
+func resendURL(req Request, target string) (string, error) {
+	if target == "" {
+		return captureURL(req), nil
+	}
+	base, err := url.Parse(target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		return "", fmt.Errorf("target must be an absolute http or https URL")
+	}
+	_, _, rawQuery := requestTarget(req)
+	if req.SubPath != "" {
+		base.Path = strings.TrimSuffix(base.Path, "/") + req.SubPath
+		base.RawPath = ""
+	}
+	if rawQuery != "" {
+		if base.RawQuery != "" {
+			base.RawQuery += "&"
+		}
+		base.RawQuery += rawQuery
+	}
+	return base.String(), nil
+}
+
+// newResendRequest builds the outgoing copy of a capture, with its headers
+// and the body as it was sent
+func newResendRequest(ctx context.Context, req Request, targetURL string, body []byte) (*http.Request, error) {
+	out, err := http.NewRequestWithContext(ctx, req.Method, targetURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range req.Headers {
+		if !resendSkippedHeaders[name] {
+			out.Header[name] = append([]string(nil), values...)
+		}
+	}
+	return out, nil
+}
+
+// ReplayOptions is the body of POST /api/bin/{binId}/replay
+type ReplayOptions struct {
+	Target string `json:"target"`
+	// Concurrency is how many requests are in flight at once (default 1)
+	Concurrency int `json:"concurrency"`
+	// RatePerSecond caps how often requests are started; 0 is unlimited
+	RatePerSecond float64 `json:"ratePerSecond"`
+	// Order is oldest (the default) or newest first
+	Order     string `json:"order"`
+	TimeoutMs int    `json:"timeoutMs"`
+	// Rules rewrite each request before it's sent
+	Rules *RewriteRules `json:"rules,omitempty"`
+}
+
+// ReplayResult reports what happened to one replayed request. Status is 0
+// when no response arrived, with Error saying why.
+type ReplayResult struct {
+	ReqID     string  `json:"reqId"`
+	URL       string  `json:"url"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+
+	// snippet is the start of the target's response body
+	snippet string
+}
+
+// maxResponseSnippet is how much of a target's response is kept with a delivery
+const maxResponseSnippet = 1024
+
+type ReplayResponse struct {
+	BinID     string         `json:"binId"`
+	Target    string         `json:"target"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Results   []ReplayResult `json:"results"`
+}
+
+// ok reports whether the target accepted the request
+func (r ReplayResult) ok() bool {
+	return r.Error == "" && r.Status > 0 && r.Status < 400
+}
+
+// replayClient doesn't follow redirects, so that they're reported as such
+func replayClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// replayOne sends a capture to target, rewritten by rw, and reports the outcome
+func replayOne(ctx context.Context, client *http.Client, req Request, target string, rw *rewriter) ReplayResult {
+	result := ReplayResult{ReqID: req.ReqID}
+	body, err := readOriginalBody(ctx, req)
+	if err != nil {
+		result.Error = "reading body: " + err.Error()
+		return result
+	}
+	req, body, err = rw.apply(req, body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	return sendCapture(ctx, client, req, body, target)
+}
+
+// sendCapture sends req with the given body to target, as replayOne does
+// once the body is loaded and rewritten
+func sendCapture(ctx context.Context, client *http.Client, req Request, body []byte, target string) ReplayResult {
+	result := ReplayResult{ReqID: req.ReqID}
+	targetURL, err := resendURL(req, target)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.URL = targetURL
+	out, err := newResendRequest(ctx, req, targetURL, body)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	start := time.Now()
+	resp, err := client.Do(out)
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSnippet))
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	result.Status = resp.StatusCode
+	result.snippet = strings.ToValidUTF8(string(snippet), "\uFFFD")
+	return result
+}
+
+// replay sends reqs to the target in order, keeping up to opts.Concurrency
+// requests in flight and starting them no faster than opts.RatePerSecond.
+// Results are in the same order as reqs.
+func replay(ctx context.Context, reqs []Request, opts ReplayOptions, rw *rewriter) []ReplayResult {
+	client := replayClient(time.Duration(opts.TimeoutMs) * time.Millisecond)
+	results := make([]ReplayResult, len(reqs))
+	sem := make(chan struct{}, opts.Concurrency)
+	var wg sync.WaitGroup
+
+	var interval time.Duration
+	if opts.RatePerSecond > 0 {
+		interval = time.Duration(float64(time.Second) / opts.RatePerSecond)
+	}
+	start := time.Now()
+	for i, req := range reqs {
+		if interval > 0 {
+			if wait := time.Until(start.Add(time.Duration(i) * interval)); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+			}
+		}
+		if ctx.Err() != nil {
+			results[i] = ReplayResult{ReqID: req.ReqID, Error: "replay cancelled"}
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, req Request) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			results[i] = replayOne(ctx, client, req, opts.Target, rw)
+		}(i, req)
+	}
+	wg.Wait()
+	return results
+}
+
+// replayHandler serves POST /api/bin/{binId}/replay: every captured request
+// matching the listing filters in the query string is sent to the target, and
+// the call returns once they've all completed.
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/replay")
+
+	var opts ReplayOptions
+	if err := json.NewDecoder(r.Body).Decode(&opts); err != nil {
+		http.Error(w, `{"msg":"Invalid request body"}`, http.StatusBadRequest)
+		return
+	}
+	if msg := opts.validate(); msg != "" {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, msg), http.StatusBadRequest)
+		return
+	}
+	rw, err := opts.Rules.compile()
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, "rules: "+err.Error()), http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	reqs, err := loadExportRequests(r.Context(), binID, filter)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+	if reqs == nil {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	}
+	if opts.Order == "newest" {
+		for i, j := 0, len(reqs)-1; i < j; i, j = i+1, j-1 {
+			reqs[i], reqs[j] = reqs[j], reqs[i]
+		}
+	}
+
+	resp := ReplayResponse{BinID: binID, Target: opts.Target}
+	resp.Results = replay(r.Context(), reqs, opts, rw)
+	recordReplayDeliveries(r.Context(), binID, "replay", resp.Results)
+	for _, result := range resp.Results {
+		if result.ok() {
+			resp.Succeeded++
+		} else {
+			resp.Failed++
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// validate fills in defaults and returns a message describing the first bad
+// option, or ""
+func (o *ReplayOptions) validate() string {
+	if o.Target == "" {
+		return "target is required"
+	}
+	if _, err := resendURL(Request{}, o.Target); err != nil {
+		return err.Error()
+	}
+	if o.Concurrency == 0 {
+		o.Concurrency = 1
+	}
+	if o.Concurrency < 1 || o.Concurrency > maxReplayConcurrency {
+		return fmt.Sprintf("concurrency must be between 1 and %d", maxReplayConcurrency)
+	}
+	if o.RatePerSecond < 0 {
+		return "ratePerSecond must not be negative"
+	}
+	if o.Order == "" {
+		o.Order = "oldest"
+	}
+	if o.Order != "oldest" && o.Order != "newest" {
+		return "order must be oldest or newest"
+	}
+	if o.TimeoutMs == 0 {
+		o.TimeoutMs = int(defaultReplayTimeout / time.Millisecond)
+	}
+	if o.TimeoutMs < 0 || time.Duration(o.TimeoutMs)*time.Millisecond > maxReplayTimeout {
+		return fmt.Sprintf("timeoutMs must be between 1 and %d", maxReplayTimeout/time.Millisecond)
+	}
+	return ""
+}
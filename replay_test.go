@@ -0,0 +1,159 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	clearDB(t)
+
+	var mu sync.Mutex
+	var paths, bodies []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		paths = append(paths, r.URL.RequestURI())
+		bodies = append(bodies, string(body))
+		mu.Unlock()
+		if r.URL.Path == "/local/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	for _, c := range []struct{ method, path, body string }{
+		{http.MethodPost, "/ok?n=1", "one"},
+		{http.MethodGet, "/skipped", ""},
+		{http.MethodPost, "/fail", "two"},
+	} {
+		req := httptest.NewRequest(c.method, "/"+bin.BinID+c.path, strings.NewReader(c.body))
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay?method=POST",
+		strings.NewReader(`{"target": "`+srv.URL+`/local", "order": "newest"}`))
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var resp ReplayResponse
+	json.NewDecoder(w.Body).Decode(&resp)
+	if len(resp.Results) != 2 || resp.Succeeded != 1 || resp.Failed != 1 {
+		t.Fatalf("Expected one success and one failure, got %+v", resp)
+	}
+	if resp.Results[0].Status != http.StatusInternalServerError || resp.Results[1].Status != http.StatusOK {
+		t.Errorf("Expected results newest first, got %+v", resp.Results)
+	}
+	if strings.Join(paths, ",") != "/local/fail,/local/ok?n=1" || strings.Join(bodies, ",") != "two,one" {
+		t.Errorf("Unexpected deliveries %v %v", paths, bodies)
+	}
+}
+
+func TestReplayRecordsDeliveries(t *testing.T) {
+	clearDB(t)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		io.WriteString(w, `{"error":"unknown event"}`+strings.Repeat(" ", 2*maxResponseSnippet))
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	capture := httptest.NewRecorder()
+	captureRequestHandler(capture, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hook", strings.NewReader("x")))
+	reqID := capture.Body.String()
+
+	w := httptest.NewRecorder()
+	binAPIHandler(w, httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay",
+		strings.NewReader(`{"target": "`+srv.URL+`"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	binAPIHandler(w, httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/"+reqID+"/deliveries", nil))
+	var deliveries []Delivery
+	json.NewDecoder(w.Body).Decode(&deliveries)
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected the replay to be recorded, got %+v", deliveries)
+	}
+	d := deliveries[0]
+	if d.Kind != deliveryReplay || d.Target != "replay" || d.URL != srv.URL+"/hook" || d.Status != deliveryFailed ||
+		d.StatusCode != http.StatusUnprocessableEntity || d.Attempts != 1 || d.LatencyMs <= 0 {
+		t.Errorf("Unexpected delivery %+v", d)
+	}
+	if len(d.ResponseSnippet) != maxResponseSnippet || !strings.HasPrefix(d.ResponseSnippet, `{"error":"unknown event"}`) {
+		t.Errorf("Expected the first %d bytes of the response, got %q", maxResponseSnippet, d.ResponseSnippet)
+	}
+}
+
+func TestReplayConcurrencyAndRate(t *testing.T) {
+	clearDB(t)
+
+	var inFlight, maxInFlight int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	for i := 0; i < 6; i++ {
+		captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay",
+		strings.NewReader(`{"target": "`+srv.URL+`", "concurrency": 2}`))
+	binAPIHandler(httptest.NewRecorder(), req)
+	if maxInFlight != 2 {
+		t.Errorf("Expected 2 requests in flight at most, got %d", maxInFlight)
+	}
+
+	start := time.Now()
+	req = httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay",
+		strings.NewReader(`{"target": "`+srv.URL+`", "concurrency": 6, "ratePerSecond": 50}`))
+	binAPIHandler(httptest.NewRecorder(), req)
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected 6 requests at 50/s to take at least 100ms, took %v", elapsed)
+	}
+}
+
+func TestReplayOptions(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{
+		`{}`,
+		`{"target": "ftp://example.com"}`,
+		`{"target": "http://localhost:1", "concurrency": 100}`,
+		`{"target": "http://localhost:1", "order": "random"}`,
+		`{"target": "http://localhost:1", "ratePerSecond": -1}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// ResponseConfig replaces the request ID postbin replies to captures with.
+// When Template is set Body is a Go template of the capture, so a reply can
+// echo part of the request back, such as {{ .JSON.challenge }} or
+// {{ .Headers.X-Request-Id }}. Script instead computes the reply with a
+// Starlark respond(req) function; Status and Headers are the defaults it
+// overrides. Sequence gives captures each response in turn, in place of
+// the rest, and with Loop starts again once it's done. Rules are tried
+// first, in order; captures matching none get the rest of the config, or
+// their request ID when nothing else is set. DelayMs holds the reply back,
+// plus up to JitterMs more at random; a rule or step with a delay of its
+// own replaces the bin's. Echo replies with the capture's own body and
+// Content-Type, plus any request headers named in EchoHeaders. ContentType
+// and Charset set the reply's Content-Type whatever its body, for senders
+// that check it; Charset alone is added to the type the reply would have.
+type ResponseConfig struct {
+	Rules    []ResponseRule    `json:"rules,omitempty"`
+	Status   int               `json:"status,omitempty"`
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	Template bool              `json:"template,omitempty"`
+	Script   string            `json:"script,omitempty"`
+	Sequence []ResponseStep    `json:"sequence,omitempty"`
+	Loop     bool              `json:"loop,omitempty"`
+	DelayMs  int               `json:"delayMs,omitempty"`
+	JitterMs int               `json:"jitterMs,omitempty"`
+	Echo     bool              `json:"echo,omitempty"`
+	// EchoHeaders are copied from the capture when echoing
+	EchoHeaders []string `json:"echoHeaders,omitempty"`
+	ContentType string   `json:"contentType,omitempty"`
+	Charset     string   `json:"charset,omitempty"`
+}
+
+// maxResponseDelay bounds how long a reply can be held back
+const maxResponseDelay = 5 * time.Minute
+
+// delay is how long to wait before replying this time
+func (c ResponseConfig) delay() time.Duration {
+	d := time.Duration(c.DelayMs) * time.Millisecond
+	if c.JitterMs > 0 {
+		d += time.Duration(rand.Int63n(int64(c.JitterMs)+1)) * time.Millisecond
+	}
+	return d
+}
+
+var headerName = regexp.MustCompile("^[!#$%&'*+.^_`|~0-9A-Za-z-]+$")
+
+func (c ResponseConfig) validate() string {
+	if msg := validateResponseRules(c.Rules); msg != "" {
+		return msg
+	}
+	if c.DelayMs < 0 || c.JitterMs < 0 || time.Duration(c.DelayMs+c.JitterMs)*time.Millisecond > maxResponseDelay {
+		return fmt.Sprintf("response delayMs and jitterMs can't be negative or add up to over %d", maxResponseDelay/time.Millisecond)
+	}
+	if len(c.Sequence) > 0 {
+		if c.Status != 0 || len(c.Headers) > 0 || c.Body != "" || c.Template || c.Script != "" || c.Echo ||
+			c.ContentType != "" || c.Charset != "" {
+			return "response sequence replaces the rest of the response; set them in its steps"
+		}
+		return validateSequence(c.Sequence)
+	}
+	if c.Loop {
+		return "response loop needs a sequence"
+	}
+	if c.Status != 0 && (c.Status < 200 || c.Status > 599) {
+		return "response status must be between 200 and 599"
+	}
+	for name, value := range c.Headers {
+		if !headerName.MatchString(name) {
+			return fmt.Sprintf("response header %q isn't a valid name", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Sprintf("response header %q can't contain line breaks", name)
+		}
+	}
+	if c.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(c.ContentType); err != nil || strings.ContainsAny(c.ContentType, "\r\n") {
+			return fmt.Sprintf("response contentType %q isn't a valid media type", c.ContentType)
+		}
+		for name := range c.Headers {
+			if http.CanonicalHeaderKey(name) == "Content-Type" {
+				return "response contentType can't be combined with a Content-Type header"
+			}
+		}
+	}
+	if c.Charset != "" && !headerName.MatchString(c.Charset) {
+		return fmt.Sprintf("response charset %q isn't a valid charset name", c.Charset)
+	}
+	for _, name := range c.EchoHeaders {
+		if !c.Echo {
+			return "response echoHeaders needs echo"
+		}
+		if !headerName.MatchString(name) {
+			return fmt.Sprintf("response echo header %q isn't a valid name", name)
+		}
+	}
+	if c.Echo && (c.Body != "" || c.Template || c.Script != "") {
+		return "response echo can't be combined with a body, template or script"
+	}
+	if c.Script != "" {
+		if c.Body != "" || c.Template {
+			return "response script can't be combined with a body or template"
+		}
+		return validateResponseScript(c.Script)
+	}
+	if c.Template {
+		if _, err := parseResponseTemplate(c.Body); err != nil {
+			return "response template: " + err.Error()
+		}
+	}
+	return ""
+}
+
+// templateHeader finds .Headers.Name references inside template actions,
+// which are rewritten as index calls so names that aren't valid template
+// fields, like X-Request-Id, work, and any case matches
+var (
+	templateAction = regexp.MustCompile(`\{\{.*?\}\}`)
+	templateHeader = regexp.MustCompile(`\.Headers\.([A-Za-z0-9_]+(?:-[A-Za-z0-9_]+)*)`)
+)
+
+var responseFuncs = template.FuncMap{
+	// json encodes a value, for splicing parts of a body into a JSON reply
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+}
+
+func parseResponseTemplate(body string) (*template.Template, error) {
+	body = templateAction.ReplaceAllStringFunc(body, func(action string) string {
+		return templateHeader.ReplaceAllStringFunc(action, func(ref string) string {
+			return fmt.Sprintf("(index .Headers %q)", http.CanonicalHeaderKey(ref[len(".Headers."):]))
+		})
+	})
+	return template.New("response").Option("missingkey=zero").Funcs(responseFuncs).Parse(body)
+}
+
+// responseTemplateData is what a response template sees. Headers holds
+// each header's first value, by its canonical name; JSON is the parsed
+// body, or empty when it couldn't be parsed.
+type responseTemplateData struct {
+	Method  string
+	Path    string
+	SubPath string
+	Headers map[string]string
+	Query   map[string]string
+	Body    string
+	JSON    interface{}
+	IP      string
+	BinID   string
+	ReqID   string
+}
+
+func newResponseTemplateData(req Request) responseTemplateData {
+	data := responseTemplateData{
+		Method:  req.Method,
+		Path:    req.Path,
+		SubPath: req.SubPath,
+		Headers: map[string]string{},
+		Query:   req.Query,
+		Body:    req.RawBody,
+		IP:      req.IP,
+		BinID:   req.BinID,
+		ReqID:   req.ReqID,
+	}
+	for name, values := range req.Headers {
+		if len(values) > 0 {
+			data.Headers[http.CanonicalHeaderKey(name)] = values[0]
+		}
+	}
+	if doc, ok := req.Body.(json.RawMessage); ok {
+		// Numbers stay as they were sent rather than becoming floats
+		dec := json.NewDecoder(bytes.NewReader(doc))
+		dec.UseNumber()
+		dec.Decode(&data.JSON)
+	}
+	if data.JSON == nil {
+		// So .JSON.field is empty, rather than an error, for other bodies
+		data.JSON = map[string]interface{}{}
+	}
+	return data
+}
+
+// writeCaptureResponse replies to a stored capture: with its request ID, or
+// the bin's configured response. A delay ends early if ctx does.
+func writeCaptureResponse(ctx context.Context, w http.ResponseWriter, cfg *ResponseConfig, req Request) {
+	if cfg == nil {
+		w.Write([]byte(req.ReqID))
+		return
+	}
+	delay := cfg.delay()
+	sequence := ""
+	if rule, name := matchResponseRule(cfg.Rules, req); rule != nil {
+		cfg, sequence = rule, name
+	}
+	if len(cfg.Sequence) > 0 {
+		step, err := nextStep(ctx, req.BinID, sequence, cfg.Sequence, cfg.Loop)
+		if err != nil {
+			http.Error(w, "Error advancing the response sequence", http.StatusInternalServerError)
+			return
+		}
+		cfg = &step.ResponseConfig
+	}
+	if cfg.DelayMs > 0 || cfg.JitterMs > 0 {
+		delay = cfg.delay()
+	}
+	if delay > 0 && !sinkSleep(ctx, delay) {
+		return
+	}
+	if cfg.Status == 0 && len(cfg.Headers) == 0 && cfg.Body == "" && !cfg.Template && cfg.Script == "" && !cfg.Echo {
+		cfg.setContentType(w.Header(), []byte(req.ReqID))
+		w.Write([]byte(req.ReqID))
+		return
+	}
+	body := []byte(cfg.Body)
+	status := cfg.Status
+	if cfg.Script != "" {
+		out, err := runResponseScript(cfg.Script, req)
+		if err != nil {
+			http.Error(w, "Error running response script: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = out.body
+		if out.status != 0 {
+			status = out.status
+		}
+		for name, value := range out.headers {
+			w.Header().Set(name, value)
+		}
+	}
+	if cfg.Template {
+		tmpl, err := parseResponseTemplate(cfg.Body)
+		var out bytes.Buffer
+		if err == nil {
+			err = tmpl.Execute(&out, newResponseTemplateData(req))
+		}
+		if err != nil {
+			http.Error(w, "Error rendering response: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = out.Bytes()
+	}
+	if cfg.Echo {
+		writeEcho(w, cfg, status, req)
+		return
+	}
+	// A script's own headers win over the configured ones
+	for name, value := range cfg.Headers {
+		if w.Header().Get(name) == "" {
+			w.Header().Set(name, value)
+		}
+	}
+	cfg.setContentType(w.Header(), body)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// setContentType gives a reply the configured Content-Type, when there's
+// no other, and charset. A reply with no type is typed as Go's server
+// would sniff it, so a charset has something to go on.
+func (c ResponseConfig) setContentType(h http.Header, body []byte) {
+	if c.ContentType == "" && c.Charset == "" {
+		return
+	}
+	contentType := h.Get("Content-Type")
+	if contentType == "" {
+		contentType = c.ContentType
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(body)
+	}
+	if c.Charset != "" {
+		mediaType, params, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return
+		}
+		params["charset"] = c.Charset
+		contentType = mime.FormatMediaType(mediaType, params)
+	}
+	h.Set("Content-Type", contentType)
+}
+
+// writeEcho replies with a capture's decoded body, typed as it was sent.
+// Configured headers override the echoed ones.
+func writeEcho(w http.ResponseWriter, cfg *ResponseConfig, status int, req Request) {
+	body, _, err := openRequestBody(req)
+	if err != nil {
+		http.Error(w, "Error reading the request body", http.StatusInternalServerError)
+		return
+	}
+	defer body.Close()
+	contentType := req.Headers.Get("Content-Type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	for _, name := range cfg.EchoHeaders {
+		for _, value := range req.Headers.Values(name) {
+			w.Header().Add(name, value)
+		}
+	}
+	for name, value := range cfg.Headers {
+		w.Header().Set(name, value)
+	}
+	if cfg.ContentType != "" {
+		w.Header().Set("Content-Type", cfg.ContentType)
+	}
+	cfg.setContentType(w.Header(), nil)
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	io.Copy(w, body)
+}
@@ -0,0 +1,132 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTemplatedResponse(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"response": {"status": 202, "headers": {"Content-Type": "application/json"}, "template": true,
+		"body": "{\"challenge\": {{ json .JSON.challenge }}, \"requestId\": \"{{ .Headers.x-request-id }}\", \"path\": \"{{ .SubPath }}\", \"id\": \"{{ .ReqID }}\"}"}}`)
+
+	r := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/events", strings.NewReader(`{"challenge": "3eZbrw1a"}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Request-Id", "abc-123")
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, r)
+
+	var reqID string
+	if err := db.QueryRow("SELECT req_id FROM requests WHERE bin_id = ?", bin.BinID).Scan(&reqID); err != nil {
+		t.Fatalf("Expected the capture to be stored: %v", err)
+	}
+	want := `{"challenge": "3eZbrw1a", "requestId": "abc-123", "path": "/events", "id": "` + reqID + `"}`
+	if w.Code != http.StatusAccepted || w.Header().Get("Content-Type") != "application/json" || w.Body.String() != want {
+		t.Errorf("Unexpected response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+}
+
+func TestStaticResponse(t *testing.T) {
+	w := httptest.NewRecorder()
+	writeCaptureResponse(context.Background(), w, &ResponseConfig{Body: "{{ not a template }}"}, Request{ReqID: "req"})
+	if w.Code != http.StatusOK || w.Body.String() != "{{ not a template }}" {
+		t.Errorf("Expected the body as configured, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestEchoResponse(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"response": {"echo": true, "echoHeaders": ["x-trace"], "headers": {"X-Echo": "1"}}}`)
+
+	r := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("name=ada&lang=go"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("X-Trace", "t-1")
+	r.Header.Set("X-Other", "kept out")
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, r)
+
+	h := w.Header()
+	if w.Code != http.StatusOK || w.Body.String() != "name=ada&lang=go" || h.Get("Content-Type") != "application/x-www-form-urlencoded" ||
+		h.Get("X-Trace") != "t-1" || h.Get("X-Echo") != "1" || h.Get("X-Other") != "" {
+		t.Errorf("Unexpected echo %d %v %s", w.Code, h, w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	writeCaptureResponse(context.Background(), w, &ResponseConfig{Echo: true}, Request{RawBody: "\x00\x01"})
+	if w.Header().Get("Content-Type") != "application/octet-stream" || w.Body.String() != "\x00\x01" {
+		t.Errorf("Expected an untyped body to echo as octet-stream, got %v %q", w.Header(), w.Body)
+	}
+}
+
+func TestResponseContentType(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  ResponseConfig
+		want string
+	}{
+		{ResponseConfig{ContentType: "application/json", Charset: "utf-8"}, "application/json; charset=utf-8"},
+		{ResponseConfig{Charset: "utf-8", Headers: map[string]string{"Content-Type": "text/xml"}, Body: "<ok/>"}, "text/xml; charset=utf-8"},
+		{ResponseConfig{Charset: "iso-8859-1"}, "text/plain; charset=iso-8859-1"},
+		{ResponseConfig{ContentType: "application/json", Script: "def respond(req):\n    return {\"headers\": {\"Content-Type\": \"text/csv\"}, \"body\": \"a,b\"}"},
+			"text/csv"},
+		{ResponseConfig{ContentType: "text/plain", Echo: true}, "text/plain"},
+	} {
+		w := httptest.NewRecorder()
+		writeCaptureResponse(context.Background(), w, &tc.cfg, Request{ReqID: "req", Headers: http.Header{"Content-Type": {"application/xml"}}})
+		if got := w.Header().Get("Content-Type"); got != tc.want {
+			t.Errorf("Expected %+v to reply as %s, got %s", tc.cfg, tc.want, got)
+		}
+	}
+}
+
+func TestResponseValidation(t *testing.T) {
+	for _, cfg := range []BinConfig{
+		{Response: &ResponseConfig{Status: 99}},
+		{Response: &ResponseConfig{Headers: map[string]string{"Bad Name": "x"}}},
+		{Response: &ResponseConfig{Headers: map[string]string{"X-Ok": "a\r\nSet-Cookie: b"}}},
+		{Response: &ResponseConfig{Template: true, Body: "{{ .Method "}},
+		{Response: &ResponseConfig{}, Proxy: &ProxyConfig{URL: "http://upstream"}},
+		{Response: &ResponseConfig{DelayMs: -1}},
+		{Response: &ResponseConfig{DelayMs: 200000, JitterMs: 200000}},
+		{Response: &ResponseConfig{Echo: true, Body: "x"}},
+		{Response: &ResponseConfig{EchoHeaders: []string{"X-Trace"}}},
+		{Response: &ResponseConfig{ContentType: "not a type"}},
+		{Response: &ResponseConfig{ContentType: "text/plain", Headers: map[string]string{"content-type": "text/html"}}},
+		{Response: &ResponseConfig{Charset: "utf 8"}},
+	} {
+		if cfg.validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg.Response)
+		}
+	}
+}
+
+func TestResponseDelay(t *testing.T) {
+	cfg := &ResponseConfig{DelayMs: 80, JitterMs: 20, Rules: []ResponseRule{
+		{Match: ResponseMatch{Method: "GET"}, Response: ResponseConfig{DelayMs: 1, Body: "fast"}},
+	}}
+	elapsed := func(ctx context.Context, method string) time.Duration {
+		start := time.Now()
+		writeCaptureResponse(ctx, httptest.NewRecorder(), cfg, Request{Method: method, ReqID: "req"})
+		return time.Since(start)
+	}
+	if d := elapsed(context.Background(), http.MethodPost); d < 80*time.Millisecond || d > time.Second {
+		t.Errorf("Expected the bin's delay, took %v", d)
+	}
+	if d := elapsed(context.Background(), http.MethodGet); d > 50*time.Millisecond {
+		t.Errorf("Expected the rule's own delay, took %v", d)
+	}
+
+	// A sender that gives up doesn't hold the handler
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if d := elapsed(ctx, http.MethodPost); d > 50*time.Millisecond {
+		t.Errorf("Expected a cancelled request to end the delay, took %v", d)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// ResponseRule gives captures matching Match their own response, so one
+// bin can stand in for an API with several endpoints
+type ResponseRule struct {
+	Match    ResponseMatch  `json:"match"`
+	Response ResponseConfig `json:"response"`
+}
+
+// ResponseMatch is what a capture must have for a rule to apply; every
+// condition set must hold. Path is a regular expression for the path within
+// the bin, such as ^/orders/[0-9]+$, and Headers must each equal one of the
+// header's values.
+type ResponseMatch struct {
+	Method       string            `json:"method,omitempty"`
+	Path         string            `json:"path,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	BodyContains string            `json:"bodyContains,omitempty"`
+}
+
+func validateResponseRules(rules []ResponseRule) string {
+	for i, rule := range rules {
+		if _, err := regexp.Compile(rule.Match.Path); err != nil {
+			return fmt.Sprintf("response rule %d path: %v", i+1, err)
+		}
+		if len(rule.Response.Rules) > 0 {
+			return fmt.Sprintf("response rule %d can't have rules of its own", i+1)
+		}
+		if msg := rule.Response.validate(); msg != "" {
+			return fmt.Sprintf("response rule %d: %s", i+1, msg)
+		}
+	}
+	return ""
+}
+
+func (m ResponseMatch) matches(req Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if m.Path != "" {
+		path := req.SubPath
+		if path == "" {
+			path = "/"
+		}
+		// Validated with the config
+		if !regexp.MustCompile(m.Path).MatchString(path) {
+			return false
+		}
+	}
+	for name, want := range m.Headers {
+		found := false
+		for _, value := range req.Headers[http.CanonicalHeaderKey(name)] {
+			found = found || value == want
+		}
+		if !found {
+			return false
+		}
+	}
+	return m.BodyContains == "" || strings.Contains(req.RawBody, m.BodyContains)
+}
+
+// matchResponseRule returns the first rule a capture matches, with the
+// name its sequence is counted under
+func matchResponseRule(rules []ResponseRule, req Request) (*ResponseConfig, string) {
+	for i := range rules {
+		if rules[i].Match.matches(req) {
+			return &rules[i].Response, fmt.Sprintf("rule %d", i+1)
+		}
+	}
+	return nil, ""
+}
@@ -0,0 +1,62 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResponseRules(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"response": {"rules": [
+		{"match": {"method": "get", "path": "^/orders/[0-9]+$"}, "response": {"body": "order"}},
+		{"match": {"headers": {"x-github-event": "ping"}}, "response": {"status": 204}},
+		{"match": {"bodyContains": "\"refund\""}, "response": {"sequence": [{"status": 500}, {"status": 200, "body": "refunded"}]}}
+	], "status": 404, "body": "not found"}}`)
+
+	respond := func(method, path, body string, headers ...string) string {
+		r := httptest.NewRequest(method, "/"+bin.BinID+path, strings.NewReader(body))
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Add(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, r)
+		return http.StatusText(w.Code) + " " + w.Body.String()
+	}
+	for _, tc := range []struct{ got, want string }{
+		{respond(http.MethodGet, "/orders/42", ""), "OK order"},
+		{respond(http.MethodPost, "/orders/42", ""), "Not Found not found"},
+		{respond(http.MethodGet, "/orders/42/items", ""), "Not Found not found"},
+		{respond(http.MethodPost, "", "", "X-GitHub-Event", "push", "X-GitHub-Event", "ping"), "No Content "},
+		{respond(http.MethodPost, "", `{"type": "refund"}`), "Internal Server Error "},
+		{respond(http.MethodPost, "", `{"type": "refund"}`), "OK refunded"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("Expected %q, got %q", tc.want, tc.got)
+		}
+	}
+
+	// Without a response of its own, unmatched captures get their request ID
+	setTestConfig(t, bin.BinID, `{"response": {"rules": [{"match": {"method": "DELETE"}, "response": {"status": 202}}]}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil))
+	if w.Code != http.StatusOK || len(w.Body.String()) == 0 || strings.Contains(w.Body.String(), " ") {
+		t.Errorf("Expected the request ID, got %d %q", w.Code, w.Body)
+	}
+}
+
+func TestResponseRuleValidation(t *testing.T) {
+	for _, rule := range []ResponseRule{
+		{Match: ResponseMatch{Path: "(unclosed"}},
+		{Response: ResponseConfig{Rules: []ResponseRule{{}}}},
+		{Response: ResponseConfig{Status: 1000}},
+	} {
+		if (ResponseConfig{Rules: []ResponseRule{rule}}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", rule)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+	"unicode/utf8"
+)
+
+// ProxyConfig makes a bin a recording reverse proxy: each capture is sent on
+// to URL, with its sub-path and query appended, and the upstream's response
+// is both returned to the sender and stored with the capture.
+type ProxyConfig struct {
+	URL       string `json:"url"`
+	TimeoutMs int    `json:"timeoutMs,omitempty"`
+}
+
+const defaultProxyTimeout = 30 * time.Second
+
+// maxRecordedResponse is how much of an upstream body is stored; the sender
+// always gets all of it
+const maxRecordedResponse = 1 << 20
+
+func (c ProxyConfig) validate() string {
+	if _, err := resendURL(Request{}, c.URL); err != nil || c.URL == "" {
+		return "proxy needs an absolute http or https url"
+	}
+	if c.TimeoutMs < 0 || time.Duration(c.TimeoutMs)*time.Millisecond > maxReplayTimeout {
+		return fmt.Sprintf("proxy timeoutMs must be between 0 and %d", maxReplayTimeout/time.Millisecond)
+	}
+	return ""
+}
+
+func (c ProxyConfig) timeout() time.Duration {
+	if c.TimeoutMs == 0 {
+		return defaultProxyTimeout
+	}
+	return time.Duration(c.TimeoutMs) * time.Millisecond
+}
+
+// UpstreamResponse is what a proxying bin's upstream replied to a capture.
+// Bodies that aren't valid UTF-8 are base64-encoded, with Encoding set.
+type UpstreamResponse struct {
+	Status    int         `json:"status"`
+	Headers   http.Header `json:"headers,omitempty"`
+	Body      string      `json:"body"`
+	Encoding  string      `json:"encoding,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+	LatencyMs float64     `json:"latencyMs"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// proxyHopHeaders describe the upstream connection rather than the response,
+// so they aren't passed back to the sender
+var proxyHopHeaders = map[string]bool{
+	"Connection":        true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+	"Trailer":           true,
+	"Proxy-Connection":  true,
+}
+
+// proxyCapture sends a stored capture to the bin's upstream and relays the
+// response to w, then records it against the capture. When the upstream
+// can't be reached the sender gets a 502.
+func proxyCapture(w http.ResponseWriter, r *http.Request, cfg ProxyConfig, req Request) {
+	recorded := UpstreamResponse{}
+	defer func() {
+		// Recorded even if the sender has gone by now
+		if _, err := store.SetUpstreamResponse(context.Background(), req.BinID, req.ReqID, recorded); err != nil {
+			log.Printf("Recording the upstream response to %s/%s failed: %v", req.BinID, req.ReqID, err)
+		}
+	}()
+
+	body, err := readOriginalBody(r.Context(), req)
+	if err != nil {
+		recorded.Error = "reading body: " + err.Error()
+		http.Error(w, "Error reading request body", http.StatusInternalServerError)
+		return
+	}
+	targetURL, _ := resendURL(req, cfg.URL)
+	out, err := newResendRequest(r.Context(), req, targetURL, body)
+	if err != nil {
+		recorded.Error = err.Error()
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+
+	start := time.Now()
+	resp, err := replayClient(cfg.timeout()).Do(out)
+	recorded.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		recorded.Error = err.Error()
+		http.Error(w, "Bad gateway", http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+
+	recorded.Status = resp.StatusCode
+	recorded.Headers = http.Header{}
+	for name, values := range resp.Header {
+		if !proxyHopHeaders[name] {
+			recorded.Headers[name] = values
+			w.Header()[name] = values
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Relay the whole body while keeping the start of it
+	var head bytes.Buffer
+	n, err := io.Copy(w, io.TeeReader(resp.Body, &limitedWriter{w: &head, n: maxRecordedResponse}))
+	if err != nil {
+		recorded.Error = "relaying upstream body: " + err.Error()
+	}
+	recorded.Truncated = n > int64(head.Len())
+	if utf8.Valid(head.Bytes()) {
+		recorded.Body = head.String()
+	} else {
+		recorded.Body = base64.StdEncoding.EncodeToString(head.Bytes())
+		recorded.Encoding = "base64"
+	}
+}
+
+// limitedWriter keeps the first n bytes written to it and discards the rest
+type limitedWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if l.n > 0 {
+		keep := p
+		if int64(len(keep)) > l.n {
+			keep = keep[:l.n]
+		}
+		l.w.Write(keep)
+		l.n -= int64(len(keep))
+	}
+	return len(p), nil
+}
@@ -0,0 +1,107 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// proxiedTestRequest fetches the only request in a bin; proxied captures
+// reply with the upstream's response rather than the request ID
+func proxiedTestRequest(t *testing.T, binID string) Request {
+	var reqID string
+	if err := db.QueryRow("SELECT req_id FROM requests WHERE bin_id = ?", binID).Scan(&reqID); err != nil {
+		t.Fatalf("Expected the capture to be stored: %v", err)
+	}
+	w := httptest.NewRecorder()
+	binAPIHandler(w, httptest.NewRequest(http.MethodGet, "/api/bin/"+binID+"/req/"+reqID, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 fetching the request, got %d", w.Code)
+	}
+	var req Request
+	json.NewDecoder(w.Body).Decode(&req)
+	return req
+}
+
+func TestProxyCapture(t *testing.T) {
+	clearDB(t)
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Upstream", r.URL.RequestURI())
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created "+string(body))
+	}))
+	defer upstream.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"proxy": {"url": "`+upstream.URL+`/api"}}`)
+
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/orders?x=1", strings.NewReader("order")))
+	if w.Code != http.StatusCreated || w.Body.String() != "created order" || w.Header().Get("X-Upstream") != "/api/orders?x=1" {
+		t.Fatalf("Expected the upstream's response, got %d %q %v", w.Code, w.Body.String(), w.Header())
+	}
+
+	resp := proxiedTestRequest(t, bin.BinID).Response
+	if resp == nil || resp.Status != http.StatusCreated || resp.Body != "created order" ||
+		resp.Headers.Get("X-Upstream") != "/api/orders?x=1" || resp.LatencyMs <= 0 || resp.Error != "" {
+		t.Errorf("Unexpected recorded response %+v", resp)
+	}
+}
+
+func TestProxyCaptureRecordsBinaryAndTruncatedBodies(t *testing.T) {
+	clearDB(t)
+
+	body := strings.Repeat("\xff", maxRecordedResponse+10)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, body)
+	}))
+	defer upstream.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"proxy": {"url": "`+upstream.URL+`"}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+	if w.Body.String() != body {
+		t.Fatalf("Expected the whole body to be relayed, got %d bytes", w.Body.Len())
+	}
+
+	resp := proxiedTestRequest(t, bin.BinID).Response
+	if resp == nil || resp.Encoding != "base64" || !resp.Truncated {
+		t.Fatalf("Expected a truncated base64 body, got %+v", resp)
+	}
+}
+
+func TestProxyCaptureUpstreamDown(t *testing.T) {
+	clearDB(t)
+
+	upstream := httptest.NewServer(http.NotFoundHandler())
+	upstream.Close()
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"proxy": {"url": "`+upstream.URL+`"}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("x")))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("Expected 502, got %d", w.Code)
+	}
+
+	resp := proxiedTestRequest(t, bin.BinID).Response
+	if resp == nil || resp.Status != 0 || resp.Error == "" {
+		t.Errorf("Expected the failure to be recorded, got %+v", resp)
+	}
+}
+
+func TestProxyConfigValidation(t *testing.T) {
+	for _, cfg := range []ProxyConfig{{}, {URL: "/relative"}, {URL: "http://x", TimeoutMs: -1}} {
+		if (BinConfig{Proxy: &cfg}).validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// RewriteRules change captures before they're sent again, so production
+// traffic can be pointed at a local target with test credentials. Headers
+// are removed before they're set, and the path rule applies to the sub-path.
+type RewriteRules struct {
+	SetHeaders    map[string]string `json:"setHeaders,omitempty"`
+	RemoveHeaders []string          `json:"removeHeaders,omitempty"`
+	PathPrefix    *PathRewrite      `json:"pathPrefix,omitempty"`
+	// Body is a text/template producing the new body, given the capture
+	Body string `json:"body,omitempty"`
+}
+
+// PathRewrite replaces a leading From in the sub-path with To
+type PathRewrite struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// rewriter is a compiled set of RewriteRules
+type rewriter struct {
+	rules RewriteRules
+	body  *template.Template
+}
+
+// rewriteFuncs are available to body templates
+var rewriteFuncs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		out, err := json.Marshal(v)
+		return string(out), err
+	},
+}
+
+func (rules *RewriteRules) compile() (*rewriter, error) {
+	if rules == nil {
+		return nil, nil
+	}
+	rw := &rewriter{rules: *rules}
+	for name := range rules.SetHeaders {
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+	}
+	if rules.PathPrefix != nil && !strings.HasPrefix(rules.PathPrefix.From, "/") {
+		return nil, fmt.Errorf("pathPrefix.from must start with /")
+	}
+	if rules.Body != "" {
+		tmpl, err := template.New("body").Funcs(rewriteFuncs).Option("missingkey=zero").Parse(rules.Body)
+		if err != nil {
+			return nil, fmt.Errorf("invalid body template: %v", err)
+		}
+		rw.body = tmpl
+	}
+	return rw, nil
+}
+
+// rewriteData is what a body template sees: the capture, with its body
+// decoded when it was parsed as a document
+type rewriteData struct {
+	Method  string
+	SubPath string
+	Headers http.Header
+	Query   map[string]string
+	Body    interface{}
+	RawBody string
+}
+
+// apply returns the rewritten capture and body. Nil rewriters leave both alone.
+func (rw *rewriter) apply(req Request, body []byte) (Request, []byte, error) {
+	if rw == nil {
+		return req, body, nil
+	}
+
+	if rw.body != nil {
+		data := rewriteData{
+			Method: req.Method, SubPath: req.SubPath, Headers: req.Headers,
+			Query: req.Query, Body: req.Body, RawBody: req.RawBody,
+		}
+		if doc, ok := req.Body.(json.RawMessage); ok {
+			var decoded interface{}
+			json.Unmarshal(doc, &decoded)
+			data.Body = decoded
+		}
+		var out bytes.Buffer
+		if err := rw.body.Execute(&out, data); err != nil {
+			return req, nil, fmt.Errorf("body template: %v", err)
+		}
+		body = out.Bytes()
+	}
+
+	req.Headers = req.Headers.Clone()
+	if req.Headers == nil {
+		req.Headers = http.Header{}
+	}
+	if rw.body != nil {
+		// The template's output is sent as is
+		req.Headers.Del("Content-Encoding")
+	}
+	for _, name := range rw.rules.RemoveHeaders {
+		req.Headers.Del(name)
+	}
+	for name, value := range rw.rules.SetHeaders {
+		req.Headers.Set(name, value)
+	}
+
+	if p := rw.rules.PathPrefix; p != nil && strings.HasPrefix(req.SubPath, p.From) {
+		req.SubPath = p.To + req.SubPath[len(p.From):]
+		if req.SubPath != "" && !strings.HasPrefix(req.SubPath, "/") {
+			req.SubPath = "/" + req.SubPath
+		}
+	}
+	return req, body, nil
+}
@@ -0,0 +1,102 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRewriteRules(t *testing.T) {
+	rules := &RewriteRules{
+		SetHeaders:    map[string]string{"Authorization": "Bearer test"},
+		RemoveHeaders: []string{"Cookie", "Content-Encoding"},
+		PathPrefix:    &PathRewrite{From: "/v1", To: "/v2"},
+		Body:          `{"type":{{json .Body.type}},"path":{{json .SubPath}}}`,
+	}
+	rw, err := rules.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := Request{
+		Method:  http.MethodPost,
+		SubPath: "/v1/hooks",
+		Headers: http.Header{"Authorization": {"Bearer live"}, "Cookie": {"a=b"}, "X-Keep": {"1"}},
+		Body:    json.RawMessage(`{"type":"charge.succeeded","amount":5}`),
+	}
+	got, body, err := rw.apply(req, []byte("ignored"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != `{"type":"charge.succeeded","path":"/v1/hooks"}` {
+		t.Errorf("Unexpected body %s", body)
+	}
+	if got.SubPath != "/v2/hooks" {
+		t.Errorf("Expected the path prefix rewritten, got %q", got.SubPath)
+	}
+	if got.Headers.Get("Authorization") != "Bearer test" || got.Headers.Get("Cookie") != "" || got.Headers.Get("X-Keep") != "1" {
+		t.Errorf("Unexpected headers %v", got.Headers)
+	}
+	if req.Headers.Get("Authorization") != "Bearer live" {
+		t.Error("Expected the original capture's headers to be left alone")
+	}
+
+	var none *rewriter
+	if same, body, _ := none.apply(req, []byte("x")); string(body) != "x" || same.SubPath != req.SubPath {
+		t.Error("Expected a nil rewriter to change nothing")
+	}
+
+	for _, bad := range []RewriteRules{
+		{Body: "{{.Body"},
+		{SetHeaders: map[string]string{"Bad Name": "x"}},
+		{PathPrefix: &PathRewrite{From: "v1"}},
+	} {
+		if _, err := bad.compile(); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestReplayWithRules(t *testing.T) {
+	clearDB(t)
+
+	var got *http.Request
+	var gotBody []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		gotBody, _ = io.ReadAll(r.Body)
+	}))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	capture := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/api/v1/orders", strings.NewReader(`{"id":7}`))
+	capture.Header.Set("Content-Type", "application/json")
+	capture.Header.Set("Authorization", "Bearer live")
+	captureRequestHandler(httptest.NewRecorder(), capture)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay", strings.NewReader(`{
+		"target": "`+srv.URL+`",
+		"rules": {"setHeaders": {"Authorization": "Bearer test"}, "pathPrefix": {"from": "/api/v1", "to": "/v2"},
+			"body": "{\"order\":{{.Body.id}}}"}}`))
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusOK || got == nil {
+		t.Fatalf("Expected the replay to arrive, got %d: %s", w.Code, w.Body.String())
+	}
+	if got.URL.Path != "/v2/orders" || got.Header.Get("Authorization") != "Bearer test" || string(gotBody) != `{"order":7}` {
+		t.Errorf("Unexpected replay %s %v %s", got.URL.Path, got.Header, gotBody)
+	}
+
+	bad := httptest.NewRequest(http.MethodPost, "/api/bin/"+bin.BinID+"/replay",
+		strings.NewReader(`{"target": "`+srv.URL+`", "rules": {"body": "{{"}}`))
+	badW := httptest.NewRecorder()
+	binAPIHandler(badW, bad)
+	if badW.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad template, got %d", badW.Code)
+	}
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	"go.starlark.net/starlark"
+	"go.starlark.net/starlarkstruct"
+)
+
+// Limits on response scripts, which run on every capture
+const (
+	maxScriptBytes = 64 << 10
+	scriptSteps    = 1_000_000
+	scriptTimeout  = time.Second
+)
+
+// validateResponseScript checks a script compiles and defines respond
+func validateResponseScript(src string) string {
+	if len(src) > maxScriptBytes {
+		return fmt.Sprintf("response script can't be over %d bytes", maxScriptBytes)
+	}
+	if _, err := loadResponseScript(src); err != nil {
+		return "response script: " + err.Error()
+	}
+	return ""
+}
+
+// loadResponseScript runs a script's top level, returning its respond
+// function. Scripts can't reach the network or files: the only modules
+// they're given are json and struct.
+func loadResponseScript(src string) (*starlark.Function, error) {
+	thread := newScriptThread()
+	predeclared := starlark.StringDict{"json": starlarkjson.Module, "struct": starlark.NewBuiltin("struct", starlarkstruct.Make)}
+	globals, err := starlark.ExecFile(thread, "response.star", src, predeclared)
+	if err != nil {
+		return nil, scriptError(err)
+	}
+	respond, ok := globals["respond"].(*starlark.Function)
+	if !ok {
+		return nil, errors.New("must define respond(req)")
+	}
+	if respond.NumParams() != 1 {
+		return nil, errors.New("respond must take one parameter, the request")
+	}
+	return respond, nil
+}
+
+func newScriptThread() *starlark.Thread {
+	thread := &starlark.Thread{Name: "response", Print: func(*starlark.Thread, string) {}}
+	thread.SetMaxExecutionSteps(scriptSteps)
+	return thread
+}
+
+// scriptError keeps a script's backtrace out of the message
+func scriptError(err error) error {
+	var evalErr *starlark.EvalError
+	if errors.As(err, &evalErr) {
+		return errors.New(evalErr.Msg)
+	}
+	return err
+}
+
+// scriptResponse is what a script's respond returned
+type scriptResponse struct {
+	status  int
+	headers map[string]string
+	body    []byte
+}
+
+// runResponseScript calls a script's respond with the request. It may
+// return a string, the body, or a dict of status, headers and body, where
+// a body that isn't a string is encoded as JSON.
+func runResponseScript(src string, req Request) (scriptResponse, error) {
+	var out scriptResponse
+	respond, err := loadResponseScript(src)
+	if err != nil {
+		return out, err
+	}
+	thread := newScriptThread()
+	timer := time.AfterFunc(scriptTimeout, func() { thread.Cancel("took too long") })
+	defer timer.Stop()
+	result, err := starlark.Call(thread, respond, starlark.Tuple{scriptRequest(req)}, nil)
+	if err != nil {
+		return out, scriptError(err)
+	}
+
+	dict, isDict := result.(*starlark.Dict)
+	if !isDict {
+		dict = starlark.NewDict(1)
+		dict.SetKey(starlark.String("body"), result)
+	}
+	encodedJSON := false
+	for _, item := range dict.Items() {
+		key, _ := starlark.AsString(item[0])
+		switch key {
+		case "status":
+			status, err := starlark.AsInt32(item[1])
+			if err != nil || status < 200 || status > 599 {
+				return out, fmt.Errorf("respond returned status %s, which isn't between 200 and 599", item[1])
+			}
+			out.status = status
+		case "headers":
+			headers, ok := item[1].(*starlark.Dict)
+			if !ok {
+				return out, fmt.Errorf("respond returned headers of type %s, not a dict", item[1].Type())
+			}
+			out.headers = map[string]string{}
+			for _, h := range headers.Items() {
+				name, nameOK := starlark.AsString(h[0])
+				value, valueOK := starlark.AsString(h[1])
+				if !nameOK || !valueOK || !headerName.MatchString(name) || strings.ContainsAny(value, "\r\n") {
+					return out, fmt.Errorf("respond returned an invalid header %s: %s", h[0], h[1])
+				}
+				out.headers[name] = value
+			}
+		case "body":
+			if s, ok := starlark.AsString(item[1]); ok {
+				out.body = []byte(s)
+				break
+			}
+			encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{item[1]}, nil)
+			if err != nil {
+				return out, scriptError(err)
+			}
+			out.body = []byte(encoded.(starlark.String))
+			encodedJSON = true
+		default:
+			return out, fmt.Errorf("respond returned an unknown key %s", item[0])
+		}
+	}
+	if encodedJSON {
+		for name := range out.headers {
+			if http.CanonicalHeaderKey(name) == "Content-Type" {
+				return out, nil
+			}
+		}
+		if out.headers == nil {
+			out.headers = map[string]string{}
+		}
+		out.headers["Content-Type"] = "application/json"
+	}
+	return out, nil
+}
+
+// scriptRequest is the request as a script sees it: a struct of the same
+// fields templates get, named in snake case, with json None when the body
+// couldn't be parsed
+func scriptRequest(req Request) starlark.Value {
+	data := newResponseTemplateData(req)
+	headers := starlark.NewDict(len(data.Headers))
+	for name, value := range data.Headers {
+		headers.SetKey(starlark.String(name), starlark.String(value))
+	}
+	query := starlark.NewDict(len(data.Query))
+	for name, value := range data.Query {
+		query.SetKey(starlark.String(name), starlark.String(value))
+	}
+	var doc starlark.Value = starlark.None
+	if raw, ok := req.Body.(json.RawMessage); ok {
+		if v, err := starlark.Call(newScriptThread(), starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(raw)}, nil); err == nil {
+			doc = v
+		}
+	}
+	fields := starlark.StringDict{
+		"method":   starlark.String(data.Method),
+		"path":     starlark.String(data.Path),
+		"sub_path": starlark.String(data.SubPath),
+		"headers":  headers,
+		"query":    query,
+		"body":     starlark.String(data.Body),
+		"json":     doc,
+		"ip":       starlark.String(data.IP),
+		"bin_id":   starlark.String(data.BinID),
+		"req_id":   starlark.String(data.ReqID),
+	}
+	for _, v := range fields {
+		v.Freeze()
+	}
+	return starlarkstruct.FromStringDict(starlarkstruct.Default, fields)
+}
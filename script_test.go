@@ -0,0 +1,76 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testScript = `
+def respond(req):
+    if req.method != "POST":
+        return {"status": 405, "body": "POST only"}
+    order = req.json["order"]
+    total = 0
+    for item in order["items"]:
+        total += item["price"]
+    return {
+        "status": 201,
+        "headers": {"X-Order": str(order["id"])},
+        "body": {"id": req.req_id, "total": total},
+    }
+`
+
+func TestScriptedResponse(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	cfg, _ := json.Marshal(BinConfig{Response: &ResponseConfig{Headers: map[string]string{"X-Mock": "yes"}, Script: testScript}})
+	setTestConfig(t, bin.BinID, string(cfg))
+
+	r := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(`{"order": {"id": 7, "items": [{"price": 3}, {"price": 4}]}}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, r)
+	var reqID string
+	db.QueryRow("SELECT req_id FROM requests WHERE bin_id = ?", bin.BinID).Scan(&reqID)
+	if w.Code != http.StatusCreated || w.Header().Get("X-Order") != "7" || w.Header().Get("X-Mock") != "yes" ||
+		w.Header().Get("Content-Type") != "application/json" || w.Body.String() != `{"id":"`+reqID+`","total":7}` {
+		t.Errorf("Unexpected response %d %v %s", w.Code, w.Header(), w.Body)
+	}
+
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodGet, "/"+bin.BinID, nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Body.String() != "POST only" {
+		t.Errorf("Unexpected response %d %s", w.Code, w.Body)
+	}
+}
+
+func TestScriptErrors(t *testing.T) {
+	for src, want := range map[string]string{
+		"def respond(req):\n    return req.json[\"missing\"]\n": "None",
+		"def respond(req):\n    return {\"status\": 99}\n":      "status 99",
+		"def respond(req):\n    return {\"colour\": 1}\n":       "unknown key",
+	} {
+		_, err := runResponseScript(src, Request{Body: ""})
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected an error containing %q from %q, got %v", want, src, err)
+		}
+	}
+}
+
+func TestScriptLimits(t *testing.T) {
+	_, err := runResponseScript("def respond(req):\n    for i in range(100000000):\n        pass\n", Request{})
+	if err == nil || !strings.Contains(err.Error(), "too many steps") {
+		t.Errorf("Expected the step limit to stop the script, got %v", err)
+	}
+	// Scripts need a one-parameter respond, and can't loop forever or load modules
+	for _, src := range []string{"x = 1", "def respond(req):\n    while True:\n        pass\n", "def respond():\n    return ''\n", "load('os', 'system')\ndef respond(req):\n    return ''\n"} {
+		if validateResponseScript(src) == "" {
+			t.Errorf("Expected %q to be rejected", src)
+		}
+	}
+}
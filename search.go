@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ftsEnabled records whether the SQLite build includes FTS5. It needs the
+// sqlite_fts5 build tag; without it searches fall back to substring matching.
+var ftsEnabled bool
+
+// The FTS index uses requests as its content table and is kept in sync by
+// triggers, so every code path that inserts or deletes requests is covered.
+const searchIndexSchema = `
+        CREATE VIRTUAL TABLE IF NOT EXISTS requests_fts USING fts5(
+            body, headers, content='requests', content_rowid='rowid'
+        );
+        CREATE TRIGGER IF NOT EXISTS requests_fts_ai AFTER INSERT ON requests BEGIN
+            INSERT INTO requests_fts(rowid, body, headers) VALUES (new.rowid, new.body, new.headers);
+        END;
+        CREATE TRIGGER IF NOT EXISTS requests_fts_ad AFTER DELETE ON requests BEGIN
+            INSERT INTO requests_fts(requests_fts, rowid, body, headers)
+            VALUES ('delete', old.rowid, old.body, old.headers);
+        END;
+        CREATE TRIGGER IF NOT EXISTS requests_fts_au AFTER UPDATE OF body, headers ON requests BEGIN
+            INSERT INTO requests_fts(requests_fts, rowid, body, headers)
+            VALUES ('delete', old.rowid, old.body, old.headers);
+            INSERT INTO requests_fts(rowid, body, headers) VALUES (new.rowid, new.body, new.headers);
+        END;
+    `
+
+var searchTriggers = []string{"requests_fts_ai", "requests_fts_ad", "requests_fts_au"}
+
+// initSearchIndex creates the full-text index when FTS5 is available. When it
+// isn't, any triggers left by an FTS5-enabled build are dropped so inserts keep
+// working; the index is rebuilt the next time an FTS5 build starts.
+func initSearchIndex(conn *sql.DB) error {
+	// CREATE VIRTUAL TABLE IF NOT EXISTS succeeds without the module when the
+	// table is already there, so ask SQLite how it was built instead
+	if err := conn.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&ftsEnabled); err != nil {
+		return err
+	}
+	if !ftsEnabled {
+		for _, name := range searchTriggers {
+			if _, err := conn.Exec("DROP TRIGGER IF EXISTS " + name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var triggers int
+	err := conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'trigger' AND name LIKE 'requests_fts_%'").
+		Scan(&triggers)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Exec(searchIndexSchema); err != nil {
+		return err
+	}
+
+	// Requests stored while the triggers were missing aren't indexed yet
+	if triggers < len(searchTriggers) {
+		_, err = conn.Exec("INSERT INTO requests_fts(requests_fts) VALUES ('rebuild')")
+	}
+	return err
+}
+
+func searchRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/search")]
+	q := strings.TrimSpace(r.URL.Query().Get("q"))
+	if q == "" {
+		http.Error(w, `{"msg":"Missing q"}`, http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultListLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, `{"msg":"Invalid limit"}`, http.StatusBadRequest)
+			return
+		}
+		if n > maxListLimit {
+			n = maxListLimit
+		}
+		limit = n
+	}
+
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	reqs, err := store.SearchRequests(r.Context(), binID, q, limit)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(reqs)
+}
+
+// searchMatches is the substring match stores without SQL use: q anywhere in
+// the body or headers, ignoring case, as LIKE does
+func searchMatches(req Request, q string) bool {
+	q = strings.ToLower(q)
+	if strings.Contains(strings.ToLower(req.RawBody), q) {
+		return true
+	}
+	headersJSON, _ := json.Marshal(req.Headers)
+	return strings.Contains(strings.ToLower(string(headersJSON)), q)
+}
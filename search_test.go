@@ -0,0 +1,63 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSearchRequests(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, body := range []string{`{"order_id":"ord-1234"}`, `{"order_id":"ord-9999"}`, `{"customer":"100%"}`} {
+		captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		captureReq.Header.Set("X-Trace", "trace-"+body[2:7])
+		captureRequestHandler(httptest.NewRecorder(), captureReq)
+	}
+
+	tests := []struct {
+		q    string
+		want int
+	}{
+		{"ord-1234", 1},
+		{"order_id", 2},
+		{"nothing-matches", 0},
+		{"trace-custo", 1}, // headers are searched too
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/search?q="+tt.q, nil)
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Errorf("%q: expected status code %d, got %d", tt.q, http.StatusOK, w.Code)
+			continue
+		}
+		var reqs []Request
+		json.NewDecoder(w.Body).Decode(&reqs)
+		if len(reqs) != tt.want {
+			t.Errorf("%q: expected %d results (fts5=%v), got %d", tt.q, tt.want, ftsEnabled, len(reqs))
+		}
+	}
+
+	// Deleted requests drop out of the index
+	testDB.Exec("DELETE FROM requests WHERE bin_id = ?", bin.BinID)
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/search?q=order_id", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if body := strings.TrimSpace(w.Body.String()); body != "[]" {
+		t.Errorf("Expected no results after deleting, got %s", body)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/search", nil)
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d without q, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// ResponseStep is one response in a sequence, given to the next Times
+// captures (one when unset)
+type ResponseStep struct {
+	ResponseConfig
+	Times int `json:"times,omitempty"`
+}
+
+// responseCursorSchema counts the captures each of a bin's response
+// sequences has answered. Name tells a bin's sequences apart; the bin's
+// own response is "". Saving the bin's config starts them all over.
+const responseCursorSchema = `
+        CREATE TABLE IF NOT EXISTS response_cursors (
+            bin_id TEXT NOT NULL,
+            name TEXT NOT NULL,
+            position INTEGER NOT NULL,
+            PRIMARY KEY(bin_id, name),
+            FOREIGN KEY(bin_id) REFERENCES bins(bin_id) ON DELETE CASCADE
+        );
+    `
+
+const maxStepTimes = 1_000_000
+
+func validateSequence(steps []ResponseStep) string {
+	for i, step := range steps {
+		if len(step.Sequence) > 0 {
+			return fmt.Sprintf("response sequence step %d can't have a sequence of its own", i+1)
+		}
+		if step.Times < 0 || step.Times > maxStepTimes {
+			return fmt.Sprintf("response sequence step %d times must be between 0 and %d", i+1, maxStepTimes)
+		}
+		if msg := step.ResponseConfig.validate(); msg != "" {
+			return fmt.Sprintf("response sequence step %d: %s", i+1, msg)
+		}
+	}
+	return ""
+}
+
+// sequenced reports whether c, or any of its rules, answers with a sequence
+func (c ResponseConfig) sequenced() bool {
+	for _, rule := range c.Rules {
+		if len(rule.Response.Sequence) > 0 {
+			return true
+		}
+	}
+	return len(c.Sequence) > 0
+}
+
+// nextStep advances a bin's sequence and returns the step for this
+// capture. Past the end the last step repeats, or with loop the sequence
+// starts again.
+func nextStep(ctx context.Context, binID, name string, steps []ResponseStep, loop bool) (ResponseStep, error) {
+	if noLocalTables != nil {
+		return ResponseStep{}, noLocalTables
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var position int64
+	err := db.QueryRowContext(ctx, `
+        INSERT INTO response_cursors (bin_id, name, position) VALUES (?, ?, 1)
+        ON CONFLICT(bin_id, name) DO UPDATE SET position = position + 1
+        RETURNING position`, binID, name).Scan(&position)
+	if err != nil {
+		return ResponseStep{}, err
+	}
+	return stepAt(steps, position-1, loop), nil
+}
+
+// stepAt is the step answering the capture after n earlier ones
+func stepAt(steps []ResponseStep, n int64, loop bool) ResponseStep {
+	var total int64
+	for _, step := range steps {
+		total += int64(stepTimes(step))
+	}
+	if n >= total {
+		if !loop {
+			return steps[len(steps)-1]
+		}
+		n %= total
+	}
+	for _, step := range steps {
+		if n < int64(stepTimes(step)) {
+			return step
+		}
+		n -= int64(stepTimes(step))
+	}
+	return steps[len(steps)-1]
+}
+
+func stepTimes(step ResponseStep) int {
+	if step.Times == 0 {
+		return 1
+	}
+	return step.Times
+}
@@ -0,0 +1,49 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sequenceStatuses(t *testing.T, binID string, n int) string {
+	var statuses []string
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+binID, nil))
+		statuses = append(statuses, http.StatusText(w.Code))
+	}
+	return strings.Join(statuses, ",")
+}
+
+func TestResponseSequence(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"response": {"sequence": [{"status": 500, "times": 2}, {"status": 200, "body": "ok"}]}}`)
+	if got := sequenceStatuses(t, bin.BinID, 4); got != "Internal Server Error,Internal Server Error,OK,OK" {
+		t.Errorf("Unexpected statuses %s", got)
+	}
+
+	// Saving the config starts the sequence over, and loop repeats it
+	setTestConfig(t, bin.BinID, `{"response": {"loop": true, "sequence": [{"status": 503}, {"status": 200}]}}`)
+	if got := sequenceStatuses(t, bin.BinID, 3); got != "Service Unavailable,OK,Service Unavailable" {
+		t.Errorf("Unexpected statuses %s", got)
+	}
+}
+
+func TestResponseSequenceValidation(t *testing.T) {
+	for _, cfg := range []ResponseConfig{
+		{Loop: true},
+		{Status: 200, Sequence: []ResponseStep{{}}},
+		{Sequence: []ResponseStep{{Times: -1}}},
+		{Sequence: []ResponseStep{{ResponseConfig: ResponseConfig{Sequence: []ResponseStep{{}}}}}},
+		{Sequence: []ResponseStep{{ResponseConfig: ResponseConfig{Status: 42}}}},
+	} {
+		if cfg.validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+}
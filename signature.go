@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+// SignatureConfig names the webhook provider whose signature scheme a bin
+// checks, and the shared secret. The "hmac" provider describes the scheme
+// with the remaining fields instead.
+type SignatureConfig struct {
+	Provider string `json:"provider"`
+	Secret   string `json:"secret"`
+
+	// Header carries the signature, after an optional Prefix such as "sha256="
+	Header string `json:"header,omitempty"`
+	Prefix string `json:"prefix,omitempty"`
+	// Algorithm is sha1 or sha256 (the default)
+	Algorithm string `json:"algorithm,omitempty"`
+	// Encoding is hex (the default) or base64
+	Encoding string `json:"encoding,omitempty"`
+	// Template builds the signed payload from {body} and {header:Name}
+	// placeholders; it defaults to "{body}"
+	Template string `json:"template,omitempty"`
+}
+
+// signatureVerifiers check a provider's signature over the body as sent
+var signatureVerifiers = map[string]func(c SignatureConfig, h http.Header, body []byte) bool{
+	"github":  verifyGitHub,
+	"stripe":  verifyStripe,
+	"slack":   verifySlack,
+	"shopify": verifyShopify,
+	"hmac":    verifyGenericHMAC,
+}
+
+// hmacAlgorithms are the hashes a generic HMAC rule may use
+var hmacAlgorithms = map[string]func() hash.Hash{
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+func (c SignatureConfig) validate() string {
+	if _, ok := signatureVerifiers[c.Provider]; !ok {
+		return "signature provider must be one of github, stripe, slack, shopify or hmac"
+	}
+	if c.Secret == "" {
+		return "signature secret is required"
+	}
+	if c.Provider != "hmac" {
+		return ""
+	}
+	if c.Header == "" {
+		return "signature header is required for hmac"
+	}
+	if _, ok := hmacAlgorithms[c.Algorithm]; !ok && c.Algorithm != "" {
+		return "signature algorithm must be sha1 or sha256"
+	}
+	if c.Encoding != "" && c.Encoding != "hex" && c.Encoding != "base64" {
+		return "signature encoding must be hex or base64"
+	}
+	if _, err := expandSignatureTemplate(c.Template, nil, nil); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// verify reports whether a capture carries a valid signature
+func (c SignatureConfig) verify(h http.Header, body []byte) bool {
+	check, ok := signatureVerifiers[c.Provider]
+	return ok && check(c, h, body)
+}
+
+func computeHMAC(newHash func() hash.Hash, secret string, parts ...string) []byte {
+	mac := hmac.New(newHash, []byte(secret))
+	for _, p := range parts {
+		mac.Write([]byte(p))
+	}
+	return mac.Sum(nil)
+}
+
+// hexMACEqual compares a hex-encoded signature with an expected MAC in
+// constant time
+func hexMACEqual(sig string, want []byte) bool {
+	got, err := hex.DecodeString(sig)
+	return err == nil && hmac.Equal(got, want)
+}
+
+// verifyGitHub checks X-Hub-Signature-256, or the legacy SHA-1 X-Hub-Signature
+func verifyGitHub(c SignatureConfig, h http.Header, body []byte) bool {
+	if sig := h.Get("X-Hub-Signature-256"); sig != "" {
+		return strings.HasPrefix(sig, "sha256=") &&
+			hexMACEqual(sig[len("sha256="):], computeHMAC(sha256.New, c.Secret, string(body)))
+	}
+	sig := h.Get("X-Hub-Signature")
+	return strings.HasPrefix(sig, "sha1=") &&
+		hexMACEqual(sig[len("sha1="):], computeHMAC(sha1.New, c.Secret, string(body)))
+}
+
+// verifyStripe checks Stripe-Signature: t=timestamp,v1=signature[,v1=...]
+// over "timestamp.body"
+func verifyStripe(c SignatureConfig, h http.Header, body []byte) bool {
+	var timestamp string
+	var sigs []string
+	for _, item := range strings.Split(h.Get("Stripe-Signature"), ",") {
+		key, value, _ := strings.Cut(strings.TrimSpace(item), "=")
+		switch key {
+		case "t":
+			timestamp = value
+		case "v1":
+			sigs = append(sigs, value)
+		}
+	}
+	if timestamp == "" {
+		return false
+	}
+	want := computeHMAC(sha256.New, c.Secret, timestamp, ".", string(body))
+	for _, sig := range sigs {
+		if hexMACEqual(sig, want) {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySlack checks X-Slack-Signature over "v0:timestamp:body"
+func verifySlack(c SignatureConfig, h http.Header, body []byte) bool {
+	sig := h.Get("X-Slack-Signature")
+	timestamp := h.Get("X-Slack-Request-Timestamp")
+	return timestamp != "" && strings.HasPrefix(sig, "v0=") &&
+		hexMACEqual(sig[len("v0="):], computeHMAC(sha256.New, c.Secret, "v0:", timestamp, ":", string(body)))
+}
+
+// verifyShopify checks the base64 X-Shopify-Hmac-Sha256 header
+func verifyShopify(c SignatureConfig, h http.Header, body []byte) bool {
+	got, err := base64.StdEncoding.DecodeString(h.Get("X-Shopify-Hmac-Sha256"))
+	return err == nil && hmac.Equal(got, computeHMAC(sha256.New, c.Secret, string(body)))
+}
+
+// verifyGenericHMAC checks a signature described by the config's header,
+// prefix, algorithm, encoding and payload template
+func verifyGenericHMAC(c SignatureConfig, h http.Header, body []byte) bool {
+	sig := h.Get(c.Header)
+	if !strings.HasPrefix(sig, c.Prefix) {
+		return false
+	}
+	sig = sig[len(c.Prefix):]
+
+	newHash := sha256.New
+	if c.Algorithm != "" {
+		newHash = hmacAlgorithms[c.Algorithm]
+	}
+	payload, err := expandSignatureTemplate(c.Template, h, body)
+	if err != nil {
+		return false
+	}
+	want := computeHMAC(newHash, c.Secret, payload)
+
+	if c.Encoding == "base64" {
+		got, err := base64.StdEncoding.DecodeString(sig)
+		return err == nil && hmac.Equal(got, want)
+	}
+	return hexMACEqual(strings.ToLower(sig), want)
+}
+
+// expandSignatureTemplate substitutes {body} and {header:Name} in a payload
+// template. An empty template signs the body alone.
+func expandSignatureTemplate(template string, h http.Header, body []byte) (string, error) {
+	if template == "" {
+		return string(body), nil
+	}
+	var out strings.Builder
+	for {
+		start := strings.IndexByte(template, '{')
+		if start < 0 {
+			out.WriteString(template)
+			return out.String(), nil
+		}
+		end := strings.IndexByte(template[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("signature template has an unclosed {")
+		}
+		out.WriteString(template[:start])
+		switch name := template[start+1 : start+end]; {
+		case name == "body":
+			out.Write(body)
+		case strings.HasPrefix(name, "header:") && len(name) > len("header:"):
+			out.WriteString(h.Get(name[len("header:"):]))
+		default:
+			return "", fmt.Errorf("signature template has an unknown placeholder {%s}", name)
+		}
+		template = template[start+end+1:]
+	}
+}
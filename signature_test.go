@@ -0,0 +1,181 @@
+//go:build cgo
+
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestVerifySignature(t *testing.T) {
+	const secret = "s3cret"
+	body := []byte(`{"event":"ping"}`)
+	hexMAC := func(parts ...string) string {
+		return hex.EncodeToString(computeHMAC(sha256.New, secret, parts...))
+	}
+
+	tests := []struct {
+		provider string
+		headers  map[string]string
+		want     bool
+	}{
+		{"github", map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC(string(body))}, true},
+		{"github", map[string]string{"X-Hub-Signature": "sha1=" + hex.EncodeToString(computeHMAC(sha1.New, secret, string(body)))}, true},
+		{"github", map[string]string{"X-Hub-Signature-256": "sha256=" + hexMAC("tampered")}, false},
+		{"github", nil, false},
+		{"stripe", map[string]string{"Stripe-Signature": "t=1700000000,v1=deadbeef,v1=" + hexMAC("1700000000.", string(body))}, true},
+		{"stripe", map[string]string{"Stripe-Signature": "v1=" + hexMAC(".", string(body))}, false},
+		{"slack", map[string]string{
+			"X-Slack-Request-Timestamp": "1700000000",
+			"X-Slack-Signature":         "v0=" + hexMAC("v0:1700000000:", string(body)),
+		}, true},
+		{"slack", map[string]string{
+			"X-Slack-Request-Timestamp": "1700000001",
+			"X-Slack-Signature":         "v0=" + hexMAC("v0:1700000000:", string(body)),
+		}, false},
+		{"shopify", map[string]string{
+			"X-Shopify-Hmac-Sha256": base64.StdEncoding.EncodeToString(computeHMAC(sha256.New, secret, string(body))),
+		}, true},
+		{"shopify", map[string]string{"X-Shopify-Hmac-Sha256": "not base64"}, false},
+	}
+	for i, tt := range tests {
+		h := http.Header{}
+		for k, v := range tt.headers {
+			h.Set(k, v)
+		}
+		cfg := SignatureConfig{Provider: tt.provider, Secret: secret}
+		if got := cfg.verify(h, body); got != tt.want {
+			t.Errorf("case %d (%s): expected %v, got %v", i, tt.provider, tt.want, got)
+		}
+	}
+}
+
+func TestGenericHMAC(t *testing.T) {
+	body := []byte(`{"id":42}`)
+	h := http.Header{}
+	h.Set("X-Timestamp", "1700000000")
+
+	hexSig := hex.EncodeToString(computeHMAC(sha256.New, "s3cret", "1700000000.", string(body)))
+	h.Set("X-Signature", "sha256="+strings.ToUpper(hexSig))
+	cfg := SignatureConfig{Provider: "hmac", Secret: "s3cret", Header: "X-Signature", Prefix: "sha256=",
+		Template: "{header:X-Timestamp}.{body}"}
+	if msg := cfg.validate(); msg != "" {
+		t.Fatalf("Expected a valid config, got %q", msg)
+	}
+	if !cfg.verify(h, body) {
+		t.Error("Expected the templated hex signature to verify")
+	}
+	if cfg.verify(h, []byte(`{"id":43}`)) {
+		t.Error("Expected a different body to fail")
+	}
+
+	h.Set("X-Sig-B64", base64.StdEncoding.EncodeToString(computeHMAC(sha1.New, "s3cret", string(body))))
+	b64 := SignatureConfig{Provider: "hmac", Secret: "s3cret", Header: "X-Sig-B64", Algorithm: "sha1", Encoding: "base64"}
+	if !b64.verify(h, body) {
+		t.Error("Expected the base64 sha1 signature over the body to verify")
+	}
+
+	for _, bad := range []SignatureConfig{
+		{Provider: "hmac", Secret: "x"},
+		{Provider: "hmac", Secret: "x", Header: "X-Sig", Algorithm: "md5"},
+		{Provider: "hmac", Secret: "x", Header: "X-Sig", Encoding: "base32"},
+		{Provider: "hmac", Secret: "x", Header: "X-Sig", Template: "{query}"},
+		{Provider: "hmac", Secret: "x", Header: "X-Sig", Template: "{body"},
+	} {
+		if bad.validate() == "" {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+}
+
+func TestBinConfig(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	put := func(body string) int {
+		req := httptest.NewRequest(http.MethodPut, "/api/bin/"+bin.BinID+"/config", strings.NewReader(body))
+		w := httptest.NewRecorder()
+		binAPIHandler(w, req)
+		return w.Code
+	}
+
+	if code := put(`{"signature":{"provider":"gitlab","secret":"x"}}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for an unknown provider, got %d", code)
+	}
+	if code := put(`{"signature":{"provider":"github"}}`); code != http.StatusBadRequest {
+		t.Errorf("Expected 400 without a secret, got %d", code)
+	}
+	if code := put(`{"signature":{"provider":"github","secret":"s3cret"}}`); code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d", code)
+	}
+
+	getReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/config", nil)
+	getW := httptest.NewRecorder()
+	binAPIHandler(getW, getReq)
+	var cfg BinConfig
+	json.NewDecoder(getW.Body).Decode(&cfg)
+	if cfg.Signature == nil || cfg.Signature.Provider != "github" {
+		t.Errorf("Expected the github config back, got %+v", cfg)
+	}
+
+	missing := httptest.NewRequest(http.MethodPut, "/api/bin/nosuchbin/config", strings.NewReader(`{}`))
+	missingW := httptest.NewRecorder()
+	binAPIHandler(missingW, missing)
+	if missingW.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing bin, got %d", missingW.Code)
+	}
+}
+
+func TestCaptureSignatureValid(t *testing.T) {
+	clearDB(t)
+
+	createReq := httptest.NewRequest(http.MethodPost, "/api/bin",
+		strings.NewReader(`{"config":{"signature":{"provider":"github","secret":"s3cret"}}}`))
+	createW := httptest.NewRecorder()
+	createBinHandler(createW, createReq)
+	var bin BinResponse
+	json.NewDecoder(createW.Body).Decode(&bin)
+
+	body := `{"zen":"Keep it simple."}`
+	for _, sig := range []string{
+		"sha256=" + hex.EncodeToString(computeHMAC(sha256.New, "s3cret", body)),
+		"sha256=" + hex.EncodeToString(computeHMAC(sha256.New, "wrong", body)),
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature-256", sig)
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 2 {
+		t.Fatalf("Expected 2 requests, got %d", len(reqs))
+	}
+	if reqs[0].SignatureValid == nil || !*reqs[0].SignatureValid {
+		t.Error("Expected the first signature to be valid")
+	}
+	if reqs[1].SignatureValid == nil || *reqs[1].SignatureValid {
+		t.Error("Expected the second signature to be invalid")
+	}
+
+	plain := createTestBin(t)
+	captureRequestHandler(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/"+plain.BinID, nil))
+	plainReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+plain.BinID+"/req", nil)
+	plainW := httptest.NewRecorder()
+	listRequestsHandler(plainW, plainReq)
+	reqs = nil
+	json.NewDecoder(plainW.Body).Decode(&reqs)
+	if len(reqs) != 1 || reqs[0].SignatureValid != nil {
+		t.Error("Expected no signatureValid on a bin without signature config")
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Sink is an integration captures are sent to once they're stored, such as
+// a message queue or search index. Each sink has its own queue, so Deliver
+// may block; it's given captures one at a time in the order they arrived.
+// A returned error is logged and counted, and the capture isn't retried
+// beyond whatever the sink does itself.
+type Sink interface {
+	Deliver(ctx context.Context, req *Request) error
+}
+
+// batchSink is a Sink that can take several queued captures in one call,
+// still in order. An error fails the whole batch.
+type batchSink interface {
+	Sink
+	DeliverBatch(ctx context.Context, reqs []*Request) error
+}
+
+// sinkKind is a type of sink, configured server-wide with flags, per bin in
+// its config, or both. Either func returns nil when that sink isn't
+// configured.
+type sinkKind struct {
+	name   string
+	global func() Sink
+	forBin func(BinConfig) Sink
+}
+
+// Sink queue tuning
+const (
+	sinkQueueSize   = 1000
+	sinkBatch       = 100
+	sinkTimeout     = 2 * time.Minute
+	sinkIdleTimeout = 5 * time.Minute
+)
+
+var (
+	sinkKinds []sinkKind
+
+	sinksMu    sync.Mutex
+	sinkQueues = map[string]*sinkQueue{}
+	sinkStats  = map[string]*SinkStats{}
+)
+
+// registerSink adds a kind of sink; each sink's file registers its own
+// from init
+func registerSink(kind sinkKind) {
+	sinkKinds = append(sinkKinds, kind)
+}
+
+// SinkStats count what's happened to the captures sent to one kind of sink
+// since the server started. Queued captures haven't been delivered yet, and
+// dropped ones arrived while the queue was full.
+type SinkStats struct {
+	Queued      int64  `json:"queued"`
+	Delivered   int64  `json:"delivered"`
+	Failed      int64  `json:"failed"`
+	Dropped     int64  `json:"dropped"`
+	LastError   string `json:"lastError,omitempty"`
+	LastErrorAt int64  `json:"lastErrorAt,omitempty"`
+}
+
+// sinkStatsSnapshot returns the stats of every registered kind of sink
+func sinkStatsSnapshot() map[string]SinkStats {
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	snapshot := map[string]SinkStats{}
+	for _, kind := range sinkKinds {
+		if stats := sinkStats[kind.name]; stats != nil {
+			snapshot[kind.name] = *stats
+		} else {
+			snapshot[kind.name] = SinkStats{}
+		}
+	}
+	return snapshot
+}
+
+// deliverToSinks queues a capture for every sink configured for the server
+// or its bin, skipping kinds the bin has switched off. It never blocks: a
+// capture that arrives while a sink's queue is full is dropped for that
+// sink.
+func deliverToSinks(config BinConfig, req Request) {
+	for _, kind := range sinkKinds {
+		if enabled, ok := config.Sinks[kind.name]; ok && !enabled {
+			continue
+		}
+		for _, sink := range []Sink{kind.global(), kind.forBin(config)} {
+			if sink != nil {
+				enqueueSink(kind.name, sink, &req)
+			}
+		}
+	}
+}
+
+func enqueueSink(kind string, sink Sink, req *Request) {
+	// Sinks with the same settings share a queue, so bins configured alike
+	// are delivered to in turn rather than all at once. A sink that's a
+	// pointer has state of its own, so it's always its own queue.
+	config, _ := json.Marshal(sink)
+	key := kind + "\x00" + string(config)
+	if reflect.ValueOf(sink).Kind() == reflect.Ptr {
+		key += fmt.Sprintf("\x00%p", sink)
+	}
+
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	stats := sinkStats[kind]
+	if stats == nil {
+		stats = &SinkStats{}
+		sinkStats[kind] = stats
+	}
+	q := sinkQueues[key]
+	if q == nil {
+		q = &sinkQueue{key: key, kind: kind, sink: sink, queue: make(chan *Request, sinkQueueSize), stats: stats}
+		sinkQueues[key] = q
+		go q.run()
+	}
+	select {
+	case q.queue <- req:
+		stats.Queued++
+	default:
+		stats.Dropped++
+		log.Printf("Dropped %s/%s for the %s sink: queue full", req.BinID, req.ReqID, kind)
+	}
+}
+
+// sinkQueue feeds one sink its captures from a single goroutine, which
+// exits once the queue has been idle for a while
+type sinkQueue struct {
+	key, kind string
+	sink      Sink
+	queue     chan *Request
+	stats     *SinkStats
+}
+
+func (q *sinkQueue) run() {
+	idle := time.NewTimer(sinkIdleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case req := <-q.queue:
+			q.deliver(req)
+			if !idle.Stop() {
+				<-idle.C
+			}
+			idle.Reset(sinkIdleTimeout)
+		case <-idle.C:
+			// Captures are only queued with sinksMu held, so none can
+			// arrive between checking and removing the queue
+			sinksMu.Lock()
+			if len(q.queue) == 0 {
+				if sinkQueues[q.key] == q {
+					delete(sinkQueues, q.key)
+				}
+				sinksMu.Unlock()
+				return
+			}
+			sinksMu.Unlock()
+			idle.Reset(sinkIdleTimeout)
+		}
+	}
+}
+
+// deliver sends req, and anything queued behind it when the sink takes
+// batches, and records the outcome
+func (q *sinkQueue) deliver(req *Request) {
+	batch := []*Request{req}
+	bs, batched := q.sink.(batchSink)
+	if batched {
+	fill:
+		for len(batch) < sinkBatch {
+			select {
+			case req := <-q.queue:
+				batch = append(batch, req)
+			default:
+				break fill
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sinkTimeout)
+	defer cancel()
+	var errs []error
+	if batched {
+		err := bs.DeliverBatch(ctx, batch)
+		if err != nil {
+			log.Printf("Delivering %d captures to the %s sink failed: %v", len(batch), q.kind, err)
+		}
+		for range batch {
+			errs = append(errs, err)
+		}
+	} else {
+		err := q.sink.Deliver(ctx, req)
+		if err != nil {
+			log.Printf("Delivering %s/%s to the %s sink failed: %v", req.BinID, req.ReqID, q.kind, err)
+		}
+		errs = append(errs, err)
+	}
+
+	sinksMu.Lock()
+	defer sinksMu.Unlock()
+	for _, err := range errs {
+		q.stats.Queued--
+		if err == nil {
+			q.stats.Delivered++
+			continue
+		}
+		q.stats.Failed++
+		q.stats.LastError = err.Error()
+		q.stats.LastErrorAt = time.Now().UnixMilli()
+	}
+}
+
+// sinkSleep waits between a sink's retries, returning false if ctx ends first
+func sinkSleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// validateSinkSwitches checks a bin's sinks map only names sinks that exist
+func validateSinkSwitches(switches map[string]bool) string {
+	names := make([]string, 0, len(switches))
+	for name := range switches {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		known := false
+		for _, kind := range sinkKinds {
+			known = known || kind.name == name
+		}
+		if !known {
+			return fmt.Sprintf("unknown sink %q", name)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,194 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink remembers the captures delivered to it, one call per entry
+// in calls. When gate is set each call announces itself on waiting and then
+// waits for a value from gate.
+type recordingSink struct {
+	mu      sync.Mutex
+	calls   [][]string
+	err     error
+	gate    chan struct{}
+	waiting chan struct{}
+}
+
+func (s *recordingSink) Deliver(ctx context.Context, req *Request) error {
+	return s.record([]*Request{req})
+}
+
+func (s *recordingSink) record(reqs []*Request) error {
+	if s.gate != nil {
+		s.waiting <- struct{}{}
+		<-s.gate
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ids []string
+	for _, req := range reqs {
+		ids = append(ids, req.ReqID)
+	}
+	s.calls = append(s.calls, ids)
+	return s.err
+}
+
+type recordingBatchSink struct {
+	*recordingSink
+}
+
+func (s recordingBatchSink) DeliverBatch(ctx context.Context, reqs []*Request) error {
+	return s.record(reqs)
+}
+
+// registerTestSink adds a server-wide sink of a new kind for one test
+func registerTestSink(t *testing.T, name string, sink Sink) {
+	kinds := sinkKinds
+	registerSink(sinkKind{name: name, global: func() Sink { return sink }, forBin: func(BinConfig) Sink { return nil }})
+	t.Cleanup(func() {
+		sinkKinds = kinds
+		sinksMu.Lock()
+		delete(sinkStats, name)
+		for key, q := range sinkQueues {
+			if q.kind == name {
+				delete(sinkQueues, key)
+			}
+		}
+		sinksMu.Unlock()
+	})
+}
+
+// waitForSinks waits until every queued capture has been delivered
+func waitForSinks(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		queued := int64(0)
+		for _, stats := range sinkStatsSnapshot() {
+			queued += stats.Queued
+		}
+		if queued == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out with %d captures queued for sinks", queued)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func captureTestRequests(t *testing.T, binID string, n int) []string {
+	var reqIDs []string
+	for i := 0; i < n; i++ {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+binID, strings.NewReader("hello")))
+		reqIDs = append(reqIDs, w.Body.String())
+	}
+	return reqIDs
+}
+
+func TestSinkDelivery(t *testing.T) {
+	clearDB(t)
+	sink := &recordingSink{}
+	registerTestSink(t, "test-delivery", sink)
+
+	bin := createTestBin(t)
+	reqIDs := captureTestRequests(t, bin.BinID, 3)
+	waitForSinks(t)
+
+	var got []string
+	for _, call := range sink.calls {
+		if len(call) != 1 {
+			t.Errorf("Expected one capture per Deliver, got %v", call)
+		}
+		got = append(got, call...)
+	}
+	if strings.Join(got, ",") != strings.Join(reqIDs, ",") {
+		t.Errorf("Expected %v in order, got %v", reqIDs, got)
+	}
+	if stats := sinkStatsSnapshot()["test-delivery"]; stats.Delivered != 3 || stats.Failed != 0 || stats.Queued != 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Switching the sink off for the bin stops its captures going there
+	setTestConfig(t, bin.BinID, `{"sinks": {"test-delivery": false}}`)
+	captureTestRequests(t, bin.BinID, 1)
+	waitForSinks(t)
+	if len(sink.calls) != 3 {
+		t.Errorf("Expected no delivery once switched off, got %v", sink.calls)
+	}
+}
+
+func TestSinkFailures(t *testing.T) {
+	clearDB(t)
+	sink := &recordingSink{err: errors.New("broker unavailable")}
+	registerTestSink(t, "test-failures", sink)
+
+	bin := createTestBin(t)
+	captureTestRequests(t, bin.BinID, 2)
+	waitForSinks(t)
+
+	stats := sinkStatsSnapshot()["test-failures"]
+	if stats.Failed != 2 || stats.Delivered != 0 || stats.LastError != "broker unavailable" || stats.LastErrorAt == 0 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestSinkBatching(t *testing.T) {
+	clearDB(t)
+	sink := recordingBatchSink{&recordingSink{gate: make(chan struct{}), waiting: make(chan struct{}, 2)}}
+	registerTestSink(t, "test-batching", sink)
+
+	bin := createTestBin(t)
+	// The first capture is held at the gate, so the rest queue up behind it
+	// and go in one batch
+	reqIDs := captureTestRequests(t, bin.BinID, 1)
+	<-sink.waiting
+	reqIDs = append(reqIDs, captureTestRequests(t, bin.BinID, 3)...)
+	close(sink.gate)
+	waitForSinks(t)
+
+	if len(sink.calls) != 2 || strings.Join(sink.calls[1], ",") != strings.Join(reqIDs[1:], ",") {
+		t.Errorf("Expected %v then a batch of the rest, got %v", reqIDs, sink.calls)
+	}
+}
+
+func TestSinkQueueFull(t *testing.T) {
+	sink := &recordingSink{gate: make(chan struct{}), waiting: make(chan struct{}, 1)}
+	registerTestSink(t, "test-full", sink)
+	enqueueSink("test-full", sink, &Request{BinID: "bin", ReqID: "held"})
+	<-sink.waiting
+	// With one capture held at the gate, the queue fills behind it
+	for i := 0; i < sinkQueueSize+1; i++ {
+		enqueueSink("test-full", sink, &Request{BinID: "bin", ReqID: "req"})
+	}
+	if stats := sinkStatsSnapshot()["test-full"]; stats.Dropped != 1 || stats.Queued != sinkQueueSize+1 {
+		t.Errorf("Expected one capture to be dropped, got %+v", stats)
+	}
+	go func() {
+		for range sink.waiting {
+		}
+	}()
+	close(sink.gate)
+	waitForSinks(t)
+	close(sink.waiting)
+}
+
+func TestSinkSwitchValidation(t *testing.T) {
+	if msg := (BinConfig{Sinks: map[string]bool{"kafka": false}}).validate(); msg != "" {
+		t.Errorf("Expected a known sink to be accepted, got %q", msg)
+	}
+	if msg := (BinConfig{Sinks: map[string]bool{"carrier-pigeon": false}}).validate(); msg == "" {
+		t.Error("Expected an unknown sink to be rejected")
+	}
+}
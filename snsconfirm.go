@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const snsConfirmTimeout = 10 * time.Second
+
+var snsConfirmClient = &http.Client{Timeout: snsConfirmTimeout}
+
+// snsSubscribeURL is what a SubscribeURL must look like to be fetched, so a
+// forged confirmation can't have the server request anything else; tests
+// point it at a fake
+var snsSubscribeURL = regexp.MustCompile(`^https://sns\.[a-z0-9-]+\.amazonaws\.com(\.cn)?/`)
+
+// confirmSNSSubscription confirms the subscription a SubscriptionConfirmation
+// capture asks for by fetching its SubscribeURL, and records the outcome as
+// a delivery of kind confirm. It reports whether req was a confirmation.
+func confirmSNSSubscription(ctx context.Context, w http.ResponseWriter, req Request) bool {
+	if req.Headers.Get("X-Amz-Sns-Message-Type") != "SubscriptionConfirmation" {
+		return false
+	}
+	var msg struct {
+		Type         string `json:"Type"`
+		TopicArn     string `json:"TopicArn"`
+		SubscribeURL string `json:"SubscribeURL"`
+	}
+	if json.Unmarshal([]byte(req.RawBody), &msg) != nil || msg.Type != "SubscriptionConfirmation" {
+		return false
+	}
+
+	result := ReplayResult{ReqID: req.ReqID, URL: msg.SubscribeURL}
+	if snsSubscribeURL.MatchString(msg.SubscribeURL) {
+		fetchSubscribeURL(ctx, &result)
+	} else {
+		result.Error = "SubscribeURL isn't an SNS endpoint"
+	}
+	d := resultDelivery(req, result)
+	d.Kind, d.Target = deliverySNSConfirm, msg.TopicArn
+	if err := insertDelivery(ctx, d); err != nil {
+		log.Printf("Recording SNS confirmation of %s/%s failed: %v", req.BinID, req.ReqID, err)
+	}
+
+	if !result.ok() {
+		// A failure reply has SNS send the confirmation again
+		http.Error(w, "Confirming the subscription failed: "+d.Error, http.StatusBadGateway)
+		return true
+	}
+	w.Write([]byte(req.ReqID))
+	return true
+}
+
+func fetchSubscribeURL(ctx context.Context, result *ReplayResult) {
+	start := time.Now()
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodGet, result.URL, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	resp, err := snsConfirmClient.Do(httpReq)
+	result.LatencyMs = float64(time.Since(start)) / float64(time.Millisecond)
+	if err != nil {
+		result.Error = err.Error()
+		return
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, maxResponseSnippet))
+	result.Status, result.snippet = resp.StatusCode, truncateUTF8(string(snippet), maxResponseSnippet)
+	if !result.ok() {
+		result.Error = fmt.Sprintf("SNS responded %d", resp.StatusCode)
+	}
+}
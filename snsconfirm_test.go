@@ -0,0 +1,71 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSNSSubscriptionConfirm(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{"handshake": {"sns": true}}`)
+
+	var confirmed []string
+	sns := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		confirmed = append(confirmed, r.URL.Query().Get("Token"))
+		if r.URL.Query().Get("Token") == "expired" {
+			http.Error(w, "<Error>expired</Error>", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("<ConfirmSubscriptionResponse/>"))
+	}))
+	defer sns.Close()
+	orig := snsSubscribeURL
+	snsSubscribeURL = regexp.MustCompile("^" + regexp.QuoteMeta(sns.URL) + "/")
+	defer func() { snsSubscribeURL = orig }()
+
+	confirm := func(subscribeURL string) *httptest.ResponseRecorder {
+		body := `{"Type": "SubscriptionConfirmation", "TopicArn": "arn:aws:sns:us-east-1:123456789012:orders",
+			"SubscribeURL": "` + subscribeURL + `"}`
+		r := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body))
+		r.Header.Set("Content-Type", "text/plain; charset=UTF-8")
+		r.Header.Set("X-Amz-Sns-Message-Type", "SubscriptionConfirmation")
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, r)
+		return w
+	}
+
+	if w := confirm(sns.URL + "/?Action=ConfirmSubscription&Token=abc"); w.Code != http.StatusOK {
+		t.Errorf("Expected the confirmation to succeed, got %d %s", w.Code, w.Body)
+	}
+	if w := confirm(sns.URL + "/?Action=ConfirmSubscription&Token=expired"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a refused confirmation to fail so SNS resends it, got %d %s", w.Code, w.Body)
+	}
+	if w := confirm("http://169.254.169.254/latest/meta-data/"); w.Code != http.StatusBadGateway {
+		t.Errorf("Expected a SubscribeURL off SNS to be refused, got %d %s", w.Code, w.Body)
+	}
+	if len(confirmed) != 2 || confirmed[0] != "abc" {
+		t.Errorf("Expected only the SNS URLs to be fetched, got %v", confirmed)
+	}
+
+	deliveries, err := queryDeliveries(context.Background(), "WHERE bin_id = ? AND kind = ? ORDER BY created_at", bin.BinID, deliverySNSConfirm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := map[string]int{}
+	for _, d := range deliveries {
+		statuses[d.Status]++
+		if d.Target != "arn:aws:sns:us-east-1:123456789012:orders" {
+			t.Errorf("Expected the topic as the target, got %s", d.Target)
+		}
+	}
+	if len(deliveries) != 3 || statuses[deliveryDelivered] != 1 || statuses[deliveryFailed] != 2 {
+		t.Errorf("Expected one confirmed and two failed, got %+v", deliveries)
+	}
+}
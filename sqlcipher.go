@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Database encryption settings; overridable with command-line flags. A key
+// from either source encrypts the SQLite database with SQLCipher, which the
+// server has to be built against (see the README).
+var (
+	// sqliteKeyEnv names the environment variable holding a passphrase
+	sqliteKeyEnv string
+	// sqliteKeyKMS is a base64 data key encrypted with AWS KMS, as
+	// returned in CiphertextBlob by GenerateDataKey
+	sqliteKeyKMS string
+	kmsRegion    = "us-east-1"
+	kmsEndpoint  string
+)
+
+// sqliteKey is the value of the PRAGMA key that opens the database, set by
+// loadSQLiteKey; empty leaves the database unencrypted
+var sqliteKey string
+
+// errNoSQLCipher is returned for a key when SQLite wasn't built as SQLCipher,
+// which would otherwise ignore it and write the database in the clear
+var errNoSQLCipher = errors.New("a database key needs a build linked against SQLCipher: go build -tags libsqlite3 with SQLCipher's libsqlite3")
+
+// loadSQLiteKey reads the database key from wherever the flags say it is
+func loadSQLiteKey(ctx context.Context) error {
+	switch {
+	case sqliteKeyEnv != "" && sqliteKeyKMS != "":
+		return errors.New("give one of --sqlite-key-env and --sqlite-key-kms")
+	case sqliteKeyEnv != "":
+		key := os.Getenv(sqliteKeyEnv)
+		if key == "" {
+			return fmt.Errorf("$%s, named by --sqlite-key-env, is empty", sqliteKeyEnv)
+		}
+		sqliteKey = "'" + strings.ReplaceAll(key, "'", "''") + "'"
+	case sqliteKeyKMS != "":
+		key, err := kmsDecrypt(ctx, sqliteKeyKMS)
+		if err != nil {
+			return err
+		}
+		// SQLCipher takes 32 bytes as the raw key, skipping its key derivation
+		if len(key) != 32 {
+			return fmt.Errorf("--sqlite-key-kms decrypts to %d bytes, want a 32-byte data key", len(key))
+		}
+		sqliteKey = `"x'` + hex.EncodeToString(key) + `'"`
+	}
+	return nil
+}
+
+// kmsDecrypt has AWS KMS decrypt a base64 ciphertext, with credentials from
+// the environment
+func kmsDecrypt(ctx context.Context, ciphertext string) ([]byte, error) {
+	endpoint := kmsEndpoint
+	if endpoint == "" {
+		endpoint = "https://kms." + kmsRegion + ".amazonaws.com"
+	}
+	payload, _ := json.Marshal(map[string]string{"CiphertextBlob": ciphertext})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService.Decrypt")
+	signAWSRequest(req, sha256Hex(payload), "kms", kmsRegion, awsCredentialsFromEnv(), time.Now())
+
+	resp, err := awsSinkClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kms: %s: %s", resp.Status, bytes.TrimSpace(raw))
+	}
+	var out struct {
+		Plaintext string
+	}
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(out.Plaintext)
+}
+
+// sqliteJournalModes are the journal modes go-sqlite3 accepts in a DSN
+var sqliteJournalModes = map[string]bool{"DELETE": true, "TRUNCATE": true, "PERSIST": true, "MEMORY": true, "WAL": true, "OFF": true}
+
+// openKeyedSQLite opens an SQLCipher database with sqliteKey. The key has to
+// come before anything reads the file, so the pragmas go-sqlite3 would run
+// from the DSN are run after it instead.
+func openKeyedSQLite(path string, foreignKeys string) (*sql.DB, error) {
+	mode := strings.ToUpper(sqliteJournalMode)
+	if !sqliteJournalModes[mode] {
+		return nil, fmt.Errorf("unknown --sqlite-journal-mode %q", sqliteJournalMode)
+	}
+	conn := sql.OpenDB(sqliteConnector{
+		dsn:   fmt.Sprintf("%s?_busy_timeout=%d&_txlock=immediate", path, sqliteBusyTimeout.Milliseconds()),
+		setup: []string{"PRAGMA key = " + sqliteKey, "PRAGMA auto_vacuum = INCREMENTAL", "PRAGMA journal_mode = " + mode, "PRAGMA foreign_keys = " + foreignKeys},
+	})
+
+	var version string
+	if err := conn.QueryRow("PRAGMA cipher_version").Scan(&version); err == sql.ErrNoRows || err == nil && version == "" {
+		conn.Close()
+		return nil, errNoSQLCipher
+	} else if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("opening %s (is the key right?): %w", path, err)
+	}
+	return conn, nil
+}
@@ -0,0 +1,101 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// resetSQLiteKey restores the key settings when a test is done with them
+func resetSQLiteKey(t *testing.T) {
+	env, kms, endpoint, key := sqliteKeyEnv, sqliteKeyKMS, kmsEndpoint, sqliteKey
+	t.Cleanup(func() { sqliteKeyEnv, sqliteKeyKMS, kmsEndpoint, sqliteKey = env, kms, endpoint, key })
+}
+
+func TestLoadSQLiteKeyFromEnv(t *testing.T) {
+	resetSQLiteKey(t)
+	t.Setenv("POSTBIN_TEST_KEY", "it's secret")
+	sqliteKeyEnv = "POSTBIN_TEST_KEY"
+	if err := loadSQLiteKey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if sqliteKey != `'it''s secret'` {
+		t.Errorf("Expected a quoted passphrase, got %s", sqliteKey)
+	}
+
+	sqliteKeyEnv = "POSTBIN_TEST_KEY_UNSET"
+	if err := loadSQLiteKey(context.Background()); err == nil {
+		t.Errorf("Expected an empty key to be refused")
+	}
+	sqliteKeyKMS = "AQID"
+	if err := loadSQLiteKey(context.Background()); err == nil {
+		t.Errorf("Expected both sources at once to be refused")
+	}
+}
+
+func TestLoadSQLiteKeyFromKMS(t *testing.T) {
+	resetSQLiteKey(t)
+	dataKey := bytes.Repeat([]byte{0xab}, 32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var in struct{ CiphertextBlob string }
+		json.NewDecoder(r.Body).Decode(&in)
+		if r.Header.Get("X-Amz-Target") != "TrentService.Decrypt" || in.CiphertextBlob != "Y2lwaGVy" {
+			http.Error(w, `{"__type":"InvalidCiphertextException"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"Plaintext": base64.StdEncoding.EncodeToString(dataKey)})
+	}))
+	defer server.Close()
+
+	kmsEndpoint, sqliteKeyKMS = server.URL, "Y2lwaGVy"
+	if err := loadSQLiteKey(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := `"x'` + strings.Repeat("ab", 32) + `'"`; sqliteKey != want {
+		t.Errorf("Expected the raw key %s, got %s", want, sqliteKey)
+	}
+
+	sqliteKeyKMS = "b3RoZXI="
+	if err := loadSQLiteKey(context.Background()); err == nil || !strings.Contains(err.Error(), "InvalidCiphertext") {
+		t.Errorf("Expected KMS's error, got %v", err)
+	}
+}
+
+func TestKeyedSQLite(t *testing.T) {
+	resetSQLiteKey(t)
+	sqliteKey = "'test key'"
+	path := filepath.Join(t.TempDir(), "postbin.db")
+	conn, err := openSQLite(path, true)
+
+	// Plain SQLite would ignore the key, so it's refused outright
+	var version string
+	testDB.QueryRow("PRAGMA cipher_version").Scan(&version)
+	if version == "" {
+		if err != errNoSQLCipher {
+			t.Errorf("Expected a build without SQLCipher to refuse the key, got %v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	raw, _ := os.ReadFile(path)
+	if bytes.HasPrefix(raw, []byte("SQLite format 3")) {
+		t.Errorf("Expected the database file to be encrypted")
+	}
+	sqliteKey = "'wrong key'"
+	if _, err := openSQLite(path, true); err == nil {
+		t.Errorf("Expected the wrong key to fail")
+	}
+}
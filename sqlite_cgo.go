@@ -0,0 +1,35 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// localSQLite reports whether this build has SQLite, which go-sqlite3 needs
+// cgo for
+const localSQLite = true
+
+// sqliteConnector opens SQLite connections that run setup before anything else
+type sqliteConnector struct {
+	dsn   string
+	setup []string
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return c.Driver().Open(c.dsn)
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{ConnectHook: func(conn *sqlite3.SQLiteConn) error {
+		for _, stmt := range c.setup {
+			if _, err := conn.Exec(stmt, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
@@ -0,0 +1,43 @@
+//go:build !cgo
+
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+)
+
+// Without cgo there's no SQLite: go-sqlite3 only registers a stub. Bins and
+// requests can still be kept by the pure-Go backends, while the features with
+// tables of their own in the local database are refused with
+// errNoLocalSQLite.
+const localSQLite = false
+
+// sqliteConnector stands in for the SQLite connector, every connection
+// failing with errNoLocalSQLite
+type sqliteConnector struct {
+	dsn   string
+	setup []string
+}
+
+func (c sqliteConnector) Connect(context.Context) (driver.Conn, error) {
+	return nil, errNoLocalSQLite
+}
+
+func (c sqliteConnector) Driver() driver.Driver {
+	return noSQLiteDriver{}
+}
+
+type noSQLiteDriver struct{}
+
+func (noSQLiteDriver) Open(string) (driver.Conn, error) {
+	return nil, errNoLocalSQLite
+}
+
+func backupSQLite(ctx context.Context, path string) error {
+	return errNoLocalSQLite
+}
+
+func restoreSQLite(ctx context.Context, path string) error {
+	return errNoLocalSQLite
+}
@@ -0,0 +1,61 @@
+//go:build !cgo
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Without cgo the rest of the tests, which run against SQLite, are left out,
+// and these run against the memory store the way such a build would.
+func TestMain(m *testing.M) {
+	if err := openStore("memory", ""); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+func TestNoCgoShiftOffloaded(t *testing.T) {
+	dir := t.TempDir()
+	blobs, blobThreshold = dirBlobStore{dir: dir}, 16
+	defer func() { blobs, blobThreshold = nil, 0 }()
+
+	createW := httptest.NewRecorder()
+	createBinHandler(createW, httptest.NewRequest(http.MethodPost, "/api/bin", nil))
+	var bin BinResponse
+	if err := json.NewDecoder(createW.Body).Decode(&bin); err != nil {
+		t.Fatalf("Failed to decode created bin: %v", err)
+	}
+
+	large := strings.Repeat("0123456789", 10)
+	captureW := httptest.NewRecorder()
+	captureRequestHandler(captureW, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(large)))
+	reqID := captureW.Body.String()
+	if _, err := os.Stat(filepath.Join(dir, bin.BinID, reqID)); err != nil {
+		t.Fatalf("Expected the body in the blob directory: %v", err)
+	}
+
+	shiftW := httptest.NewRecorder()
+	binAPIHandler(shiftW, httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req/shift", nil))
+	if shiftW.Code != http.StatusOK {
+		t.Fatalf("Expected the shift to succeed without SQLite, got %d: %s", shiftW.Code, shiftW.Body.String())
+	}
+	var shifted Request
+	json.NewDecoder(shiftW.Body).Decode(&shifted)
+	if shifted.ReqID != reqID {
+		t.Errorf("Expected %s shifted, got %+v", reqID, shifted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, bin.BinID, reqID)); !os.IsNotExist(err) {
+		t.Errorf("Expected the shifted request's blob deleted, got %v", err)
+	}
+	if n, _ := store.CountRequests(context.Background(), bin.BinID, requestFilter{}); n != 0 {
+		t.Errorf("Expected the bin emptied, got %d", n)
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Global AWS sink settings; overridable with command-line flags. They use
+// the server's own credentials and $AWS_REGION from the environment, so
+// unlike per-bin sinks they don't need any in their config.
+var (
+	sqsQueueURL string
+	snsTopicARN string
+)
+
+const awsSinkTimeout = 10 * time.Second
+
+var awsSinkClient = &http.Client{Timeout: awsSinkTimeout}
+
+// AWSSinkCredentials are the keys a per-bin AWS sink signs its requests
+// with. Region is worked out from the queue URL or topic ARN when omitted,
+// and Endpoint points at an AWS-compatible service such as LocalStack.
+type AWSSinkCredentials struct {
+	Region          string `json:"region,omitempty"`
+	Endpoint        string `json:"endpoint,omitempty"`
+	AccessKeyID     string `json:"accessKeyId"`
+	SecretAccessKey string `json:"secretAccessKey"`
+	SessionToken    string `json:"sessionToken,omitempty"`
+}
+
+func (c AWSSinkCredentials) validate(service string) string {
+	if c.AccessKeyID == "" || c.SecretAccessKey == "" {
+		return service + " needs an accessKeyId and secretAccessKey"
+	}
+	if c.Endpoint != "" {
+		if u, err := url.Parse(c.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return service + " endpoint must be an absolute http or https URL"
+		}
+	}
+	return ""
+}
+
+func (c AWSSinkCredentials) credentials() awsCredentials {
+	return awsCredentials{AccessKeyID: c.AccessKeyID, SecretAccessKey: c.SecretAccessKey, SessionToken: c.SessionToken}
+}
+
+// SQSSinkConfig sends each of a bin's captures to an SQS queue as JSON.
+// FIFO queues get the bin ID as message group and the request ID as
+// deduplication ID.
+type SQSSinkConfig struct {
+	QueueURL string `json:"queueUrl"`
+	AWSSinkCredentials
+}
+
+func (c SQSSinkConfig) validate() string {
+	if u, err := url.Parse(c.QueueURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "sqs queueUrl must be an absolute http or https URL"
+	}
+	if c.region() == "" {
+		return "sqs needs a region when the queue URL doesn't name one"
+	}
+	return c.AWSSinkCredentials.validate("sqs")
+}
+
+// region is the configured region, or the one in a queue URL such as
+// https://sqs.eu-west-1.amazonaws.com/123456789012/hooks
+func (c SQSSinkConfig) region() string {
+	if c.Region != "" {
+		return c.Region
+	}
+	u, err := url.Parse(c.QueueURL)
+	if err != nil {
+		return ""
+	}
+	if parts := strings.Split(u.Hostname(), "."); len(parts) >= 3 && parts[0] == "sqs" {
+		return parts[1]
+	}
+	return ""
+}
+
+// SNSSinkConfig publishes each of a bin's captures to an SNS topic as JSON,
+// using the bin ID as message group on FIFO topics.
+type SNSSinkConfig struct {
+	TopicARN string `json:"topicArn"`
+	AWSSinkCredentials
+}
+
+func (c SNSSinkConfig) validate() string {
+	if len(strings.Split(c.TopicARN, ":")) != 6 || !strings.HasPrefix(c.TopicARN, "arn:") {
+		return "sns topicArn must look like arn:aws:sns:region:account:topic"
+	}
+	if c.region() == "" {
+		return "sns needs a region when the topic ARN doesn't name one"
+	}
+	return c.AWSSinkCredentials.validate("sns")
+}
+
+func (c SNSSinkConfig) region() string {
+	if c.Region != "" {
+		return c.Region
+	}
+	if parts := strings.Split(c.TopicARN, ":"); len(parts) == 6 {
+		return parts[3]
+	}
+	return ""
+}
+
+func (c SNSSinkConfig) endpoint() string {
+	if c.Endpoint != "" {
+		return c.Endpoint
+	}
+	return "https://sns." + c.region() + ".amazonaws.com/"
+}
+
+// globalSQSSink and globalSNSSink are the sinks configured with
+// --sqs-queue-url and --sns-topic-arn, if any
+func globalSQSSink() *SQSSinkConfig {
+	if sqsQueueURL == "" {
+		return nil
+	}
+	creds := awsCredentialsFromEnv()
+	return &SQSSinkConfig{QueueURL: sqsQueueURL, AWSSinkCredentials: AWSSinkCredentials{
+		Region:      os.Getenv("AWS_REGION"),
+		AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.SessionToken,
+	}}
+}
+
+func globalSNSSink() *SNSSinkConfig {
+	if snsTopicARN == "" {
+		return nil
+	}
+	creds := awsCredentialsFromEnv()
+	return &SNSSinkConfig{TopicARN: snsTopicARN, AWSSinkCredentials: AWSSinkCredentials{
+		Region:      os.Getenv("AWS_REGION"),
+		AccessKeyID: creds.AccessKeyID, SecretAccessKey: creds.SecretAccessKey, SessionToken: creds.SessionToken,
+	}}
+}
+
+func init() {
+	registerSink(sinkKind{
+		name: "sqs",
+		global: func() Sink {
+			if sink := globalSQSSink(); sink != nil {
+				return *sink
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.SQS != nil {
+				return *c.SQS
+			}
+			return nil
+		},
+	})
+	registerSink(sinkKind{
+		name: "sns",
+		global: func() Sink {
+			if sink := globalSNSSink(); sink != nil {
+				return *sink
+			}
+			return nil
+		},
+		forBin: func(c BinConfig) Sink {
+			if c.SNS != nil {
+				return *c.SNS
+			}
+			return nil
+		},
+	})
+}
+
+// Deliver sends a capture to the queue as one message
+func (c SQSSinkConfig) Deliver(ctx context.Context, req *Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":      {"SendMessage"},
+		"Version":     {"2012-11-05"},
+		"MessageBody": {string(body)},
+	}
+	addAWSMessageAttributes(form, req)
+	if strings.HasSuffix(c.QueueURL, ".fifo") {
+		form.Set("MessageGroupId", req.BinID)
+		form.Set("MessageDeduplicationId", req.ReqID)
+	}
+	target := c.QueueURL
+	if c.Endpoint != "" {
+		u, _ := url.Parse(c.QueueURL)
+		target = strings.TrimSuffix(c.Endpoint, "/") + u.Path
+	}
+	return awsFormPost(ctx, target, "sqs", c.region(), c.credentials(), form)
+}
+
+// Deliver publishes a capture to the topic as one message
+func (c SNSSinkConfig) Deliver(ctx context.Context, req *Request) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	form := url.Values{
+		"Action":   {"Publish"},
+		"Version":  {"2010-03-31"},
+		"TopicArn": {c.TopicARN},
+		"Message":  {string(body)},
+	}
+	addAWSMessageAttributes(form, req)
+	if strings.HasSuffix(c.TopicARN, ".fifo") {
+		form.Set("MessageGroupId", req.BinID)
+		form.Set("MessageDeduplicationId", req.ReqID)
+	}
+	return awsFormPost(ctx, c.endpoint(), "sns", c.region(), c.credentials(), form)
+}
+
+// addAWSMessageAttributes tags a message with its bin and request IDs, in
+// the form both SQS and SNS expect
+func addAWSMessageAttributes(form url.Values, req *Request) {
+	for i, attr := range [][2]string{{"binId", req.BinID}, {"reqId", req.ReqID}} {
+		prefix := fmt.Sprintf("MessageAttribute.%d.", i+1)
+		if form.Get("Action") == "Publish" {
+			prefix = fmt.Sprintf("MessageAttributes.entry.%d.", i+1)
+		}
+		form.Set(prefix+"Name", attr[0])
+		form.Set(prefix+"Value.DataType", "String")
+		form.Set(prefix+"Value.StringValue", attr[1])
+	}
+}
+
+// awsFormPost makes a signed query-protocol call and checks it succeeded
+func awsFormPost(ctx context.Context, target, service, region string, creds awsCredentials, form url.Values) error {
+	payload := []byte(form.Encode())
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, target, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	signAWSRequest(httpReq, sha256Hex(payload), service, region, creds, time.Now())
+
+	resp, err := awsSinkClient.Do(httpReq)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	return awsQueryError(service, resp)
+}
+
+// awsQueryError turns an error response into an error, using the message
+// in its XML body when there is one
+func awsQueryError(service string, resp *http.Response) error {
+	raw, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	var parsed struct {
+		Error struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	if xml.Unmarshal(raw, &parsed) == nil && parsed.Error.Code != "" {
+		return fmt.Errorf("%s: %s: %s", service, parsed.Error.Code, parsed.Error.Message)
+	}
+	return fmt.Errorf("%s: %s: %s", service, resp.Status, bytes.TrimSpace(raw))
+}
@@ -0,0 +1,117 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAWSQueryServer records signed query-protocol calls, failing those for
+// topics or queues named "missing" the way AWS does
+func fakeAWSQueryServer(t *testing.T) (*httptest.Server, <-chan url.Values) {
+	calls := make(chan url.Values, 8)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		form, _ := url.ParseQuery(string(body))
+		form.Set("_path", r.URL.Path)
+		form.Set("_auth", r.Header.Get("Authorization"))
+		calls <- form
+		if strings.Contains(r.URL.Path+form.Get("TopicArn"), "missing") {
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `<ErrorResponse><Error><Type>Sender</Type><Code>NotFound</Code>`+
+				`<Message>Topic does not exist</Message></Error></ErrorResponse>`)
+			return
+		}
+		io.WriteString(w, `<SendMessageResponse/>`)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, calls
+}
+
+func receiveAWSCall(t *testing.T, calls <-chan url.Values) url.Values {
+	select {
+	case form := <-calls:
+		return form
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the AWS call")
+		return nil
+	}
+}
+
+func TestSQSAndSNSSinks(t *testing.T) {
+	clearDB(t)
+	srv, calls := fakeAWSQueryServer(t)
+
+	bin := createTestBin(t)
+	setTestConfig(t, bin.BinID, `{
+		"sqs": {"queueUrl": "`+srv.URL+`/000000000000/hooks.fifo", "region": "eu-west-1",
+			"accessKeyId": "AKIDTEST", "secretAccessKey": "secret"},
+		"sns": {"topicArn": "arn:aws:sns:eu-west-1:000000000000:hooks", "endpoint": "`+srv.URL+`",
+			"accessKeyId": "AKIDTEST", "secretAccessKey": "secret"}}`)
+	w := httptest.NewRecorder()
+	captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("hi")))
+	reqID := w.Body.String()
+
+	// The queue and topic are separate sinks, so either call may come first
+	sqs, sns := receiveAWSCall(t, calls), receiveAWSCall(t, calls)
+	if sqs.Get("Action") == "Publish" {
+		sqs, sns = sns, sqs
+	}
+	var req Request
+	json.Unmarshal([]byte(sqs.Get("MessageBody")), &req)
+	if sqs.Get("Action") != "SendMessage" || sqs.Get("_path") != "/000000000000/hooks.fifo" || req.ReqID != reqID {
+		t.Errorf("Unexpected SQS call %v", sqs)
+	}
+	if sqs.Get("MessageGroupId") != bin.BinID || sqs.Get("MessageDeduplicationId") != reqID ||
+		sqs.Get("MessageAttribute.2.Name") != "reqId" || sqs.Get("MessageAttribute.2.Value.StringValue") != reqID {
+		t.Errorf("Expected FIFO and attribute fields, got %v", sqs)
+	}
+	if !strings.HasPrefix(sqs.Get("_auth"), "AWS4-HMAC-SHA256 Credential=AKIDTEST/") ||
+		!strings.Contains(sqs.Get("_auth"), "/eu-west-1/sqs/aws4_request") {
+		t.Errorf("Expected a SigV4 signature for eu-west-1 sqs, got %q", sqs.Get("_auth"))
+	}
+
+	if sns.Get("Action") != "Publish" || sns.Get("TopicArn") != "arn:aws:sns:eu-west-1:000000000000:hooks" ||
+		sns.Get("MessageAttributes.entry.1.Value.StringValue") != bin.BinID || sns.Get("MessageGroupId") != "" ||
+		!strings.Contains(sns.Get("_auth"), "/eu-west-1/sns/aws4_request") {
+		t.Errorf("Unexpected SNS call %v", sns)
+	}
+}
+
+func TestSNSError(t *testing.T) {
+	srv, _ := fakeAWSQueryServer(t)
+	cfg := SNSSinkConfig{TopicARN: "arn:aws:sns:us-east-1:000000000000:missing",
+		AWSSinkCredentials: AWSSinkCredentials{Endpoint: srv.URL, AccessKeyID: "a", SecretAccessKey: "b"}}
+	err := cfg.Deliver(context.Background(), &Request{BinID: "b", ReqID: "r"})
+	if err == nil || err.Error() != "sns: NotFound: Topic does not exist" {
+		t.Errorf("Expected the AWS error message, got %v", err)
+	}
+}
+
+func TestAWSSinkValidation(t *testing.T) {
+	creds := AWSSinkCredentials{AccessKeyID: "a", SecretAccessKey: "b"}
+	for _, cfg := range []BinConfig{
+		{SQS: &SQSSinkConfig{QueueURL: "https://sqs.us-east-1.amazonaws.com/1/q"}},
+		{SQS: &SQSSinkConfig{QueueURL: "http://localhost:4566/1/q", AWSSinkCredentials: creds}},
+		{SNS: &SNSSinkConfig{TopicARN: "hooks", AWSSinkCredentials: creds}},
+	} {
+		if cfg.validate() == "" {
+			t.Errorf("Expected %+v to be rejected", cfg)
+		}
+	}
+	ok := BinConfig{
+		SQS: &SQSSinkConfig{QueueURL: "https://sqs.us-east-1.amazonaws.com/1/q", AWSSinkCredentials: creds},
+		SNS: &SNSSinkConfig{TopicARN: "arn:aws:sns:us-east-1:1:t", AWSSinkCredentials: creds},
+	}
+	if msg := ok.validate(); msg != "" {
+		t.Errorf("Expected regions to come from the URL and ARN, got %q", msg)
+	}
+}
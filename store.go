@@ -0,0 +1,1036 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Store keeps bins and the requests captured into them. Lookups that find
+// nothing return sql.ErrNoRows, whatever the backend, and the methods that
+// report a bool report whether the bin or request existed. Each call gives
+// up once ctx is done or dbTimeout has passed. Everything that reads or
+// changes bins and requests goes through Store. Consumer groups, forwarding
+// deliveries, replay jobs, response sequences, assets and digests keep
+// tables of their own in the local SQLite database instead, so they're only
+// offered when that database is this server's alone to answer for; see
+// noLocalTables.
+type Store interface {
+	// CreateBin stores a new bin, reporting false if its ID is taken
+	CreateBin(ctx context.Context, bin BinRecord) (bool, error)
+	GetBin(ctx context.Context, binID string) (BinRecord, error)
+	// ExtendBin pushes a bin's expiry back by ms, from now if it has
+	// already lapsed, to no later than latest (see extendedExpiry);
+	// permanent bins are left alone
+	ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error)
+	SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error)
+	// DeleteBin removes a bin and everything stored for it
+	DeleteBin(ctx context.Context, binID string) error
+	// PurgeExpiredBins deletes up to limit expired bins, all of them when
+	// limit is 0, returning how many bins and requests went
+	PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error)
+
+	// ListBins pages through bins oldest first, all of them when limit is 0
+	ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error)
+	// Usage totals what the store holds, or only the requests of one bin
+	// when binID isn't empty
+	Usage(ctx context.Context, binID string) (StoreUsage, error)
+	// UsageByBin is Usage for each of binIDs at once. Bins holding no
+	// requests may be left out.
+	UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error)
+	// OldestActiveBin returns the first bin, in ListBins order, that hasn't
+	// expired, or sql.ErrNoRows when there's none
+	OldestActiveBin(ctx context.Context) (BinRecord, error)
+
+	// InsertRequest stores a capture. When maxEntries is positive the bin's
+	// oldest requests beyond that many are evicted along with it. Over
+	// --max-storage-bytes it fails with errInsufficientStorage or, under the
+	// evict policy, first evicts the oldest requests in any bin.
+	InsertRequest(ctx context.Context, req Request, maxEntries int) error
+	GetRequest(ctx context.Context, binID, reqID string) (Request, error)
+	CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error)
+	// CountBuckets counts a bin's requests matching filter by when they were
+	// inserted, in buckets bucketMs wide, returning those with any in order
+	CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error)
+	// ListRequests pages through a bin's requests, oldest first
+	ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error)
+	// RequestsAfter returns up to limit requests matching filter that come
+	// after the cursor, in cursor order, so a caller pages through a bin by
+	// moving the cursor to the last one each time
+	RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error)
+	// SearchRequests returns up to limit requests whose body or headers
+	// contain q, oldest first
+	SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error)
+	// EncodedBody returns a decoded request's body as it was sent, before
+	// its Content-Encoding was removed
+	EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error)
+	// SetUpstreamResponse records what a proxying bin's upstream replied
+	SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error)
+	// TakeRequests removes and returns up to count requests from the oldest
+	// end of a bin, or the newest, so no two consumers get the same one.
+	// Leased requests are skipped.
+	TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error)
+	// LeaseRequest hides the oldest request that isn't leased from other
+	// consumers until until, returning it
+	LeaseRequest(ctx context.Context, binID string, until int64) (Request, error)
+	// SettleLease deletes a leased request, or releases it when release is
+	// set. A request whose lease has lapsed, or that was never leased, may
+	// belong to another consumer by now, so it's refused with errLeaseLapsed.
+	SettleLease(ctx context.Context, binID, reqID string, release bool) error
+	DeleteRequest(ctx context.Context, binID, reqID string) (bool, error)
+	// RequestPart returns the first part of a multipart capture with the
+	// given form name
+	RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error)
+}
+
+// noLocalTables is why the features with tables of their own in the local
+// SQLite database are refused, or nil when they're offered. A build without
+// cgo has no such database, and a backend other servers share would leave
+// each server's tables disagreeing with the rest, so openStore sets it for
+// both rather than let them quietly hold one server's share.
+var noLocalTables error
+
+// errNoLocalSQLite is noLocalTables in a build without cgo, and what anything
+// reaching for the local database there fails with
+var errNoLocalSQLite = errors.New("this build has no SQLite, which needs cgo: build with CGO_ENABLED=1")
+
+// refuseLocalFeature answers with 501 when noLocalTables rules out feature,
+// reporting whether it did
+func refuseLocalFeature(w http.ResponseWriter, feature string) bool {
+	if noLocalTables == nil {
+		return false
+	}
+	msg, _ := json.Marshal(map[string]string{"msg": feature + " aren't available: " + noLocalTables.Error()})
+	http.Error(w, string(msg), http.StatusNotImplemented)
+	return true
+}
+
+// storeIsSQLite reports whether bins and requests are kept in the local
+// SQLite database, which admin backups, restores and maintenance work on
+func storeIsSQLite() bool {
+	_, ok := store.(*sqliteStore)
+	return ok
+}
+
+// requestPart is RequestPart for stores that keep no parts apart from the
+// body they came in, which is parsed again for them
+func requestPart(req Request, name string) (bodyPart, error) {
+	_, parts := parseBody(req.Headers.Get("Content-Type"), []byte(req.RawBody))
+	for _, part := range parts {
+		if part.Name == name {
+			return part, nil
+		}
+	}
+	return bodyPart{}, sql.ErrNoRows
+}
+
+// StoreUsage is what a store holds. Bytes is the storage its requests use, as
+// requestSize counts it.
+type StoreUsage struct {
+	Bins        int
+	ExpiredBins int
+	Requests    int
+	Bytes       int64
+}
+
+// requestCursor is a place in a bin's requests, just after the one inserted
+// at Inserted with ID ReqID; the zero cursor is the start of the bin. Cursor
+// order is by inserted and then by ID, which for captures from one server is
+// the order they arrived in, so it doesn't depend on anything a particular
+// store numbers its requests with.
+type requestCursor struct {
+	Inserted int64
+	ReqID    string
+}
+
+// cursorAt is the cursor just after req
+func cursorAt(req Request) requestCursor {
+	return requestCursor{Inserted: req.Inserted, ReqID: req.ReqID}
+}
+
+// precedes reports whether req comes after the cursor
+func (c requestCursor) precedes(req Request) bool {
+	return req.Inserted > c.Inserted || req.Inserted == c.Inserted && req.ReqID > c.ReqID
+}
+
+// pageRequests calls fn with each of a bin's requests matching filter, in
+// cursor order, until it returns false, fetching them from store a page at
+// a time
+func pageRequests(ctx context.Context, binID string, filter requestFilter, fn func(Request) (bool, error)) error {
+	var after requestCursor
+	for {
+		reqs, err := store.RequestsAfter(ctx, binID, after, filter, maxListLimit)
+		if err != nil {
+			return err
+		}
+		for _, req := range reqs {
+			if more, err := fn(req); err != nil || !more {
+				return err
+			}
+		}
+		if len(reqs) < maxListLimit {
+			return nil
+		}
+		after = cursorAt(reqs[len(reqs)-1])
+	}
+}
+
+// cursorPage collects a page of RequestsAfter for stores that hold requests
+// in Go, fed through add in inserted order. Requests inserted in the same
+// millisecond are held back until it's over and then taken in ID order, as
+// such stores keep them in arrival order instead.
+type cursorPage struct {
+	after  requestCursor
+	filter requestFilter
+	limit  int
+	reqs   []Request
+	held   []Request
+}
+
+func newCursorPage(after requestCursor, filter requestFilter, limit int) *cursorPage {
+	return &cursorPage{after: after, filter: filter, limit: limit, reqs: []Request{}}
+}
+
+// add takes the next request, reporting false once the page is full
+func (p *cursorPage) add(req Request) bool {
+	if len(p.held) > 0 && p.held[0].Inserted != req.Inserted {
+		p.flush()
+	}
+	if len(p.reqs) >= p.limit {
+		return false
+	}
+	if p.after.precedes(req) && p.filter.matches(req) {
+		p.held = append(p.held, req)
+	}
+	return true
+}
+
+// done returns the page once every request has been added
+func (p *cursorPage) done() []Request {
+	p.flush()
+	return p.reqs
+}
+
+func (p *cursorPage) flush() {
+	sort.Slice(p.held, func(i, j int) bool { return p.held[i].ReqID < p.held[j].ReqID })
+	for _, req := range p.held {
+		if len(p.reqs) == p.limit {
+			break
+		}
+		p.reqs = append(p.reqs, req)
+	}
+	p.held = p.held[:0]
+}
+
+// errLeaseLapsed is returned by SettleLease for a request that isn't leased,
+// or whose lease has expired
+var errLeaseLapsed = errors.New("request is not leased or the lease has expired")
+
+// sortBins puts bins in ListBins order and pages them, for stores that
+// don't keep them that way
+func sortBins(bins []BinRecord, limit, offset int) []BinRecord {
+	sort.Slice(bins, func(i, j int) bool {
+		if bins[i].CreatedAt != bins[j].CreatedAt {
+			return bins[i].CreatedAt < bins[j].CreatedAt
+		}
+		return bins[i].BinID < bins[j].BinID
+	})
+	if offset >= len(bins) {
+		return []BinRecord{}
+	}
+	bins = bins[offset:]
+	if limit > 0 && limit < len(bins) {
+		bins = bins[:limit]
+	}
+	return bins
+}
+
+// BinRecord is a bin as it's stored
+type BinRecord struct {
+	BinID      string
+	CreatedAt  int64
+	ExpiresAt  int64
+	MaxEntries int
+	Config     BinConfig
+}
+
+// store is where the server keeps bins; it's set up alongside db
+var store Store
+
+// Store settings; overridable with command-line flags. dbTimeout bounds
+// each database call, so a slow query gives up rather than holding its
+// connection and the goroutine waiting on it.
+var (
+	dbDriver  = "sqlite"
+	dbDSN     string
+	dbTimeout = 5 * time.Second
+)
+
+// dbContext bounds a database call made on ctx's behalf by dbTimeout
+func dbContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if dbTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, dbTimeout)
+}
+
+// openStore switches store to the configured driver, opening the SQLite
+// database with the configured settings. Other backends leave it to the
+// features that don't go through Store, with foreign keys off since its bins
+// table is no longer filled.
+func openStore(driver, dsn string) error {
+	path, foreignKeys := sqlitePath, false
+	noLocalTables = nil
+	switch driver {
+	case "sqlite":
+		if !localSQLite {
+			return errors.New("--db-driver=sqlite needs a build with cgo; without it use memory, bolt, postgres or dynamodb")
+		}
+		foreignKeys = true
+	case "postgres":
+		if dsn == "" {
+			return errors.New("--db-driver=postgres needs a --dsn")
+		}
+		pg, err := openPostgresStore(dsn)
+		if err != nil {
+			return err
+		}
+		store = pg
+		noLocalTables = errors.New("--db-driver=postgres is shared with other servers, and this server's local database isn't")
+	case "memory":
+		store, path = newMemoryStore(), ":memory:"
+	case "bolt":
+		if dsn == "" {
+			dsn = "./postbin.bolt"
+		}
+		bs, err := openBoltStore(dsn)
+		if err != nil {
+			return err
+		}
+		store = bs
+	case "dynamodb":
+		if dsn == "" {
+			return errors.New("--db-driver=dynamodb needs a table name as --dsn")
+		}
+		if maxStorageBytes > 0 {
+			return errors.New("--max-storage-bytes isn't supported with --db-driver=dynamodb")
+		}
+		ds, err := openDynamoStore(dsn, dynamoRegion, dynamoEndpoint)
+		if err != nil {
+			return err
+		}
+		store = ds
+		noLocalTables = errors.New("--db-driver=dynamodb is shared with other servers, and this server's local database isn't")
+	default:
+		return fmt.Errorf("unknown --db-driver %q: want sqlite, postgres, memory, bolt or dynamodb", driver)
+	}
+
+	if db != nil {
+		db.Close()
+	}
+	if !localSQLite {
+		db = sql.OpenDB(sqliteConnector{})
+		noLocalTables = errNoLocalSQLite
+		return nil
+	}
+	var err error
+	if db, err = openSQLite(path, foreignKeys); err != nil {
+		return err
+	}
+	if driver == "sqlite" {
+		ss, err := newSQLiteStore(db)
+		if err != nil {
+			return err
+		}
+		store = ss
+	}
+	return nil
+}
+
+// closeStore closes the store, when it has a connection or file of its own,
+// and the local database, once nothing is left to write to either
+func closeStore() {
+	if c, ok := store.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			log.Printf("Closing the store failed: %v", err)
+		}
+	}
+	if db != nil {
+		db.Close()
+	}
+}
+
+// clearLocalBinData deletes what this instance's SQLite database holds for
+// bins that are gone from another backend
+func clearLocalBinData(ctx context.Context, binIDs ...string) error {
+	if noLocalTables != nil {
+		return nil
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range binDataTables {
+		for _, binID := range binIDs {
+			if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE bin_id = ?", binID); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// sqliteStore is the Store on postbin's SQLite database. The statements
+// every capture runs are prepared once, rather than parsed each time.
+type sqliteStore struct {
+	db         *sql.DB
+	getBin     *sql.Stmt
+	insert     *sql.Stmt
+	evict      *sql.Stmt
+	takeOldest *sql.Stmt
+	takeNewest *sql.Stmt
+	deleteReq  *sql.Stmt
+}
+
+const insertRequestSQL = `
+        INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted, truncated,
+            blob_key, blob_size, sub_path, host, proto, content_length, tls, hops,
+            received_at, read_duration_ns, raw_head, parsed_body, decoded_from, encoded_body,
+            user_agent, signature_valid, valid, validation_errors, encrypted)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+const evictRequestsSQL = `
+        DELETE FROM requests WHERE bin_id = ? AND rowid NOT IN (
+            SELECT rowid FROM requests WHERE bin_id = ? ORDER BY inserted DESC, rowid DESC LIMIT ?)`
+
+// takeRequestsSQL selects the requests TakeRequests removes; requests leased
+// to another consumer are invisible until the lease lapses
+func takeRequestsSQL(order string) string {
+	return `
+        SELECT ` + requestColumns + `
+        FROM requests WHERE bin_id = ? AND leased_until <= ?
+        ORDER BY inserted ` + order + `, rowid ` + order + ` LIMIT ?`
+}
+
+func newSQLiteStore(db *sql.DB) (*sqliteStore, error) {
+	s := &sqliteStore{db: db}
+	for _, stmt := range []struct {
+		to    **sql.Stmt
+		query string
+	}{
+		{&s.getBin, "SELECT bin_id, created_at, expires_at, max_entries, config FROM bins WHERE bin_id = ?"},
+		{&s.insert, insertRequestSQL},
+		{&s.evict, evictRequestsSQL},
+		{&s.takeOldest, takeRequestsSQL("ASC")},
+		{&s.takeNewest, takeRequestsSQL("DESC")},
+		{&s.deleteReq, "DELETE FROM requests WHERE req_id = ?"},
+	} {
+		var err error
+		if *stmt.to, err = db.Prepare(stmt.query); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *sqliteStore) CreateBin(ctx context.Context, bin BinRecord) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, `
+        INSERT OR IGNORE INTO bins (bin_id, created_at, expires_at, max_entries, config)
+        VALUES (?, ?, ?, ?, ?)`,
+		bin.BinID, bin.CreatedAt, bin.ExpiresAt, bin.MaxEntries, bin.Config.encode())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (s *sqliteStore) GetBin(ctx context.Context, binID string) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var bin BinRecord
+	var raw string
+	err := s.getBin.QueryRowContext(ctx, binID).
+		Scan(&bin.BinID, &bin.CreatedAt, &bin.ExpiresAt, &bin.MaxEntries, &raw)
+	bin.Config = loadBinConfig(raw)
+	return bin, err
+}
+
+func (s *sqliteStore) ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	// Anything past latest is capped anyway, and SQLite would turn an
+	// overflowing sum into a REAL
+	now := time.Now().UnixMilli()
+	if ms > latest-now {
+		ms = latest - now
+	}
+	res, err := s.db.ExecContext(ctx, `
+        UPDATE bins SET expires_at = CASE WHEN expires_at = ? THEN expires_at
+            ELSE MAX(expires_at, MIN(MAX(expires_at, ?) + ?, ?)) END
+        WHERE bin_id = ?`,
+		neverExpires, now, ms, latest, binID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *sqliteStore) SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, "UPDATE bins SET config = ? WHERE bin_id = ?", config.encode(), binID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// binDataTables hold rows that belong to a bin. Databases created before
+// foreign keys cascaded need them cleared explicitly before the bin itself,
+// so they're listed children first.
+var binDataTables = []string{"bin_assets", "response_cursors", "notify_digests", "replay_jobs", "group_leases", "consumer_groups", "deliveries", "request_parts", "requests"}
+
+func (s *sqliteStore) DeleteBin(ctx context.Context, binID string) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range append(binDataTables, "bins") {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE bin_id = ?", binID); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	if limit <= 0 {
+		limit = -1 // SQLite reads a negative LIMIT as unbounded
+	}
+	_, err = tx.ExecContext(ctx, `
+        CREATE TEMP TABLE IF NOT EXISTS purge_bins (bin_id TEXT PRIMARY KEY);
+        DELETE FROM purge_bins;`)
+	if err != nil {
+		return 0, 0, err
+	}
+	_, err = tx.ExecContext(ctx, `
+        INSERT INTO purge_bins SELECT bin_id FROM bins
+        WHERE expires_at != ? AND expires_at < ? LIMIT ?`,
+		neverExpires, time.Now().UnixMilli(), limit)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, table := range binDataTables {
+		res, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE bin_id IN (SELECT bin_id FROM purge_bins)")
+		if err != nil {
+			return 0, 0, err
+		}
+		if table == "requests" {
+			requests, _ = res.RowsAffected()
+		}
+	}
+	res, err := tx.ExecContext(ctx, "DELETE FROM bins WHERE bin_id IN (SELECT bin_id FROM purge_bins)")
+	if err != nil {
+		return 0, 0, err
+	}
+	bins, _ = res.RowsAffected()
+
+	return bins, requests, tx.Commit()
+}
+
+func (s *sqliteStore) InsertRequest(ctx context.Context, req Request, maxEntries int) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := s.insertRequest(ctx, tx, req, maxEntries); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// InsertRequests writes a batch in one transaction, each request under a
+// savepoint of its own so one that fails, say over quota, is rolled back
+// alone
+func (s *sqliteStore) InsertRequests(ctx context.Context, batch []pendingInsert) []error {
+	errs := make([]error, len(batch))
+	fail := func(err error) []error {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return fail(err)
+	}
+	defer tx.Rollback()
+	for i, p := range batch {
+		if _, err := tx.ExecContext(ctx, "SAVEPOINT capture"); err != nil {
+			return fail(err)
+		}
+		if errs[i] = s.insertRequest(ctx, tx, p.req, p.maxEntries); errs[i] != nil {
+			if _, err := tx.ExecContext(ctx, "ROLLBACK TO capture"); err != nil {
+				return fail(err)
+			}
+		}
+		if _, err := tx.ExecContext(ctx, "RELEASE capture"); err != nil {
+			return fail(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return fail(err)
+	}
+	return errs
+}
+
+// insertRequest JSON-encodes a capture's structured fields, and evicts in
+// the same transaction
+func (s *sqliteStore) insertRequest(ctx context.Context, tx *sql.Tx, req Request, maxEntries int) error {
+	headersJSON, _ := json.Marshal(req.Headers)
+	queryJSON, _ := json.Marshal(req.Query)
+	bodyJSON, _ := json.Marshal(req.RawBody)
+	parsed, _ := req.Body.(json.RawMessage)
+	encodedBody := req.encodedBody
+	if encodedBody == nil {
+		encodedBody = []byte{}
+	}
+	var tlsJSON, hopsJSON, uaJSON, validationJSON []byte
+	if req.TLS != nil {
+		tlsJSON, _ = json.Marshal(req.TLS)
+	}
+	if req.Hops != nil {
+		hopsJSON, _ = json.Marshal(req.Hops)
+	}
+	if req.UserAgent != nil {
+		uaJSON, _ = json.Marshal(req.UserAgent)
+	}
+	if req.ValidationErrors != nil {
+		validationJSON, _ = json.Marshal(req.ValidationErrors)
+	}
+
+	size := int64(len(headersJSON)+len(queryJSON)+len(bodyJSON)+len(parsed)+len(encodedBody)) + req.BodySize
+	if err := enforceQuota(ctx, tx, size); err != nil {
+		return err
+	}
+
+	_, err := tx.StmtContext(ctx, s.insert).ExecContext(ctx,
+		req.ReqID, req.BinID, req.Method, req.Path, string(headersJSON), string(queryJSON), string(bodyJSON),
+		req.IP, req.Inserted, req.Truncated, req.blobKey, req.BodySize, req.SubPath,
+		req.Host, req.Proto, req.ContentLength, string(tlsJSON), string(hopsJSON),
+		req.ReceivedAt, int64(req.ReadDurationMs*float64(time.Millisecond)), req.rawHead,
+		string(parsed), req.DecodedFrom, encodedBody, string(uaJSON),
+		req.SignatureValid, req.Valid, string(validationJSON), req.Encrypted)
+	if err != nil {
+		return err
+	}
+	if err := insertParts(ctx, tx, req); err != nil {
+		return err
+	}
+
+	if maxEntries > 0 {
+		_, err = tx.StmtContext(ctx, s.evict).ExecContext(ctx, req.BinID, req.BinID, maxEntries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) GetRequest(ctx context.Context, binID, reqID string) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return scanRequest(s.db.QueryRowContext(ctx, `
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND req_id = ?`, binID, reqID))
+}
+
+func (s *sqliteStore) CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.where()
+	var n int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests WHERE bin_id = ?"+where,
+		append([]interface{}{binID}, args...)...).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.where()
+	return scanBuckets(s.db.QueryContext(ctx, `
+        SELECT (inserted / ?) * ? AS start, COUNT(*)
+        FROM requests WHERE bin_id = ?`+where+`
+        GROUP BY start ORDER BY start`, append([]interface{}{bucketMs, bucketMs, binID}, args...)...))
+}
+
+func (s *sqliteStore) ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.where()
+	args = append([]interface{}{binID}, args...)
+	return queryRequests(ctx, s.db, `
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ?`+where+` ORDER BY inserted ASC, rowid ASC LIMIT ? OFFSET ?`,
+		append(args, limit, offset)...)
+}
+
+func (s *sqliteStore) TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error) {
+	take := s.takeOldest
+	if newest {
+		take = s.takeNewest
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reqs, err := scanRequests(tx.StmtContext(ctx, take).QueryContext(ctx, binID, time.Now().UnixMilli(), count))
+	if err != nil {
+		return nil, err
+	}
+
+	// Delete the requests we just retrieved
+	deleteReq := tx.StmtContext(ctx, s.deleteReq)
+	for _, req := range reqs {
+		if _, err := deleteReq.ExecContext(ctx, req.ReqID); err != nil {
+			return nil, err
+		}
+	}
+
+	return reqs, tx.Commit()
+}
+
+func (s *sqliteStore) DeleteRequest(ctx context.Context, binID, reqID string) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, "DELETE FROM requests WHERE bin_id = ? AND req_id = ?", binID, reqID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *sqliteStore) RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	part := bodyPart{Name: name}
+	err := s.db.QueryRowContext(ctx, `
+        SELECT filename, content_type, data FROM request_parts
+        WHERE bin_id = ? AND req_id = ? AND name = ? ORDER BY idx LIMIT 1`, binID, reqID, name).
+		Scan(&part.Filename, &part.ContentType, &part.Data)
+	return part, err
+}
+
+func (s *sqliteStore) ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	if limit <= 0 {
+		limit = -1
+	}
+	return scanBins(s.db.QueryContext(ctx, `
+        SELECT bin_id, created_at, expires_at, max_entries, config FROM bins
+        ORDER BY created_at ASC, bin_id ASC LIMIT ? OFFSET ?`, limit, offset))
+}
+
+// Usage reads the total from storage_usage, which the quota's triggers keep
+// current
+func (s *sqliteStore) Usage(ctx context.Context, binID string) (StoreUsage, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var u StoreUsage
+	if binID != "" {
+		err := s.db.QueryRowContext(ctx, "SELECT COUNT(*), COALESCE(SUM("+requestBytes+"), 0) FROM requests WHERE bin_id = ?",
+			binID).Scan(&u.Requests, &u.Bytes)
+		return u, err
+	}
+	err := s.db.QueryRowContext(ctx, `
+        SELECT COUNT(*), COALESCE(SUM(expires_at != ? AND expires_at < ?), 0),
+            (SELECT COUNT(*) FROM requests), (SELECT COALESCE(MAX(bytes), 0) FROM storage_usage)
+        FROM bins`, neverExpires, time.Now().UnixMilli()).Scan(&u.Bins, &u.ExpiredBins, &u.Requests, &u.Bytes)
+	return u, err
+}
+
+func (s *sqliteStore) UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error) {
+	if len(binIDs) == 0 {
+		return map[string]StoreUsage{}, nil
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return scanUsageByBin(s.db.QueryContext(ctx, "SELECT bin_id, COUNT(*), COALESCE(SUM("+requestBytes+"), 0) FROM requests "+
+		"WHERE bin_id IN ("+inList(len(binIDs))+") GROUP BY bin_id", stringArgs(binIDs)...))
+}
+
+func (s *sqliteStore) OldestActiveBin(ctx context.Context) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return firstBin(scanBins(s.db.QueryContext(ctx, `
+        SELECT bin_id, created_at, expires_at, max_entries, config FROM bins
+        WHERE expires_at = ? OR expires_at >= ?
+        ORDER BY created_at ASC, bin_id ASC LIMIT 1`, neverExpires, time.Now().UnixMilli())))
+}
+
+func (s *sqliteStore) RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.where()
+	args = append([]interface{}{binID, after.Inserted, after.Inserted, after.ReqID}, args...)
+	return queryRequests(ctx, s.db, `
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND (inserted > ? OR (inserted = ? AND req_id > ?))`+where+`
+        ORDER BY inserted ASC, req_id ASC LIMIT ?`, append(args, limit)...)
+}
+
+// SearchRequests uses the FTS index when this build has one, treating q as a
+// phrase so punctuation in identifiers can't trip the FTS5 query syntax, and
+// LIKE when it doesn't
+func (s *sqliteStore) SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	if ftsEnabled {
+		phrase := `"` + strings.ReplaceAll(q, `"`, `""`) + `"`
+		return queryRequests(ctx, s.db, `
+            SELECT `+requestColumns+`
+            FROM requests WHERE bin_id = ? AND rowid IN (
+                SELECT rowid FROM requests_fts WHERE requests_fts MATCH ?)
+            ORDER BY inserted ASC, rowid ASC LIMIT ?`, binID, phrase, limit)
+	}
+	like := "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(q) + "%"
+	return queryRequests(ctx, s.db, `
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND (body LIKE ? ESCAPE '\' OR headers LIKE ? ESCAPE '\')
+        ORDER BY inserted ASC, rowid ASC LIMIT ?`, binID, like, like, limit)
+}
+
+func (s *sqliteStore) EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var encoded []byte
+	err := s.db.QueryRowContext(ctx, "SELECT encoded_body FROM requests WHERE bin_id = ? AND req_id = ?", binID, reqID).
+		Scan(&encoded)
+	return encoded, err
+}
+
+func (s *sqliteStore) SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	out, _ := json.Marshal(resp)
+	res, err := s.db.ExecContext(ctx, "UPDATE requests SET upstream_response = ? WHERE bin_id = ? AND req_id = ?",
+		string(out), binID, reqID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *sqliteStore) LeaseRequest(ctx context.Context, binID string, until int64) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Request{}, err
+	}
+	defer tx.Rollback()
+
+	req, err := scanRequest(tx.QueryRowContext(ctx, `
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND leased_until <= ?
+        ORDER BY inserted ASC, rowid ASC LIMIT 1`, binID, time.Now().UnixMilli()))
+	if err != nil {
+		return Request{}, err
+	}
+
+	req.LeasedUntil = until
+	_, err = tx.ExecContext(ctx, "UPDATE requests SET leased_until = ? WHERE req_id = ?", until, req.ReqID)
+	if err != nil {
+		return Request{}, err
+	}
+	return req, tx.Commit()
+}
+
+func (s *sqliteStore) SettleLease(ctx context.Context, binID, reqID string, release bool) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	stmt := "DELETE FROM requests"
+	if release {
+		stmt = "UPDATE requests SET leased_until = 0"
+	}
+	res, err := s.db.ExecContext(ctx, stmt+" WHERE bin_id = ? AND req_id = ? AND leased_until >= ?",
+		binID, reqID, time.Now().UnixMilli())
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	var exists int
+	err = s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM requests WHERE bin_id = ? AND req_id = ?", binID, reqID).
+		Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+	return errLeaseLapsed
+}
+
+// scanBins collects the rows of a query over a bin's columns, as GetBin
+// selects them
+func scanBins(rows *sql.Rows, err error) ([]BinRecord, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	bins := []BinRecord{}
+	for rows.Next() {
+		var bin BinRecord
+		var raw string
+		if err := rows.Scan(&bin.BinID, &bin.CreatedAt, &bin.ExpiresAt, &bin.MaxEntries, &raw); err != nil {
+			return nil, err
+		}
+		bin.Config = loadBinConfig(raw)
+		bins = append(bins, bin)
+	}
+	return bins, rows.Err()
+}
+
+// firstBin is the first of bins, or sql.ErrNoRows when there's none
+func firstBin(bins []BinRecord, err error) (BinRecord, error) {
+	if err == nil && len(bins) == 0 {
+		err = sql.ErrNoRows
+	}
+	if err != nil {
+		return BinRecord{}, err
+	}
+	return bins[0], nil
+}
+
+// inList is n placeholders for an SQL IN list
+func inList(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
+
+// scanUsageByBin collects rows of bin_id, request count and bytes
+func scanUsageByBin(rows *sql.Rows, err error) (map[string]StoreUsage, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := map[string]StoreUsage{}
+	for rows.Next() {
+		var binID string
+		var u StoreUsage
+		if err := rows.Scan(&binID, &u.Requests, &u.Bytes); err != nil {
+			return nil, err
+		}
+		usage[binID] = u
+	}
+	return usage, rows.Err()
+}
+
+// scanBuckets collects rows of bucket start and count
+func scanBuckets(rows *sql.Rows, err error) ([]TimeseriesBucket, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []TimeseriesBucket
+	for rows.Next() {
+		var b TimeseriesBucket
+		if err := rows.Scan(&b.Start, &b.Count); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// countInBucket adds a request inserted at inserted to buckets, for stores
+// that count in Go and come across requests in the order they were inserted
+func countInBucket(buckets []TimeseriesBucket, inserted, bucketMs int64) []TimeseriesBucket {
+	start := inserted / bucketMs * bucketMs
+	if len(buckets) == 0 || buckets[len(buckets)-1].Start != start {
+		buckets = append(buckets, TimeseriesBucket{Start: start})
+	}
+	buckets[len(buckets)-1].Count++
+	return buckets
+}
+
+// queryRequests runs a SELECT over requestColumns and collects the rows,
+// always as a non-nil slice
+func queryRequests(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}, query string, args ...interface{}) ([]Request, error) {
+	return scanRequests(q.QueryContext(ctx, query, args...))
+}
+
+// scanRequests collects the rows of a query over requestColumns
+func scanRequests(rows *sql.Rows, err error) ([]Request, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reqs := []Request{}
+	for rows.Next() {
+		req, err := scanRequest(rows)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, rows.Err()
+}
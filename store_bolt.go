@@ -0,0 +1,809 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Top-level buckets of the bolt store. Each bin has a bucket of its own in
+// boltRequests, keyed by inserted then a sequence number so cursors walk it
+// in capture order, and one in boltRequestIDs mapping request IDs to keys.
+// boltMeta holds boltBytesKey, the total requestSize of every request.
+var (
+	boltBins       = []byte("bins")
+	boltRequests   = []byte("requests")
+	boltRequestIDs = []byte("request_ids")
+	boltMeta       = []byte("meta")
+	boltBytesKey   = []byte("bytes")
+)
+
+// boltStore is the Store in a single bbolt file, a pure Go embedded
+// database. Multipart parts are parsed again from the stored body.
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	bdb, err := bolt.Open(path, 0o600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = bdb.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{boltBins, boltRequests, boltRequestIDs, boltMeta} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		if tx.Bucket(boltMeta).Get(boltBytesKey) == nil {
+			return countBoltUsage(tx)
+		}
+		return nil
+	})
+	if err != nil {
+		bdb.Close()
+		return nil, err
+	}
+	return &boltStore{db: bdb}, nil
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+// boltBin is a bin as it's stored, with its config encoded as in SQLite and
+// a count of its requests, and their bytes, for eviction
+type boltBin struct {
+	CreatedAt  int64  `json:"createdAt"`
+	ExpiresAt  int64  `json:"expiresAt"`
+	MaxEntries int    `json:"maxEntries,omitempty"`
+	Config     string `json:"config,omitempty"`
+	Requests   int    `json:"requests,omitempty"`
+	Bytes      int64  `json:"bytes,omitempty"`
+}
+
+// boltRequest is a request as it's stored: its JSON form plus what that
+// leaves out
+type boltRequest struct {
+	Request
+	BlobKey     string          `json:"blobKey,omitempty"`
+	RawHead     string          `json:"rawHead,omitempty"`
+	ParsedBody  json.RawMessage `json:"parsedBody,omitempty"`
+	EncodedBody []byte          `json:"encodedBody,omitempty"`
+}
+
+func encodeBoltRequest(req Request) ([]byte, error) {
+	parsed, _ := req.Body.(json.RawMessage)
+	br := boltRequest{Request: req, BlobKey: req.blobKey, RawHead: req.rawHead, ParsedBody: parsed, EncodedBody: req.encodedBody}
+	br.Body = nil
+	return json.Marshal(br)
+}
+
+func decodeBoltRequest(data []byte) (Request, error) {
+	var br boltRequest
+	if err := json.Unmarshal(data, &br); err != nil {
+		return Request{}, err
+	}
+	req := br.Request
+	req.blobKey, req.rawHead, req.encodedBody = br.BlobKey, br.RawHead, br.EncodedBody
+	req.Body = nil
+	if len(br.ParsedBody) > 0 {
+		req.Body = br.ParsedBody
+	}
+	return storedRequest(req), nil
+}
+
+// boltKey orders a bin's requests by inserted, then by arrival
+func boltKey(inserted int64, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(inserted))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+func getBoltBin(tx *bolt.Tx, binID string) (boltBin, bool, error) {
+	var bin boltBin
+	data := tx.Bucket(boltBins).Get([]byte(binID))
+	if data == nil {
+		return bin, false, nil
+	}
+	return bin, true, json.Unmarshal(data, &bin)
+}
+
+func putBoltBin(tx *bolt.Tx, binID string, bin boltBin) error {
+	data, err := json.Marshal(bin)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(boltBins).Put([]byte(binID), data)
+}
+
+// updateBoltBin applies change to a stored bin, reporting whether it exists
+func (s *boltStore) updateBoltBin(binID string, change func(*boltBin)) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		found, err = changeBoltBin(tx, binID, change)
+		return err
+	})
+	return found, err
+}
+
+func changeBoltBin(tx *bolt.Tx, binID string, change func(*boltBin)) (bool, error) {
+	bin, ok, err := getBoltBin(tx, binID)
+	if err != nil || !ok {
+		return false, err
+	}
+	change(&bin)
+	return true, putBoltBin(tx, binID, bin)
+}
+
+// countBoltUsage works out every bin's bytes, and the total, from scratch,
+// for files written before they were counted
+func countBoltUsage(tx *bolt.Tx) error {
+	var total int64
+	err := tx.Bucket(boltBins).ForEach(func(k, v []byte) error {
+		var bytes int64
+		err := eachRequest(tx, string(k), nil, func(req Request) bool {
+			bytes += requestSize(req)
+			return true
+		})
+		if err != nil {
+			return err
+		}
+		total += bytes
+		_, err = changeBoltBin(tx, string(k), func(bin *boltBin) { bin.Bytes = bytes })
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return putBoltBytes(tx, total)
+}
+
+// boltBytes is the total requestSize of the store's requests
+func boltBytes(tx *bolt.Tx) int64 {
+	v := tx.Bucket(boltMeta).Get(boltBytesKey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func putBoltBytes(tx *bolt.Tx, bytes int64) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(bytes))
+	return tx.Bucket(boltMeta).Put(boltBytesKey, v)
+}
+
+// removeBoltRequests deletes requests, found at keys, from a bin and the
+// usage counts
+func removeBoltRequests(tx *bolt.Tx, binID string, keys [][]byte, reqs []Request) error {
+	bucket := tx.Bucket(boltRequests).Bucket([]byte(binID))
+	ids := tx.Bucket(boltRequestIDs).Bucket([]byte(binID))
+	var bytes int64
+	for i, key := range keys {
+		if err := bucket.Delete(key); err != nil {
+			return err
+		}
+		if err := ids.Delete([]byte(reqs[i].ReqID)); err != nil {
+			return err
+		}
+		bytes += requestSize(reqs[i])
+	}
+	_, err := changeBoltBin(tx, binID, func(bin *boltBin) {
+		bin.Requests -= len(keys)
+		bin.Bytes -= bytes
+	})
+	if err != nil {
+		return err
+	}
+	return putBoltBytes(tx, boltBytes(tx)-bytes)
+}
+
+// evictOldestBolt deletes the oldest request in any bin, for the quota,
+// reporting false when there are none
+func evictOldestBolt(tx *bolt.Tx) (Request, bool, error) {
+	var binID string
+	var oldest []byte
+	err := tx.Bucket(boltRequests).ForEach(func(name, _ []byte) error {
+		if k, _ := tx.Bucket(boltRequests).Bucket(name).Cursor().First(); k != nil && (oldest == nil || bytes.Compare(k, oldest) < 0) {
+			binID, oldest = string(name), append([]byte(nil), k...)
+		}
+		return nil
+	})
+	if err != nil || oldest == nil {
+		return Request{}, false, err
+	}
+	req, err := decodeBoltRequest(tx.Bucket(boltRequests).Bucket([]byte(binID)).Get(oldest))
+	if err != nil {
+		return Request{}, false, err
+	}
+	return req, true, removeBoltRequests(tx, binID, [][]byte{oldest}, []Request{req})
+}
+
+// updateBoltRequest applies change to a stored request, reporting whether
+// it exists
+func updateBoltRequest(tx *bolt.Tx, binID, reqID string, change func(*Request) error) (bool, error) {
+	reqs := tx.Bucket(boltRequests).Bucket([]byte(binID))
+	ids := tx.Bucket(boltRequestIDs).Bucket([]byte(binID))
+	if reqs == nil || ids == nil {
+		return false, nil
+	}
+	key := ids.Get([]byte(reqID))
+	if key == nil {
+		return false, nil
+	}
+	req, err := decodeBoltRequest(reqs.Get(key))
+	if err != nil {
+		return true, err
+	}
+	if err := change(&req); err != nil {
+		return true, err
+	}
+	data, err := encodeBoltRequest(req)
+	if err != nil {
+		return true, err
+	}
+	return true, reqs.Put(key, data)
+}
+
+func (s *boltStore) CreateBin(ctx context.Context, bin BinRecord) (bool, error) {
+	created := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if _, ok, err := getBoltBin(tx, bin.BinID); err != nil || ok {
+			return err
+		}
+		created = true
+		return putBoltBin(tx, bin.BinID, boltBin{CreatedAt: bin.CreatedAt, ExpiresAt: bin.ExpiresAt,
+			MaxEntries: bin.MaxEntries, Config: bin.Config.encode()})
+	})
+	return created, err
+}
+
+func (s *boltStore) GetBin(ctx context.Context, binID string) (BinRecord, error) {
+	var record BinRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		bin, ok, err := getBoltBin(tx, binID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return sql.ErrNoRows
+		}
+		record = BinRecord{BinID: binID, CreatedAt: bin.CreatedAt, ExpiresAt: bin.ExpiresAt,
+			MaxEntries: bin.MaxEntries, Config: loadBinConfig(bin.Config)}
+		return nil
+	})
+	return record, err
+}
+
+func (s *boltStore) ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error) {
+	return s.updateBoltBin(binID, func(bin *boltBin) {
+		bin.ExpiresAt = extendedExpiry(bin.ExpiresAt, time.Now().UnixMilli(), ms, latest)
+	})
+}
+
+func (s *boltStore) SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error) {
+	return s.updateBoltBin(binID, func(bin *boltBin) { bin.Config = config.encode() })
+}
+
+// deleteBoltBin removes a bin and its requests, returning how many there
+// were and their blobs
+func deleteBoltBin(tx *bolt.Tx, binID string) (int, []string, error) {
+	bin, _, err := getBoltBin(tx, binID)
+	if err != nil {
+		return 0, nil, err
+	}
+	var keys []string
+	err = eachRequest(tx, binID, nil, func(req Request) bool {
+		keys = append(keys, req.blobKey)
+		return true
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	if tx.Bucket(boltRequests).Bucket([]byte(binID)) != nil {
+		if err := tx.Bucket(boltRequests).DeleteBucket([]byte(binID)); err != nil {
+			return 0, nil, err
+		}
+	}
+	if tx.Bucket(boltRequestIDs).Bucket([]byte(binID)) != nil {
+		if err := tx.Bucket(boltRequestIDs).DeleteBucket([]byte(binID)); err != nil {
+			return 0, nil, err
+		}
+	}
+	if err := putBoltBytes(tx, boltBytes(tx)-bin.Bytes); err != nil {
+		return 0, nil, err
+	}
+	return bin.Requests, keys, tx.Bucket(boltBins).Delete([]byte(binID))
+}
+
+func (s *boltStore) DeleteBin(ctx context.Context, binID string) error {
+	var keys []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		_, keys, err = deleteBoltBin(tx, binID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	orphanBlobs(ctx, keys...)
+	return clearLocalBinData(ctx, binID)
+}
+
+func (s *boltStore) PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error) {
+	var ids, keys []string
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		now := time.Now().UnixMilli()
+		c := tx.Bucket(boltBins).Cursor()
+		for k, v := c.First(); k != nil && (limit <= 0 || len(ids) < limit); k, v = c.Next() {
+			var bin boltBin
+			if err := json.Unmarshal(v, &bin); err != nil {
+				return err
+			}
+			if bin.ExpiresAt != neverExpires && bin.ExpiresAt < now {
+				ids = append(ids, string(k))
+			}
+		}
+		for _, id := range ids {
+			n, blobs, err := deleteBoltBin(tx, id)
+			if err != nil {
+				return err
+			}
+			requests += int64(n)
+			keys = append(keys, blobs...)
+		}
+		return nil
+	})
+	if err != nil || len(ids) == 0 {
+		return 0, 0, err
+	}
+	orphanBlobs(ctx, keys...)
+	return int64(len(ids)), requests, clearLocalBinData(ctx, ids...)
+}
+
+func (s *boltStore) ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error) {
+	bins := []BinRecord{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBins).ForEach(func(k, v []byte) error {
+			var bin boltBin
+			if err := json.Unmarshal(v, &bin); err != nil {
+				return err
+			}
+			bins = append(bins, BinRecord{BinID: string(k), CreatedAt: bin.CreatedAt, ExpiresAt: bin.ExpiresAt,
+				MaxEntries: bin.MaxEntries, Config: loadBinConfig(bin.Config)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortBins(bins, limit, offset), nil
+}
+
+func (s *boltStore) Usage(ctx context.Context, binID string) (StoreUsage, error) {
+	var u StoreUsage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if binID != "" {
+			bin, _, err := getBoltBin(tx, binID)
+			u.Requests, u.Bytes = bin.Requests, bin.Bytes
+			return err
+		}
+		u.Bytes = boltBytes(tx)
+		return tx.Bucket(boltBins).ForEach(func(k, v []byte) error {
+			var bin boltBin
+			if err := json.Unmarshal(v, &bin); err != nil {
+				return err
+			}
+			u.Bins++
+			u.Requests += bin.Requests
+			if binExpired(bin.ExpiresAt) {
+				u.ExpiredBins++
+			}
+			return nil
+		})
+	})
+	return u, err
+}
+
+func (s *boltStore) UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error) {
+	usage := map[string]StoreUsage{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		for _, binID := range binIDs {
+			bin, ok, err := getBoltBin(tx, binID)
+			if err != nil {
+				return err
+			}
+			if ok {
+				usage[binID] = StoreUsage{Requests: bin.Requests, Bytes: bin.Bytes}
+			}
+		}
+		return nil
+	})
+	return usage, err
+}
+
+func (s *boltStore) OldestActiveBin(ctx context.Context) (BinRecord, error) {
+	var active []BinRecord
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(boltBins).ForEach(func(k, v []byte) error {
+			var bin boltBin
+			if err := json.Unmarshal(v, &bin); err != nil {
+				return err
+			}
+			if !binExpired(bin.ExpiresAt) {
+				active = append(active, BinRecord{BinID: string(k), CreatedAt: bin.CreatedAt, ExpiresAt: bin.ExpiresAt,
+					MaxEntries: bin.MaxEntries, Config: loadBinConfig(bin.Config)})
+			}
+			return nil
+		})
+	})
+	return firstBin(sortBins(active, 1, 0), err)
+}
+
+func (s *boltStore) InsertRequest(ctx context.Context, req Request, maxEntries int) error {
+	data, err := encodeBoltRequest(req)
+	if err != nil {
+		return err
+	}
+	size := requestSize(storedRequest(req))
+	var evicted []string
+	err = s.db.Update(func(tx *bolt.Tx) error {
+		if _, ok, err := getBoltBin(tx, req.BinID); err != nil || !ok {
+			if err == nil {
+				err = sql.ErrNoRows
+			}
+			return err
+		}
+		err := makeRoom(size, func() (int64, error) { return boltBytes(tx), nil }, func() (bool, error) {
+			old, ok, err := evictOldestBolt(tx)
+			if ok {
+				evicted = append(evicted, old.blobKey)
+			}
+			return ok, err
+		})
+		if err != nil {
+			return err
+		}
+		// Read after making room, which may have evicted from this bin
+		bin, _, err := getBoltBin(tx, req.BinID)
+		if err != nil {
+			return err
+		}
+		reqs, err := tx.Bucket(boltRequests).CreateBucketIfNotExists([]byte(req.BinID))
+		if err != nil {
+			return err
+		}
+		ids, err := tx.Bucket(boltRequestIDs).CreateBucketIfNotExists([]byte(req.BinID))
+		if err != nil {
+			return err
+		}
+		if ids.Get([]byte(req.ReqID)) != nil {
+			return fmt.Errorf("request %s already exists", req.ReqID)
+		}
+		seq, _ := reqs.NextSequence()
+		key := boltKey(req.Inserted, seq)
+		if err := reqs.Put(key, data); err != nil {
+			return err
+		}
+		if err := ids.Put([]byte(req.ReqID), key); err != nil {
+			return err
+		}
+		bin.Requests++
+		bin.Bytes += size
+		added := size
+
+		c := reqs.Cursor()
+		for k, v := c.First(); k != nil && maxEntries > 0 && bin.Requests > maxEntries; k, v = c.First() {
+			old, err := decodeBoltRequest(v)
+			if err != nil {
+				return err
+			}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+			if err := ids.Delete([]byte(old.ReqID)); err != nil {
+				return err
+			}
+			evicted = append(evicted, old.blobKey)
+			bin.Requests--
+			bin.Bytes -= requestSize(old)
+			added -= requestSize(old)
+		}
+		if err := putBoltBytes(tx, boltBytes(tx)+added); err != nil {
+			return err
+		}
+		return putBoltBin(tx, req.BinID, bin)
+	})
+	if err != nil {
+		return err
+	}
+	orphanBlobs(ctx, evicted...)
+	return nil
+}
+
+func (s *boltStore) GetRequest(ctx context.Context, binID, reqID string) (Request, error) {
+	var req Request
+	err := s.db.View(func(tx *bolt.Tx) error {
+		reqs := tx.Bucket(boltRequests).Bucket([]byte(binID))
+		ids := tx.Bucket(boltRequestIDs).Bucket([]byte(binID))
+		if reqs == nil || ids == nil {
+			return sql.ErrNoRows
+		}
+		key := ids.Get([]byte(reqID))
+		if key == nil {
+			return sql.ErrNoRows
+		}
+		var err error
+		req, err = decodeBoltRequest(reqs.Get(key))
+		return err
+	})
+	return req, err
+}
+
+// eachRequest calls fn with a bin's requests from the first at or after
+// from, oldest first, until fn returns false
+func eachRequest(tx *bolt.Tx, binID string, from []byte, fn func(Request) bool) error {
+	reqs := tx.Bucket(boltRequests).Bucket([]byte(binID))
+	if reqs == nil {
+		return nil
+	}
+	c := reqs.Cursor()
+	for k, v := c.Seek(from); k != nil; k, v = c.Next() {
+		req, err := decodeBoltRequest(v)
+		if err != nil {
+			return err
+		}
+		if !fn(req) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *boltStore) CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error) {
+	n := 0
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachRequest(tx, binID, nil, func(req Request) bool {
+			if filter.matches(req) {
+				n++
+			}
+			return true
+		})
+	})
+	return n, err
+}
+
+// CountBuckets reads when requests were inserted from their keys, only
+// decoding them when the filter needs more
+func (s *boltStore) CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error) {
+	var buckets []TimeseriesBucket
+	var from []byte
+	if filter.since != nil && *filter.since > 0 {
+		from = boltKey(*filter.since, 0)
+	}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		if filter.onlyTimes() {
+			reqs := tx.Bucket(boltRequests).Bucket([]byte(binID))
+			if reqs == nil {
+				return nil
+			}
+			c := reqs.Cursor()
+			for k, _ := c.Seek(from); k != nil; k, _ = c.Next() {
+				inserted := int64(binary.BigEndian.Uint64(k))
+				if filter.until != nil && inserted > *filter.until {
+					break
+				}
+				buckets = countInBucket(buckets, inserted, bucketMs)
+			}
+			return nil
+		}
+		return eachRequest(tx, binID, from, func(req Request) bool {
+			if filter.matches(req) {
+				buckets = countInBucket(buckets, req.Inserted, bucketMs)
+			}
+			return true
+		})
+	})
+	return buckets, err
+}
+
+func (s *boltStore) ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error) {
+	reqs := []Request{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachRequest(tx, binID, nil, func(req Request) bool {
+			if len(reqs) == limit {
+				return false
+			}
+			if filter.matches(req) {
+				if offset > 0 {
+					offset--
+				} else {
+					reqs = append(reqs, req)
+				}
+			}
+			return true
+		})
+	})
+	return reqs, err
+}
+
+func (s *boltStore) RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error) {
+	page := newCursorPage(after, filter, limit)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachRequest(tx, binID, boltKey(after.Inserted, 0), page.add)
+	})
+	return page.done(), err
+}
+
+func (s *boltStore) SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error) {
+	reqs := []Request{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return eachRequest(tx, binID, nil, func(req Request) bool {
+			if len(reqs) == limit {
+				return false
+			}
+			if searchMatches(req, q) {
+				reqs = append(reqs, req)
+			}
+			return true
+		})
+	})
+	return reqs, err
+}
+
+func (s *boltStore) EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	return req.encodedBody, err
+}
+
+func (s *boltStore) SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error) {
+	found := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		var err error
+		found, err = updateBoltRequest(tx, binID, reqID, func(req *Request) error {
+			req.Response = &resp
+			return nil
+		})
+		return err
+	})
+	return found, err
+}
+
+func (s *boltStore) TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error) {
+	reqs := []Request{}
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRequests).Bucket([]byte(binID))
+		ids := tx.Bucket(boltRequestIDs).Bucket([]byte(binID))
+		if bucket == nil || ids == nil {
+			return nil
+		}
+		now := time.Now().UnixMilli()
+		c := bucket.Cursor()
+		first, next := c.First, c.Next
+		if newest {
+			first, next = c.Last, c.Prev
+		}
+		var keys [][]byte
+		for k, v := first(); k != nil && len(reqs) < count; k, v = next() {
+			req, err := decodeBoltRequest(v)
+			if err != nil {
+				return err
+			}
+			if req.LeasedUntil <= now {
+				reqs = append(reqs, req)
+				keys = append(keys, append([]byte(nil), k...))
+			}
+		}
+		return removeBoltRequests(tx, binID, keys, reqs)
+	})
+	if err != nil {
+		return nil, err
+	}
+	orphanBlobs(ctx, blobKeys(reqs)...)
+	return reqs, nil
+}
+
+func (s *boltStore) LeaseRequest(ctx context.Context, binID string, until int64) (Request, error) {
+	var leased Request
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltRequests).Bucket([]byte(binID))
+		if bucket == nil {
+			return sql.ErrNoRows
+		}
+		now := time.Now().UnixMilli()
+		c := bucket.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			req, err := decodeBoltRequest(v)
+			if err != nil {
+				return err
+			}
+			if req.LeasedUntil > now {
+				continue
+			}
+			req.LeasedUntil = until
+			data, err := encodeBoltRequest(req)
+			if err != nil {
+				return err
+			}
+			leased = req
+			return bucket.Put(k, data)
+		}
+		return sql.ErrNoRows
+	})
+	return leased, err
+}
+
+func (s *boltStore) SettleLease(ctx context.Context, binID, reqID string, release bool) error {
+	var acked *Request
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		found, err := updateBoltRequest(tx, binID, reqID, func(req *Request) error {
+			if req.LeasedUntil < time.Now().UnixMilli() {
+				return errLeaseLapsed
+			}
+			if !release {
+				acked = req
+			}
+			req.LeasedUntil = 0
+			return nil
+		})
+		if err != nil || !found {
+			if err == nil {
+				err = sql.ErrNoRows
+			}
+			return err
+		}
+		if acked == nil {
+			return nil
+		}
+		key := tx.Bucket(boltRequestIDs).Bucket([]byte(binID)).Get([]byte(reqID))
+		return removeBoltRequests(tx, binID, [][]byte{key}, []Request{*acked})
+	})
+	if err != nil || acked == nil {
+		return err
+	}
+	orphanBlobs(ctx, acked.blobKey)
+	return nil
+}
+
+func (s *boltStore) RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	if err != nil {
+		return bodyPart{}, err
+	}
+	return requestPart(req, name)
+}
+
+func (s *boltStore) DeleteRequest(ctx context.Context, binID, reqID string) (bool, error) {
+	var deleted *Request
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		reqs := tx.Bucket(boltRequests).Bucket([]byte(binID))
+		ids := tx.Bucket(boltRequestIDs).Bucket([]byte(binID))
+		if reqs == nil || ids == nil {
+			return nil
+		}
+		key := ids.Get([]byte(reqID))
+		if key == nil {
+			return nil
+		}
+		req, err := decodeBoltRequest(reqs.Get(key))
+		if err != nil {
+			return err
+		}
+		deleted = &req
+		return removeBoltRequests(tx, binID, [][]byte{key}, []Request{req})
+	})
+	if err != nil || deleted == nil {
+		return false, err
+	}
+	orphanBlobs(ctx, deleted.blobKey)
+	return true, nil
+}
@@ -0,0 +1,70 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestBoltStore(t *testing.T) {
+	clearDB(t)
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "postbin.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	testStoreContract(t, s)
+
+	// Requests must come back with what their JSON form leaves out
+	s.CreateBin(context.Background(), BinRecord{BinID: "bolt", CreatedAt: 1, ExpiresAt: neverExpires})
+	in := Request{BinID: "bolt", ReqID: "r1", Inserted: 5, RawBody: "a=1", Body: map[string]string{"a": "1"},
+		rawHead: "POST / HTTP/1.1\r\n\r\n", blobKey: "bolt/r1"}
+	if err := s.InsertRequest(context.Background(), in, 0); err != nil {
+		t.Fatal(err)
+	}
+	out, err := s.GetRequest(context.Background(), "bolt", "r1")
+	if err != nil || out.rawHead != in.rawHead || out.blobKey != in.blobKey || !out.BodyOffloaded || out.Body != nil {
+		t.Errorf("Unexpected request %+v %v", out, err)
+	}
+}
+
+func TestBoltStoreUsage(t *testing.T) {
+	clearDB(t)
+	s, err := openBoltStore(filepath.Join(t.TempDir(), "postbin.bolt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	defer func() { maxStorageBytes, storagePolicy = 0, "reject" }()
+
+	s.CreateBin(context.Background(), BinRecord{BinID: "usage", CreatedAt: 1, ExpiresAt: neverExpires})
+	s.InsertRequest(context.Background(), Request{BinID: "usage", ReqID: "r1", Inserted: 5, RawBody: "first"}, 0)
+
+	// Files from before usage was kept have it counted when they're opened
+	before, _ := s.Usage(context.Background(), "")
+	s.db.Update(func(tx *bolt.Tx) error { return tx.Bucket(boltMeta).Delete(boltBytesKey) })
+	s.db.Update(countBoltUsage)
+	if after, _ := s.Usage(context.Background(), ""); after.Bytes != before.Bytes || after.Bytes == 0 {
+		t.Errorf("Expected %d bytes recounted, got %d", before.Bytes, after.Bytes)
+	}
+
+	maxStorageBytes = before.Bytes
+	if err := s.InsertRequest(context.Background(), Request{BinID: "usage", ReqID: "r2", Inserted: 6, RawBody: "again"}, 0); err != errInsufficientStorage {
+		t.Errorf("Expected the quota to refuse the capture, got %v", err)
+	}
+	storagePolicy = "evict"
+	if err := s.InsertRequest(context.Background(), Request{BinID: "usage", ReqID: "r2", Inserted: 6, RawBody: "again"}, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetRequest(context.Background(), "usage", "r1"); err != sql.ErrNoRows {
+		t.Errorf("Expected r1 evicted, got %v", err)
+	}
+	if u, _ := s.Usage(context.Background(), "usage"); u.Requests != 1 || u.Bytes != before.Bytes {
+		t.Errorf("Unexpected usage after eviction %+v", u)
+	}
+}
@@ -0,0 +1,937 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DynamoDB settings; overridable with command-line flags. The table is named
+// by --dsn.
+var (
+	dynamoRegion   = "us-east-1"
+	dynamoEndpoint string
+)
+
+// dynamoStore is the Store on a DynamoDB table, for deployments with no
+// database to run. A bin and its requests share a partition: the bin is
+// item "bin", each request "req#{inserted}#{reqId}", and an "id#{reqId}"
+// item points at its request. Expiry is left to DynamoDB's TTL on the ttl
+// attribute as well as the sweeper. Multipart parts are parsed again from
+// the stored body. TTL deletes items without telling anyone, so there's no
+// running total for the storage quota to keep, and openStore refuses it.
+type dynamoStore struct {
+	table    string
+	region   string
+	endpoint string
+	creds    awsCredentials
+	client   *http.Client
+}
+
+// dynamoValue is an attribute value in DynamoDB's JSON, {"S": "..."} or
+// {"N": "..."}
+type dynamoValue map[string]string
+
+type dynamoItem map[string]dynamoValue
+
+func dynamoS(s string) dynamoValue { return dynamoValue{"S": s} }
+
+func dynamoN(n int64) dynamoValue { return dynamoValue{"N": strconv.FormatInt(n, 10)} }
+
+func (item dynamoItem) str(name string) string { return item[name]["S"] }
+
+func (item dynamoItem) num(name string) int64 {
+	n, _ := strconv.ParseInt(item[name]["N"], 10, 64)
+	return n
+}
+
+// dynamoError is an error response from DynamoDB
+type dynamoError struct {
+	Type    string `json:"__type"`
+	Message string `json:"message"`
+}
+
+func (e *dynamoError) Error() string {
+	return "dynamodb: " + e.Type[strings.LastIndex(e.Type, "#")+1:] + ": " + e.Message
+}
+
+// is reports whether e is the named exception
+func (e *dynamoError) is(name string) bool {
+	return strings.HasSuffix(e.Type, "#"+name)
+}
+
+func isDynamoError(err error, name string) bool {
+	var de *dynamoError
+	return errors.As(err, &de) && de.is(name)
+}
+
+func openDynamoStore(table, region, endpoint string) (*dynamoStore, error) {
+	if endpoint == "" {
+		endpoint = "https://dynamodb." + region + ".amazonaws.com"
+	}
+	s := &dynamoStore{table: table, region: region, endpoint: strings.TrimSuffix(endpoint, "/"),
+		creds: awsCredentialsFromEnv(), client: &http.Client{Timeout: awsSinkTimeout}}
+	return s, s.ensureTable(context.Background())
+}
+
+// call makes one DynamoDB API call, decoding the response into out
+func (s *dynamoStore) call(ctx context.Context, op string, in, out interface{}) error {
+	payload, err := json.Marshal(in)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	signAWSRequest(req, sha256Hex(payload), "dynamodb", s.region, s.creds, time.Now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var de dynamoError
+		if json.Unmarshal(raw, &de) == nil && de.Type != "" {
+			return &de
+		}
+		return fmt.Errorf("dynamodb: %s: %s", resp.Status, bytes.TrimSpace(raw))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// ensureTable creates the table, and turns on TTL, if it doesn't exist yet
+func (s *dynamoStore) ensureTable(ctx context.Context) error {
+	var described struct {
+		Table struct {
+			TableStatus string
+		}
+	}
+	err := s.call(ctx, "DescribeTable", map[string]string{"TableName": s.table}, &described)
+	if err == nil {
+		return nil
+	}
+	if !isDynamoError(err, "ResourceNotFoundException") {
+		return err
+	}
+
+	err = s.call(ctx, "CreateTable", map[string]interface{}{
+		"TableName":   s.table,
+		"BillingMode": "PAY_PER_REQUEST",
+		"AttributeDefinitions": []map[string]string{
+			{"AttributeName": "pk", "AttributeType": "S"},
+			{"AttributeName": "sk", "AttributeType": "S"},
+		},
+		"KeySchema": []map[string]string{
+			{"AttributeName": "pk", "KeyType": "HASH"},
+			{"AttributeName": "sk", "KeyType": "RANGE"},
+		},
+	}, nil)
+	if err != nil {
+		return err
+	}
+	for i := 0; described.Table.TableStatus != "ACTIVE"; i++ {
+		if i == 60 {
+			return fmt.Errorf("dynamodb: table %s didn't become active", s.table)
+		}
+		time.Sleep(time.Second)
+		if err := s.call(ctx, "DescribeTable", map[string]string{"TableName": s.table}, &described); err != nil {
+			return err
+		}
+	}
+	return s.call(ctx, "UpdateTimeToLive", map[string]interface{}{
+		"TableName":               s.table,
+		"TimeToLiveSpecification": map[string]interface{}{"AttributeName": "ttl", "Enabled": true},
+	}, nil)
+}
+
+func dynamoKey(binID, sk string) dynamoItem {
+	return dynamoItem{"pk": dynamoS("bin#" + binID), "sk": dynamoS(sk)}
+}
+
+// dynamoRequestKey sorts a bin's requests by inserted
+func dynamoRequestKey(inserted int64, reqID string) string {
+	return fmt.Sprintf("req#%016d#%s", inserted, reqID)
+}
+
+// dynamoTTL is the ttl attribute for an expiry, in the seconds DynamoDB
+// wants; permanent bins get none
+func dynamoTTL(item dynamoItem, expiresAt int64) dynamoItem {
+	if expiresAt != neverExpires {
+		item["ttl"] = dynamoN(expiresAt/1000 + 1)
+	}
+	return item
+}
+
+func (s *dynamoStore) getItem(ctx context.Context, key dynamoItem) (dynamoItem, error) {
+	var out struct{ Item dynamoItem }
+	err := s.call(ctx, "GetItem", map[string]interface{}{"TableName": s.table, "Key": key, "ConsistentRead": true}, &out)
+	return out.Item, err
+}
+
+func (s *dynamoStore) CreateBin(ctx context.Context, bin BinRecord) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	item := dynamoKey(bin.BinID, "bin")
+	item["created_at"] = dynamoN(bin.CreatedAt)
+	item["expires_at"] = dynamoN(bin.ExpiresAt)
+	item["max_entries"] = dynamoN(int64(bin.MaxEntries))
+	item["config"] = dynamoS(bin.Config.encode())
+	err := s.call(ctx, "PutItem", map[string]interface{}{
+		"TableName":           s.table,
+		"Item":                dynamoTTL(item, bin.ExpiresAt),
+		"ConditionExpression": "attribute_not_exists(pk)",
+	}, nil)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// GetBin still finds bins that have expired but that TTL hasn't got round
+// to, as the other stores do until their sweep
+func (s *dynamoStore) GetBin(ctx context.Context, binID string) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	item, err := s.getItem(ctx, dynamoKey(binID, "bin"))
+	if err != nil {
+		return BinRecord{}, err
+	}
+	if item == nil {
+		return BinRecord{}, sql.ErrNoRows
+	}
+	return BinRecord{BinID: binID, CreatedAt: item.num("created_at"), ExpiresAt: item.num("expires_at"),
+		MaxEntries: int(item.num("max_entries")), Config: loadBinConfig(item.str("config"))}, nil
+}
+
+// ExtendBin moves the ttl of every item in the bin along with its expiry
+func (s *dynamoStore) ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	bin, err := s.GetBin(ctx, binID)
+	if err == sql.ErrNoRows {
+		return false, nil
+	} else if err != nil || bin.ExpiresAt == neverExpires {
+		return err == nil, err
+	}
+	expires := extendedExpiry(bin.ExpiresAt, time.Now().UnixMilli(), ms, latest)
+
+	keys, err := s.partitionKeys(ctx, binID)
+	if err != nil {
+		return false, err
+	}
+	for _, key := range keys {
+		update := map[string]interface{}{
+			"TableName":                 s.table,
+			"Key":                       key,
+			"UpdateExpression":          "SET #ttl = :ttl",
+			"ConditionExpression":       "attribute_exists(pk)",
+			"ExpressionAttributeNames":  map[string]string{"#ttl": "ttl"},
+			"ExpressionAttributeValues": dynamoItem{":ttl": dynamoN(expires/1000 + 1)},
+		}
+		if key.str("sk") == "bin" {
+			update["UpdateExpression"] = "SET #ttl = :ttl, expires_at = :expires"
+			update["ExpressionAttributeValues"] = dynamoItem{":ttl": dynamoN(expires/1000 + 1), ":expires": dynamoN(expires)}
+		}
+		err := s.call(ctx, "UpdateItem", update, nil)
+		if err != nil && !isDynamoError(err, "ConditionalCheckFailedException") {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (s *dynamoStore) SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	err := s.call(ctx, "UpdateItem", map[string]interface{}{
+		"TableName":                 s.table,
+		"Key":                       dynamoKey(binID, "bin"),
+		"UpdateExpression":          "SET config = :config",
+		"ConditionExpression":       "attribute_exists(pk)",
+		"ExpressionAttributeValues": dynamoItem{":config": dynamoS(config.encode())},
+	}, nil)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// query pages through a bin's items whose sort keys fall in [from, to], or
+// all of them when from is empty
+func (s *dynamoStore) query(ctx context.Context, binID, from, to string, newest bool, fn func(dynamoItem) (bool, error)) error {
+	return s.pages(ctx, "Query", s.queryInput(binID, from, to, newest), fn)
+}
+
+// queryInput is the Query input for query, for callers that add to it
+func (s *dynamoStore) queryInput(binID, from, to string, newest bool) map[string]interface{} {
+	in := map[string]interface{}{
+		"TableName":                 s.table,
+		"KeyConditionExpression":    "pk = :pk",
+		"ExpressionAttributeValues": dynamoItem{":pk": dynamoS("bin#" + binID)},
+		"ConsistentRead":            true,
+		"ScanIndexForward":          !newest,
+	}
+	if from != "" {
+		in["KeyConditionExpression"] = "pk = :pk AND sk BETWEEN :from AND :to"
+		in["ExpressionAttributeValues"] = dynamoItem{
+			":pk": dynamoS("bin#" + binID), ":from": dynamoS(from), ":to": dynamoS(to)}
+	}
+	return in
+}
+
+// pages calls op, a Query or Scan, page after page, passing fn each item
+// until it returns false
+func (s *dynamoStore) pages(ctx context.Context, op string, in map[string]interface{}, fn func(dynamoItem) (bool, error)) error {
+	for {
+		var out struct {
+			Items            []dynamoItem
+			LastEvaluatedKey dynamoItem
+		}
+		if err := s.call(ctx, op, in, &out); err != nil {
+			return err
+		}
+		for _, item := range out.Items {
+			if more, err := fn(item); err != nil || !more {
+				return err
+			}
+		}
+		if out.LastEvaluatedKey == nil {
+			return nil
+		}
+		in["ExclusiveStartKey"] = out.LastEvaluatedKey
+	}
+}
+
+// eachRequest calls fn with a bin's requests inserted from since on, oldest
+// first or newest first, until fn returns false
+func (s *dynamoStore) eachRequest(ctx context.Context, binID string, since int64, newest bool, fn func(Request, dynamoItem) (bool, error)) error {
+	return s.query(ctx, binID, dynamoRequestKey(since, ""), "req#~", newest, func(item dynamoItem) (bool, error) {
+		req, err := decodeBoltRequest([]byte(item.str("data")))
+		if err != nil {
+			return false, err
+		}
+		return fn(req, item)
+	})
+}
+
+// partitionKeys lists the keys of a bin's items, the bin's own included
+func (s *dynamoStore) partitionKeys(ctx context.Context, binID string) ([]dynamoItem, error) {
+	var keys []dynamoItem
+	err := s.query(ctx, binID, "", "", false, func(item dynamoItem) (bool, error) {
+		keys = append(keys, dynamoItem{"pk": item["pk"], "sk": item["sk"]})
+		return true, nil
+	})
+	return keys, err
+}
+
+// deleteKeys deletes items in batches of the 25 DynamoDB allows, retrying
+// whatever it leaves unprocessed
+func (s *dynamoStore) deleteKeys(ctx context.Context, keys []dynamoItem) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 25 {
+			n = 25
+		}
+		var writes []interface{}
+		for _, key := range keys[:n] {
+			writes = append(writes, map[string]interface{}{"DeleteRequest": map[string]interface{}{"Key": key}})
+		}
+		keys = keys[n:]
+
+		var out struct {
+			UnprocessedItems map[string][]struct {
+				DeleteRequest struct{ Key dynamoItem }
+			}
+		}
+		err := s.call(ctx, "BatchWriteItem", map[string]interface{}{
+			"RequestItems": map[string]interface{}{s.table: writes},
+		}, &out)
+		if err != nil {
+			return err
+		}
+		for _, w := range out.UnprocessedItems[s.table] {
+			keys = append(keys, w.DeleteRequest.Key)
+		}
+	}
+	return nil
+}
+
+// deleteBin removes a bin's items, returning how many of them were requests
+// and their blobs
+func (s *dynamoStore) deleteBin(ctx context.Context, binID string) (int64, []string, error) {
+	var keys []dynamoItem
+	var blobs []string
+	err := s.query(ctx, binID, "", "", false, func(item dynamoItem) (bool, error) {
+		keys = append(keys, dynamoItem{"pk": item["pk"], "sk": item["sk"]})
+		if strings.HasPrefix(item.str("sk"), "req#") {
+			req, err := decodeBoltRequest([]byte(item.str("data")))
+			if err != nil {
+				return false, err
+			}
+			blobs = append(blobs, req.blobKey)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return int64(len(blobs)), blobs, s.deleteKeys(ctx, keys)
+}
+
+func (s *dynamoStore) DeleteBin(ctx context.Context, binID string) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, blobs, err := s.deleteBin(ctx, binID)
+	if err != nil {
+		return err
+	}
+	orphanBlobs(ctx, blobs...)
+	return clearLocalBinData(ctx, binID)
+}
+
+// scan pages through every item in the table that in's FilterExpression
+// matches, until fn returns false
+func (s *dynamoStore) scan(ctx context.Context, in map[string]interface{}, fn func(dynamoItem) (bool, error)) error {
+	in["TableName"] = s.table
+	in["ConsistentRead"] = true
+	return s.pages(ctx, "Scan", in, fn)
+}
+
+// PurgeExpiredBins scans for expired bins rather than waiting on TTL, which
+// can take a day or more to get round to them
+func (s *dynamoStore) PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var ids []string
+	err = s.scan(ctx, map[string]interface{}{
+		"FilterExpression":     "sk = :bin AND expires_at <> :never AND expires_at < :now",
+		"ProjectionExpression": "pk",
+		"ExpressionAttributeValues": dynamoItem{
+			":bin": dynamoS("bin"), ":never": dynamoN(neverExpires), ":now": dynamoN(time.Now().UnixMilli())},
+	}, func(item dynamoItem) (bool, error) {
+		ids = append(ids, strings.TrimPrefix(item.str("pk"), "bin#"))
+		return limit <= 0 || len(ids) < limit, nil
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for _, id := range ids {
+		n, blobs, err := s.deleteBin(ctx, id)
+		if err != nil {
+			return bins, requests, err
+		}
+		bins++
+		requests += n
+		orphanBlobs(ctx, blobs...)
+	}
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+	return bins, requests, clearLocalBinData(ctx, ids...)
+}
+
+func (s *dynamoStore) ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	bins := []BinRecord{}
+	err := s.scan(ctx, map[string]interface{}{
+		"FilterExpression":          "sk = :bin",
+		"ExpressionAttributeValues": dynamoItem{":bin": dynamoS("bin")},
+	}, func(item dynamoItem) (bool, error) {
+		bins = append(bins, BinRecord{BinID: strings.TrimPrefix(item.str("pk"), "bin#"), CreatedAt: item.num("created_at"),
+			ExpiresAt: item.num("expires_at"), MaxEntries: int(item.num("max_entries")), Config: loadBinConfig(item.str("config"))})
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sortBins(bins, limit, offset), nil
+}
+
+// Usage counts by scanning the table, or the bin's partition, as nothing
+// keeps a running total
+func (s *dynamoStore) Usage(ctx context.Context, binID string) (StoreUsage, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var u StoreUsage
+	if binID != "" {
+		err := s.eachRequest(ctx, binID, 0, false, func(req Request, _ dynamoItem) (bool, error) {
+			u.Requests++
+			u.Bytes += requestSize(req)
+			return true, nil
+		})
+		return u, err
+	}
+	err := s.scan(ctx, map[string]interface{}{
+		"FilterExpression":          "sk = :bin OR begins_with(sk, :req)",
+		"ExpressionAttributeValues": dynamoItem{":bin": dynamoS("bin"), ":req": dynamoS("req#")},
+	}, func(item dynamoItem) (bool, error) {
+		if item.str("sk") == "bin" {
+			u.Bins++
+			if binExpired(item.num("expires_at")) {
+				u.ExpiredBins++
+			}
+			return true, nil
+		}
+		req, err := decodeBoltRequest([]byte(item.str("data")))
+		u.Requests++
+		u.Bytes += requestSize(req)
+		return err == nil, err
+	})
+	return u, err
+}
+
+// UsageByBin queries each bin's partition in turn, DynamoDB having nothing
+// to total them with in one go
+func (s *dynamoStore) UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	usage := map[string]StoreUsage{}
+	for _, binID := range binIDs {
+		var u StoreUsage
+		err := s.eachRequest(ctx, binID, 0, false, func(req Request, _ dynamoItem) (bool, error) {
+			u.Requests++
+			u.Bytes += requestSize(req)
+			return true, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if u.Requests > 0 {
+			usage[binID] = u
+		}
+	}
+	return usage, nil
+}
+
+func (s *dynamoStore) OldestActiveBin(ctx context.Context) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var active []BinRecord
+	err := s.scan(ctx, map[string]interface{}{
+		"FilterExpression": "sk = :bin AND (expires_at = :never OR expires_at >= :now)",
+		"ExpressionAttributeValues": dynamoItem{
+			":bin": dynamoS("bin"), ":never": dynamoN(neverExpires), ":now": dynamoN(time.Now().UnixMilli())},
+	}, func(item dynamoItem) (bool, error) {
+		active = append(active, BinRecord{BinID: strings.TrimPrefix(item.str("pk"), "bin#"), CreatedAt: item.num("created_at"),
+			ExpiresAt: item.num("expires_at"), MaxEntries: int(item.num("max_entries")), Config: loadBinConfig(item.str("config"))})
+		return true, nil
+	})
+	return firstBin(sortBins(active, 1, 0), err)
+}
+
+// InsertRequest writes the request and its ID item together, on condition
+// that the bin exists and the ID is free. Items are limited to 400KB, so
+// large bodies need --blob-threshold.
+func (s *dynamoStore) InsertRequest(ctx context.Context, req Request, maxEntries int) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	bin, err := s.GetBin(ctx, req.BinID)
+	if err != nil {
+		return err
+	}
+	data, err := encodeBoltRequest(req)
+	if err != nil {
+		return err
+	}
+	sk := dynamoRequestKey(req.Inserted, req.ReqID)
+	item := dynamoKey(req.BinID, sk)
+	item["data"] = dynamoS(string(data))
+	idItem := dynamoKey(req.BinID, "id#"+req.ReqID)
+	idItem["ref"] = dynamoS(sk)
+
+	err = s.call(ctx, "TransactWriteItems", map[string]interface{}{
+		"TransactItems": []interface{}{
+			map[string]interface{}{"ConditionCheck": map[string]interface{}{
+				"TableName": s.table, "Key": dynamoKey(req.BinID, "bin"), "ConditionExpression": "attribute_exists(pk)"}},
+			map[string]interface{}{"Put": map[string]interface{}{
+				"TableName": s.table, "Item": dynamoTTL(item, bin.ExpiresAt)}},
+			map[string]interface{}{"Put": map[string]interface{}{
+				"TableName": s.table, "Item": dynamoTTL(idItem, bin.ExpiresAt), "ConditionExpression": "attribute_not_exists(pk)"}},
+		},
+	}, nil)
+	if isDynamoError(err, "TransactionCanceledException") {
+		return fmt.Errorf("request %s already exists, or its bin doesn't", req.ReqID)
+	} else if err != nil {
+		return err
+	}
+
+	if maxEntries > 0 {
+		return s.evict(ctx, req.BinID, maxEntries)
+	}
+	return nil
+}
+
+// evict deletes a bin's oldest requests beyond maxEntries
+func (s *dynamoStore) evict(ctx context.Context, binID string, maxEntries int) error {
+	var keys []dynamoItem
+	var blobs []string
+	kept := 0
+	err := s.eachRequest(ctx, binID, 0, true, func(req Request, item dynamoItem) (bool, error) {
+		if kept++; kept > maxEntries {
+			keys = append(keys, dynamoItem{"pk": item["pk"], "sk": item["sk"]}, dynamoKey(binID, "id#"+req.ReqID))
+			blobs = append(blobs, req.blobKey)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.deleteKeys(ctx, keys); err != nil {
+		return err
+	}
+	orphanBlobs(ctx, blobs...)
+	return nil
+}
+
+func (s *dynamoStore) GetRequest(ctx context.Context, binID, reqID string) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	ref, err := s.getItem(ctx, dynamoKey(binID, "id#"+reqID))
+	if err != nil {
+		return Request{}, err
+	}
+	if ref == nil {
+		return Request{}, sql.ErrNoRows
+	}
+	item, err := s.getItem(ctx, dynamoKey(binID, ref.str("ref")))
+	if err != nil {
+		return Request{}, err
+	}
+	if item == nil {
+		return Request{}, sql.ErrNoRows
+	}
+	return decodeBoltRequest([]byte(item.str("data")))
+}
+
+func (s *dynamoStore) CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	n := 0
+	err := s.eachRequest(ctx, binID, 0, false, func(req Request, _ dynamoItem) (bool, error) {
+		if filter.matches(req) {
+			n++
+		}
+		return true, nil
+	})
+	return n, err
+}
+
+// CountBuckets reads when requests were inserted from their sort keys,
+// fetching nothing else, unless the filter needs the requests themselves
+func (s *dynamoStore) CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var since int64
+	if filter.since != nil && *filter.since > 0 {
+		since = *filter.since
+	}
+	var buckets []TimeseriesBucket
+	if !filter.onlyTimes() {
+		err := s.eachRequest(ctx, binID, since, false, func(req Request, _ dynamoItem) (bool, error) {
+			if filter.matches(req) {
+				buckets = countInBucket(buckets, req.Inserted, bucketMs)
+			}
+			return true, nil
+		})
+		return buckets, err
+	}
+	in := s.queryInput(binID, dynamoRequestKey(since, ""), "req#~", false)
+	in["ProjectionExpression"] = "sk"
+	err := s.pages(ctx, "Query", in, func(item dynamoItem) (bool, error) {
+		inserted, err := strconv.ParseInt(strings.SplitN(item.str("sk"), "#", 3)[1], 10, 64)
+		if err != nil || (filter.until != nil && inserted > *filter.until) {
+			return false, err
+		}
+		buckets = countInBucket(buckets, inserted, bucketMs)
+		return true, nil
+	})
+	return buckets, err
+}
+
+func (s *dynamoStore) ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	reqs := []Request{}
+	err := s.eachRequest(ctx, binID, 0, false, func(req Request, _ dynamoItem) (bool, error) {
+		if len(reqs) == limit {
+			return false, nil
+		}
+		if filter.matches(req) {
+			if offset > 0 {
+				offset--
+			} else {
+				reqs = append(reqs, req)
+			}
+		}
+		return true, nil
+	})
+	return reqs, err
+}
+
+// TakeRequests claims each request by deleting it, and keeps only those
+// whose delete found them, so concurrent consumers never share one
+func (s *dynamoStore) TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	reqs := []Request{}
+	now := time.Now().UnixMilli()
+	err := s.eachRequest(ctx, binID, 0, newest, func(req Request, item dynamoItem) (bool, error) {
+		if len(reqs) == count {
+			return false, nil
+		}
+		if req.LeasedUntil > now {
+			return true, nil
+		}
+		var out struct{ Attributes dynamoItem }
+		err := s.call(ctx, "DeleteItem", map[string]interface{}{
+			"TableName":    s.table,
+			"Key":          dynamoItem{"pk": item["pk"], "sk": item["sk"]},
+			"ReturnValues": "ALL_OLD",
+		}, &out)
+		if err != nil {
+			return false, err
+		}
+		if out.Attributes != nil {
+			reqs = append(reqs, req)
+			s.call(ctx, "DeleteItem", map[string]interface{}{"TableName": s.table, "Key": dynamoKey(binID, "id#"+req.ReqID)}, nil)
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	orphanBlobs(ctx, blobKeys(reqs)...)
+	return reqs, nil
+}
+
+func (s *dynamoStore) RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	page := newCursorPage(after, filter, limit)
+	err := s.eachRequest(ctx, binID, after.Inserted, false, func(req Request, _ dynamoItem) (bool, error) {
+		return page.add(req), nil
+	})
+	return page.done(), err
+}
+
+func (s *dynamoStore) SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	reqs := []Request{}
+	err := s.eachRequest(ctx, binID, 0, false, func(req Request, _ dynamoItem) (bool, error) {
+		if len(reqs) == limit {
+			return false, nil
+		}
+		if searchMatches(req, q) {
+			reqs = append(reqs, req)
+		}
+		return true, nil
+	})
+	return reqs, err
+}
+
+func (s *dynamoStore) EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	return req.encodedBody, err
+}
+
+// replaceRequest writes req over the request item, on condition that it
+// still holds what was read from it, reporting false if it doesn't
+func (s *dynamoStore) replaceRequest(ctx context.Context, item dynamoItem, req Request) (bool, error) {
+	data, err := encodeBoltRequest(req)
+	if err != nil {
+		return false, err
+	}
+	err = s.call(ctx, "UpdateItem", map[string]interface{}{
+		"TableName":                 s.table,
+		"Key":                       dynamoItem{"pk": item["pk"], "sk": item["sk"]},
+		"UpdateExpression":          "SET #data = :new",
+		"ConditionExpression":       "#data = :old",
+		"ExpressionAttributeNames":  map[string]string{"#data": "data"},
+		"ExpressionAttributeValues": dynamoItem{":new": dynamoS(string(data)), ":old": item["data"]},
+	}, nil)
+	if isDynamoError(err, "ConditionalCheckFailedException") {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// requestItem finds the item holding a request by its ID item
+func (s *dynamoStore) requestItem(ctx context.Context, binID, reqID string) (dynamoItem, error) {
+	ref, err := s.getItem(ctx, dynamoKey(binID, "id#"+reqID))
+	if err != nil || ref == nil {
+		return nil, err
+	}
+	return s.getItem(ctx, dynamoKey(binID, ref.str("ref")))
+}
+
+// changeRequest applies change to a stored request, reading it again
+// whenever another writer got there in between, and reports whether it
+// exists
+func (s *dynamoStore) changeRequest(ctx context.Context, binID, reqID string, change func(*Request) error) (bool, error) {
+	for {
+		item, err := s.requestItem(ctx, binID, reqID)
+		if err != nil || item == nil {
+			return false, err
+		}
+		req, err := decodeBoltRequest([]byte(item.str("data")))
+		if err != nil {
+			return true, err
+		}
+		if err := change(&req); err != nil {
+			return true, err
+		}
+		if ok, err := s.replaceRequest(ctx, item, req); err != nil || ok {
+			return true, err
+		}
+	}
+}
+
+func (s *dynamoStore) SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return s.changeRequest(ctx, binID, reqID, func(req *Request) error {
+		req.Response = &resp
+		return nil
+	})
+}
+
+// LeaseRequest moves on to the next request whenever another consumer
+// leases or changes the one it picked first
+func (s *dynamoStore) LeaseRequest(ctx context.Context, binID string, until int64) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var leased *Request
+	now := time.Now().UnixMilli()
+	err := s.eachRequest(ctx, binID, 0, false, func(req Request, item dynamoItem) (bool, error) {
+		if req.LeasedUntil > now {
+			return true, nil
+		}
+		req.LeasedUntil = until
+		ok, err := s.replaceRequest(ctx, item, req)
+		if ok {
+			leased = &req
+		}
+		return !ok, err
+	})
+	if err != nil {
+		return Request{}, err
+	}
+	if leased == nil {
+		return Request{}, sql.ErrNoRows
+	}
+	return *leased, nil
+}
+
+func (s *dynamoStore) SettleLease(ctx context.Context, binID, reqID string, release bool) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	lapsed := func(req *Request) error {
+		if req.LeasedUntil < time.Now().UnixMilli() {
+			return errLeaseLapsed
+		}
+		req.LeasedUntil = 0
+		return nil
+	}
+	if release {
+		found, err := s.changeRequest(ctx, binID, reqID, lapsed)
+		if err == nil && !found {
+			err = sql.ErrNoRows
+		}
+		return err
+	}
+
+	// The delete is conditional in the same way, so a lease taken over in
+	// between isn't acked
+	for {
+		item, err := s.requestItem(ctx, binID, reqID)
+		if err != nil {
+			return err
+		}
+		if item == nil {
+			return sql.ErrNoRows
+		}
+		req, err := decodeBoltRequest([]byte(item.str("data")))
+		if err != nil {
+			return err
+		}
+		if err := lapsed(&req); err != nil {
+			return err
+		}
+		err = s.call(ctx, "DeleteItem", map[string]interface{}{
+			"TableName":                 s.table,
+			"Key":                       dynamoItem{"pk": item["pk"], "sk": item["sk"]},
+			"ConditionExpression":       "#data = :old",
+			"ExpressionAttributeNames":  map[string]string{"#data": "data"},
+			"ExpressionAttributeValues": dynamoItem{":old": item["data"]},
+		}, nil)
+		if isDynamoError(err, "ConditionalCheckFailedException") {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := s.call(ctx, "DeleteItem", map[string]interface{}{"TableName": s.table, "Key": dynamoKey(binID, "id#"+reqID)}, nil); err != nil {
+			return err
+		}
+		orphanBlobs(ctx, req.blobKey)
+		return nil
+	}
+}
+
+func (s *dynamoStore) RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	if err != nil {
+		return bodyPart{}, err
+	}
+	return requestPart(req, name)
+}
+
+func (s *dynamoStore) DeleteRequest(ctx context.Context, binID, reqID string) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var out struct{ Attributes dynamoItem }
+	err := s.call(ctx, "DeleteItem", map[string]interface{}{
+		"TableName":    s.table,
+		"Key":          dynamoKey(binID, "id#"+reqID),
+		"ReturnValues": "ALL_OLD",
+	}, &out)
+	if err != nil || out.Attributes == nil {
+		return false, err
+	}
+	var old struct{ Attributes dynamoItem }
+	err = s.call(ctx, "DeleteItem", map[string]interface{}{
+		"TableName":    s.table,
+		"Key":          dynamoKey(binID, out.Attributes.str("ref")),
+		"ReturnValues": "ALL_OLD",
+	}, &old)
+	if err != nil || old.Attributes == nil {
+		return err == nil, err
+	}
+	req, err := decodeBoltRequest([]byte(old.Attributes.str("data")))
+	if err != nil {
+		return true, err
+	}
+	orphanBlobs(ctx, req.blobKey)
+	return true, nil
+}
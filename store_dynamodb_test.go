@@ -0,0 +1,74 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDynamoStore(t *testing.T) {
+	endpoint := os.Getenv("POSTBIN_TEST_DYNAMODB_ENDPOINT")
+	if endpoint == "" {
+		t.Skip("POSTBIN_TEST_DYNAMODB_ENDPOINT is not set")
+	}
+	clearDB(t)
+	s, err := openDynamoStore("postbin-test", "us-east-1", endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []string{"contract", "contract-more", "contract-expired"} {
+		if err := s.DeleteBin(context.Background(), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testStoreContract(t, s)
+}
+
+func TestDynamoStoreCalls(t *testing.T) {
+	var targets []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		targets = append(targets, r.Header.Get("X-Amz-Target"))
+		if !strings.Contains(r.Header.Get("Authorization"), "/us-east-1/dynamodb/aws4_request") {
+			t.Errorf("Expected a SigV4 signature for dynamodb, got %q", r.Header.Get("Authorization"))
+		}
+		var in map[string]interface{}
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &in)
+		switch {
+		case strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".DescribeTable"):
+			io.WriteString(w, `{"Table":{"TableStatus":"ACTIVE"}}`)
+		case strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".PutItem"):
+			if in["ConditionExpression"] != "attribute_not_exists(pk)" {
+				t.Errorf("Expected bins to be created on condition, got %v", in)
+			}
+			w.WriteHeader(http.StatusBadRequest)
+			io.WriteString(w, `{"__type":"com.amazonaws.dynamodb.v20120810#ConditionalCheckFailedException","message":"The conditional request failed"}`)
+		case strings.HasSuffix(r.Header.Get("X-Amz-Target"), ".GetItem"):
+			io.WriteString(w, `{}`)
+		}
+	}))
+	defer srv.Close()
+
+	s, err := openDynamoStore("bins", "us-east-1", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created, err := s.CreateBin(context.Background(), BinRecord{BinID: "taken"}); created || err != nil {
+		t.Errorf("Expected a failed condition to report the ID taken, got %v %v", created, err)
+	}
+	if _, err := s.GetBin(context.Background(), "missing"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing item, got %v", err)
+	}
+	want := "DynamoDB_20120810.DescribeTable DynamoDB_20120810.PutItem DynamoDB_20120810.GetItem"
+	if strings.Join(targets, " ") != want {
+		t.Errorf("Unexpected calls %v", targets)
+	}
+}
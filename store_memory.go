@@ -0,0 +1,533 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memoryStore is the Store in process memory, for CI and for embedding
+// postbin, where nothing needs to outlive the process. Multipart parts are
+// parsed again from the stored body.
+type memoryStore struct {
+	mu   sync.Mutex
+	bins map[string]*memoryBin
+	// binOf maps request IDs to their bin, as they're unique across bins
+	binOf map[string]string
+	// bytes is the requestSize of every request, for the quota
+	bytes int64
+}
+
+// memoryBin is a bin and its requests. They're kept oldest first in
+// buf[head:], so evicting the oldest only moves head along; see evict.
+type memoryBin struct {
+	record BinRecord
+	buf    []Request
+	head   int
+	bytes  int64
+}
+
+// requests are the bin's requests, oldest first
+func (b *memoryBin) requests() []Request {
+	return b.buf[b.head:]
+}
+
+// evict drops the bin's n oldest requests, returning them. Their slots are
+// cleared and skipped rather than copied over, and the rest are only moved
+// down once the cleared ones are half of buf, so a bin at its maxEntries
+// costs the same per capture however big it is.
+func (b *memoryBin) evict(n int) []Request {
+	evicted := append([]Request(nil), b.buf[b.head:b.head+n]...)
+	for i := b.head; i < b.head+n; i++ {
+		b.buf[i] = Request{}
+	}
+	b.head += n
+	if b.head > len(b.buf)/2 {
+		kept := copy(b.buf, b.buf[b.head:])
+		for i := kept; i < len(b.buf); i++ {
+			b.buf[i] = Request{}
+		}
+		b.buf, b.head = b.buf[:kept], 0
+	}
+	return evicted
+}
+
+// forget drops requests taken out of bin from the index and the usage
+// totals. s.mu must be held.
+func (s *memoryStore) forget(bin *memoryBin, removed ...Request) {
+	for _, req := range removed {
+		delete(s.binOf, req.ReqID)
+		size := requestSize(req)
+		bin.bytes -= size
+		s.bytes -= size
+	}
+}
+
+// find returns a request's bin and its index in the bin's requests, or a nil
+// bin if there's no such request. s.mu must be held.
+func (s *memoryStore) find(binID, reqID string) (*memoryBin, int) {
+	if bin, ok := s.bins[binID]; ok {
+		for i, req := range bin.requests() {
+			if req.ReqID == reqID {
+				return bin, i
+			}
+		}
+	}
+	return nil, 0
+}
+
+// remove deletes the request at i in bin's requests, returning it. s.mu
+// must be held.
+func (s *memoryStore) remove(bin *memoryBin, i int) Request {
+	live := bin.requests()
+	req := live[i]
+	bin.buf, bin.head = append(live[:i], live[i+1:]...), 0
+	live[len(live)-1] = Request{}
+	s.forget(bin, req)
+	return req
+}
+
+// evictOldest deletes the oldest request in any bin, for the quota,
+// reporting false when there are none. s.mu must be held.
+func (s *memoryStore) evictOldest() (Request, bool) {
+	var oldest *memoryBin
+	for _, bin := range s.bins {
+		if live := bin.requests(); len(live) > 0 && (oldest == nil || live[0].Inserted < oldest.requests()[0].Inserted) {
+			oldest = bin
+		}
+	}
+	if oldest == nil {
+		return Request{}, false
+	}
+	evicted := oldest.evict(1)
+	s.forget(oldest, evicted...)
+	return evicted[0], true
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{bins: map[string]*memoryBin{}, binOf: map[string]string{}}
+}
+
+func (s *memoryStore) CreateBin(ctx context.Context, bin BinRecord) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.bins[bin.BinID]; ok {
+		return false, nil
+	}
+	s.bins[bin.BinID] = &memoryBin{record: bin}
+	return true, nil
+}
+
+func (s *memoryStore) GetBin(ctx context.Context, binID string) (BinRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, ok := s.bins[binID]
+	if !ok {
+		return BinRecord{}, sql.ErrNoRows
+	}
+	return bin.record, nil
+}
+
+func (s *memoryStore) ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, ok := s.bins[binID]
+	if !ok {
+		return false, nil
+	}
+	bin.record.ExpiresAt = extendedExpiry(bin.record.ExpiresAt, time.Now().UnixMilli(), ms, latest)
+	return true, nil
+}
+
+func (s *memoryStore) SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, ok := s.bins[binID]
+	if !ok {
+		return false, nil
+	}
+	bin.record.Config = config
+	return true, nil
+}
+
+func (s *memoryStore) DeleteBin(ctx context.Context, binID string) error {
+	s.mu.Lock()
+	removed := s.removeBin(binID)
+	s.mu.Unlock()
+	orphanBlobs(ctx, blobKeys(removed)...)
+	return clearLocalBinData(ctx, binID)
+}
+
+// removeBin drops a bin, returning the requests that went with it. s.mu
+// must be held.
+func (s *memoryStore) removeBin(binID string) []Request {
+	bin, ok := s.bins[binID]
+	if !ok {
+		return nil
+	}
+	for _, req := range bin.requests() {
+		delete(s.binOf, req.ReqID)
+	}
+	s.bytes -= bin.bytes
+	delete(s.bins, binID)
+	return bin.requests()
+}
+
+func (s *memoryStore) PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error) {
+	s.mu.Lock()
+	now := time.Now().UnixMilli()
+	var ids, keys []string
+	for id, bin := range s.bins {
+		if limit > 0 && len(ids) == limit {
+			break
+		}
+		if bin.record.ExpiresAt != neverExpires && bin.record.ExpiresAt < now {
+			ids = append(ids, id)
+			removed := s.removeBin(id)
+			requests += int64(len(removed))
+			keys = append(keys, blobKeys(removed)...)
+		}
+	}
+	s.mu.Unlock()
+
+	if len(ids) == 0 {
+		return 0, 0, nil
+	}
+	orphanBlobs(ctx, keys...)
+	return int64(len(ids)), requests, clearLocalBinData(ctx, ids...)
+}
+
+func (s *memoryStore) ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error) {
+	s.mu.Lock()
+	bins := make([]BinRecord, 0, len(s.bins))
+	for _, bin := range s.bins {
+		bins = append(bins, bin.record)
+	}
+	s.mu.Unlock()
+	return sortBins(bins, limit, offset), nil
+}
+
+func (s *memoryStore) Usage(ctx context.Context, binID string) (StoreUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if binID != "" {
+		var u StoreUsage
+		if bin, ok := s.bins[binID]; ok {
+			u.Requests, u.Bytes = len(bin.requests()), bin.bytes
+		}
+		return u, nil
+	}
+	u := StoreUsage{Bins: len(s.bins), Requests: len(s.binOf), Bytes: s.bytes}
+	for _, bin := range s.bins {
+		if binExpired(bin.record.ExpiresAt) {
+			u.ExpiredBins++
+		}
+	}
+	return u, nil
+}
+
+func (s *memoryStore) UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	usage := map[string]StoreUsage{}
+	for _, binID := range binIDs {
+		if bin, ok := s.bins[binID]; ok {
+			usage[binID] = StoreUsage{Requests: len(bin.requests()), Bytes: bin.bytes}
+		}
+	}
+	return usage, nil
+}
+
+func (s *memoryStore) OldestActiveBin(ctx context.Context) (BinRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var active []BinRecord
+	for _, bin := range s.bins {
+		if !binExpired(bin.record.ExpiresAt) {
+			active = append(active, bin.record)
+		}
+	}
+	return firstBin(sortBins(active, 1, 0), nil)
+}
+
+// InsertRequest keeps the bin ordered by inserted, so imported requests
+// with older timestamps land where SQLite would list them
+func (s *memoryStore) InsertRequest(ctx context.Context, req Request, maxEntries int) error {
+	stored := storedRequest(req)
+	size := requestSize(stored)
+
+	s.mu.Lock()
+	bin, ok := s.bins[req.BinID]
+	if !ok {
+		s.mu.Unlock()
+		return sql.ErrNoRows
+	}
+	if _, taken := s.binOf[req.ReqID]; taken {
+		s.mu.Unlock()
+		return fmt.Errorf("request %s already exists", req.ReqID)
+	}
+	var evicted []Request
+	err := makeRoom(size, func() (int64, error) { return s.bytes, nil }, func() (bool, error) {
+		old, ok := s.evictOldest()
+		if ok {
+			evicted = append(evicted, old)
+		}
+		return ok, nil
+	})
+	if err == nil {
+		live := bin.requests()
+		i := bin.head + sort.Search(len(live), func(i int) bool { return live[i].Inserted > req.Inserted })
+		bin.buf = append(bin.buf, Request{})
+		copy(bin.buf[i+1:], bin.buf[i:])
+		bin.buf[i] = stored
+		s.binOf[req.ReqID] = req.BinID
+		bin.bytes += size
+		s.bytes += size
+		if n := len(bin.requests()); maxEntries > 0 && n > maxEntries {
+			old := bin.evict(n - maxEntries)
+			s.forget(bin, old...)
+			evicted = append(evicted, old...)
+		}
+	}
+	s.mu.Unlock()
+
+	orphanBlobs(ctx, blobKeys(evicted)...)
+	return err
+}
+
+// storedRequest is req as reading it back from SQLite would give it
+func storedRequest(req Request) Request {
+	req.BodyOffloaded = req.blobKey != ""
+	if req.BodyOffloaded {
+		req.Body = nil
+	} else if _, ok := req.Body.(json.RawMessage); !ok {
+		req.Body = req.RawBody
+	}
+	req.JWTHeader, req.JWTClaims = decodeJWT(req.Headers.Get("Authorization"))
+	req.parts = nil
+	return req
+}
+
+func (s *memoryStore) GetRequest(ctx context.Context, binID, reqID string) (Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, i := s.find(binID, reqID)
+	if bin == nil {
+		return Request{}, sql.ErrNoRows
+	}
+	return bin.requests()[i], nil
+}
+
+func (s *memoryStore) CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	if bin, ok := s.bins[binID]; ok {
+		for _, req := range bin.requests() {
+			if filter.matches(req) {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+func (s *memoryStore) CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var buckets []TimeseriesBucket
+	if bin, ok := s.bins[binID]; ok {
+		for _, req := range bin.requests() {
+			if filter.matches(req) {
+				buckets = countInBucket(buckets, req.Inserted, bucketMs)
+			}
+		}
+	}
+	return buckets, nil
+}
+
+func (s *memoryStore) ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := []Request{}
+	bin, ok := s.bins[binID]
+	if !ok {
+		return reqs, nil
+	}
+	for _, req := range bin.requests() {
+		if len(reqs) == limit {
+			break
+		}
+		if !filter.matches(req) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, nil
+}
+
+func (s *memoryStore) RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	page := newCursorPage(after, filter, limit)
+	if bin, ok := s.bins[binID]; ok {
+		live := bin.requests()
+		i := sort.Search(len(live), func(i int) bool { return live[i].Inserted >= after.Inserted })
+		for _, req := range live[i:] {
+			if !page.add(req) {
+				break
+			}
+		}
+	}
+	return page.done(), nil
+}
+
+func (s *memoryStore) SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := []Request{}
+	if bin, ok := s.bins[binID]; ok {
+		for _, req := range bin.requests() {
+			if len(reqs) == limit {
+				break
+			}
+			if searchMatches(req, q) {
+				reqs = append(reqs, req)
+			}
+		}
+	}
+	return reqs, nil
+}
+
+func (s *memoryStore) EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, i := s.find(binID, reqID)
+	if bin == nil {
+		return nil, sql.ErrNoRows
+	}
+	return bin.requests()[i].encodedBody, nil
+}
+
+func (s *memoryStore) SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bin, i := s.find(binID, reqID)
+	if bin == nil {
+		return false, nil
+	}
+	bin.requests()[i].Response = &resp
+	return true, nil
+}
+
+func (s *memoryStore) TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error) {
+	reqs := s.takeRequests(binID, newest, count)
+	orphanBlobs(ctx, blobKeys(reqs)...)
+	return reqs, nil
+}
+
+func (s *memoryStore) takeRequests(binID string, newest bool, count int) []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reqs := []Request{}
+	bin, ok := s.bins[binID]
+	if !ok {
+		return reqs
+	}
+	now := time.Now().UnixMilli()
+	live := bin.requests()
+	taken := map[string]bool{}
+	for i := range live {
+		if len(reqs) == count {
+			break
+		}
+		if newest {
+			i = len(live) - 1 - i
+		}
+		if req := live[i]; req.LeasedUntil <= now {
+			reqs = append(reqs, req)
+			taken[req.ReqID] = true
+		}
+	}
+	kept := live[:0]
+	for _, req := range live {
+		if taken[req.ReqID] {
+			s.forget(bin, req)
+		} else {
+			kept = append(kept, req)
+		}
+	}
+	for i := len(kept); i < len(live); i++ {
+		live[i] = Request{}
+	}
+	bin.buf, bin.head = kept, 0
+	return reqs
+}
+
+func (s *memoryStore) LeaseRequest(ctx context.Context, binID string, until int64) (Request, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if bin, ok := s.bins[binID]; ok {
+		now := time.Now().UnixMilli()
+		live := bin.requests()
+		for i := range live {
+			if live[i].LeasedUntil <= now {
+				live[i].LeasedUntil = until
+				return live[i], nil
+			}
+		}
+	}
+	return Request{}, sql.ErrNoRows
+}
+
+func (s *memoryStore) SettleLease(ctx context.Context, binID, reqID string, release bool) error {
+	s.mu.Lock()
+	bin, i := s.find(binID, reqID)
+	if bin == nil {
+		s.mu.Unlock()
+		return sql.ErrNoRows
+	}
+	live := bin.requests()
+	if live[i].LeasedUntil < time.Now().UnixMilli() {
+		s.mu.Unlock()
+		return errLeaseLapsed
+	}
+	if release {
+		live[i].LeasedUntil = 0
+		s.mu.Unlock()
+		return nil
+	}
+	acked := s.remove(bin, i)
+	s.mu.Unlock()
+	orphanBlobs(ctx, acked.blobKey)
+	return nil
+}
+
+func (s *memoryStore) RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	if err != nil {
+		return bodyPart{}, err
+	}
+	return requestPart(req, name)
+}
+
+func (s *memoryStore) DeleteRequest(ctx context.Context, binID, reqID string) (bool, error) {
+	s.mu.Lock()
+	bin, i := s.find(binID, reqID)
+	if bin == nil {
+		s.mu.Unlock()
+		return false, nil
+	}
+	deleted := s.remove(bin, i)
+	s.mu.Unlock()
+	orphanBlobs(ctx, deleted.blobKey)
+	return true, nil
+}
@@ -0,0 +1,344 @@
+//go:build cgo
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryStore(t *testing.T) {
+	clearDB(t)
+	testStoreContract(t, newMemoryStore())
+}
+
+func TestMemoryStoreEviction(t *testing.T) {
+	mem := newMemoryStore()
+	now := time.Now().UnixMilli()
+	mem.CreateBin(context.Background(), BinRecord{BinID: "capped", CreatedAt: now, ExpiresAt: now + 60000})
+	for i := 0; i < 100; i++ {
+		req := Request{BinID: "capped", ReqID: fmt.Sprintf("r%03d", i), Inserted: now + int64(i)}
+		if err := mem.InsertRequest(context.Background(), req, 10); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	reqs, _ := mem.ListRequests(context.Background(), "capped", requestFilter{}, 100, 0)
+	if len(reqs) != 10 || reqs[0].ReqID != "r090" || reqs[9].ReqID != "r099" {
+		t.Errorf("Expected the newest 10 requests, got %q", ids(reqs))
+	}
+	if len(mem.binOf) != 10 {
+		t.Errorf("Expected evicted requests forgotten, %d are still indexed", len(mem.binOf))
+	}
+	if bin := mem.bins["capped"]; len(bin.buf) > 20 {
+		t.Errorf("Expected evicted slots to be reclaimed, the buffer holds %d", len(bin.buf))
+	}
+	if _, err := mem.GetRequest(context.Background(), "capped", "r089"); err != sql.ErrNoRows {
+		t.Errorf("Expected r089 evicted, got %v", err)
+	}
+}
+
+// TestMemoryStoreHandlers runs the features that used to read the local
+// SQLite database's requests table directly against the memory store, where
+// that table stays empty
+func TestMemoryStoreHandlers(t *testing.T) {
+	clearDB(t)
+	saved := store
+	store = newMemoryStore()
+	cachedBins.clear()
+	// Other backends open the local database without foreign keys, as its
+	// bins table is never filled
+	testDB.Exec("PRAGMA foreign_keys = OFF")
+	defer func() {
+		store = saved
+		cachedBins.clear()
+		testDB.Exec("PRAGMA foreign_keys = ON")
+		maxStorageBytes, storagePolicy = 0, "reject"
+	}()
+
+	api := func(method, path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		binAPIHandler(w, httptest.NewRequest(method, path, nil))
+		return w
+	}
+	bin := createTestBin(t)
+	base := "/api/bin/" + bin.BinID
+	var reqIDs []string
+	for _, body := range []string{`{"n":1}`, `{"n":2}`, `{"n":3,"needle":true}`} {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/in", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, req)
+		reqIDs = append(reqIDs, w.Body.String())
+	}
+	var local int
+	if testDB.QueryRow("SELECT COUNT(*) FROM requests").Scan(&local); local != 0 {
+		t.Fatalf("Expected nothing in the local requests table, found %d", local)
+	}
+
+	var leased Request
+	json.NewDecoder(api(http.MethodGet, base+"/req/lease").Body).Decode(&leased)
+	if leased.ReqID != reqIDs[0] {
+		t.Errorf("Expected the oldest request leased, got %q", leased.ReqID)
+	}
+	if w := api(http.MethodPost, base+"/req/"+leased.ReqID+"/nack"); w.Code != http.StatusOK {
+		t.Errorf("Expected the nack to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	json.NewDecoder(api(http.MethodGet, base+"/req/lease").Body).Decode(&leased)
+	if w := api(http.MethodPost, base+"/req/"+leased.ReqID+"/ack"); w.Code != http.StatusOK {
+		t.Errorf("Expected the ack to succeed, got %d %s", w.Code, w.Body.String())
+	}
+	if w := api(http.MethodPost, base+"/req/"+leased.ReqID+"/ack"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected an acked request to be gone, got %d", w.Code)
+	}
+	if w := api(http.MethodPost, base+"/req/"+reqIDs[1]+"/ack"); w.Code != http.StatusConflict {
+		t.Errorf("Expected acking an unleased request refused, got %d", w.Code)
+	}
+
+	var shifted []Request
+	json.NewDecoder(api(http.MethodGet, base+"/req/shift?group=g&count=10").Body).Decode(&shifted)
+	if ids(shifted) != reqIDs[1]+reqIDs[2] {
+		t.Errorf("Expected the group to read what's left, got %q", ids(shifted))
+	}
+	if w := api(http.MethodGet, base+"/req/lease?group=g"); w.Code != http.StatusNotFound {
+		t.Errorf("Expected the group's cursor at the end, got %d", w.Code)
+	}
+	json.NewDecoder(api(http.MethodGet, base+"/req/lease?group=h").Body).Decode(&leased)
+	if leased.ReqID != reqIDs[1] {
+		t.Errorf("Expected a new group to lease from the start, got %q", leased.ReqID)
+	}
+	if w := api(http.MethodPost, base+"/req/"+leased.ReqID+"/ack?group=h"); w.Code != http.StatusOK {
+		t.Errorf("Expected the group ack to succeed, got %d", w.Code)
+	}
+
+	var found []Request
+	json.NewDecoder(api(http.MethodGet, base+"/search?q=needle").Body).Decode(&found)
+	if ids(found) != reqIDs[2] {
+		t.Errorf("Expected the search to find the third request, got %q", ids(found))
+	}
+	var har struct {
+		Log struct{ Entries []interface{} }
+	}
+	json.NewDecoder(api(http.MethodGet, base+"/export?format=har").Body).Decode(&har)
+	if len(har.Log.Entries) != 2 {
+		t.Errorf("Expected 2 exported requests, got %d", len(har.Log.Entries))
+	}
+	var series TimeseriesResponse
+	json.NewDecoder(api(http.MethodGet, base+"/timeseries").Body).Decode(&series)
+	if len(series.Buckets) != 1 || series.Buckets[0].Count != 2 {
+		t.Errorf("Expected both requests counted, got %+v", series.Buckets)
+	}
+	var schema map[string]interface{}
+	json.NewDecoder(api(http.MethodGet, base+"/schema").Body).Decode(&schema)
+	if schema["description"] != "Inferred from 2 captured bodies" {
+		t.Errorf("Expected a schema from both bodies, got %v", schema["description"])
+	}
+
+	adminToken = "s3cret"
+	defer func() { adminToken = "" }()
+	var bins AdminBinsResponse
+	json.NewDecoder(adminRequest(http.MethodGet, "/api/admin/bins").Body).Decode(&bins)
+	if bins.Total != 1 || len(bins.Bins) != 1 || bins.Bins[0].Entries != 2 || bins.Bins[0].Bytes != bins.TotalBytes || bins.TotalBytes == 0 {
+		t.Errorf("Unexpected bins %+v", bins)
+	}
+	var stats AdminStats
+	json.NewDecoder(adminRequest(http.MethodGet, "/api/admin/stats").Body).Decode(&stats)
+	if stats.Bins != 1 || stats.Requests != 2 || stats.OldestActiveBin == nil || stats.OldestActiveBin.Entries != 2 || stats.DBBytes != nil {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+
+	// Room for one more of the same size, then eviction of the oldest
+	maxStorageBytes = bins.TotalBytes + bins.TotalBytes/2
+	capture := func(body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/in", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, req)
+		return w.Code
+	}
+	if code := capture(`{"n":4}`); code != http.StatusOK {
+		t.Fatalf("Expected the capture to fit, got %d", code)
+	}
+	if code := capture(`{"n":5}`); code != http.StatusInsufficientStorage {
+		t.Errorf("Expected status code %d once full, got %d", http.StatusInsufficientStorage, code)
+	}
+	storagePolicy = "evict"
+	if code := capture(`{"n":5}`); code != http.StatusOK {
+		t.Fatalf("Expected eviction to make room, got %d", code)
+	}
+	if _, err := store.GetRequest(context.Background(), bin.BinID, reqIDs[1]); err != sql.ErrNoRows {
+		t.Errorf("Expected the oldest request evicted, got %v", err)
+	}
+	if u, _ := store.Usage(context.Background(), ""); u.Bytes > maxStorageBytes {
+		t.Errorf("Expected usage within %d bytes, got %d", maxStorageBytes, u.Bytes)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	maxStorageBytes = 0
+	setTestConfig(t, bin.BinID, `{"proxy": {"url": "`+upstream.URL+`"}}`)
+	capture("proxied")
+	reqs, _ := store.ListRequests(context.Background(), bin.BinID, requestFilter{}, 10, 0)
+	if last := reqs[len(reqs)-1]; last.Response == nil || last.Response.Status != http.StatusCreated {
+		t.Errorf("Expected the upstream response recorded, got %+v", last.Response)
+	}
+}
+
+// TestSharedStoreLocalFeatures checks that, on a backend other servers
+// share, features with local tables are refused instead of being kept by one
+// server, while multipart parts still come from the store
+func TestSharedStoreLocalFeatures(t *testing.T) {
+	clearDB(t)
+	saved := store
+	store = newMemoryStore()
+	noLocalTables = errors.New("shared")
+	cachedBins.clear()
+	adminToken = "s3cret"
+	defer func() {
+		store, noLocalTables, adminToken = saved, nil, ""
+		cachedBins.clear()
+	}()
+
+	api := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		binAPIHandler(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+	bin := createTestBin(t)
+	base := "/api/bin/" + bin.BinID
+
+	for _, path := range []string{"/req/shift?group=g", "/req/lease?group=g", "/jobs", "/deliveries", "/asset"} {
+		if w := api(http.MethodGet, base+path, ""); w.Code != http.StatusNotImplemented {
+			t.Errorf("Expected %s to be refused with %d, got %d", path, http.StatusNotImplemented, w.Code)
+		}
+	}
+	for _, cfg := range []string{`{"forward":{"url":"http://example.com"}}`, `{"response":{"sequence":[{"status":201}]}}`,
+		`{"notify":{"digest":"hourly"}}`} {
+		if w := api(http.MethodPut, base+"/config", cfg); w.Code != http.StatusBadRequest ||
+			!strings.Contains(w.Body.String(), "available") {
+			t.Errorf("Expected config %s to be refused, got %d: %s", cfg, w.Code, w.Body.String())
+		}
+	}
+	w := httptest.NewRecorder()
+	maintenance := httptest.NewRequest(http.MethodPost, "/api/admin/maintenance", nil)
+	maintenance.Header.Set("Authorization", "Bearer s3cret")
+	adminAPIHandler(w, maintenance)
+	if w.Code != http.StatusNotImplemented {
+		t.Errorf("Expected maintenance of the local database to be refused, got %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	backup := httptest.NewRequest(http.MethodGet, "/api/admin/backup", nil)
+	backup.Header.Set("Authorization", "Bearer s3cret")
+	adminAPIHandler(w, backup)
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), "sqlite") {
+		t.Errorf("Expected a backup of the local database to be refused, got %d %s", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	restore := httptest.NewRequest(http.MethodPost, "/api/admin/restore", strings.NewReader("snapshot"))
+	restore.Header.Set("Authorization", "Bearer s3cret")
+	adminAPIHandler(w, restore)
+	if w.Code != http.StatusNotImplemented || !strings.Contains(w.Body.String(), "sqlite") {
+		t.Errorf("Expected a restore into the local database to be refused, got %d %s", w.Code, w.Body.String())
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	fw, _ := mw.CreateFormFile("upload", "report.csv")
+	fw.Write([]byte("a,b\n"))
+	mw.Close()
+	capture := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, &buf)
+	capture.Header.Set("Content-Type", mw.FormDataContentType())
+	w = httptest.NewRecorder()
+	captureRequestHandler(w, capture)
+	if w = api(http.MethodGet, base+"/req/"+w.Body.String()+"/part/upload", ""); w.Body.String() != "a,b\n" {
+		t.Errorf("Expected the part parsed from the stored body, got %d: %q", w.Code, w.Body.String())
+	}
+}
+
+// BenchmarkMemoryStoreAtCap captures into bins already at their maxEntries,
+// which should cost about the same per capture whatever the cap
+func BenchmarkMemoryStoreAtCap(b *testing.B) {
+	for _, limit := range []int{100, 10000} {
+		b.Run(fmt.Sprint(limit), func(b *testing.B) {
+			mem := newMemoryStore()
+			now := time.Now().UnixMilli()
+			mem.CreateBin(context.Background(), BinRecord{BinID: "bench", CreatedAt: now, ExpiresAt: now + 3600000})
+			for i := 0; i < limit; i++ {
+				mem.InsertRequest(context.Background(), Request{BinID: "bench", ReqID: fmt.Sprint("fill", i), Inserted: now}, limit)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := Request{BinID: "bench", ReqID: fmt.Sprint("r", i), Inserted: now}
+				if err := mem.InsertRequest(context.Background(), req, limit); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterMatchesWhere(t *testing.T) {
+	clearDB(t)
+	mem := newMemoryStore()
+	now := time.Now().UnixMilli()
+	valid := true
+	reqs := []Request{
+		{ReqID: "a", Method: "POST", Path: "/filters/hooks/github", SubPath: "/hooks/github", Headers: http.Header{"X-Event": {"push"}},
+			Body: json.RawMessage(`{"action":"opened","n":1.50,"ok":true,"none":null,"items":[{"id":7}]}`), Valid: &valid},
+		{ReqID: "b", Method: "GET", Path: "/filters/health", SubPath: "/health", RawBody: `{"action":"closed"}`,
+			UserAgent: &UserAgent{Kind: "bot"}},
+		{ReqID: "c", Method: "POST", Path: "/filters/hooks/stripe", SubPath: "/hooks/stripe", Headers: http.Header{"X-Event": {"charge", "push"}},
+			Body: json.RawMessage(`[1,2]`)},
+	}
+	for i, req := range reqs {
+		req.BinID, req.Inserted = "filters", now+int64(i)
+		if req.UserAgent == nil {
+			req.UserAgent = &UserAgent{Kind: "library"}
+		}
+		for _, s := range []Store{store, mem} {
+			s.CreateBin(context.Background(), BinRecord{BinID: "filters", CreatedAt: now, ExpiresAt: now + 60000})
+			if err := s.InsertRequest(context.Background(), req, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	for _, q := range []string{
+		"", "method=post", "agent=bot", "valid=true", "pathPrefix=/hooks/", "header=X-Event:push",
+		"jsonpath=$.action", "jsonpath=$.action&equals=closed", "jsonpath=$.n&equals=1.50",
+		"jsonpath=$.ok&equals=true", "jsonpath=$.none&equals=null", "jsonpath=$.items[0].id&equals=7",
+		"jsonpath=$[1]&equals=2", "jsonpath=$.missing",
+	} {
+		values, _ := url.ParseQuery(q)
+		f, err := parseRequestFilter(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := store.ListRequests(context.Background(), "filters", f, 10, 0)
+		got, _ := mem.ListRequests(context.Background(), "filters", f, 10, 0)
+		if ids(got) != ids(want) {
+			t.Errorf("%s: expected %q like SQLite, got %q", q, ids(want), ids(got))
+		}
+	}
+}
+
+func ids(reqs []Request) string {
+	s := ""
+	for _, req := range reqs {
+		s += req.ReqID
+	}
+	return s
+}
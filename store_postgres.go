@@ -0,0 +1,663 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// postgresSchema is the baseline migration's tables: bins and requests with
+// the same columns as SQLite, plus seq to break ties between requests
+// inserted in the same millisecond
+const postgresSchema = `
+        CREATE TABLE IF NOT EXISTS bins (
+            bin_id TEXT PRIMARY KEY,
+            created_at BIGINT NOT NULL,
+            expires_at BIGINT NOT NULL,
+            max_entries INTEGER NOT NULL DEFAULT 0,
+            config TEXT NOT NULL DEFAULT ''
+        );
+        CREATE TABLE IF NOT EXISTS requests (
+            seq BIGSERIAL,
+            req_id TEXT PRIMARY KEY,
+            bin_id TEXT NOT NULL REFERENCES bins(bin_id) ON DELETE CASCADE,
+            method TEXT NOT NULL,
+            path TEXT NOT NULL,
+            headers TEXT NOT NULL,
+            query TEXT NOT NULL,
+            body TEXT NOT NULL,
+            ip TEXT NOT NULL,
+            inserted BIGINT NOT NULL,
+            leased_until BIGINT NOT NULL DEFAULT 0,
+            truncated BOOLEAN NOT NULL DEFAULT false,
+            blob_key TEXT NOT NULL DEFAULT '',
+            blob_size BIGINT NOT NULL DEFAULT 0,
+            sub_path TEXT NOT NULL DEFAULT '',
+            host TEXT NOT NULL DEFAULT '',
+            proto TEXT NOT NULL DEFAULT '',
+            content_length BIGINT NOT NULL DEFAULT -1,
+            tls TEXT NOT NULL DEFAULT '',
+            hops TEXT NOT NULL DEFAULT '',
+            received_at BIGINT NOT NULL DEFAULT 0,
+            read_duration_ns BIGINT NOT NULL DEFAULT 0,
+            raw_head BYTEA NOT NULL DEFAULT '',
+            parsed_body TEXT NOT NULL DEFAULT '',
+            decoded_from TEXT NOT NULL DEFAULT '',
+            encoded_body BYTEA NOT NULL DEFAULT '',
+            user_agent TEXT NOT NULL DEFAULT '',
+            signature_valid BOOLEAN,
+            valid BOOLEAN,
+            validation_errors TEXT NOT NULL DEFAULT '',
+            upstream_response TEXT NOT NULL DEFAULT ''
+        );
+        CREATE INDEX IF NOT EXISTS requests_bin_inserted ON requests(bin_id, inserted, seq);
+        CREATE INDEX IF NOT EXISTS bins_expires_at ON bins(expires_at);
+    `
+
+// postgresUsageSchema is the storage_usage table as in SQLite, shared by
+// every instance so the quota covers them all, and the trigger keeping it
+// current. It's spelled out rather than built from storedColumns, since a
+// released migration never changes.
+const postgresUsageSchema = `
+        CREATE TABLE IF NOT EXISTS storage_usage (
+            id INTEGER PRIMARY KEY CHECK (id = 1),
+            bytes BIGINT NOT NULL
+        );
+        INSERT INTO storage_usage (id, bytes)
+        SELECT 1, COALESCE(SUM(octet_length(headers) + octet_length(query) + octet_length(body)
+            + octet_length(parsed_body) + octet_length(encoded_body) + blob_size), 0) FROM requests
+        ON CONFLICT (id) DO NOTHING;
+        CREATE OR REPLACE FUNCTION requests_usage() RETURNS trigger AS $$
+        BEGIN
+            IF TG_OP IN ('UPDATE', 'DELETE') THEN
+                UPDATE storage_usage SET bytes = bytes - (octet_length(OLD.headers) + octet_length(OLD.query)
+                    + octet_length(OLD.body) + octet_length(OLD.parsed_body) + octet_length(OLD.encoded_body)
+                    + OLD.blob_size) WHERE id = 1;
+            END IF;
+            IF TG_OP IN ('UPDATE', 'INSERT') THEN
+                UPDATE storage_usage SET bytes = bytes + (octet_length(NEW.headers) + octet_length(NEW.query)
+                    + octet_length(NEW.body) + octet_length(NEW.parsed_body) + octet_length(NEW.encoded_body)
+                    + NEW.blob_size) WHERE id = 1;
+            END IF;
+            RETURN NULL;
+        END $$ LANGUAGE plpgsql;
+        CREATE TRIGGER requests_usage AFTER INSERT OR DELETE
+            OR UPDATE OF headers, query, body, parsed_body, encoded_body, blob_size
+            ON requests FOR EACH ROW EXECUTE FUNCTION requests_usage();
+        CREATE INDEX IF NOT EXISTS requests_inserted ON requests(inserted, seq);
+    `
+
+// pgRequestBytes is requestBytes in Postgres, where length counts characters
+var pgRequestBytes = strings.ReplaceAll(requestBytes, "length(", "octet_length(")
+
+// postgresStore is the Store on a PostgreSQL database, for running several
+// instances against one. Multipart parts are parsed again from the stored
+// body.
+type postgresStore struct {
+	db *sql.DB
+}
+
+func openPostgresStore(dsn string) (*postgresStore, error) {
+	conn, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := postgresMigrations.run(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &postgresStore{db: conn}, nil
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+// rebind numbers a query's ? placeholders as Postgres's $1, $2, ...
+func rebind(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, r := range query {
+		if r == '?' {
+			n++
+			fmt.Fprintf(&b, "$%d", n)
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// pgText makes a string one Postgres will store as text, which can't hold
+// NUL or invalid UTF-8
+func pgText(s string) string {
+	return strings.ToValidUTF8(strings.ReplaceAll(s, "\x00", "\uFFFD"), "\uFFFD")
+}
+
+func (s *postgresStore) CreateBin(ctx context.Context, bin BinRecord) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, rebind(`
+        INSERT INTO bins (bin_id, created_at, expires_at, max_entries, config)
+        VALUES (?, ?, ?, ?, ?) ON CONFLICT (bin_id) DO NOTHING`),
+		bin.BinID, bin.CreatedAt, bin.ExpiresAt, bin.MaxEntries, bin.Config.encode())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n == 1, nil
+}
+
+func (s *postgresStore) GetBin(ctx context.Context, binID string) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var bin BinRecord
+	var raw string
+	err := s.db.QueryRowContext(ctx, rebind("SELECT bin_id, created_at, expires_at, max_entries, config FROM bins WHERE bin_id = ?"), binID).
+		Scan(&bin.BinID, &bin.CreatedAt, &bin.ExpiresAt, &bin.MaxEntries, &raw)
+	bin.Config = loadBinConfig(raw)
+	return bin, err
+}
+
+func (s *postgresStore) ExtendBin(ctx context.Context, binID string, ms, latest int64) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	// Anything past latest is capped anyway, and BIGINT overflow is an error
+	now := time.Now().UnixMilli()
+	if ms > latest-now {
+		ms = latest - now
+	}
+	res, err := s.db.ExecContext(ctx, rebind(`
+        UPDATE bins SET expires_at = CASE WHEN expires_at = ? THEN expires_at
+            ELSE GREATEST(expires_at, LEAST(GREATEST(expires_at, ?) + ?, ?)) END
+        WHERE bin_id = ?`),
+		neverExpires, now, ms, latest, binID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *postgresStore) SetBinConfig(ctx context.Context, binID string, config BinConfig) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	res, err := s.db.ExecContext(ctx, rebind("UPDATE bins SET config = ? WHERE bin_id = ?"), config.encode(), binID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// deleteRequests runs a DELETE ... RETURNING blob_key on requests, returning
+// how many went and their blobs
+func deleteRequests(ctx context.Context, q interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}, query string, args ...interface{}) (int64, []string, error) {
+	rows, err := q.QueryContext(ctx, rebind(query+" RETURNING blob_key"), args...)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer rows.Close()
+
+	var n int64
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return 0, nil, err
+		}
+		n++
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	return n, keys, rows.Err()
+}
+
+func (s *postgresStore) DeleteBin(ctx context.Context, binID string) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	_, keys, err := deleteRequests(ctx, s.db, "DELETE FROM requests WHERE bin_id = ?", binID)
+	if err != nil {
+		return err
+	}
+	if _, err := s.db.ExecContext(ctx, rebind("DELETE FROM bins WHERE bin_id = ?"), binID); err != nil {
+		return err
+	}
+	orphanBlobs(ctx, keys...)
+	return clearLocalBinData(ctx, binID)
+}
+
+func (s *postgresStore) PurgeExpiredBins(ctx context.Context, limit int) (bins, requests int64, err error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	// A NULL LIMIT is no limit. Bins another instance is purging are left to it.
+	var max sql.NullInt64
+	if limit > 0 {
+		max = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	rows, err := tx.QueryContext(ctx, rebind(`
+        SELECT bin_id FROM bins WHERE expires_at != ? AND expires_at < ?
+        LIMIT ? FOR UPDATE SKIP LOCKED`), neverExpires, time.Now().UnixMilli(), max)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil || len(ids) == 0 {
+		return 0, 0, err
+	}
+
+	requests, keys, err := deleteRequests(ctx, tx, "DELETE FROM requests WHERE bin_id = ANY(?)", ids)
+	if err != nil {
+		return 0, 0, err
+	}
+	res, err := tx.ExecContext(ctx, rebind("DELETE FROM bins WHERE bin_id = ANY(?)"), ids)
+	if err != nil {
+		return 0, 0, err
+	}
+	bins, _ = res.RowsAffected()
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	orphanBlobs(ctx, keys...)
+	return bins, requests, clearLocalBinData(ctx, ids...)
+}
+
+func (s *postgresStore) InsertRequest(ctx context.Context, req Request, maxEntries int) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	headersJSON, _ := json.Marshal(req.Headers)
+	queryJSON, _ := json.Marshal(req.Query)
+	bodyJSON, _ := json.Marshal(req.RawBody)
+	parsed, _ := req.Body.(json.RawMessage)
+	encodedBody := req.encodedBody
+	if encodedBody == nil {
+		encodedBody = []byte{}
+	}
+	var tlsJSON, hopsJSON, uaJSON, validationJSON []byte
+	if req.TLS != nil {
+		tlsJSON, _ = json.Marshal(req.TLS)
+	}
+	if req.Hops != nil {
+		hopsJSON, _ = json.Marshal(req.Hops)
+	}
+	if req.UserAgent != nil {
+		uaJSON, _ = json.Marshal(req.UserAgent)
+	}
+	if req.ValidationErrors != nil {
+		validationJSON, _ = json.Marshal(req.ValidationErrors)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	evicted, err := pgMakeRoom(ctx, tx, requestSize(req))
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, rebind(`
+        INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted, truncated,
+            blob_key, blob_size, sub_path, host, proto, content_length, tls, hops,
+            received_at, read_duration_ns, raw_head, parsed_body, decoded_from, encoded_body,
+            user_agent, signature_valid, valid, validation_errors, encrypted)
+        VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		req.ReqID, req.BinID, pgText(req.Method), pgText(req.Path), string(headersJSON), string(queryJSON),
+		string(bodyJSON), pgText(req.IP), req.Inserted, req.Truncated, req.blobKey, req.BodySize, pgText(req.SubPath),
+		pgText(req.Host), pgText(req.Proto), req.ContentLength, string(tlsJSON), string(hopsJSON),
+		req.ReceivedAt, int64(req.ReadDurationMs*float64(time.Millisecond)), []byte(req.rawHead),
+		string(parsed), req.DecodedFrom, encodedBody, string(uaJSON),
+		req.SignatureValid, req.Valid, string(validationJSON), req.Encrypted)
+	if err != nil {
+		return err
+	}
+
+	if maxEntries > 0 {
+		_, keys, err := deleteRequests(ctx, tx, `
+            DELETE FROM requests WHERE bin_id = ? AND seq NOT IN (
+                SELECT seq FROM requests WHERE bin_id = ? ORDER BY inserted DESC, seq DESC LIMIT ?)`,
+			req.BinID, req.BinID, maxEntries)
+		if err != nil {
+			return err
+		}
+		evicted = append(evicted, keys...)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	orphanBlobs(ctx, evicted...)
+	return nil
+}
+
+// pgMakeRoom is enforceQuota on Postgres, returning the blobs of what it
+// evicted. The usage row stays locked until tx ends, so instances make room
+// one at a time.
+func pgMakeRoom(ctx context.Context, tx *sql.Tx, size int64) ([]string, error) {
+	var evicted []string
+	err := makeRoom(size, func() (int64, error) {
+		var used int64
+		err := tx.QueryRowContext(ctx, "SELECT bytes FROM storage_usage WHERE id = 1 FOR UPDATE").Scan(&used)
+		return used, err
+	}, func() (bool, error) {
+		n, keys, err := deleteRequests(ctx, tx, `
+            DELETE FROM requests WHERE req_id IN (
+                SELECT req_id FROM requests ORDER BY inserted ASC, seq ASC LIMIT 100 FOR UPDATE SKIP LOCKED)`)
+		evicted = append(evicted, keys...)
+		return n > 0, err
+	})
+	return evicted, err
+}
+
+func (s *postgresStore) GetRequest(ctx context.Context, binID, reqID string) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return scanRequest(s.db.QueryRowContext(ctx, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND req_id = ?`), binID, reqID))
+}
+
+func (s *postgresStore) CountRequests(ctx context.Context, binID string, filter requestFilter) (int, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.pgWhere()
+	var n int
+	err := s.db.QueryRowContext(ctx, rebind("SELECT COUNT(*) FROM requests WHERE bin_id = ?"+where),
+		append([]interface{}{binID}, args...)...).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStore) CountBuckets(ctx context.Context, binID string, filter requestFilter, bucketMs int64) ([]TimeseriesBucket, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.pgWhere()
+	return scanBuckets(s.db.QueryContext(ctx, rebind(`
+        SELECT (inserted / ?) * ? AS start, COUNT(*)
+        FROM requests WHERE bin_id = ?`+where+`
+        GROUP BY start ORDER BY start`), append([]interface{}{bucketMs, bucketMs, binID}, args...)...))
+}
+
+func (s *postgresStore) ListRequests(ctx context.Context, binID string, filter requestFilter, limit, offset int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.pgWhere()
+	args = append([]interface{}{binID}, args...)
+	return queryRequests(ctx, s.db, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ?`+where+` ORDER BY inserted ASC, seq ASC LIMIT ? OFFSET ?`),
+		append(args, limit, offset)...)
+}
+
+// TakeRequests skips rows another instance has locked, so concurrent
+// consumers on different instances don't wait on each other
+func (s *postgresStore) TakeRequests(ctx context.Context, binID string, newest bool, count int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	order := "ASC"
+	if newest {
+		order = "DESC"
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	reqs, err := queryRequests(ctx, tx, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND leased_until <= ?
+        ORDER BY inserted `+order+`, seq `+order+` LIMIT ? FOR UPDATE SKIP LOCKED`),
+		binID, time.Now().UnixMilli(), count)
+	if err != nil || len(reqs) == 0 {
+		return reqs, err
+	}
+	ids := make([]string, len(reqs))
+	for i, req := range reqs {
+		ids[i] = req.ReqID
+	}
+	if _, err := tx.ExecContext(ctx, rebind("DELETE FROM requests WHERE req_id = ANY(?)"), ids); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	orphanBlobs(ctx, blobKeys(reqs)...)
+	return reqs, nil
+}
+
+func (s *postgresStore) RequestPart(ctx context.Context, binID, reqID, name string) (bodyPart, error) {
+	req, err := s.GetRequest(ctx, binID, reqID)
+	if err != nil {
+		return bodyPart{}, err
+	}
+	return requestPart(req, name)
+}
+
+func (s *postgresStore) DeleteRequest(ctx context.Context, binID, reqID string) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	n, keys, err := deleteRequests(ctx, s.db, "DELETE FROM requests WHERE bin_id = ? AND req_id = ?", binID, reqID)
+	if err != nil {
+		return false, err
+	}
+	orphanBlobs(ctx, keys...)
+	return n > 0, nil
+}
+
+// pgBodyDocument is the captured body as jsonb, or NULL when it has none
+const pgBodyDocument = "NULLIF(parsed_body, '')::jsonb"
+
+// pgWhere is where in Postgres. JSONPath is evaluated strictly, so it
+// matches what SQLite's json_extract finds, and errors silently match nothing.
+func (f requestFilter) pgWhere() (string, []interface{}) {
+	var c sqlConds
+	if f.method != "" {
+		c.add("method = ?", f.method)
+	}
+	if f.agent != "" {
+		c.add("NULLIF(user_agent, '')::jsonb ->> 'kind' = ?", f.agent)
+	}
+	if f.valid != nil {
+		c.add("valid = ?", *f.valid)
+	}
+	if f.pathPrefix != "" {
+		c.add("starts_with(sub_path, ?)", f.pathPrefix)
+	}
+	if f.since != nil {
+		c.add("inserted >= ?", *f.since)
+	}
+	if f.until != nil {
+		c.add("inserted <= ?", *f.until)
+	}
+	for _, h := range f.headers {
+		c.add("EXISTS (SELECT 1 FROM jsonb_array_elements_text(headers::jsonb -> ?::text) AS v WHERE v = ?)", h[0], h[1])
+	}
+	if f.jsonPath != "" {
+		path := "strict " + f.jsonPath
+		if f.equals != nil {
+			c.add(`(SELECT CASE jsonb_typeof(v) WHEN 'null' THEN 'null' ELSE v #>> '{}' END
+                FROM jsonb_path_query_first(`+pgBodyDocument+`, ?::text::jsonpath, '{}', true) AS v) = ?`, path, *f.equals)
+		} else {
+			c.add("jsonb_path_exists("+pgBodyDocument+", ?::text::jsonpath, '{}', true)", path)
+		}
+	}
+	return c.suffix()
+}
+
+func (s *postgresStore) ListBins(ctx context.Context, limit, offset int) ([]BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var max sql.NullInt64
+	if limit > 0 {
+		max = sql.NullInt64{Int64: int64(limit), Valid: true}
+	}
+	return scanBins(s.db.QueryContext(ctx, rebind(`
+        SELECT bin_id, created_at, expires_at, max_entries, config FROM bins
+        ORDER BY created_at ASC, bin_id ASC LIMIT ? OFFSET ?`), max, offset))
+}
+
+func (s *postgresStore) Usage(ctx context.Context, binID string) (StoreUsage, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var u StoreUsage
+	if binID != "" {
+		err := s.db.QueryRowContext(ctx, rebind("SELECT COUNT(*), COALESCE(SUM("+pgRequestBytes+"), 0) FROM requests WHERE bin_id = ?"),
+			binID).Scan(&u.Requests, &u.Bytes)
+		return u, err
+	}
+	err := s.db.QueryRowContext(ctx, rebind(`
+        SELECT COUNT(*), COUNT(*) FILTER (WHERE expires_at != ? AND expires_at < ?),
+            (SELECT COUNT(*) FROM requests), (SELECT COALESCE(MAX(bytes), 0) FROM storage_usage)
+        FROM bins`), neverExpires, time.Now().UnixMilli()).Scan(&u.Bins, &u.ExpiredBins, &u.Requests, &u.Bytes)
+	return u, err
+}
+
+func (s *postgresStore) UsageByBin(ctx context.Context, binIDs []string) (map[string]StoreUsage, error) {
+	if len(binIDs) == 0 {
+		return map[string]StoreUsage{}, nil
+	}
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return scanUsageByBin(s.db.QueryContext(ctx, rebind("SELECT bin_id, COUNT(*), COALESCE(SUM("+pgRequestBytes+"), 0) FROM requests "+
+		"WHERE bin_id IN ("+inList(len(binIDs))+") GROUP BY bin_id"), stringArgs(binIDs)...))
+}
+
+func (s *postgresStore) OldestActiveBin(ctx context.Context) (BinRecord, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	return firstBin(scanBins(s.db.QueryContext(ctx, rebind(`
+        SELECT bin_id, created_at, expires_at, max_entries, config FROM bins
+        WHERE expires_at = ? OR expires_at >= ?
+        ORDER BY created_at ASC, bin_id ASC LIMIT 1`), neverExpires, time.Now().UnixMilli())))
+}
+
+// RequestsAfter compares request IDs bytewise, as the other stores do,
+// whatever the database's collation
+func (s *postgresStore) RequestsAfter(ctx context.Context, binID string, after requestCursor, filter requestFilter, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	where, args := filter.pgWhere()
+	args = append([]interface{}{binID, after.Inserted, after.Inserted, after.ReqID}, args...)
+	return queryRequests(ctx, s.db, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND (inserted > ? OR (inserted = ? AND req_id COLLATE "C" > ?))`+where+`
+        ORDER BY inserted ASC, req_id COLLATE "C" ASC LIMIT ?`), append(args, limit)...)
+}
+
+// SearchRequests matches substrings as SQLite's LIKE fallback does
+func (s *postgresStore) SearchRequests(ctx context.Context, binID, q string, limit int) ([]Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	q = pgText(q)
+	return queryRequests(ctx, s.db, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND (strpos(lower(body), lower(?)) > 0 OR strpos(lower(headers), lower(?)) > 0)
+        ORDER BY inserted ASC, seq ASC LIMIT ?`), binID, q, q, limit)
+}
+
+func (s *postgresStore) EncodedBody(ctx context.Context, binID, reqID string) ([]byte, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var encoded []byte
+	err := s.db.QueryRowContext(ctx, rebind("SELECT encoded_body FROM requests WHERE bin_id = ? AND req_id = ?"), binID, reqID).
+		Scan(&encoded)
+	return encoded, err
+}
+
+func (s *postgresStore) SetUpstreamResponse(ctx context.Context, binID, reqID string, resp UpstreamResponse) (bool, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	out, _ := json.Marshal(resp)
+	res, err := s.db.ExecContext(ctx, rebind("UPDATE requests SET upstream_response = ? WHERE bin_id = ? AND req_id = ?"),
+		string(out), binID, reqID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// LeaseRequest skips rows another instance is leasing, as TakeRequests does
+func (s *postgresStore) LeaseRequest(ctx context.Context, binID string, until int64) (Request, error) {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return Request{}, err
+	}
+	defer tx.Rollback()
+
+	req, err := scanRequest(tx.QueryRowContext(ctx, rebind(`
+        SELECT `+requestColumns+`
+        FROM requests WHERE bin_id = ? AND leased_until <= ?
+        ORDER BY inserted ASC, seq ASC LIMIT 1 FOR UPDATE SKIP LOCKED`), binID, time.Now().UnixMilli()))
+	if err != nil {
+		return Request{}, err
+	}
+
+	req.LeasedUntil = until
+	if _, err := tx.ExecContext(ctx, rebind("UPDATE requests SET leased_until = ? WHERE req_id = ?"), until, req.ReqID); err != nil {
+		return Request{}, err
+	}
+	return req, tx.Commit()
+}
+
+func (s *postgresStore) SettleLease(ctx context.Context, binID, reqID string, release bool) error {
+	ctx, cancel := dbContext(ctx)
+	defer cancel()
+	var n int64
+	var keys []string
+	var err error
+	if release {
+		var res sql.Result
+		res, err = s.db.ExecContext(ctx, rebind(`
+            UPDATE requests SET leased_until = 0 WHERE bin_id = ? AND req_id = ? AND leased_until >= ?`),
+			binID, reqID, time.Now().UnixMilli())
+		if err == nil {
+			n, _ = res.RowsAffected()
+		}
+	} else {
+		n, keys, err = deleteRequests(ctx, s.db, "DELETE FROM requests WHERE bin_id = ? AND req_id = ? AND leased_until >= ?",
+			binID, reqID, time.Now().UnixMilli())
+	}
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		orphanBlobs(ctx, keys...)
+		return nil
+	}
+	var exists int
+	err = s.db.QueryRowContext(ctx, rebind("SELECT COUNT(*) FROM requests WHERE bin_id = ? AND req_id = ?"), binID, reqID).
+		Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists == 0 {
+		return sql.ErrNoRows
+	}
+	return errLeaseLapsed
+}
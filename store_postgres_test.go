@@ -0,0 +1,52 @@
+//go:build cgo
+
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestPostgresStore(t *testing.T) {
+	dsn := os.Getenv("POSTBIN_TEST_POSTGRES_DSN")
+	if dsn == "" {
+		t.Skip("POSTBIN_TEST_POSTGRES_DSN is not set")
+	}
+	clearDB(t)
+	s, err := openPostgresStore(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.db.Close()
+	if _, err := s.db.Exec("DELETE FROM bins WHERE bin_id LIKE 'contract%'"); err != nil {
+		t.Fatal(err)
+	}
+	testStoreContract(t, s)
+}
+
+func TestRebind(t *testing.T) {
+	got := rebind("SELECT 1 FROM requests WHERE bin_id = ? AND inserted > ? LIMIT ?")
+	if got != "SELECT 1 FROM requests WHERE bin_id = $1 AND inserted > $2 LIMIT $3" {
+		t.Errorf("Unexpected query %s", got)
+	}
+}
+
+func TestPostgresFilter(t *testing.T) {
+	f, err := parseRequestFilter(map[string][]string{
+		"method":   {"post"},
+		"header":   {"x-event:push"},
+		"jsonpath": {"$.action"},
+		"equals":   {"opened"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	where, args := f.pgWhere()
+	if strings.Count(where, "?") != len(args) {
+		t.Errorf("Expected a placeholder per argument, got %q %v", where, args)
+	}
+	if len(args) != 5 || args[0] != "POST" || args[1] != "X-Event" || args[3] != "strict $.action" || args[4] != "opened" {
+		t.Errorf("Unexpected arguments %v", args)
+	}
+}
@@ -0,0 +1,399 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testStoreContract checks the behaviour every Store must share. s must be
+// empty of bins with the IDs used here.
+func testStoreContract(t *testing.T, s Store) {
+	now := time.Now().UnixMilli()
+	if created, err := s.CreateBin(context.Background(), BinRecord{BinID: "contract", CreatedAt: now, ExpiresAt: now + 60000, MaxEntries: 2,
+		Config: BinConfig{Response: &ResponseConfig{Body: "ok"}}}); err != nil || !created {
+		t.Fatalf("Expected the bin to be created, got %v %v", created, err)
+	}
+	if created, _ := s.CreateBin(context.Background(), BinRecord{BinID: "contract", CreatedAt: now}); created {
+		t.Errorf("Expected a taken ID to be refused")
+	}
+	bin, err := s.GetBin(context.Background(), "contract")
+	if err != nil || bin.MaxEntries != 2 || bin.Config.Response == nil || bin.Config.Response.Body != "ok" {
+		t.Errorf("Unexpected bin %+v %v", bin, err)
+	}
+	if _, err := s.GetBin(context.Background(), "missing"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing bin, got %v", err)
+	}
+	if found, err := s.ExtendBin(context.Background(), "contract", 1000, now+3600000); err != nil || !found {
+		t.Errorf("Expected the bin to be extended, got %v %v", found, err)
+	}
+	if bin, _ := s.GetBin(context.Background(), "contract"); bin.ExpiresAt != now+61000 {
+		t.Errorf("Expected the expiry to move by 1000, got %d", bin.ExpiresAt-now)
+	}
+	if _, err := s.ExtendBin(context.Background(), "contract", math.MaxInt64, now+120000); err != nil {
+		t.Errorf("Expected a huge extension to be capped, got %v", err)
+	}
+	if bin, _ := s.GetBin(context.Background(), "contract"); bin.ExpiresAt != now+120000 {
+		t.Errorf("Expected the expiry capped at latest, got %d", bin.ExpiresAt-now)
+	}
+
+	for i, id := range []string{"r1", "r2", "r3"} {
+		req := Request{BinID: "contract", ReqID: id, Method: "POST", Path: "/contract", RawBody: id, Inserted: now + int64(i)}
+		if err := s.InsertRequest(context.Background(), req, bin.MaxEntries); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n, _ := s.CountRequests(context.Background(), "contract", requestFilter{}); n != 2 {
+		t.Errorf("Expected the oldest request to be evicted past maxEntries, got %d", n)
+	}
+	if _, err := s.GetRequest(context.Background(), "contract", "r1"); err != sql.ErrNoRows {
+		t.Errorf("Expected r1 to be gone, got %v", err)
+	}
+	if reqs, _ := s.ListRequests(context.Background(), "contract", requestFilter{}, 10, 1); len(reqs) != 1 || reqs[0].ReqID != "r3" {
+		t.Errorf("Expected the second page to hold r3, got %+v", reqs)
+	}
+	if reqs, _ := s.RequestsAfter(context.Background(), "contract", requestCursor{Inserted: now + 1, ReqID: "r2"}, requestFilter{}, 10); len(reqs) != 1 || reqs[0].ReqID != "r3" {
+		t.Errorf("Expected only r3 after r2, got %+v", reqs)
+	}
+	if reqs, _ := s.TakeRequests(context.Background(), "contract", true, 1); len(reqs) != 1 || reqs[0].ReqID != "r3" {
+		t.Errorf("Expected to take the newest request, got %+v", reqs)
+	}
+	if found, _ := s.DeleteRequest(context.Background(), "contract", "r2"); !found {
+		t.Errorf("Expected r2 to be deleted")
+	}
+	if found, _ := s.DeleteRequest(context.Background(), "contract", "r2"); found {
+		t.Errorf("Expected deleting r2 twice to report it missing")
+	}
+
+	db.Exec("DELETE FROM blob_orphans WHERE blob_key = 'contract/r4'")
+	s.InsertRequest(context.Background(), Request{BinID: "contract", ReqID: "r4", Inserted: now + 3, blobKey: "contract/r4", BodySize: 1 << 20}, 0)
+	s.DeleteRequest(context.Background(), "contract", "r4")
+	var orphaned int
+	db.QueryRow("SELECT COUNT(*) FROM blob_orphans WHERE blob_key = 'contract/r4'").Scan(&orphaned)
+	if orphaned != 1 {
+		t.Errorf("Expected a deleted request's blob to be queued for removal")
+	}
+
+	if found, err := s.SetBinConfig(context.Background(), "contract", BinConfig{}); err != nil || !found {
+		t.Errorf("Expected the config to be replaced, got %v %v", found, err)
+	}
+	if err := s.DeleteBin(context.Background(), "contract"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetBin(context.Background(), "contract"); err != sql.ErrNoRows {
+		t.Errorf("Expected the bin to be deleted, got %v", err)
+	}
+
+	// Two requests in the same millisecond, inserted out of ID order
+	s.CreateBin(context.Background(), BinRecord{BinID: "contract-more", CreatedAt: now + 1, ExpiresAt: now + 60000})
+	for _, req := range []Request{
+		{ReqID: "m2", Inserted: now, RawBody: "a needle"},
+		{ReqID: "m1", Inserted: now, Headers: http.Header{"X-Find": {"Needle"}}},
+		{ReqID: "m3", Inserted: now + 1, Method: "PUT", DecodedFrom: "gzip", encodedBody: []byte("gz")},
+	} {
+		req.BinID = "contract-more"
+		if err := s.InsertRequest(context.Background(), req, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if reqs, _ := s.RequestsAfter(context.Background(), "contract-more", requestCursor{}, requestFilter{}, 2); ids(reqs) != "m1m2" {
+		t.Errorf("Expected the first page in cursor order, got %q", ids(reqs))
+	}
+	if reqs, _ := s.RequestsAfter(context.Background(), "contract-more", requestCursor{Inserted: now, ReqID: "m2"}, requestFilter{}, 10); ids(reqs) != "m3" {
+		t.Errorf("Expected m3 after m2, got %q", ids(reqs))
+	}
+	if reqs, _ := s.RequestsAfter(context.Background(), "contract-more", requestCursor{}, requestFilter{method: "PUT"}, 10); ids(reqs) != "m3" {
+		t.Errorf("Expected the filter to apply, got %q", ids(reqs))
+	}
+	if reqs, _ := s.SearchRequests(context.Background(), "contract-more", "NEEDLE", 10); len(reqs) != 2 {
+		t.Errorf("Expected the body and header matches, got %q", ids(reqs))
+	}
+	if encoded, err := s.EncodedBody(context.Background(), "contract-more", "m3"); err != nil || string(encoded) != "gz" {
+		t.Errorf("Unexpected encoded body %q %v", encoded, err)
+	}
+	if found, _ := s.SetUpstreamResponse(context.Background(), "contract-more", "m3", UpstreamResponse{Status: 502}); !found {
+		t.Errorf("Expected the upstream response to be recorded")
+	}
+	if req, _ := s.GetRequest(context.Background(), "contract-more", "m3"); req.Response == nil || req.Response.Status != 502 {
+		t.Errorf("Expected the upstream response stored, got %+v", req.Response)
+	}
+	if u, err := s.Usage(context.Background(), "contract-more"); err != nil || u.Requests != 3 || u.Bytes <= 0 {
+		t.Errorf("Unexpected bin usage %+v %v", u, err)
+	}
+	if usage, err := s.UsageByBin(context.Background(), []string{"contract-more", "missing"}); err != nil ||
+		usage["contract-more"].Requests != 3 || usage["contract-more"].Bytes <= 0 || usage["missing"].Requests != 0 {
+		t.Errorf("Unexpected usage by bin %+v %v", usage, err)
+	}
+	if buckets, err := s.CountBuckets(context.Background(), "contract-more", requestFilter{}, 1); err != nil ||
+		fmt.Sprint(buckets) != fmt.Sprint([]TimeseriesBucket{{now, 2}, {now + 1, 1}}) {
+		t.Errorf("Unexpected buckets %+v %v", buckets, err)
+	}
+	since := now + 1
+	if buckets, _ := s.CountBuckets(context.Background(), "contract-more", requestFilter{since: &since}, 1); len(buckets) != 1 || buckets[0].Start != now+1 {
+		t.Errorf("Expected only the bucket from since, got %+v", buckets)
+	}
+	if buckets, _ := s.CountBuckets(context.Background(), "contract-more", requestFilter{method: "PUT"}, 1000); len(buckets) != 1 || buckets[0].Count != 1 {
+		t.Errorf("Expected the filter to apply to buckets, got %+v", buckets)
+	}
+	if u, _ := s.Usage(context.Background(), ""); u.Bins < 1 || u.Requests < 3 {
+		t.Errorf("Unexpected usage %+v", u)
+	}
+	if bins, _ := s.ListBins(context.Background(), 0, 0); len(bins) == 0 || bins[len(bins)-1].BinID != "contract-more" {
+		t.Errorf("Expected the newest bin last, got %+v", bins)
+	}
+
+	first, err := s.LeaseRequest(context.Background(), "contract-more", now+60000)
+	if err != nil || first.LeasedUntil != now+60000 {
+		t.Fatalf("Unexpected lease %+v %v", first, err)
+	}
+	second, _ := s.LeaseRequest(context.Background(), "contract-more", now+60000)
+	third, _ := s.LeaseRequest(context.Background(), "contract-more", now+60000)
+	if second.ReqID == first.ReqID || third.ReqID != "m3" {
+		t.Errorf("Expected leases oldest first and never shared, got %s %s %s", first.ReqID, second.ReqID, third.ReqID)
+	}
+	if _, err := s.LeaseRequest(context.Background(), "contract-more", now+60000); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows with everything leased, got %v", err)
+	}
+	if err := s.SettleLease(context.Background(), "contract-more", first.ReqID, true); err != nil {
+		t.Errorf("Expected the lease released, got %v", err)
+	}
+	if err := s.SettleLease(context.Background(), "contract-more", first.ReqID, false); err != errLeaseLapsed {
+		t.Errorf("Expected acking a released request refused, got %v", err)
+	}
+	if err := s.SettleLease(context.Background(), "contract-more", second.ReqID, false); err != nil {
+		t.Errorf("Expected the lease acked, got %v", err)
+	}
+	if _, err := s.GetRequest(context.Background(), "contract-more", second.ReqID); err != sql.ErrNoRows {
+		t.Errorf("Expected an acked request deleted, got %v", err)
+	}
+	if err := s.SettleLease(context.Background(), "contract-more", "missing", false); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing request, got %v", err)
+	}
+	form := "--b\r\nContent-Disposition: form-data; name=\"f\"; filename=\"f.txt\"\r\n\r\nhello\r\n--b--\r\n"
+	multi := Request{BinID: "contract-more", ReqID: "m4", Inserted: now + 2, RawBody: form,
+		Headers: http.Header{"Content-Type": {"multipart/form-data; boundary=b"}}}
+	multi.Body, multi.parts = parseBody(multi.Headers.Get("Content-Type"), []byte(form))
+	if err := s.InsertRequest(context.Background(), multi, 0); err != nil {
+		t.Fatal(err)
+	}
+	if part, err := s.RequestPart(context.Background(), "contract-more", "m4", "f"); err != nil || string(part.Data) != "hello" || part.Filename != "f.txt" {
+		t.Errorf("Unexpected part %+v %v", part, err)
+	}
+	if _, err := s.RequestPart(context.Background(), "contract-more", "m4", "missing"); err != sql.ErrNoRows {
+		t.Errorf("Expected sql.ErrNoRows for a missing part, got %v", err)
+	}
+	if err := s.DeleteBin(context.Background(), "contract-more"); err != nil {
+		t.Fatal(err)
+	}
+
+	s.CreateBin(context.Background(), BinRecord{BinID: "contract-expired", CreatedAt: now - 2000, ExpiresAt: now - 1000})
+	s.InsertRequest(context.Background(), Request{BinID: "contract-expired", ReqID: "old", Inserted: now - 1500}, 0)
+	s.CreateBin(context.Background(), BinRecord{BinID: "contract-active", CreatedAt: now - 1000, ExpiresAt: now + 60000})
+	if bin, err := s.OldestActiveBin(context.Background()); err != nil || binExpired(bin.ExpiresAt) {
+		t.Errorf("Expected an expired bin passed over, got %+v %v", bin, err)
+	}
+	s.DeleteBin(context.Background(), "contract-active")
+	if bins, requests, err := s.PurgeExpiredBins(context.Background(), 0); err != nil || bins != 1 || requests != 1 {
+		t.Errorf("Expected the expired bin and its request to be purged, got %d %d %v", bins, requests, err)
+	}
+}
+
+func TestSQLiteStore(t *testing.T) {
+	clearDB(t)
+	testStoreContract(t, store)
+}
+
+func TestSQLiteConcurrentWrites(t *testing.T) {
+	conn, err := openSQLite(filepath.Join(t.TempDir(), "postbin.db"), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	var mode string
+	if conn.QueryRow("PRAGMA journal_mode").Scan(&mode); mode != "wal" {
+		t.Errorf("Expected WAL, got %q", mode)
+	}
+
+	s, err := newSQLiteStore(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now().UnixMilli()
+	s.CreateBin(context.Background(), BinRecord{BinID: "busy", CreatedAt: now, ExpiresAt: now + 60000})
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 25; i++ {
+				req := Request{BinID: "busy", ReqID: fmt.Sprintf("%d-%d", w, i), Inserted: now, Headers: map[string][]string{}}
+				if err := s.InsertRequest(context.Background(), req, 100); err != nil {
+					errs <- err
+				}
+				s.ListRequests(context.Background(), "busy", requestFilter{}, 10, 0)
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Expected concurrent captures to wait their turn, got %v", err)
+	}
+	if n, _ := s.CountRequests(context.Background(), "busy", requestFilter{}); n != 100 {
+		t.Errorf("Expected the bin to hold its 100 newest, got %d", n)
+	}
+}
+
+func TestSQLiteStoreContext(t *testing.T) {
+	clearDB(t)
+	bin := createTestBin(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := store.GetBin(ctx, bin.BinID); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled lookup to give up, got %v", err)
+	}
+	if _, err := store.ListRequests(ctx, bin.BinID, requestFilter{}, 10, 0); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled listing to give up, got %v", err)
+	}
+
+	defer func(timeout time.Duration) { dbTimeout = timeout }(dbTimeout)
+	dbTimeout = time.Nanosecond
+	if err := store.InsertRequest(context.Background(), Request{BinID: bin.BinID, ReqID: "late"}, 0); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected an insert past --db-timeout to give up, got %v", err)
+	}
+	dbTimeout = 0
+	if _, err := store.GetBin(context.Background(), bin.BinID); err != nil {
+		t.Errorf("Expected no timeout to leave calls unbounded, got %v", err)
+	}
+}
+
+func TestRequestsInsertedIndex(t *testing.T) {
+	for _, query := range []string{
+		"SELECT COUNT(*) FROM requests WHERE bin_id = 'bin'",
+		"SELECT req_id FROM requests WHERE bin_id = 'bin' ORDER BY inserted ASC, rowid ASC LIMIT 10 OFFSET 10",
+		"SELECT req_id FROM requests WHERE bin_id = 'bin' AND inserted > 0 ORDER BY inserted ASC, rowid ASC LIMIT 10",
+		"SELECT rowid FROM requests WHERE bin_id = 'bin' ORDER BY inserted DESC, rowid DESC LIMIT 10",
+	} {
+		rows, err := db.Query("EXPLAIN QUERY PLAN " + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var plan []string
+		for rows.Next() {
+			var id, parent, unused int
+			var detail string
+			rows.Scan(&id, &parent, &unused, &detail)
+			plan = append(plan, detail)
+		}
+		rows.Close()
+		if joined := strings.Join(plan, "; "); !strings.Contains(joined, "INDEX requests_bin_") || strings.Contains(joined, "TEMP B-TREE") {
+			t.Errorf("Expected %q to be served by an index, got %s", query, joined)
+		}
+	}
+}
+
+// BenchmarkSQLiteStatements compares the capture path's statements prepared
+// once against the same SQL parsed on every call.
+func BenchmarkSQLiteStatements(b *testing.B) {
+	conn, err := openSQLite(filepath.Join(b.TempDir(), "postbin.db"), true)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	s, err := newSQLiteStore(conn)
+	if err != nil {
+		b.Fatal(err)
+	}
+	now := time.Now().UnixMilli()
+	s.CreateBin(context.Background(), BinRecord{BinID: "bench", CreatedAt: now, ExpiresAt: now + 3600000})
+
+	getBin := "SELECT bin_id, created_at, expires_at, max_entries, config FROM bins WHERE bin_id = ?"
+	b.Run("GetBin/prepared", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := s.GetBin(context.Background(), "bench"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("GetBin/unprepared", func(b *testing.B) {
+		var bin BinRecord
+		var raw string
+		for i := 0; i < b.N; i++ {
+			err := conn.QueryRow(getBin, "bench").Scan(&bin.BinID, &bin.CreatedAt, &bin.ExpiresAt, &bin.MaxEntries, &raw)
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	// Each insert evicts, so the bin stays the same size throughout. Benchmarks
+	// are run more than once, so IDs are numbered across all of them.
+	seq := 0
+	nextID := func() string {
+		seq++
+		return fmt.Sprintf("bench-%d", seq)
+	}
+	insert := func(b *testing.B, exec func(tx *sql.Tx, query string, args ...interface{}) error) {
+		for i := 0; i < b.N; i++ {
+			tx, err := conn.Begin()
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := exec(tx, insertRequestSQL, nextID(), "bench", "POST", "/bench", "{}", "{}", `"body"`, "", now, false,
+				"", 0, "", "", "", -1, "", "", now, 0, "", "", "", []byte{}, "", nil, nil, ""); err != nil {
+				b.Fatal(err)
+			}
+			if err := exec(tx, evictRequestsSQL, "bench", "bench", 100); err != nil {
+				b.Fatal(err)
+			}
+			if err := tx.Commit(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	b.Run("Insert/prepared", func(b *testing.B) {
+		stmts := map[string]*sql.Stmt{insertRequestSQL: s.insert, evictRequestsSQL: s.evict}
+		insert(b, func(tx *sql.Tx, query string, args ...interface{}) error {
+			_, err := tx.Stmt(stmts[query]).Exec(args...)
+			return err
+		})
+	})
+	b.Run("Insert/unprepared", func(b *testing.B) {
+		insert(b, func(tx *sql.Tx, query string, args ...interface{}) error {
+			_, err := tx.Exec(query, args...)
+			return err
+		})
+	})
+
+	b.Run("InsertRequest", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			req := Request{BinID: "bench", ReqID: nextID(), Method: "POST", RawBody: "body", Inserted: now}
+			if err := s.InsertRequest(context.Background(), req, 100); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("TakeRequests", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			req := Request{BinID: "bench", ReqID: nextID(), Method: "POST", RawBody: "body", Inserted: now}
+			if err := s.InsertRequest(context.Background(), req, 100); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := s.TakeRequests(context.Background(), "bench", true, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Bucket width bounds and the most buckets a single timeseries may span
+const (
+	defaultBucket = time.Minute
+	minBucket     = time.Second
+	maxBucket     = 24 * time.Hour
+	maxBuckets    = 10000
+)
+
+// TimeseriesBucket counts the requests inserted in [Start, Start+bucket)
+type TimeseriesBucket struct {
+	Start int64 `json:"start"`
+	Count int   `json:"count"`
+}
+
+type TimeseriesResponse struct {
+	BinID    string             `json:"binId"`
+	BucketMs int64              `json:"bucketMs"`
+	Buckets  []TimeseriesBucket `json:"buckets"`
+}
+
+// timeseriesHandler returns request counts per time bucket. Buckets between
+// the first and last capture are always present, with zero counts where
+// nothing arrived, so the result can be graphed directly. The listing
+// filters apply, so a single event type can be graphed on its own.
+func timeseriesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/timeseries")]
+
+	bucket, err := parseDurationParam(r.URL.Query().Get("bucket"), defaultBucket, maxBucket)
+	if err != nil || bucket < minBucket {
+		http.Error(w, `{"msg":"Invalid bucket"}`, http.StatusBadRequest)
+		return
+	}
+	filter, err := parseRequestFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, fmt.Sprintf(`{"msg":%q}`, err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	bucketMs := bucket.Milliseconds()
+	counted, err := store.CountBuckets(r.Context(), binID, filter, bucketMs)
+	if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	buckets := []TimeseriesBucket{}
+	if len(counted) > 0 {
+		first, last := counted[0].Start, counted[len(counted)-1].Start
+		if (last-first)/bucketMs+1 > maxBuckets {
+			http.Error(w, fmt.Sprintf(`{"msg":"Range spans more than %d buckets; use a wider bucket"}`, maxBuckets),
+				http.StatusBadRequest)
+			return
+		}
+		i := 0
+		for start := first; start <= last; start += bucketMs {
+			b := TimeseriesBucket{Start: start}
+			if counted[i].Start == start {
+				b.Count = counted[i].Count
+				i++
+			}
+			buckets = append(buckets, b)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(TimeseriesResponse{
+		BinID:    binID,
+		BucketMs: bucketMs,
+		Buckets:  buckets,
+	})
+}
@@ -0,0 +1,59 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTimeseries(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	// Two requests in the first minute, none in the second, one in the third
+	base := int64(1700000040000)
+	for i, offset := range []int64{0, 30000, 150000} {
+		_, err := testDB.Exec(`INSERT INTO requests (req_id, bin_id, method, path, headers, query, body, ip, inserted)
+            VALUES (?, ?, 'POST', '/', '{}', '{}', '""', '', ?)`, "ts"+string(rune('a'+i)), bin.BinID, base+offset)
+		if err != nil {
+			t.Fatalf("Failed to insert request: %v", err)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/timeseries?bucket=1m", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status code %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var ts TimeseriesResponse
+	if err := json.NewDecoder(w.Body).Decode(&ts); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	if ts.BucketMs != 60000 {
+		t.Errorf("Expected bucketMs 60000, got %d", ts.BucketMs)
+	}
+
+	want := []TimeseriesBucket{{base, 2}, {base + 60000, 0}, {base + 120000, 1}}
+	if len(ts.Buckets) != len(want) {
+		t.Fatalf("Expected %d buckets, got %v", len(want), ts.Buckets)
+	}
+	for i := range want {
+		if ts.Buckets[i] != want[i] {
+			t.Errorf("Bucket %d: expected %+v, got %+v", i, want[i], ts.Buckets[i])
+		}
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/timeseries?bucket=10ms", nil)
+	w = httptest.NewRecorder()
+	binAPIHandler(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected status code %d for a tiny bucket, got %d", http.StatusBadRequest, w.Code)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tunnel tuning. Captures are read from the database in batches rather than
+// taken from the capture hub, so a tunnel that falls behind catches up
+// instead of missing requests, and a client that reconnects with ?after=
+// resumes where it left off.
+const (
+	tunnelBatch        = 100
+	tunnelReadLimit    = 64 << 10
+	minTunnelReconnect = time.Second
+	maxTunnelReconnect = 30 * time.Second
+)
+
+// TunnelMessage is a frame sent down a tunnel: Type "request" carries a
+// capture and its body exactly as it was sent.
+type TunnelMessage struct {
+	Type    string   `json:"type"`
+	Request *Request `json:"request"`
+	Body    []byte   `json:"body"`
+}
+
+// TunnelResult is what a tunnel client reports back after delivering a
+// capture to its local target.
+type TunnelResult struct {
+	Type      string  `json:"type"`
+	ReqID     string  `json:"reqId"`
+	URL       string  `json:"url"`
+	Status    int     `json:"status"`
+	LatencyMs float64 `json:"latencyMs"`
+	Error     string  `json:"error,omitempty"`
+	Snippet   string  `json:"snippet,omitempty"`
+}
+
+// tunnelHandler serves the WebSocket at GET /api/bin/{binId}/tunnel. Every
+// capture after ?after={reqId}, or made since connecting when that's
+// omitted, is pushed down it in order; the results the client sends back
+// are recorded as deliveries of kind "tunnel".
+func tunnelHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := strings.TrimSuffix(r.URL.Path[len("/api/bin/"):], "/tunnel")
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before reading the cursor so nothing captured in between is missed
+	sub := captures.subscribe(binID, 1)
+	defer sub.Close()
+
+	cursor, err := tunnelCursor(r.Context(), binID, r.URL.Query().Get("after"))
+	if errors.Is(err, errInvalidTunnelCursor) {
+		http.Error(w, `{"msg":"Invalid after"}`, http.StatusBadRequest)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(tunnelReadLimit)
+		conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+		})
+		for {
+			var result TunnelResult
+			if err := conn.ReadJSON(&result); err != nil {
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+			if result.Type == "result" {
+				recordTunnelResult(r.Context(), binID, result)
+			}
+		}
+	}()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+
+	for {
+		var ok bool
+		if cursor, ok = sendTunnelBacklog(r.Context(), conn, binID, cursor); !ok {
+			return
+		}
+		select {
+		case <-sub.C:
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// errInvalidTunnelCursor is returned by tunnelCursor for an ?after= that
+// isn't a request ID
+var errInvalidTunnelCursor = errors.New("invalid tunnel cursor")
+
+// tunnelCursor is where a tunnel starts: just after the request after names,
+// or now when it's empty. A request that has since been deleted still marks
+// a place, by the time in its ID.
+func tunnelCursor(ctx context.Context, binID, after string) (requestCursor, error) {
+	if after == "" {
+		// A fresh ID sorts after every capture already made this millisecond
+		// and before any made from now on
+		id := generateRequestID()
+		ms, _ := ulidTime(id)
+		return requestCursor{Inserted: ms, ReqID: id}, nil
+	}
+	req, err := store.GetRequest(ctx, binID, after)
+	if err == nil {
+		return cursorAt(req), nil
+	} else if err != sql.ErrNoRows {
+		return requestCursor{}, err
+	}
+	ms, ok := ulidTime(after)
+	if !ok {
+		return requestCursor{}, errInvalidTunnelCursor
+	}
+	return requestCursor{Inserted: ms, ReqID: after}, nil
+}
+
+// sendTunnelBacklog sends every capture in the bin after cursor, returning
+// the new cursor and false once the connection is unusable.
+func sendTunnelBacklog(ctx context.Context, conn *websocket.Conn, binID string, cursor requestCursor) (requestCursor, bool) {
+	for {
+		reqs, err := store.RequestsAfter(ctx, binID, cursor, requestFilter{}, tunnelBatch)
+		if err != nil {
+			log.Printf("Reading captures for the %s tunnel failed: %v", binID, err)
+			return cursor, false
+		}
+
+		for _, req := range reqs {
+			req := req
+			body, err := readOriginalBody(ctx, req)
+			if err != nil {
+				log.Printf("Reading the body of %s/%s for its tunnel failed: %v", binID, req.ReqID, err)
+			}
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteJSON(TunnelMessage{Type: "request", Request: &req, Body: body}); err != nil {
+				return cursor, false
+			}
+			cursor = cursorAt(req)
+		}
+		if len(reqs) < tunnelBatch {
+			return cursor, true
+		}
+	}
+}
+
+// recordTunnelResult stores a client's report on one capture of binID
+func recordTunnelResult(ctx context.Context, binID string, result TunnelResult) {
+	if _, err := store.GetRequest(ctx, binID, result.ReqID); err != nil {
+		return
+	}
+	d := resultDelivery(Request{BinID: binID, ReqID: result.ReqID}, ReplayResult{
+		ReqID:     result.ReqID,
+		URL:       result.URL,
+		Status:    result.Status,
+		LatencyMs: result.LatencyMs,
+		Error:     result.Error,
+		snippet:   truncateUTF8(result.Snippet, maxResponseSnippet),
+	})
+	d.Kind, d.Target = deliveryTunnel, deliveryTunnel
+	if err := insertDelivery(ctx, d); err != nil {
+		log.Printf("Recording tunnel delivery of %s/%s failed: %v", binID, result.ReqID, err)
+	}
+}
+
+// truncateUTF8 cuts s to at most n bytes without splitting a character
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return strings.ToValidUTF8(s[:n], "")
+}
+
+// runTunnel is the `postbin tunnel` command: it connects to a postbin
+// server and delivers a bin's captures to a local target until interrupted.
+func runTunnel(args []string) error {
+	flags := flag.NewFlagSet("tunnel", flag.ExitOnError)
+	server := flags.String("server", "http://localhost:8080", "postbin server to connect to")
+	binID := flags.String("bin", "", "bin whose captures are delivered")
+	target := flags.String("target", "http://localhost:3000", "local URL captures are sent to, with their sub-path and query appended")
+	after := flags.String("after", "", "deliver captures after this request ID, instead of only new ones")
+	timeout := flags.Duration("timeout", defaultReplayTimeout, "how long each delivery may take")
+	flags.Parse(args)
+
+	if *binID == "" {
+		return errors.New("tunnel: -bin is required")
+	}
+	if _, err := resendURL(Request{}, *target); err != nil || *target == "" {
+		return fmt.Errorf("tunnel: -target must be an absolute http or https URL")
+	}
+	return tunnelClient(context.Background(), *server, *binID, *target, *after, *timeout)
+}
+
+// tunnelClient keeps a tunnel to binID open, reconnecting with backoff and
+// resuming after the last capture it saw, until ctx is done.
+func tunnelClient(ctx context.Context, server, binID, target, after string, timeout time.Duration) error {
+	endpoint, err := url.Parse(strings.TrimSuffix(server, "/") + "/api/bin/" + url.PathEscape(binID) + "/tunnel")
+	if err != nil {
+		return err
+	}
+	switch endpoint.Scheme {
+	case "http":
+		endpoint.Scheme = "ws"
+	case "https":
+		endpoint.Scheme = "wss"
+	default:
+		return fmt.Errorf("tunnel: server must be an http or https URL")
+	}
+
+	client := replayClient(timeout)
+	wait := minTunnelReconnect
+	for {
+		q := url.Values{}
+		if after != "" {
+			q.Set("after", after)
+		}
+		endpoint.RawQuery = q.Encode()
+
+		conn, resp, err := websocket.DefaultDialer.DialContext(ctx, endpoint.String(), nil)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("tunnel: no such bin %s", binID)
+		}
+		if err == nil {
+			log.Printf("Tunnel open: %s captures go to %s", binID, target)
+			wait = minTunnelReconnect
+			err = serveTunnel(ctx, conn, client, target, &after)
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		log.Printf("Tunnel closed: %v; reconnecting in %s", err, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil
+		}
+		if wait *= 2; wait > maxTunnelReconnect {
+			wait = maxTunnelReconnect
+		}
+	}
+}
+
+// serveTunnel delivers each capture that arrives on conn to target in turn
+// and reports how it went, recording the last one seen in after.
+func serveTunnel(ctx context.Context, conn *websocket.Conn, client *http.Client, target string, after *string) error {
+	defer conn.Close()
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	for {
+		var msg TunnelMessage
+		if err := conn.ReadJSON(&msg); err != nil {
+			return err
+		}
+		if msg.Type != "request" || msg.Request == nil {
+			continue
+		}
+		req := *msg.Request
+		result := sendCapture(ctx, client, req, msg.Body, target)
+		if result.Error != "" {
+			log.Printf("Delivering %s to %s failed: %s", req.ReqID, target, result.Error)
+		} else {
+			log.Printf("%s %s -> %d (%.0fms)", req.Method, result.URL, result.Status, result.LatencyMs)
+		}
+		*after = req.ReqID
+
+		report := TunnelResult{
+			Type:      "result",
+			ReqID:     req.ReqID,
+			URL:       result.URL,
+			Status:    result.Status,
+			LatencyMs: result.LatencyMs,
+			Error:     result.Error,
+			Snippet:   result.snippet,
+		}
+		conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+		if err := conn.WriteJSON(report); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,119 @@
+//go:build cgo
+
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTunnel(t *testing.T) {
+	clearDB(t)
+
+	got := make(chan string, 2)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case got <- r.URL.RequestURI() + " " + string(body):
+		default:
+		}
+		io.WriteString(w, "thanks")
+	}))
+	defer local.Close()
+	srv := httptest.NewServer(http.HandlerFunc(binAPIHandler))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	before := httptest.NewRecorder()
+	captureRequestHandler(before, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/old", strings.NewReader("old")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tunnelClient(ctx, srv.URL, bin.BinID, local.URL+"/dev", "", time.Second) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	// Captures made before connecting are skipped; keep capturing until the
+	// tunnel is up and one gets through
+	var reqID string
+	deadline := time.After(5 * time.Second)
+	for reqID == "" {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID+"/hook?n=1", strings.NewReader("new")))
+		select {
+		case delivered := <-got:
+			if delivered != "/dev/hook?n=1 new" {
+				t.Fatalf("Unexpected delivery %q", delivered)
+			}
+			reqID = w.Body.String()
+		case <-time.After(50 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Timed out waiting for the tunnel")
+		}
+	}
+
+	deliveries := waitForDeliveries(t, bin.BinID, reqID, 1)
+	d := deliveries[0]
+	if d.Kind != deliveryTunnel || d.Status != deliveryDelivered || d.StatusCode != http.StatusOK ||
+		d.ResponseSnippet != "thanks" || !strings.HasPrefix(d.URL, local.URL+"/dev/hook") {
+		t.Errorf("Unexpected delivery %+v", d)
+	}
+}
+
+func TestTunnelResumesAfterCursor(t *testing.T) {
+	clearDB(t)
+
+	got := make(chan string, 4)
+	local := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got <- string(body)
+	}))
+	defer local.Close()
+	srv := httptest.NewServer(http.HandlerFunc(binAPIHandler))
+	defer srv.Close()
+
+	bin := createTestBin(t)
+	var ids []string
+	for _, body := range []string{"one", "two", "three"} {
+		w := httptest.NewRecorder()
+		captureRequestHandler(w, httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader(body)))
+		ids = append(ids, w.Body.String())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- tunnelClient(ctx, srv.URL, bin.BinID, local.URL, ids[0], time.Second) }()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	for _, want := range []string{"two", "three"} {
+		select {
+		case body := <-got:
+			if body != want {
+				t.Errorf("Expected %q next, got %q", want, body)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for %q", want)
+		}
+	}
+}
+
+func TestTunnelUnknownBin(t *testing.T) {
+	clearDB(t)
+	srv := httptest.NewServer(http.HandlerFunc(binAPIHandler))
+	defer srv.Close()
+
+	err := tunnelClient(context.Background(), srv.URL, "missing", "http://localhost:1", "", time.Second)
+	if err == nil || !strings.Contains(err.Error(), "no such bin") {
+		t.Errorf("Expected an unknown bin to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+)
+
+// UserAgent is a rough classification of a User-Agent header
+type UserAgent struct {
+	// Kind is "browser", "bot" (crawlers and scanners), "webhook" (a known
+	// webhook sender), "library" (HTTP clients and tools) or "unknown"
+	Kind    string `json:"kind"`
+	Name    string `json:"name,omitempty"`
+	Version string `json:"version,omitempty"`
+	OS      string `json:"os,omitempty"`
+}
+
+// uaProduct matches a leading "Name/version" product token
+var uaProduct = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9._-]*)(?:/([^\s;()]+))?`)
+
+// Product names that identify webhook senders, HTTP libraries and scanners,
+// matched case-insensitively against the leading product token
+var (
+	webhookAgents = []string{
+		"GitHub-Hookshot", "Stripe", "Shopify-Captain-Hook", "Slackbot", "Twilio", "Bitbucket-Webhooks",
+		"GitLab", "PayPal", "SendGrid", "Mailgun", "Zapier", "Discord-Webhook",
+	}
+	libraryAgents = []string{
+		"curl", "Wget", "python-requests", "Python-urllib", "python-httpx", "aiohttp", "Go-http-client",
+		"axios", "node-fetch", "undici", "got", "okhttp", "Java", "Apache-HttpClient", "Ruby", "Faraday",
+		"GuzzleHttp", "PostmanRuntime", "HTTPie", "insomnia", "libwww-perl", "Dart", "RestSharp",
+	}
+	botAgents = []string{"zgrab", "masscan", "Nmap", "sqlmap", "Nikto", "CensysInspect", "Expanse", "nuclei"}
+)
+
+// uaBrowsers are checked in order, since most browsers also claim to be
+// Chrome or Safari
+var uaBrowsers = []struct {
+	name string
+	re   *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`OPR/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+}
+
+var uaOS = []struct {
+	name, token string
+}{
+	{"Windows", "Windows"},
+	{"Android", "Android"},
+	{"iOS", "iPhone"},
+	{"iOS", "iPad"},
+	{"macOS", "Mac OS X"},
+	{"ChromeOS", "CrOS"},
+	{"Linux", "Linux"},
+}
+
+var (
+	uaCrawler = regexp.MustCompile(`(?i)bot\b|crawler|spider|scanner`)
+	uaToken   = regexp.MustCompile(`[A-Za-z][A-Za-z0-9._-]*(?:/[\w.]+)?`)
+)
+
+// parseUserAgent classifies a User-Agent header. It only aims to tell
+// browsers, crawlers, webhook senders and scripts apart, not to identify
+// every client exactly.
+func parseUserAgent(ua string) *UserAgent {
+	ua = strings.TrimSpace(ua)
+	if ua == "" {
+		return nil
+	}
+
+	name, version := "", ""
+	if m := uaProduct.FindStringSubmatch(ua); m != nil {
+		name, version = m[1], m[2]
+	}
+	for _, list := range []struct {
+		kind  string
+		names []string
+	}{{"webhook", webhookAgents}, {"bot", botAgents}, {"library", libraryAgents}} {
+		for _, known := range list.names {
+			if strings.EqualFold(name, known) {
+				return &UserAgent{Kind: list.kind, Name: known, Version: version}
+			}
+		}
+	}
+
+	if uaCrawler.MatchString(ua) {
+		// Prefer the crawler's own product token, e.g. "Googlebot/2.1" inside
+		// a Mozilla-compatible string
+		for _, token := range uaToken.FindAllString(ua, -1) {
+			if uaCrawler.MatchString(token) {
+				name, version, _ = strings.Cut(token, "/")
+				break
+			}
+		}
+		return &UserAgent{Kind: "bot", Name: name, Version: version}
+	}
+
+	if strings.HasPrefix(ua, "Mozilla/") {
+		agent := &UserAgent{Kind: "browser"}
+		for _, b := range uaBrowsers {
+			if m := b.re.FindStringSubmatch(ua); m != nil {
+				agent.Name, agent.Version = b.name, m[1]
+				break
+			}
+		}
+		for _, os := range uaOS {
+			if strings.Contains(ua, os.token) {
+				agent.OS = os.name
+				break
+			}
+		}
+		return agent
+	}
+
+	return &UserAgent{Kind: "unknown", Name: name, Version: version}
+}
@@ -0,0 +1,60 @@
+//go:build cgo
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	tests := []struct {
+		ua   string
+		want UserAgent
+	}{
+		{"GitHub-Hookshot/a1b2c3d", UserAgent{Kind: "webhook", Name: "GitHub-Hookshot", Version: "a1b2c3d"}},
+		{"Stripe/1.0 (+https://stripe.com/docs/webhooks)", UserAgent{Kind: "webhook", Name: "Stripe", Version: "1.0"}},
+		{"curl/8.4.0", UserAgent{Kind: "library", Name: "curl", Version: "8.4.0"}},
+		{"python-requests/2.31.0", UserAgent{Kind: "library", Name: "python-requests", Version: "2.31.0"}},
+		{"Mozilla/5.0 (compatible; Googlebot/2.1; +http://www.google.com/bot.html)",
+			UserAgent{Kind: "bot", Name: "Googlebot", Version: "2.1"}},
+		{"zgrab/0.x", UserAgent{Kind: "bot", Name: "zgrab", Version: "0.x"}},
+		{"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 Edg/120.0.2210.91",
+			UserAgent{Kind: "browser", Name: "Edge", Version: "120.0.2210.91", OS: "Windows"}},
+		{"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Safari/605.1.15",
+			UserAgent{Kind: "browser", Name: "Safari", Version: "17.2", OS: "macOS"}},
+		{"SomethingElse/3", UserAgent{Kind: "unknown", Name: "SomethingElse", Version: "3"}},
+	}
+	for _, tt := range tests {
+		got := parseUserAgent(tt.ua)
+		if got == nil || *got != tt.want {
+			t.Errorf("%q: expected %+v, got %+v", tt.ua, tt.want, got)
+		}
+	}
+	if parseUserAgent("") != nil {
+		t.Error("Expected no classification for an empty User-Agent")
+	}
+}
+
+func TestFilterByAgent(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+	for _, ua := range []string{"GitHub-Hookshot/1", "curl/8.0", "curl/7.0"} {
+		req := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, nil)
+		req.Header.Set("User-Agent", ua)
+		captureRequestHandler(httptest.NewRecorder(), req)
+	}
+
+	listReq := httptest.NewRequest(http.MethodGet, "/api/bin/"+bin.BinID+"/req?agent=library", nil)
+	listW := httptest.NewRecorder()
+	listRequestsHandler(listW, listReq)
+
+	var reqs []Request
+	json.NewDecoder(listW.Body).Decode(&reqs)
+	if len(reqs) != 2 || reqs[0].UserAgent.Name != "curl" {
+		t.Errorf("Expected the two curl requests, got %d", len(reqs))
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Live tail connection tuning
+const (
+	liveTailBuffer   = 64
+	liveWriteTimeout = 10 * time.Second
+	livePongTimeout  = 60 * time.Second
+	livePingInterval = livePongTimeout * 9 / 10
+)
+
+// LiveEvent is a single WebSocket frame sent to live tail clients. Type is
+// "request" for a new capture, or "dropped" when Dropped captures were skipped
+// because the client wasn't reading fast enough.
+type LiveEvent struct {
+	Type    string   `json:"type"`
+	Request *Request `json:"request,omitempty"`
+	Dropped uint64   `json:"dropped,omitempty"`
+}
+
+var upgrader = websocket.Upgrader{
+	// Bins are public, so dashboards on any origin may tail them
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+func liveTailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	binID := r.URL.Path[len("/api/bin/") : len(r.URL.Path)-len("/ws")]
+	if _, err := loadBinResponse(r.Context(), binID); err == sql.ErrNoRows {
+		http.Error(w, `{"msg":"No such bin"}`, http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, `{"msg":"Internal Server Error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written an error response
+		return
+	}
+	defer conn.Close()
+
+	sub := captures.subscribe(binID, liveTailBuffer)
+	defer sub.Close()
+
+	// The read loop only exists to process pongs and notice the client going away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		conn.SetReadLimit(512)
+		conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(livePongTimeout))
+		})
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(livePingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case req := <-sub.C:
+			if n := sub.Dropped(); n > 0 {
+				if !writeLiveEvent(conn, LiveEvent{Type: "dropped", Dropped: n}) {
+					return
+				}
+			}
+			if !writeLiveEvent(conn, LiveEvent{Type: "request", Request: &req}) {
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+// writeLiveEvent sends ev, reporting false once the connection is unusable.
+// A client that can't accept a frame within liveWriteTimeout is disconnected.
+func writeLiveEvent(conn *websocket.Conn, ev LiveEvent) bool {
+	conn.SetWriteDeadline(time.Now().Add(liveWriteTimeout))
+	return conn.WriteJSON(ev) == nil
+}
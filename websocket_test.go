@@ -0,0 +1,56 @@
+//go:build cgo
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestLiveTail(t *testing.T) {
+	clearDB(t)
+
+	bin := createTestBin(t)
+
+	server := httptest.NewServer(http.HandlerFunc(binAPIHandler))
+	defer server.Close()
+
+	wsURL := "ws" + strings.TrimPrefix(server.URL, "http") + "/api/bin/" + bin.BinID + "/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Give the handler a moment to subscribe before capturing
+	time.Sleep(50 * time.Millisecond)
+	captureReq := httptest.NewRequest(http.MethodPost, "/"+bin.BinID, strings.NewReader("live"))
+	captureRequestHandler(httptest.NewRecorder(), captureReq)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var ev LiveEvent
+	if err := conn.ReadJSON(&ev); err != nil {
+		t.Fatalf("Failed to read event: %v", err)
+	}
+	if ev.Type != "request" || ev.Request == nil {
+		t.Fatalf("Expected a request event, got %+v", ev)
+	}
+	if ev.Request.Body != "live" {
+		t.Errorf("Expected body %q, got %v", "live", ev.Request.Body)
+	}
+}
+
+func TestLiveTailUnknownBin(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/api/bin/nosuchbin/ws", nil)
+	w := httptest.NewRecorder()
+	binAPIHandler(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status code %d, got %d", http.StatusNotFound, w.Code)
+	}
+}